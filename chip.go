@@ -0,0 +1,275 @@
+package nukeykt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/elemir/cbool"
+)
+
+// Chip is an emulated sound chip as seen by players and mixers.
+type Chip interface {
+	// Reset clears the chip state, sets its output rate and input clock. The
+	// order is that of OPN2_Reset.
+	Reset(rate, clock uint32)
+	// Write writes data to the given port.
+	Write(port uint32, data uint8)
+	// Read reads the given port.
+	Read(port uint32) uint8
+	// NativeRate returns the rate the chip produces samples at.
+	NativeRate() uint32
+	// Generate renders numsamples stereo samples at the output rate.
+	Generate(sndptr [][]int32, numsamples uint32)
+	// SaveState returns a snapshot of the chip state.
+	SaveState() []byte
+	// LoadState restores a snapshot returned by SaveState.
+	LoadState(data []byte) error
+}
+
+// Kind identifies a sound chip model.
+type Kind int
+
+const (
+	KindYM2612 Kind = iota + 1
+	KindYM3438
+	KindYM2203
+	KindYM2608
+	KindYM2610
+	KindYM2151
+	KindSN76489
+	KindAY8910
+)
+
+var kindNames = map[Kind]string{
+	KindYM2612:  "YM2612",
+	KindYM3438:  "YM3438",
+	KindYM2203:  "YM2203",
+	KindYM2608:  "YM2608",
+	KindYM2610:  "YM2610",
+	KindYM2151:  "YM2151",
+	KindSN76489: "SN76489",
+	KindAY8910:  "AY8910",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// ErrUnsupported is returned by New for chip kinds without an emulator.
+var ErrUnsupported = errors.New("nukeykt: unsupported chip")
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[Kind]func() Chip{
+		KindYM2612: func() Chip { return NewYM2612() },
+		KindYM3438: func() Chip { return NewYM3438() },
+	}
+)
+
+// Register makes an emulator available for the given chip kind, replacing
+// the previous one.
+func Register(kind Kind, ctor func() Chip) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[kind] = ctor
+}
+
+// New creates an emulator for the given chip kind. The chip must be Reset
+// before use.
+func New(kind Kind) (Chip, error) {
+	registryMu.RLock()
+	ctor, ok := registry[kind]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, kind)
+	}
+	return ctor(), nil
+}
+
+// StatusBus configures how the status register reads back. A read of a
+// status port latches the status on the bus, where it stays readable from any
+// port for Decay cycles before the bus floats to OpenBus.
+type StatusBus struct {
+	Decay   uint32
+	OpenBus uint8
+	// Ports has bit n set if port n reads the status.
+	Ports uint8
+}
+
+// Status buses of the two chip variants. Console revisions differ only in
+// which of them they carry.
+var (
+	// StatusMD1 is the discrete YM2612 of the MD1 up to VA6 and the MD2 VA2,
+	// the default of YM2612 chips.
+	StatusMD1 = StatusBus{Decay: 300000, Ports: 0x01}
+	// StatusYM3438 is the YM3438 core of the TeraDrive and of the ASIC of
+	// the MD1 VA7 and the later MD2, the default of YM3438 chips.
+	StatusYM3438 = StatusBus{Decay: 40000000, Ports: 0x0f}
+)
+
+// defaultStatusBus returns the status bus of chips of the given type.
+func defaultStatusBus(typ uint32) StatusBus {
+	bus := StatusBus{Decay: 40000000, Ports: 0x01}
+	if typ&ModeYM2612 != 0 {
+		bus.Decay = 300000
+	}
+	if typ&ModeReadmode != 0 {
+		bus.Ports = 0x0f
+	}
+	return bus
+}
+
+// NewYM2612 creates a chip emulating the discrete YM2612 of the MD1 and MD2 VA2.
+func NewYM2612() *YM3438 {
+	return &YM3438{chip_type: ModeYM2612, use_filter: 1}
+}
+
+// NewYM3438 creates a chip emulating the CMOS YM3438 core: the discrete
+// YM3438 of the TeraDrive, which the MD1 VA7 and the later MD2 integrate in
+// their ASIC.
+func NewYM3438() *YM3438 {
+	return &YM3438{chip_type: ModeReadmode, use_filter: 1}
+}
+
+// Kind returns KindYM2612 for chips emulating the YM2612 and KindYM3438
+// otherwise.
+func (chip *YM3438) Kind() Kind {
+	if chip.chip_type&ModeYM2612 != 0 {
+		return KindYM2612
+	}
+	return KindYM3438
+}
+
+// Reset resets the chip keeping its type, filter, busy mode and status bus.
+func (chip *YM3438) Reset(rate, clock uint32) {
+	typ, filter := chip.chip_type, chip.use_filter
+	mode, hook := chip.busy_mode, chip.busy_hook
+	bus, busSet := chip.status_bus, chip.status_bus_set
+	OPN2_Reset(chip, rate, clock)
+	chip.chip_type = typ
+	chip.use_filter = filter
+	chip.busy_mode = mode
+	chip.busy_hook = hook
+	chip.status_bus = bus
+	chip.status_bus_set = busSet
+}
+
+// SetFilter enables or disables the output low pass filter, enabled for new
+// chips.
+func (chip *YM3438) SetFilter(on bool) {
+	OPN2_SetChipFilter(chip, cbool.ToInt[int](on))
+}
+
+// Write queues a write through the chip write buffer, so consecutive writes
+// are spaced like on real hardware.
+func (chip *YM3438) Write(port uint32, data uint8) {
+	OPN2_WriteBuffered(chip, port, data)
+}
+
+func (chip *YM3438) Read(port uint32) uint8 {
+	return OPN2_Read(chip, port)
+}
+
+func (chip *YM3438) NativeRate() uint32 {
+	return chip.clock / 144
+}
+
+// NextCycle returns the cycle, in the time base of OPN2_WriteBufferedAt, the
+// chip reaches once the next output sample is generated.
+func (chip *YM3438) NextCycle() uint64 {
+	var frames uint64
+	if chip.samplecnt >= chip.rateratio {
+		frames = uint64(chip.samplecnt / chip.rateratio)
+	}
+	return chip.writebuf_samplecnt + frames*24
+}
+
+func (chip *YM3438) Generate(sndptr [][]int32, numsamples uint32) {
+	OPN2_GenerateStream(chip, sndptr, numsamples)
+}
+
+func (chip *YM3438) SaveState() []byte {
+	return saveState(chip)
+}
+
+func (chip *YM3438) LoadState(data []byte) error {
+	return loadState(chip, data)
+}
+
+// Hash returns a digest of the emulation state: registers, phase and
+// envelope generators, LFO, timers, resampler and queued writes. Chips in the
+// same state hash alike on every platform, so two chips fed the same writes
+// can be compared as they run. The configuration (chip type, filter, clock
+// and rate, mute, idle skip, busy mode and status bus) and the busy counters
+// take no part.
+func (chip *YM3438) Hash() uint64 {
+	h := hashState(fnvOffset, chip)
+	// Only queued entries of the write buffer take part, the others were
+	// applied already
+	i := chip.writebuf_cur
+	for range OPN_WRITEBUF_SIZE {
+		if chip.writebuf[i].port&0x04 == 0 {
+			break
+		}
+		w := &chip.writebuf[i]
+		var b [10]byte
+		binary.LittleEndian.PutUint64(b[:], w.time)
+		b[8], b[9] = w.port, w.data
+		h = hashBytes(h, b[:])
+		i = (i + 1) % OPN_WRITEBUF_SIZE
+	}
+	return h
+}
+
+// FindDivergence clocks a and b for up to cycles cycles, calling step with
+// each chip and the cycle number before every cycle, and returns the number
+// of cycles run when their hashes first differ. The chips are compared after
+// every frame and a differing frame is run again from the states the chips
+// had on entry, so step must feed the same writes every time it is called
+// for a cycle. The chips are left at the divergence, or after cycles cycles
+// with ok false if they did not diverge.
+func FindDivergence(a, b *YM3438, cycles uint64, step func(chip *YM3438, cycle uint64)) (n uint64, ok bool) {
+	if a.Hash() != b.Hash() {
+		return 0, true
+	}
+
+	var buf [2]int32
+	run := func(from, to uint64) {
+		for cycle := from; cycle < to; cycle++ {
+			for _, chip := range [2]*YM3438{a, b} {
+				if step != nil {
+					step(chip, cycle)
+				}
+				OPN2_Clock(chip, buf[:])
+			}
+		}
+	}
+
+	stateA, stateB := a.SaveState(), b.SaveState()
+	for start := uint64(0); start < cycles; start += 24 {
+		end := min(start+24, cycles)
+		run(start, end)
+		if a.Hash() == b.Hash() {
+			continue
+		}
+
+		a.LoadState(stateA)
+		b.LoadState(stateB)
+		run(0, start)
+		for cycle := start; cycle < end; cycle++ {
+			run(cycle, cycle+1)
+			if a.Hash() != b.Hash() {
+				return cycle + 1, true
+			}
+		}
+		return end, true
+	}
+	return cycles, false
+}
@@ -0,0 +1,128 @@
+package nukeykt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	for _, kind := range []Kind{KindYM2612, KindYM3438} {
+		chip, err := New(kind)
+		if err != nil {
+			t.Fatalf("%v: %v", kind, err)
+		}
+		if got := chip.(*YM3438).Kind(); got != kind {
+			t.Errorf("New(%v) emulates %v", kind, got)
+		}
+	}
+
+	if _, err := New(KindSN76489); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("New(%v) error %v, want ErrUnsupported", KindSN76489, err)
+	}
+
+	// Register replaces and adds emulators
+	defer func(ctor func() Chip) { Register(KindYM2612, ctor) }(registry[KindYM2612])
+	defer delete(registry, KindSN76489)
+	Register(KindYM2612, func() Chip { return NewFastYM2612() })
+	Register(KindSN76489, func() Chip { return NewYM3438() })
+	if chip, _ := New(KindYM2612); reflect.TypeOf(chip) != reflect.TypeFor[*Fast]() {
+		t.Errorf("New(%v) after Register returned %T", KindYM2612, chip)
+	}
+	if _, err := New(KindSN76489); err != nil {
+		t.Errorf("New(%v) after Register: %v", KindSN76489, err)
+	}
+
+	if got := KindYM3438.String(); got != "YM3438" {
+		t.Errorf("KindYM3438.String() = %q", got)
+	}
+	if got := Kind(99).String(); got != "Kind(99)" {
+		t.Errorf("Kind(99).String() = %q", got)
+	}
+}
+
+func TestHash(t *testing.T) {
+	a, b := frameChips(ModeYM2612)
+	if a.Hash() != b.Hash() {
+		t.Fatal("restored chip hashes differently")
+	}
+
+	// The hash digests the fields in the order and byte order of SaveState
+	h := uint64(fnvOffset)
+	rv := reflect.ValueOf(a).Elem()
+	for i := range rv.NumField() {
+		if rv.Type().Field(i).Tag.Get("hash") != "-" {
+			h = hashBytes(h, appendState(nil, rv.Field(i)))
+		}
+	}
+	if got := hashState(fnvOffset, a); got != h {
+		t.Fatalf("hash of the state %#x, want %#x", got, h)
+	}
+
+	// Applied writes take no part, queued ones do
+	b.writebuf[(b.writebuf_last+1)%OPN_WRITEBUF_SIZE].data ^= 0xff
+	if a.Hash() != b.Hash() {
+		t.Error("applied write changed the hash")
+	}
+	OPN2_WriteBuffered(b, 0, 0x30)
+	if a.Hash() == b.Hash() {
+		t.Error("queued write did not change the hash")
+	}
+
+	// Configuration and busy counters take no part
+	b = &YM3438{}
+	if err := b.LoadState(a.SaveState()); err != nil {
+		t.Fatal(err)
+	}
+	OPN2_SetType(b, ModeReadmode)
+	OPN2_SetChipFilter(b, 0)
+	OPN2_SetMute(b, 0x01)
+	OPN2_SetIdleSkip(b, 1)
+	OPN2_SetBusyMode(b, BusyReport, nil)
+	OPN2_SetStatusBus(b, &StatusBus{Decay: 100})
+	b.clock, b.rate, b.rateratio = 8000000, 48000, 1
+	b.busy_writes, b.busy_dropped = 10, 2
+	if a.Hash() != b.Hash() {
+		t.Error("configuration changed the hash")
+	}
+
+	var buf [2]int32
+	h = a.Hash()
+	OPN2_Clock(a, buf[:])
+	if a.Hash() == h {
+		t.Error("clocking did not change the hash")
+	}
+}
+
+func TestFindDivergence(t *testing.T) {
+	a, b := frameChips(ModeYM2612)
+	same := func(chip *YM3438, cycle uint64) {
+		if cycle%100 == 0 {
+			OPN2_Write(chip, 0, 0x40)
+			OPN2_Write(chip, 1, uint8(cycle))
+		}
+	}
+	if n, ok := FindDivergence(a, b, 5000, same); ok || n != 5000 {
+		t.Fatalf("chips fed the same writes diverged after %d cycles", n)
+	}
+
+	a, b = frameChips(ModeYM2612)
+	diverge := func(chip *YM3438, cycle uint64) {
+		if chip == a && cycle == 1234 {
+			OPN2_Write(chip, 1, 0x7f)
+		}
+	}
+	if n, ok := FindDivergence(a, b, 5000, diverge); !ok || n != 1235 {
+		t.Fatalf("divergence after %d cycles, %v, want 1235", n, ok)
+	}
+	if a.Hash() == b.Hash() {
+		t.Fatal("chips not left at the divergence")
+	}
+}
+
+func BenchmarkHash(b *testing.B) {
+	chip, _ := frameChips(ModeYM2612)
+	for b.Loop() {
+		chip.Hash()
+	}
+}
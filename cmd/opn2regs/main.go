@@ -0,0 +1,186 @@
+// Command opn2regs prints the register writes of VGM, VGZ, GYM and register
+// log files as text, decoded the way the chip decodes them.
+//
+// Usage:
+//
+//	opn2regs [flags] file
+//
+// Each line holds the time in seconds, the port and raw address and data,
+// and the decoded write:
+//
+//	1.234567  0:40=1F  ch1 OP1 TL=0x1F
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/gym"
+	"github.com/elemir/nukeykt/render"
+	"github.com/elemir/nukeykt/vgm"
+)
+
+var (
+	channels = flag.String("ch", "", "comma separated `channels` 1-6 to show")
+	regs     = flag.String("reg", "", "comma separated register `addresses` or ranges to show, like 0x28,0x40-0x4f")
+	region   = flag.String("region", "ntsc", "console timing of GYM logs: ntsc or pal")
+)
+
+// write is a port write pair of any log format.
+type write struct {
+	time       float64
+	chip       uint8
+	port       uint8
+	addr, data uint8
+}
+
+type regRange struct {
+	lo, hi uint8
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	chMask, err := parseChannels(*channels)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "opn2regs:", err)
+		os.Exit(2)
+	}
+	ranges, err := parseRanges(*regs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "opn2regs:", err)
+		os.Exit(2)
+	}
+
+	writes, err := load(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "opn2regs:", err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	// Dual VGM logs drive two chips
+	var dec [2]nukeykt.RegDecoder
+	for _, w := range writes {
+		d := &dec[w.chip&1]
+		port := uint32(w.port&1) << 1
+		d.Write(port, w.addr)
+		rw, _ := d.Write(port|1, w.data)
+
+		if chMask != 0 && (rw.Channel < 0 || chMask&(1<<rw.Channel) == 0) {
+			continue
+		}
+		if ranges != nil && !inRanges(ranges, uint8(rw.Addr)) {
+			continue
+		}
+		prefix := ""
+		if w.chip != 0 {
+			prefix = "chip2 "
+		}
+		fmt.Fprintf(out, "%11.6f  %d:%02X=%02X  %s%s\n", w.time, w.port, w.addr, w.data, prefix, rw.Text)
+	}
+}
+
+func load(name string) ([]write, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	song, err := render.Load(name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var writes []write
+	switch song.Format {
+	case render.FormatVGM:
+		for _, w := range song.VGM.Writes() {
+			writes = append(writes, write{float64(w.Sample) / vgm.Rate, w.Chip, w.Port, w.Addr, w.Data})
+		}
+	case render.FormatGYM:
+		writes = gymWrites(song.GYM)
+	case render.FormatLog:
+		for _, w := range song.Log.Writes {
+			writes = append(writes, write{float64(w.Cycle) * 6 / float64(song.Log.Clock), 0, w.Port, w.Addr, w.Data})
+		}
+	}
+
+	return writes, nil
+}
+
+func gymWrites(f *gym.File) []write {
+	r := gym.NTSC
+	if strings.EqualFold(*region, "pal") {
+		r = gym.PAL
+	}
+	master, frame := r.Timing()
+
+	var writes []write
+	for _, w := range f.Writes() {
+		writes = append(writes, write{float64(w.Frame*frame) / float64(master), 0, w.Port, w.Addr, w.Data})
+	}
+	return writes
+}
+
+func parseChannels(s string) (uint32, error) {
+	var mask uint32
+	if s == "" {
+		return 0, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 1 || n > 6 {
+			return 0, fmt.Errorf("bad channel %q", f)
+		}
+		mask |= 1 << (n - 1)
+	}
+	return mask, nil
+}
+
+func parseRanges(s string) ([]regRange, error) {
+	var ranges []regRange
+	if s == "" {
+		return nil, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		lo, hi, found := strings.Cut(strings.TrimSpace(f), "-")
+		if !found {
+			hi = lo
+		}
+		l, err := strconv.ParseUint(lo, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad register %q", f)
+		}
+		h, err := strconv.ParseUint(hi, 0, 8)
+		if err != nil || h < l {
+			return nil, fmt.Errorf("bad register %q", f)
+		}
+		ranges = append(ranges, regRange{uint8(l), uint8(h)})
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []regRange, reg uint8) bool {
+	for _, r := range ranges {
+		if reg >= r.lo && reg <= r.hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+// Command opn2render renders VGM, VGZ, GYM and register log files to WAV.
+//
+// Usage:
+//
+//	opn2render [flags] file...
+//
+// The tags of each file are printed as it is rendered. With -stems every
+// channel is also rendered alone to <output>-fm1.wav ... <output>-dac.wav.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/gym"
+	"github.com/elemir/nukeykt/render"
+	"github.com/elemir/nukeykt/wav"
+)
+
+var (
+	output    = flag.String("o", "", "output `file`, only with a single input (default input name with .wav)")
+	rate      = flag.Uint("rate", render.DefaultRate, "output sample `rate`")
+	chipName  = flag.String("chip", "auto", "chip variant: auto, ym2612 or ym3438")
+	filter    = flag.String("filter", "lowpass", "output filter: lowpass or none")
+	loops     = flag.Int("loops", render.DefaultLoops, "times to play the looped part, 0 to stop at the loop point")
+	fade      = flag.Float64("fade", render.DefaultFade, "fade out `seconds` of looping songs")
+	tail      = flag.Float64("tail", render.DefaultTail, "`seconds` rendered after songs that do not loop")
+	maxLength = flag.Float64("length", render.DefaultMaxLength, "maximum length in `seconds`")
+	mute      = flag.String("mute", "", "comma separated `channels` to mute: 1-6 and dac")
+	stems     = flag.Bool("stems", false, "also render every channel alone")
+	region    = flag.String("region", "ntsc", "console timing of GYM logs: ntsc or pal")
+	fast      = flag.Bool("fast", false, "render with the faster, less accurate engine")
+)
+
+var stemNames = []string{"fm1", "fm2", "fm3", "fm4", "fm5", "fm6", "dac"}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || (*output != "" && flag.NArg() > 1) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	set, err := settings()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "opn2render:", err)
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, name := range flag.Args() {
+		if err := renderFile(name, set); err != nil {
+			fmt.Fprintln(os.Stderr, "opn2render:", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func settings() (render.Settings, error) {
+	set := render.Settings{
+		Rate:      uint32(*rate),
+		Loops:     loops,
+		Fade:      *fade,
+		Tail:      *tail,
+		MaxLength: *maxLength,
+		Fast:      *fast,
+	}
+
+	if *loops < 0 {
+		return set, fmt.Errorf("negative loop count %d", *loops)
+	}
+
+	switch strings.ToLower(*chipName) {
+	case "auto":
+	case "ym2612":
+		set.Chip = nukeykt.KindYM2612
+	case "ym3438":
+		set.Chip = nukeykt.KindYM3438
+	default:
+		return set, fmt.Errorf("unknown chip %q", *chipName)
+	}
+
+	switch strings.ToLower(*filter) {
+	case "lowpass":
+		set.Filter = render.FilterLowPass
+	case "none":
+		set.Filter = render.FilterNone
+	default:
+		return set, fmt.Errorf("unknown filter %q", *filter)
+	}
+
+	switch strings.ToLower(*region) {
+	case "ntsc":
+		set.Region = gym.NTSC
+	case "pal":
+		set.Region = gym.PAL
+	default:
+		return set, fmt.Errorf("unknown region %q", *region)
+	}
+
+	if *mute != "" {
+		for _, ch := range strings.Split(*mute, ",") {
+			ch = strings.TrimSpace(strings.ToLower(ch))
+			if ch == "dac" {
+				set.Mute |= render.MuteDAC
+				continue
+			}
+			n, err := strconv.Atoi(ch)
+			if err != nil || n < 1 || n > 6 {
+				return set, fmt.Errorf("bad channel %q", ch)
+			}
+			set.Mute |= 1 << (n - 1)
+		}
+	}
+
+	return set, nil
+}
+
+func renderFile(name string, set render.Settings) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	song, err := render.Load(name, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s (%v)\n", name, song.Format)
+	for _, tag := range song.Tags() {
+		fmt.Printf("  %-12s %s\n", tag.Name+":", tag.Value)
+	}
+
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(name, filepath.Ext(name)) + ".wav"
+	}
+	if err := writeWAV(out, render.Render(song, set), set.Rate); err != nil {
+		return err
+	}
+
+	if *stems {
+		base := strings.TrimSuffix(out, filepath.Ext(out))
+		for ch, stem := range stemNames {
+			solo := set
+			solo.Mute = render.MuteAll &^ (1 << ch)
+			if err := writeWAV(base+"-"+stem+".wav", render.Render(song, solo), set.Rate); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeWAV(name string, samples []int16, rate uint32) error {
+	var b bytes.Buffer
+	if err := wav.Encode(&b, rate, 2, samples); err != nil {
+		return err
+	}
+	return os.WriteFile(name, b.Bytes(), 0o644)
+}
@@ -0,0 +1,213 @@
+// Command opn2view plays VGM, VGZ, GYM and register log files through the
+// emulator in real time and shows what the chip does in the terminal: key-on
+// state, envelope phase and attenuation of every operator, channel notes,
+// LFO and DAC activity. Nothing is played back on a sound device.
+//
+// Usage:
+//
+//	opn2view [flags] file
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/gym"
+	"github.com/elemir/nukeykt/render"
+)
+
+var (
+	fps      = flag.Int("fps", 30, "screen updates per second")
+	speed    = flag.Float64("speed", 1, "playback speed")
+	start    = flag.Float64("at", 0, "start showing at `seconds`, rendering up to it at full speed")
+	length   = flag.Float64("length", 0, "stop after `seconds` (default until the song ends)")
+	once     = flag.Bool("once", false, "print a single screen at the start time and exit")
+	chipName = flag.String("chip", "auto", "chip variant: auto, ym2612 or ym3438")
+	region   = flag.String("region", "ntsc", "console timing of GYM logs: ntsc or pal")
+)
+
+const (
+	rate        = 44100
+	barWidth    = 16
+	clearScreen = "\x1b[H\x1b[2J"
+)
+
+var opNames = [4]string{"OP1", "OP2", "OP3", "OP4"}
+
+var phaseNames = map[nukeykt.EnvelopePhase]string{
+	nukeykt.PhaseAttack:  "A",
+	nukeykt.PhaseDecay:   "D",
+	nukeykt.PhaseSustain: "S",
+	nukeykt.PhaseRelease: "R",
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *fps <= 0 || *speed <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, "opn2view:", err)
+		os.Exit(1)
+	}
+}
+
+func run(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	song, err := render.Load(name, data)
+	if err != nil {
+		return err
+	}
+
+	set := render.Settings{Rate: rate}
+	switch strings.ToLower(*chipName) {
+	case "auto":
+	case "ym2612":
+		set.Chip = nukeykt.KindYM2612
+	case "ym3438":
+		set.Chip = nukeykt.KindYM3438
+	default:
+		return fmt.Errorf("unknown chip %q", *chipName)
+	}
+	if strings.EqualFold(*region, "pal") {
+		set.Region = gym.PAL
+	}
+
+	chip := song.NewChip(set)
+	src := song.Player(chip, set)
+	clock := song.Clock(set)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	frame := uint32(float64(rate) * *speed / float64(*fps))
+	buf := [2][]int32{make([]int32, frame), make([]int32, frame)}
+	out := bufio.NewWriter(os.Stdout)
+
+	var rendered uint64
+	skip := uint64(*start * rate)
+	for rendered < skip && !src.Done() {
+		n := uint32(min(uint64(frame), skip-rendered))
+		src.Generate(buf[:], n)
+		rendered += uint64(n)
+	}
+	if *once {
+		draw(out, name, chip, src, clock, rendered, buf[0][:0], buf[1][:0])
+		return out.Flush()
+	}
+
+	end := uint64(0)
+	if *length > 0 {
+		end = rendered + uint64(*length*rate)
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(*fps))
+	defer ticker.Stop()
+	defer fmt.Fprint(os.Stdout, "\n")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		src.Generate(buf[:], frame)
+		rendered += uint64(frame)
+		draw(out, name, chip, src, clock, rendered, buf[0], buf[1])
+		if err := out.Flush(); err != nil {
+			return err
+		}
+
+		if (end != 0 && rendered >= end) || (end == 0 && src.Done()) {
+			return nil
+		}
+	}
+}
+
+func draw(out *bufio.Writer, name string, chip *nukeykt.YM3438, src render.Source, clock uint32, rendered uint64, left, right []int32) {
+	s := chip.State()
+
+	fmt.Fprint(out, clearScreen)
+	secs := float64(rendered) / rate
+	fmt.Fprintf(out, "%s  %d:%06.3f  loop %d\n", name, int(secs)/60, secs-float64(int(secs)/60*60), src.Loops())
+	fmt.Fprintf(out, "level L %s  R %s\n", bar(peak(left), 1<<15), bar(peak(right), 1<<15))
+
+	lfo := "off"
+	if s.LFOEnabled {
+		lfo = fmt.Sprintf("on  rate %d  step %3d", s.LFORate, s.LFOCounter)
+	}
+	fmt.Fprintf(out, "LFO %s\n\n", lfo)
+
+	for ch, c := range s.Channels {
+		pan := []byte("--")
+		if c.PanL {
+			pan[0] = 'L'
+		}
+		if c.PanR {
+			pan[1] = 'R'
+		}
+		fmt.Fprintf(out, "FM%d %-4s blk %d fnum 0x%03X  alg %d fb %d  %s",
+			ch+1, nukeykt.NoteName(c.FNum, c.Block, clock), c.Block, c.FNum, c.Algorithm, c.Feedback, pan)
+		switch {
+		case ch == 2 && s.Ch3Mode != 0:
+			mode := "special"
+			if s.Ch3Mode == 2 {
+				mode = "CSM"
+			}
+			fmt.Fprintf(out, "  %s", mode)
+			for op := range s.Ch3FNum {
+				fmt.Fprintf(out, " %s", orDash(nukeykt.NoteName(s.Ch3FNum[op], s.Ch3Block[op], clock)))
+			}
+		case ch == 5 && s.DACEnabled:
+			fmt.Fprintf(out, "  DAC %+4d %s", s.DACData, bar(int32(s.DACData)+256, 512))
+		}
+		fmt.Fprintln(out)
+
+		for op, o := range c.Operators {
+			key := " "
+			if o.KeyOn {
+				key = "*"
+			}
+			fmt.Fprintf(out, "   %s %s %s %03X %s\n", opNames[op], key, phaseNames[o.Phase],
+				o.Attenuation, bar(0x3ff-int32(o.Attenuation), 0x3ff))
+		}
+	}
+}
+
+func bar(v, full int32) string {
+	n := int(min(max(v, 0), full) * barWidth / full)
+	return strings.Repeat("#", n) + strings.Repeat(".", barWidth-n)
+}
+
+func peak(samples []int32) int32 {
+	var p int32
+	for _, s := range samples {
+		p = max(p, s, -s)
+	}
+	return p
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
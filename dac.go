@@ -0,0 +1,215 @@
+package nukeykt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// PCMFormat is the sample format of PCM data.
+type PCMFormat int
+
+const (
+	PCMUnsigned8 PCMFormat = iota
+	PCMSigned8
+	PCMSigned16 // little endian
+)
+
+// PCM is mono sample data converted to signed 16 bit.
+type PCM struct {
+	Rate    uint32
+	Samples []int16
+	// LoopStart is the sample looping voices jump back to.
+	LoopStart int
+}
+
+// NewPCM converts raw mono sample data of the given format.
+func NewPCM(data []byte, format PCMFormat, rate uint32) *PCM {
+	pcm := &PCM{Rate: rate}
+
+	switch format {
+	case PCMUnsigned8:
+		pcm.Samples = make([]int16, len(data))
+		for i, b := range data {
+			pcm.Samples[i] = int16(b^0x80) << 8
+		}
+	case PCMSigned8:
+		pcm.Samples = make([]int16, len(data))
+		for i, b := range data {
+			pcm.Samples[i] = int16(int8(b)) << 8
+		}
+	case PCMSigned16:
+		pcm.Samples = make([]int16, len(data)/2)
+		for i := range pcm.Samples {
+			pcm.Samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+	}
+
+	return pcm
+}
+
+const dacFrac = 32
+
+// ErrDACRate is returned by NewDACStream for a rate the chip cannot keep up
+// with.
+var ErrDACRate = errors.New("nukeykt: DAC rate out of range")
+
+type dacVoice struct {
+	pcm     *PCM
+	pos     uint64
+	step    uint64
+	volume  int32
+	loop    bool
+	playing bool
+}
+
+// DACStream streams PCM through the channel 6 DAC. It mixes several voices
+// in software like Mega Drive sound drivers do, and writes register 0x2A at
+// the exact chip cycles of the playback rate.
+type DACStream struct {
+	chip   *YM3438
+	rate   uint32
+	voices []dacVoice
+
+	active bool
+	start  uint64
+	count  uint64
+	next   uint64
+}
+
+// NewDACStream creates a stream writing the DAC of an already reset chip
+// rate times per second and mixing the given number of voices. The rate must
+// be at most MaxDACRate of the chip clock.
+func NewDACStream(chip *YM3438, rate uint32, voices int) (*DACStream, error) {
+	if rate == 0 || rate > MaxDACRate(chip.clock) {
+		return nil, fmt.Errorf("%w: %d Hz at a clock of %d Hz", ErrDACRate, rate, chip.clock)
+	}
+
+	return &DACStream{
+		chip:   chip,
+		rate:   rate,
+		voices: make([]dacVoice, voices),
+	}, nil
+}
+
+// MaxDACRate returns the fastest rate the DAC can be streamed at with the
+// given chip clock. A DAC write takes two writes through the write buffer.
+func MaxDACRate(clock uint32) uint32 {
+	return clock / (6 * 2 * OPN_WRITEBUF_DELAY)
+}
+
+// Rate returns the DAC playback rate.
+func (d *DACStream) Rate() uint32 {
+	return d.rate
+}
+
+// Play starts playing pcm on a voice at a linear volume, 1 being full scale.
+// Looping voices play until stopped.
+func (d *DACStream) Play(voice int, pcm *PCM, volume float64, loop bool) {
+	if voice < 0 || voice >= len(d.voices) || len(pcm.Samples) == 0 {
+		return
+	}
+
+	d.voices[voice] = dacVoice{
+		pcm:     pcm,
+		step:    (uint64(pcm.Rate) << dacFrac) / uint64(d.rate),
+		volume:  int32(math.Round(volume * 0x100)),
+		loop:    loop,
+		playing: true,
+	}
+	if !d.active {
+		d.active = true
+		d.start = max(d.chip.writebuf_samplecnt, d.chip.writebuf_lasttime)
+		d.count = 0
+		d.next = d.start
+		d.write(0x2b, 0x80, d.next)
+	}
+}
+
+// Stop stops a voice.
+func (d *DACStream) Stop(voice int) {
+	if voice >= 0 && voice < len(d.voices) {
+		d.voices[voice].playing = false
+	}
+}
+
+// Playing reports whether a voice is playing.
+func (d *DACStream) Playing(voice int) bool {
+	return voice >= 0 && voice < len(d.voices) && d.voices[voice].playing
+}
+
+// Generate renders numsamples stereo samples, queueing the DAC writes of each
+// sample before the chip is clocked through it.
+func (d *DACStream) Generate(sndptr [][]int32, numsamples uint32) {
+	var buffer [2]int32
+
+	for i := range numsamples {
+		if d.active {
+			d.queue(d.chip.NextCycle())
+		}
+
+		OPN2_GenerateResampled(d.chip, buffer[:])
+		sndptr[0][i] = buffer[0]
+		sndptr[1][i] = buffer[1]
+	}
+}
+
+// queue writes all DAC samples due before the given cycle.
+func (d *DACStream) queue(horizon uint64) {
+	for d.active && d.next < horizon {
+		sample, playing := d.mix()
+		if !playing {
+			d.active = false
+			d.write(0x2b, 0x00, d.next)
+			return
+		}
+
+		d.write(0x2a, uint8(sample>>8)^0x80, d.next)
+		d.count++
+		d.next = d.start + d.count*uint64(d.chip.clock)/(6*uint64(d.rate))
+	}
+}
+
+// mix sums the voices with linear interpolation and clips the result.
+func (d *DACStream) mix() (int32, bool) {
+	var sum int32
+	playing := false
+
+	for i := range d.voices {
+		v := &d.voices[i]
+		if !v.playing {
+			continue
+		}
+
+		samples := v.pcm.Samples
+		idx := v.pos >> dacFrac
+		if idx >= uint64(len(samples)) {
+			if !v.loop {
+				v.playing = false
+				continue
+			}
+			start := uint64(min(v.pcm.LoopStart, len(samples)-1)) << dacFrac
+			v.pos = start + (v.pos-start)%(uint64(len(samples))<<dacFrac-start)
+			idx = v.pos >> dacFrac
+		}
+		s0 := int32(samples[idx])
+		s1 := s0
+		if idx+1 < uint64(len(samples)) {
+			s1 = int32(samples[idx+1])
+		} else if v.loop {
+			s1 = int32(samples[min(v.pcm.LoopStart, len(samples)-1)])
+		}
+		frac := int32((v.pos >> (dacFrac - 15)) & 0x7fff)
+		sum += (s0 + (s1-s0)*frac>>15) * v.volume >> 8
+		v.pos += v.step
+		playing = true
+	}
+
+	return min(max(sum, math.MinInt16), math.MaxInt16), playing
+}
+
+func (d *DACStream) write(addr, data uint8, time uint64) {
+	OPN2_WriteBufferedAt(d.chip, 0, addr, time)
+	OPN2_WriteBufferedAt(d.chip, 1, data, time+OPN_WRITEBUF_DELAY)
+}
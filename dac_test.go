@@ -0,0 +1,185 @@
+package nukeykt
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNewPCM(t *testing.T) {
+	for _, tc := range []struct {
+		format PCMFormat
+		data   []byte
+		want   []int16
+	}{
+		{PCMUnsigned8, []byte{0x00, 0x80, 0xff}, []int16{-0x8000, 0, 0x7f00}},
+		{PCMSigned8, []byte{0x80, 0x00, 0x7f}, []int16{-0x8000, 0, 0x7f00}},
+		// A trailing odd byte is dropped
+		{PCMSigned16, []byte{0x00, 0x80, 0x34, 0x12, 0xff}, []int16{-0x8000, 0x1234}},
+	} {
+		pcm := NewPCM(tc.data, tc.format, 8000)
+		if pcm.Rate != 8000 || !slices.Equal(pcm.Samples, tc.want) {
+			t.Errorf("format %d: %d Hz %v, want %v", tc.format, pcm.Rate, pcm.Samples, tc.want)
+		}
+	}
+}
+
+func TestNewDACStreamRate(t *testing.T) {
+	const clock = 7670453
+	for _, tc := range []struct {
+		clock, rate uint32
+		ok          bool
+	}{
+		{clock, 0, false},
+		{clock, 1, true},
+		{clock, 22050, true},
+		{clock, MaxDACRate(clock), true},
+		{clock, MaxDACRate(clock) + 1, false},
+		// The chip must be reset first
+		{0, 22050, false},
+	} {
+		chip := NewYM2612()
+		if tc.clock != 0 {
+			chip.Reset(44100, tc.clock)
+		}
+		d, err := NewDACStream(chip, tc.rate, 1)
+		if tc.ok != (err == nil) || !tc.ok && !errors.Is(err, ErrDACRate) {
+			t.Errorf("clock %d, rate %d: error %v", tc.clock, tc.rate, err)
+		}
+		if tc.ok && d.Rate() != tc.rate {
+			t.Errorf("clock %d, rate %d: stream rate %d", tc.clock, tc.rate, d.Rate())
+		}
+	}
+}
+
+// dacWrites returns the register 0x2A writes queued in the write buffer and
+// the cycles they are applied at.
+func dacWrites(chip *YM3438) (data []uint8, times []uint64) {
+	var addr uint8
+	for i := chip.writebuf_cur; i != chip.writebuf_last; i = (i + 1) % OPN_WRITEBUF_SIZE {
+		w := chip.writebuf[i]
+		if w.port&0x01 == 0 {
+			addr = w.data
+			continue
+		}
+		if addr == 0x2a {
+			data = append(data, w.data)
+			times = append(times, w.time)
+		}
+	}
+	return data, times
+}
+
+func TestDACStreamTiming(t *testing.T) {
+	const clock, rate = 7670453, 14000
+	chip := NewYM2612()
+	chip.Reset(44100, clock)
+	d, err := NewDACStream(chip, rate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcm := &PCM{Rate: rate, Samples: make([]int16, 100)}
+	for i := range pcm.Samples {
+		pcm.Samples[i] = int16(i) << 8
+	}
+	last := chip.writebuf_lasttime
+	d.Play(0, pcm, 1, false)
+	d.queue(d.start + 50*clock/(6*rate))
+
+	data, times := dacWrites(chip)
+	if len(data) != 50 {
+		t.Fatalf("%d DAC writes queued, want 50", len(data))
+	}
+	// Samples are written at the exact cycles of the rate unless the write
+	// buffer is still busy with the previous write, the first one follows
+	// enabling the DAC. Every write is at least OPN_WRITEBUF_DELAY after the
+	// one before it.
+	prev := max(d.start, last+OPN_WRITEBUF_DELAY) + OPN_WRITEBUF_DELAY
+	for i := range data {
+		want := max(d.start+uint64(i)*clock/(6*rate), prev+OPN_WRITEBUF_DELAY) + OPN_WRITEBUF_DELAY
+		prev = want
+		if times[i] != want || data[i] != uint8(i)^0x80 {
+			t.Fatalf("write %d: %#x at cycle %d, want %#x at %d", i, data[i], times[i], uint8(i)^0x80, want)
+		}
+	}
+
+	// Once the sample ends the DAC is disabled
+	buf := [][]int32{make([]int32, 1000), make([]int32, 1000)}
+	d.Generate(buf, 1000)
+	if d.Playing(0) || d.active {
+		t.Error("stream active after the sample ended")
+	}
+	if chip.dacen != 0 {
+		t.Error("DAC enabled after the sample ended")
+	}
+}
+
+func TestDACStreamMix(t *testing.T) {
+	constant := func(v int16, n int) *PCM {
+		return &PCM{Rate: 8000, Samples: slices.Repeat([]int16{v}, n)}
+	}
+	ramp := &PCM{Rate: 4000, Samples: []int16{0, 0x1000}}
+
+	for _, tc := range []struct {
+		name  string
+		play  func(d *DACStream)
+		mixed []int32
+		loop  bool
+	}{
+		{"volume", func(d *DACStream) {
+			d.Play(0, constant(0x1000, 2), 1, false)
+			d.Play(1, constant(0x1000, 2), 0.5, false)
+		}, []int32{0x1800, 0x1800}, false},
+		{"clip", func(d *DACStream) {
+			d.Play(0, constant(0x7000, 1), 1, false)
+			d.Play(1, constant(0x7000, 1), 1, false)
+			d.Play(2, constant(-0x8000, 2), 1, false)
+		}, []int32{0x6000, -0x8000}, false},
+		{"clip low", func(d *DACStream) {
+			d.Play(0, constant(-0x7000, 1), 1, false)
+			d.Play(1, constant(-0x7000, 1), 1, false)
+		}, []int32{-0x8000}, false},
+		// Half rate samples are interpolated, the last one holds
+		{"interpolate", func(d *DACStream) { d.Play(0, ramp, 1, false) }, []int32{0, 0x800, 0x1000, 0x1000}, false},
+		{"loop", func(d *DACStream) { d.Play(0, ramp, 1, true) }, []int32{0, 0x800, 0x1000, 0x800, 0, 0x800}, true},
+		{"loop start", func(d *DACStream) {
+			d.Play(0, &PCM{Rate: 8000, Samples: []int16{0x100, 0x200, 0x300}, LoopStart: 1}, 1, true)
+		}, []int32{0x100, 0x200, 0x300, 0x200, 0x300, 0x200}, true},
+		{"stop", func(d *DACStream) {
+			d.Play(0, ramp, 1, true)
+			d.Stop(0)
+		}, nil, false},
+		// Voices out of range and empty samples are ignored
+		{"ignored", func(d *DACStream) {
+			d.Play(3, ramp, 1, false)
+			d.Play(-1, ramp, 1, false)
+			d.Play(0, &PCM{Rate: 8000}, 1, false)
+		}, nil, false},
+	} {
+		chip := NewYM2612()
+		chip.Reset(44100, 7670453)
+		d, err := NewDACStream(chip, 8000, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.play(d)
+
+		// Voices that do not loop stop after their samples
+		n := len(tc.mixed) + 1
+		if tc.loop {
+			n = len(tc.mixed)
+		}
+		var mixed []int32
+		for range n {
+			sample, playing := d.mix()
+			if !playing {
+				break
+			}
+			mixed = append(mixed, sample)
+		}
+		if !slices.Equal(mixed, tc.mixed) {
+			t.Errorf("%s: mixed %#x, want %#x", tc.name, mixed, tc.mixed)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package nukeykt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RegKind classifies a decoded register write.
+type RegKind int
+
+const (
+	RegUnused RegKind = iota
+	RegSSG
+	RegTest
+	RegLFO
+	RegTimerA
+	RegTimerB
+	RegMode
+	RegKeyOn
+	RegDAC
+	RegDACEnable
+	RegOperator
+	RegChannel
+)
+
+// RegWrite is a data write decoded like OPN2_DoRegWrite does.
+type RegWrite struct {
+	// Addr is the 9 bit register address, bit 8 set for port 1.
+	Addr uint16
+	Data uint8
+	Kind RegKind
+	// Channel is the channel 0-5 the register belongs to or -1.
+	Channel int
+	// Slot is the chip slot 0-23 of operator registers or -1.
+	Slot int
+	// Operator is the operator 1-4 of operator registers or 0.
+	Operator int
+	// Text describes the write, like "ch2 OP3 TL=0x1F".
+	Text string
+}
+
+// RegDecoder decodes the port writes of a chip into register writes. It
+// latches addresses, the frequency high bytes shared by all channels and the
+// timer A value like the chip does.
+type RegDecoder struct {
+	addr     uint16
+	fmAddr   bool
+	modeAddr uint16
+	regA4    uint8
+	regAC    uint8
+	timerA   uint16
+}
+
+// Operators of the slot groups of op_offset
+var slotOperators = [4]int{1, 3, 2, 4}
+
+// Register A8-AA order of the channel 3 special mode frequencies
+var ch3Operators = [3]int{3, 1, 2}
+
+var ch3Modes = [4]string{"ch3 normal mode", "ch3 special mode", "ch3 CSM mode", "ch3 special mode"}
+
+// Write decodes a port write. Address writes only latch the address and
+// return false.
+func (d *RegDecoder) Write(port uint32, data uint8) (RegWrite, bool) {
+	port &= 3
+	value := uint16(port<<7)&0x100 | uint16(data)
+
+	if port&1 == 0 {
+		if value&0xf0 != 0 {
+			d.addr = value
+			d.fmAddr = true
+		} else {
+			d.fmAddr = false
+		}
+		d.modeAddr = value & 0x1ff
+		return RegWrite{}, false
+	}
+
+	w := RegWrite{Addr: d.modeAddr, Data: data, Channel: -1, Slot: -1}
+	switch {
+	case value&0x100 == 0 && d.modeAddr >= 0x21 && d.modeAddr <= 0x2c:
+		d.mode(&w)
+	case !d.fmAddr:
+		w.Kind = RegSSG
+		w.Text = fmt.Sprintf("SSG 0x%02X=0x%02X", d.modeAddr&0x0f, data)
+	default:
+		w.Addr = d.addr
+		if !d.operator(&w) && !d.channel(&w) {
+			w.Text = fmt.Sprintf("unused 0x%03X=0x%02X", w.Addr, data)
+		}
+	}
+	if w.Text == "" {
+		w.Text = fmt.Sprintf("unused 0x%03X=0x%02X", w.Addr, data)
+	}
+
+	return w, true
+}
+
+func (d *RegDecoder) mode(w *RegWrite) {
+	data := w.Data
+
+	switch w.Addr {
+	case 0x21, 0x2c:
+		w.Kind = RegTest
+		w.Text = fmt.Sprintf("test 0x%02X=0x%02X", w.Addr, data)
+	case 0x22:
+		w.Kind = RegLFO
+		if data&0x08 != 0 {
+			w.Text = fmt.Sprintf("LFO on, rate %d", data&0x07)
+		} else {
+			w.Text = "LFO off"
+		}
+	case 0x24, 0x25:
+		w.Kind = RegTimerA
+		if w.Addr == 0x24 {
+			d.timerA = d.timerA&0x03 | uint16(data)<<2
+		} else {
+			d.timerA = d.timerA&0x3fc | uint16(data&0x03)
+		}
+		w.Text = fmt.Sprintf("Timer A = 0x%03X", d.timerA)
+	case 0x26:
+		w.Kind = RegTimerB
+		w.Text = fmt.Sprintf("Timer B = 0x%02X", data)
+	case 0x27:
+		w.Kind = RegMode
+		w.Channel = 2
+		parts := []string{ch3Modes[data>>6]}
+		for _, t := range []struct {
+			name                string
+			load, enable, reset uint8
+		}{
+			{"Timer A", 0x01, 0x04, 0x10},
+			{"Timer B", 0x02, 0x08, 0x20},
+		} {
+			var flags []string
+			if data&t.load != 0 {
+				flags = append(flags, "load")
+			}
+			if data&t.enable != 0 {
+				flags = append(flags, "irq")
+			}
+			if data&t.reset != 0 {
+				flags = append(flags, "reset")
+			}
+			if flags != nil {
+				parts = append(parts, t.name+" "+strings.Join(flags, " "))
+			}
+		}
+		w.Text = strings.Join(parts, ", ")
+	case 0x28:
+		w.Kind = RegKeyOn
+		if data&0x03 == 0x03 {
+			w.Text = fmt.Sprintf("key ops 0x%X invalid channel", data>>4)
+			return
+		}
+		w.Channel = int(data&0x03) + int(data>>2&1)*3
+		if data&0xf0 == 0 {
+			w.Text = fmt.Sprintf("key-off ch%d", w.Channel+1)
+			return
+		}
+		var ops strings.Builder
+		for op := range 4 {
+			if data>>(4+op)&1 != 0 {
+				fmt.Fprintf(&ops, "%d", op+1)
+			}
+		}
+		w.Text = fmt.Sprintf("key-on ch%d ops %s", w.Channel+1, ops.String())
+	case 0x2a:
+		w.Kind = RegDAC
+		w.Channel = 5
+		w.Text = fmt.Sprintf("DAC=0x%02X", data)
+	case 0x2b:
+		w.Kind = RegDACEnable
+		w.Channel = 5
+		if data&0x80 != 0 {
+			w.Text = "DAC on"
+		} else {
+			w.Text = "DAC off"
+		}
+	}
+}
+
+func (d *RegDecoder) operator(w *RegWrite) bool {
+	reg := w.Addr & 0xf0
+	if reg < 0x30 || reg > 0x90 {
+		return false
+	}
+
+	for slot := range uint32(12) {
+		if op_offset[slot] != uint32(w.Addr)&0x107 {
+			continue
+		}
+		group := int(slot / 6)
+		if w.Addr&0x08 != 0 {
+			slot += 12
+			group += 2
+		}
+		w.Kind = RegOperator
+		w.Slot = int(slot)
+		w.Channel = int(slot % 6)
+		w.Operator = slotOperators[group]
+
+		data := w.Data
+		var text string
+		switch reg {
+		case 0x30:
+			text = fmt.Sprintf("DT=%d MUL=%d", data>>4&0x07, data&0x0f)
+		case 0x40:
+			text = fmt.Sprintf("TL=0x%02X", data&0x7f)
+		case 0x50:
+			text = fmt.Sprintf("KS=%d AR=%d", data>>6, data&0x1f)
+		case 0x60:
+			text = fmt.Sprintf("AM=%d D1R=%d", data>>7, data&0x1f)
+		case 0x70:
+			text = fmt.Sprintf("D2R=%d", data&0x1f)
+		case 0x80:
+			text = fmt.Sprintf("D1L=%d RR=%d", data>>4, data&0x0f)
+		case 0x90:
+			text = fmt.Sprintf("SSG-EG=0x%X", data&0x0f)
+		}
+		w.Text = fmt.Sprintf("ch%d OP%d %s", w.Channel+1, w.Operator, text)
+		return true
+	}
+	return false
+}
+
+func (d *RegDecoder) channel(w *RegWrite) bool {
+	reg := w.Addr & 0xfc
+	if reg < 0xa0 || reg > 0xb4 {
+		return false
+	}
+
+	for ch := range 6 {
+		if ch_offset[ch] != uint32(w.Addr)&0x103 {
+			continue
+		}
+		w.Kind = RegChannel
+		w.Channel = ch
+
+		data := w.Data
+		name := fmt.Sprintf("ch%d", ch+1)
+		switch reg {
+		case 0xa0:
+			fnum := uint16(d.regA4&0x07)<<8 | uint16(data)
+			w.Text = fmt.Sprintf("%s BLOCK=%d FNUM=0x%03X", name, d.regA4>>3&0x07, fnum)
+		case 0xa4:
+			d.regA4 = data
+			w.Text = fmt.Sprintf("%s BLOCK/FNUM latch=0x%02X", name, data)
+		case 0xa8:
+			fnum := uint16(d.regAC&0x07)<<8 | uint16(data)
+			w.Text = fmt.Sprintf("%s BLOCK=%d FNUM=0x%03X", ch3Name(ch), d.regAC>>3&0x07, fnum)
+		case 0xac:
+			d.regAC = data
+			w.Text = fmt.Sprintf("%s BLOCK/FNUM latch=0x%02X", ch3Name(ch), data)
+		case 0xb0:
+			w.Text = fmt.Sprintf("%s FB=%d ALG=%d", name, data>>3&0x07, data&0x07)
+		case 0xb4:
+			pan := []byte("--")
+			if data&0x80 != 0 {
+				pan[0] = 'L'
+			}
+			if data&0x40 != 0 {
+				pan[1] = 'R'
+			}
+			w.Text = fmt.Sprintf("%s PAN=%s AMS=%d PMS=%d", name, pan, data>>4&0x03, data&0x07)
+		}
+		return true
+	}
+	return false
+}
+
+// ch3Name names the channel 3 special mode frequency register of a channel
+// offset. Only the port 0 registers are used by the chip.
+func ch3Name(ch int) string {
+	if ch < 3 {
+		return fmt.Sprintf("ch3 special OP%d", ch3Operators[ch])
+	}
+	return fmt.Sprintf("ch3 special unused %d", ch+1)
+}
@@ -0,0 +1,101 @@
+package nukeykt
+
+import (
+	"testing"
+)
+
+// TestRegDecoder decodes port writes, given as port and data pairs, and
+// checks the last register write.
+func TestRegDecoder(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		writes [][2]uint8
+		want   RegWrite
+	}{
+		// Port 1 channels
+		{"port 1 frequency", [][2]uint8{{2, 0xa4}, {3, 0x22}, {2, 0xa0}, {3, 0x69}},
+			RegWrite{0x1a0, 0x69, RegChannel, 3, -1, 0, "ch4 BLOCK=4 FNUM=0x269"}},
+		{"port 1 algorithm", [][2]uint8{{2, 0xb2}, {3, 0x3a}},
+			RegWrite{0x1b2, 0x3a, RegChannel, 5, -1, 0, "ch6 FB=7 ALG=2"}},
+		{"port 1 pan", [][2]uint8{{2, 0xb5}, {3, 0x92}},
+			RegWrite{0x1b5, 0x92, RegChannel, 4, -1, 0, "ch5 PAN=L- AMS=1 PMS=2"}},
+		// The frequency latch is shared by all channels
+		{"shared latch", [][2]uint8{{0, 0xa4}, {1, 0x1a}, {2, 0xa1}, {3, 0xff}},
+			RegWrite{0x1a1, 0xff, RegChannel, 4, -1, 0, "ch5 BLOCK=3 FNUM=0x2FF"}},
+		{"port 1 unused channel", [][2]uint8{{2, 0xa3}, {3, 0x01}},
+			RegWrite{0x1a3, 0x01, RegUnused, -1, -1, 0, "unused 0x1A3=0x01"}},
+
+		// Channel 3 special mode frequencies
+		{"ch3 OP3", [][2]uint8{{0, 0xac}, {1, 0x1c}, {0, 0xa8}, {1, 0x3b}},
+			RegWrite{0x0a8, 0x3b, RegChannel, 0, -1, 0, "ch3 special OP3 BLOCK=3 FNUM=0x43B"}},
+		{"ch3 OP1", [][2]uint8{{0, 0xad}, {1, 0x0a}, {0, 0xa9}, {1, 0x10}},
+			RegWrite{0x0a9, 0x10, RegChannel, 1, -1, 0, "ch3 special OP1 BLOCK=1 FNUM=0x210"}},
+		{"ch3 OP2 latch", [][2]uint8{{0, 0xae}, {1, 0x23}},
+			RegWrite{0x0ae, 0x23, RegChannel, 2, -1, 0, "ch3 special OP2 BLOCK/FNUM latch=0x23"}},
+		{"ch3 special port 1", [][2]uint8{{2, 0xa8}, {3, 0x55}},
+			RegWrite{0x1a8, 0x55, RegChannel, 3, -1, 0, "ch3 special unused 4 BLOCK=0 FNUM=0x055"}},
+		{"ch3 special mode", [][2]uint8{{0, 0x27}, {1, 0x45}},
+			RegWrite{0x027, 0x45, RegMode, 2, -1, 0, "ch3 special mode, Timer A load irq"}},
+
+		// Key on
+		{"key-on", [][2]uint8{{0, 0x28}, {1, 0xf0}},
+			RegWrite{0x028, 0xf0, RegKeyOn, 0, -1, 0, "key-on ch1 ops 1234"}},
+		{"key-on port 1 channel", [][2]uint8{{0, 0x28}, {1, 0x56}},
+			RegWrite{0x028, 0x56, RegKeyOn, 5, -1, 0, "key-on ch6 ops 13"}},
+		{"key-off", [][2]uint8{{0, 0x28}, {1, 0x04}},
+			RegWrite{0x028, 0x04, RegKeyOn, 3, -1, 0, "key-off ch4"}},
+		{"key-on invalid channel", [][2]uint8{{0, 0x28}, {1, 0xf3}},
+			RegWrite{0x028, 0xf3, RegKeyOn, -1, -1, 0, "key ops 0xF invalid channel"}},
+		{"key-on invalid port 1 channel", [][2]uint8{{0, 0x28}, {1, 0x17}},
+			RegWrite{0x028, 0x17, RegKeyOn, -1, -1, 0, "key ops 0x1 invalid channel"}},
+
+		// Timer A latches its MSB and LSB
+		{"timer A MSB", [][2]uint8{{0, 0x24}, {1, 0xff}},
+			RegWrite{0x024, 0xff, RegTimerA, -1, -1, 0, "Timer A = 0x3FC"}},
+		{"timer A LSB", [][2]uint8{{0, 0x24}, {1, 0xff}, {0, 0x25}, {1, 0xff}},
+			RegWrite{0x025, 0xff, RegTimerA, -1, -1, 0, "Timer A = 0x3FF"}},
+		{"timer A MSB keeps LSB", [][2]uint8{{0, 0x25}, {1, 0x02}, {0, 0x24}, {1, 0x01}},
+			RegWrite{0x024, 0x01, RegTimerA, -1, -1, 0, "Timer A = 0x006"}},
+		// The mode registers are only on port 0
+		{"timer A port 1", [][2]uint8{{2, 0x24}, {3, 0xff}},
+			RegWrite{0x124, 0xff, RegUnused, -1, -1, 0, "unused 0x124=0xFF"}},
+
+		// Operators
+		{"OP1", [][2]uint8{{0, 0x30}, {1, 0x71}},
+			RegWrite{0x030, 0x71, RegOperator, 0, 0, 1, "ch1 OP1 DT=7 MUL=1"}},
+		{"OP3", [][2]uint8{{0, 0x55}, {1, 0x9f}},
+			RegWrite{0x055, 0x9f, RegOperator, 1, 7, 3, "ch2 OP3 KS=2 AR=31"}},
+		{"OP2", [][2]uint8{{0, 0x3a}, {1, 0x05}},
+			RegWrite{0x03a, 0x05, RegOperator, 2, 14, 2, "ch3 OP2 DT=0 MUL=5"}},
+		{"OP4 port 1", [][2]uint8{{2, 0x4c}, {3, 0x7f}},
+			RegWrite{0x14c, 0x7f, RegOperator, 3, 21, 4, "ch4 OP4 TL=0x7F"}},
+		{"SSG-EG", [][2]uint8{{2, 0x96}, {3, 0x0b}},
+			RegWrite{0x196, 0x0b, RegOperator, 5, 11, 3, "ch6 OP3 SSG-EG=0xB"}},
+		// Slots 3, 7, B and F of a register group do not exist
+		{"invalid slot 3", [][2]uint8{{0, 0x33}, {1, 0x01}},
+			RegWrite{0x033, 0x01, RegUnused, -1, -1, 0, "unused 0x033=0x01"}},
+		{"invalid slot F port 1", [][2]uint8{{2, 0x8f}, {3, 0x01}},
+			RegWrite{0x18f, 0x01, RegUnused, -1, -1, 0, "unused 0x18F=0x01"}},
+
+		// Other registers
+		{"SSG", [][2]uint8{{0, 0x07}, {1, 0x38}},
+			RegWrite{0x007, 0x38, RegSSG, -1, -1, 0, "SSG 0x07=0x38"}},
+		{"DAC", [][2]uint8{{0, 0x2a}, {1, 0x80}},
+			RegWrite{0x02a, 0x80, RegDAC, 5, -1, 0, "DAC=0x80"}},
+		{"LFO", [][2]uint8{{0, 0x22}, {1, 0x0b}},
+			RegWrite{0x022, 0x0b, RegLFO, -1, -1, 0, "LFO on, rate 3"}},
+	} {
+		var d RegDecoder
+		var got RegWrite
+		for i, w := range tc.writes {
+			rw, ok := d.Write(uint32(w[0]), w[1])
+			if ok != (w[0]&1 != 0) {
+				t.Errorf("%s: write %d decoded %v", tc.name, i, ok)
+			}
+			got = rw
+		}
+		if got != tc.want {
+			t.Errorf("%s: decoded\n%+v, want\n%+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package echo plays ESF streams of the Echo sound driver with EIF FM
+// instruments and EWF samples.
+package echo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/elemir/nukeykt"
+)
+
+// Stream commands, the low nibble of the channel commands selects the channel:
+// 0-2 FM1-FM3, 4-6 FM4-FM6, 8-B PSG1-PSG3 and noise, C PCM.
+const (
+	CmdNoteOn     = 0x00
+	CmdNoteOff    = 0x10
+	CmdVolume     = 0x20
+	CmdFreq       = 0x30
+	CmdInstrument = 0x40
+	CmdPan        = 0xe0
+	CmdSetFlags   = 0xf0
+	CmdClearFlags = 0xf1
+	CmdFMReg0     = 0xf8
+	CmdFMReg1     = 0xf9
+	CmdLoopEnd    = 0xfc
+	CmdLoopStart  = 0xfd
+	CmdDelay      = 0xfe
+	CmdStop       = 0xff
+	// CmdShortDelay to CmdShortDelay+15 wait 1 to 16 ticks.
+	CmdShortDelay = 0xd0
+)
+
+const (
+	ChanPCM = 0x0c
+
+	// EIFSize is the size of an FM instrument: the 0xB0 register followed
+	// by the 0x30, 0x40, 0x50, 0x60, 0x70, 0x80 and 0x90 registers of the
+	// four operators in register order.
+	EIFSize = 29
+
+	// PCMRate is the rate Echo streams samples to the DAC at.
+	PCMRate = 10650
+
+	// TimerB is the Timer B value Echo ticks on, about 60 Hz.
+	TimerB = 0xc8
+
+	ewfEnd = 0xff
+)
+
+var ErrFormat = errors.New("echo: invalid instrument")
+
+// Instrument is an Echo instrument. Only one of the fields is set: FM holds
+// an EIF instrument, PCM an EWF sample. PSG envelopes are not rendered.
+type Instrument struct {
+	FM  []byte
+	PCM *nukeykt.PCM
+}
+
+// ParseEIF parses an FM instrument.
+func ParseEIF(data []byte) (Instrument, error) {
+	if len(data) < EIFSize {
+		return Instrument{}, fmt.Errorf("%w: short EIF", ErrFormat)
+	}
+	return Instrument{FM: data[:EIFSize]}, nil
+}
+
+// ParseEWF parses an unsigned 8 bit sample terminated by 0xFF.
+func ParseEWF(data []byte) (Instrument, error) {
+	end := 0
+	for end < len(data) && data[end] != ewfEnd {
+		end++
+	}
+	if end == len(data) {
+		return Instrument{}, fmt.Errorf("%w: unterminated EWF", ErrFormat)
+	}
+	return Instrument{PCM: nukeykt.NewPCM(data[:end], nukeykt.PCMUnsigned8, PCMRate)}, nil
+}
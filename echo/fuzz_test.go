@@ -0,0 +1,31 @@
+package echo
+
+import (
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzPlayer(f *testing.F) {
+	f.Add(make([]byte, EIFSize), []byte{0x80, 0x7f, 0xff},
+		[]byte{0x40, 0x00, 0x00, 0x2a, 0xfe, 0x10, 0x4c, 0x01, 0x0c, 0xfe, 0x20, 0xff})
+
+	f.Fuzz(func(t *testing.T, eif, ewf, stream []byte) {
+		var instruments []Instrument
+		if ins, err := ParseEIF(eif); err == nil {
+			instruments = append(instruments, ins)
+		}
+		if ins, err := ParseEWF(ewf); err == nil {
+			instruments = append(instruments, ins)
+		}
+
+		p, err := NewPlayer(stream, instruments, nukeykt.NewYM2612(), 7670453, 8000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package echo
+
+import (
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/internal/driver"
+)
+
+type fmChannel struct {
+	instrument []byte
+	volume     uint8
+}
+
+// Player plays an ESF stream through an OPN2, clocking the stream ticks from
+// Timer B overflows like the driver does. PSG commands are interpreted but
+// not rendered.
+type Player struct {
+	stream      []byte
+	instruments []Instrument
+	chip        *nukeykt.YM3438
+	dac         *nukeykt.DACStream
+	timer       *driver.Timer
+
+	pos     int
+	loop    int
+	loops   int
+	waited  bool
+	delay   int
+	playing bool
+	fm      [6]fmChannel
+
+	out [2][]int32
+}
+
+// NewPlayer resets the chip with the given clock and output rate and returns
+// a player for the stream. Instrument numbers of the stream index instruments.
+// It fails if the clock is too slow to stream PCM at PCMRate.
+func NewPlayer(stream []byte, instruments []Instrument, chip *nukeykt.YM3438, clock, rate uint32) (*Player, error) {
+	chip.Reset(rate, clock)
+	dac, err := nukeykt.NewDACStream(chip, PCMRate, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Player{
+		stream:      stream,
+		instruments: instruments,
+		chip:        chip,
+		dac:         dac,
+		timer:       driver.NewTimerB(TimerB, clock, rate),
+		loop:        -1,
+		playing:     true,
+	}
+
+	p.write(0, 0x22, 0x00)
+	p.write(0, 0x27, 0x00)
+	p.write(0, 0x2b, 0x00)
+	for ch := range 6 {
+		p.write(0, 0x28, driver.KeyChannel(ch))
+		p.writeCh(ch, 0xb4, 0xc0)
+	}
+	p.write(0, 0x26, TimerB)
+	p.restartTimer()
+	p.step()
+
+	return p, nil
+}
+
+// Loops returns how many times the stream jumped back to its loop point.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether the stream stopped.
+func (p *Player) Done() bool {
+	return !p.playing
+}
+
+// Generate renders numsamples stereo samples. The chip is rendered in chunks
+// up to the next tick, the timer is polled every sample once it can overflow.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+	for off < uint64(numsamples) {
+		if p.timer.Ready() && p.timer.Overflow(nukeykt.OPN2_Read(p.chip, 0)) {
+			p.restartTimer()
+			p.step()
+		}
+		n := min(uint64(numsamples)-off, p.timer.Left())
+
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.dac.Generate(p.out[:], uint32(n))
+		p.timer.Advance(n)
+		off += n
+	}
+}
+
+// restartTimer clears the Timer B overflow flag and keeps the timer running.
+func (p *Player) restartTimer() {
+	p.write(0, 0x27, p.timer.Restart())
+}
+
+// step runs one tick of the stream.
+func (p *Player) step() {
+	if p.delay > 0 {
+		p.delay--
+	}
+	for p.playing && p.delay == 0 {
+		p.command()
+	}
+}
+
+func (p *Player) command() {
+	cmd, ok := p.next()
+	if !ok {
+		p.playing = false
+		return
+	}
+
+	ch := int(cmd & 0x0f)
+	switch {
+	case cmd >= CmdShortDelay && cmd < CmdShortDelay+0x10:
+		p.delay = int(cmd-CmdShortDelay) + 1
+		p.waited = true
+	case cmd == CmdDelay:
+		b, _ := p.next()
+		p.delay = int(b)
+		if p.delay == 0 {
+			p.delay = 256
+		}
+		p.waited = true
+	case cmd == CmdStop:
+		p.playing = false
+		p.stopAll()
+	case cmd == CmdLoopStart:
+		p.loop = p.pos
+		p.waited = false
+	case cmd == CmdLoopEnd:
+		// A loop without delays would never finish a tick
+		if p.loop < 0 || !p.waited {
+			p.playing = false
+			p.stopAll()
+			return
+		}
+		p.pos = p.loop
+		p.loops++
+	case cmd == CmdSetFlags, cmd == CmdClearFlags:
+		p.next()
+	case cmd == CmdFMReg0, cmd == CmdFMReg1:
+		reg, _ := p.next()
+		data, _ := p.next()
+		p.write(uint32(cmd-CmdFMReg0), reg, data)
+	case cmd&0xf0 == CmdNoteOn:
+		b, _ := p.next()
+		p.noteOn(ch, b)
+	case cmd&0xf0 == CmdNoteOff:
+		p.noteOff(ch)
+	case cmd&0xf0 == CmdVolume:
+		b, _ := p.next()
+		if fm := fmIndex(ch); fm >= 0 {
+			p.fm[fm].volume = b & 0x7f
+			p.writeLevel(fm)
+		}
+	case cmd&0xf0 == CmdFreq:
+		hi, _ := p.next()
+		if fm := fmIndex(ch); fm >= 0 {
+			lo, _ := p.next()
+			p.writeCh(fm, 0xa4, hi)
+			p.writeCh(fm, 0xa0, lo)
+		} else if ch < ChanPCM {
+			p.next()
+		}
+	case cmd&0xf0 == CmdInstrument:
+		b, _ := p.next()
+		if fm := fmIndex(ch); fm >= 0 && int(b) < len(p.instruments) {
+			if inst := p.instruments[b].FM; inst != nil {
+				p.fm[fm].instrument = inst
+				p.loadInstrument(fm)
+			}
+		}
+	case cmd&0xf0 == CmdPan:
+		b, _ := p.next()
+		if fm := fmIndex(ch); fm >= 0 {
+			p.writeCh(fm, 0xb4, b)
+		}
+	default:
+		// Unknown command, nothing sensible follows
+		p.playing = false
+		p.stopAll()
+	}
+}
+
+func (p *Player) next() (uint8, bool) {
+	if p.pos >= len(p.stream) {
+		p.playing = false
+		return 0, false
+	}
+	b := p.stream[p.pos]
+	p.pos++
+	return b, true
+}
+
+func (p *Player) noteOn(ch int, b uint8) {
+	if ch == ChanPCM {
+		if int(b) < len(p.instruments) && p.instruments[b].PCM != nil {
+			p.dac.Play(0, p.instruments[b].PCM, 1, false)
+		}
+		return
+	}
+
+	fm := fmIndex(ch)
+	if fm < 0 {
+		return
+	}
+	semitone := min(int(b&0x1f)>>1, 11)
+	freq := uint16(b>>5)<<11 | driver.Freqs[semitone]
+	p.write(0, 0x28, driver.KeyChannel(fm))
+	p.writeCh(fm, 0xa4, uint8(freq>>8))
+	p.writeCh(fm, 0xa0, uint8(freq))
+	p.write(0, 0x28, 0xf0|driver.KeyChannel(fm))
+}
+
+func (p *Player) noteOff(ch int) {
+	if ch == ChanPCM {
+		p.dac.Stop(0)
+	} else if fm := fmIndex(ch); fm >= 0 {
+		p.write(0, 0x28, driver.KeyChannel(fm))
+	}
+}
+
+func (p *Player) stopAll() {
+	for fm := range p.fm {
+		p.write(0, 0x28, driver.KeyChannel(fm))
+	}
+	p.dac.Stop(0)
+}
+
+func (p *Player) loadInstrument(fm int) {
+	inst := p.fm[fm].instrument
+	p.writeCh(fm, 0xb0, inst[0])
+	for i, reg := range []uint8{0x30, 0x40, 0x50, 0x60, 0x70, 0x80, 0x90} {
+		for op := range 4 {
+			p.writeCh(fm, reg+uint8(op*4), inst[1+i*4+op])
+		}
+	}
+	p.writeLevel(fm)
+}
+
+// writeLevel adds the channel attenuation to the total level of the carriers.
+func (p *Player) writeLevel(fm int) {
+	c := &p.fm[fm]
+	if c.instrument == nil {
+		return
+	}
+	mask := driver.Carriers[c.instrument[0]&0x07]
+	for op := range 4 {
+		tl := c.instrument[5+op] & 0x7f
+		if mask&(1<<op) != 0 {
+			tl = min(tl+c.volume, 0x7f)
+		}
+		p.writeCh(fm, 0x40+uint8(op*4), tl)
+	}
+}
+
+// fmIndex returns the FM channel 0-5 of a stream channel or -1.
+func fmIndex(ch int) int {
+	switch {
+	case ch < 3:
+		return ch
+	case ch >= 4 && ch < 7:
+		return ch - 1
+	}
+	return -1
+}
+
+func (p *Player) writeCh(fm int, reg, data uint8) {
+	p.write(uint32(fm/3), reg+uint8(fm%3), data)
+}
+
+func (p *Player) write(port uint32, addr, data uint8) {
+	nukeykt.OPN2_WriteBuffered(p.chip, port<<1, addr)
+	nukeykt.OPN2_WriteBuffered(p.chip, port<<1|1, data)
+}
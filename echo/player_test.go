@@ -0,0 +1,65 @@
+package echo
+
+import (
+	"math"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func TestStreamLoops(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		done   bool
+		loops  bool
+	}{
+		{"loop without a delay", []byte{CmdLoopStart, CmdLoopEnd}, true, false},
+		{"loop of register writes", []byte{CmdLoopStart, CmdFMReg0, 0x22, 0x00, CmdLoopEnd}, true, false},
+		{"loop end without a start", []byte{CmdShortDelay, CmdLoopEnd}, true, false},
+		{"stop", []byte{CmdShortDelay, CmdStop}, true, false},
+		{"unknown command", []byte{0x50}, true, false},
+		{"end of stream", []byte{CmdNoteOff}, true, false},
+		{"loop with a delay", []byte{CmdLoopStart, CmdNoteOn, 0x4c, CmdShortDelay + 2, CmdLoopEnd}, false, true},
+	} {
+		p, err := NewPlayer(tc.stream, nil, nukeykt.NewYM2612(), 7670453, 8000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := [][]int32{make([]int32, 8000), make([]int32, 8000)}
+		p.Generate(buf, 8000)
+
+		if p.Done() != tc.done || (p.Loops() > 0) != tc.loops {
+			t.Errorf("%s: done %v after %d loops", tc.name, p.Done(), p.Loops())
+		}
+	}
+}
+
+func TestNewPlayerClock(t *testing.T) {
+	// Too slow to stream PCM at PCMRate
+	if _, err := NewPlayer(nil, nil, nukeykt.NewYM2612(), 1000000, 8000); err == nil {
+		t.Error("no error for a 1 MHz clock")
+	}
+}
+
+// TestTickRate counts the ticks of a stream waiting a tick per loop for a
+// second and compares them to the Timer B rate.
+func TestTickRate(t *testing.T) {
+	const clock = 7670453
+	for _, rate := range []uint32{44100, 96000, 192000} {
+		stream := []byte{CmdLoopStart, CmdShortDelay, CmdLoopEnd}
+		p, err := NewPlayer(stream, nil, nukeykt.NewYM2612(), clock, rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := [][]int32{make([]int32, 1000), make([]int32, 1000)}
+		for range rate / 1000 {
+			p.Generate(buf, 1000)
+		}
+
+		want := clock / 144 / float64((256-TimerB)*16)
+		if math.Abs(float64(p.Loops())-want) > 1 {
+			t.Errorf("%d Hz: %d ticks a second, want %.1f", rate, p.Loops(), want)
+		}
+	}
+}
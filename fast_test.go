@@ -0,0 +1,149 @@
+package nukeykt_test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/reglog"
+)
+
+// Error bound of the fast engine, see nukeykt.Fast
+const (
+	fastMaxRMS  = 0.01
+	fastMaxPeak = 0.2
+)
+
+var fastModes = []struct {
+	name string
+	acc  func() *nukeykt.YM3438
+	fast func() *nukeykt.Fast
+}{
+	{"ym2612", nukeykt.NewYM2612, nukeykt.NewFastYM2612},
+	{"ym3438", nukeykt.NewYM3438, nukeykt.NewFastYM3438},
+}
+
+// TestFastError renders the golden scripts with the fast engine and the
+// accurate one and measures the RMS error relative to the RMS of the output
+// and the largest sample error relative to the largest output sample. The
+// script of the test registers the fast engine ignores is left out.
+func TestFastError(t *testing.T) {
+	scripts, err := filepath.Glob("testdata/golden/*.log")
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no golden scripts: %v", err)
+	}
+
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".log")
+		if name == "test" {
+			continue
+		}
+		data, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := reglog.Parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", script, err)
+		}
+
+		for _, mode := range fastModes {
+			t.Run(name+"/"+mode.name, func(t *testing.T) {
+				rms, peak := fastError(mode.acc(), mode.fast(), l)
+				t.Logf("rms error %.4f, peak error %.4f", rms, peak)
+				if rms > fastMaxRMS || peak > fastMaxPeak {
+					t.Errorf("error above the bound of %v rms, %v peak", fastMaxRMS, fastMaxPeak)
+				}
+			})
+		}
+	}
+}
+
+func fastError(acc *nukeykt.YM3438, fast *nukeykt.Fast, l *reglog.Log) (rms, peak float64) {
+	acc.Reset(goldenRate, l.Clock)
+	fast.Reset(goldenRate, l.Clock)
+
+	end := uint64(goldenTail)
+	if n := len(l.Writes); n > 0 {
+		end += l.Writes[n-1].Cycle
+	}
+
+	a := [][]int32{make([]int32, 1), make([]int32, 1)}
+	f := [][]int32{make([]int32, 1), make([]int32, 1)}
+	var sum, diff, maxDiff, maxOut float64
+	pos := 0
+	for acc.NextCycle() < end {
+		for pos < len(l.Writes) && l.Writes[pos].Cycle <= acc.NextCycle() {
+			w := l.Writes[pos]
+			port := uint32(w.Port) << 1
+			nukeykt.OPN2_WriteBufferedAt(acc, port, w.Addr, w.Cycle)
+			nukeykt.OPN2_WriteBufferedAt(acc, port|1, w.Data, w.Cycle)
+			fast.WriteAt(port, w.Addr, w.Cycle)
+			fast.WriteAt(port|1, w.Data, w.Cycle)
+			pos++
+		}
+
+		acc.Generate(a, 1)
+		fast.Generate(f, 1)
+		for c := range 2 {
+			out, d := float64(a[c][0]), float64(f[c][0]-a[c][0])
+			sum += out * out
+			diff += d * d
+			maxOut = max(maxOut, math.Abs(out))
+			maxDiff = max(maxDiff, math.Abs(d))
+		}
+	}
+
+	if diff == 0 {
+		return 0, 0
+	}
+	return math.Sqrt(diff / sum), maxDiff / maxOut
+}
+
+// benchVoices keys on a voice on every channel.
+func benchVoices(chip nukeykt.Chip) {
+	chip.Reset(44100, 7670453)
+	for ch := range uint8(6) {
+		port := uint32(ch/3) << 1
+		for _, w := range [][2]uint8{{0xb0, 0x32}, {0xb4, 0xc0}, {0xa4, 0x22}, {0xa0, 0x69 + ch*8},
+			{0x30, 0x71}, {0x34, 0x0d}, {0x38, 0x33}, {0x3c, 0x01},
+			{0x40, 0x23}, {0x44, 0x2d}, {0x48, 0x26}, {0x4c, 0x00},
+			{0x50, 0x1f}, {0x54, 0x19}, {0x58, 0x1f}, {0x5c, 0x14},
+			{0x80, 0x07}, {0x84, 0x07}, {0x88, 0x07}, {0x8c, 0x07}} {
+			chip.Write(port, w[0]+ch%3)
+			chip.Write(port|1, w[1])
+		}
+		chip.Write(0, 0x28)
+		chip.Write(1, 0xf0|ch/3<<2|ch%3)
+	}
+}
+
+// benchEngine renders six voices on chip.
+func benchEngine(chip nukeykt.Chip) func(b *testing.B) {
+	return func(b *testing.B) {
+		benchVoices(chip)
+		buf := [][]int32{make([]int32, 1024), make([]int32, 1024)}
+		for b.Loop() {
+			chip.Generate(buf, 1024)
+		}
+	}
+}
+
+// BenchmarkEngine renders six voices with both engines and reports the
+// speedup of the fast one.
+func BenchmarkEngine(b *testing.B) {
+	var acc float64
+	b.Run("accurate", func(b *testing.B) {
+		benchEngine(nukeykt.NewYM2612())(b)
+		acc = float64(b.Elapsed()) / float64(b.N)
+	})
+	b.Run("fast", func(b *testing.B) {
+		benchEngine(nukeykt.NewFastYM2612())(b)
+		if acc != 0 {
+			b.ReportMetric(acc/(float64(b.Elapsed())/float64(b.N)), "speedup")
+		}
+	})
+}
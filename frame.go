@@ -0,0 +1,758 @@
+package nukeykt
+
+import (
+	"github.com/elemir/cbool"
+)
+
+// frameSlot holds the slots the pipeline stages of OPN2_Clock work on in one
+// cycle of a frame.
+type frameSlot struct {
+	ch    uint32 // Channel of ChOutput
+	next  uint32 // Channel whose frequency is prepared for the next cycle
+	fm    uint32 // FMPrepare modulation slot
+	prev  uint32 // ChGenerate and FMPrepare previous slot
+	gen   uint32 // FMGenerate and phase step slot
+	mask  uint32 // Phase increment mask slot
+	adsr  uint32 // EnvelopeADSR slot
+	level uint32 // EnvelopeGenerate slot
+	cycle uint32 // Next cycle
+}
+
+var frameSlots = func() (slots [24]frameSlot) {
+	for c := range uint32(24) {
+		slots[c] = frameSlot{
+			ch:    c%6 + cbool.ToInt[uint32](c < 12),
+			next:  (c%6 + 1) % 6,
+			fm:    (c + 6) % 24,
+			prev:  (c + 18) % 24,
+			gen:   (c + 19) % 24,
+			mask:  (c + 20) % 24,
+			adsr:  (c + 22) % 24,
+			level: (c + 23) % 24,
+			cycle: (c + 1) % 24,
+		}
+	}
+	return slots
+}()
+
+// frameMods holds the rows of fm_algorithm selecting the modulators of
+// FMPrepare as masks.
+var frameMods = func() (t [4][8][5]int16) {
+	for op := range t {
+		for connect := range t[op] {
+			for row := range t[op][connect] {
+				t[op][connect][row] = -int16(fm_algorithm[op][row][connect])
+			}
+		}
+	}
+	return t
+}()
+
+// OPN2_ClockFrame clocks the chip for a frame of 24 cycles, the time of one
+// native sample, and stores the output of every cycle in buffer. The result
+// is the same as calling OPN2_Clock 24 times.
+func OPN2_ClockFrame(chip *YM3438, buffer *[24][2]int32) {
+	for i := range buffer {
+		clockFused(chip, &buffer[i])
+	}
+}
+
+// clockFused is OPN2_Clock with the pipeline stages inlined, the slot
+// arithmetic looked up in frameSlots, the modulators selected with
+// frameMods and the sine output computed without branches. Writes are checked for only when a
+// write is in progress. Any change to the stages must be made here too, the
+// tests compare both.
+func clockFused(chip *YM3438, buffer *[2]int32) {
+	var cycles uint32 = chip.cycles
+	var channel uint32 = chip.channel
+	var s *frameSlot = &frameSlots[cycles]
+
+	chip.lfo_inc = chip.mode_test_21[1]
+	chip.pg_read >>= 1
+	chip.eg_read[1] >>= 1
+	chip.eg_cycle++
+	/* Lock envelope generator timer value */
+	if cycles == 1 && chip.eg_quotient == 2 {
+		if chip.eg_cycle_stop != 0 {
+			chip.eg_shift_lock = 0
+		} else {
+			chip.eg_shift_lock = chip.eg_shift + 1
+		}
+		chip.eg_timer_low_lock = uint8(chip.eg_timer & 0x03)
+	}
+	/* Cycle specific functions */
+	switch cycles {
+	case 0:
+		chip.lfo_pm = chip.lfo_cnt >> 2
+		if chip.lfo_cnt&0x40 != 0 {
+			chip.lfo_am = chip.lfo_cnt & 0x3f
+		} else {
+			chip.lfo_am = chip.lfo_cnt ^ 0x3f
+		}
+		chip.lfo_am <<= 1
+	case 1:
+		chip.eg_quotient++
+		chip.eg_quotient %= 3
+		chip.eg_cycle = 0
+		chip.eg_cycle_stop = 1
+		chip.eg_shift = 0
+		chip.eg_timer_inc |= uint8(chip.eg_quotient >> 1)
+		chip.eg_timer = chip.eg_timer + uint16(chip.eg_timer_inc)
+		chip.eg_timer_inc = uint8(chip.eg_timer >> 12)
+		chip.eg_timer &= 0xfff
+	case 2:
+		chip.pg_read = chip.pg_phase[21] & 0x3ff
+		chip.eg_read[1] = uint32(chip.eg_out[0])
+	case 13:
+		chip.eg_cycle = 0
+		chip.eg_cycle_stop = 1
+		chip.eg_shift = 0
+		chip.eg_timer = chip.eg_timer + uint16(chip.eg_timer_inc)
+		chip.eg_timer_inc = uint8(chip.eg_timer >> 12)
+		chip.eg_timer &= 0xfff
+	case 23:
+		chip.lfo_inc |= 1
+	}
+	chip.eg_timer &= ^uint16(chip.mode_test_21[5] << chip.eg_cycle)
+	if ((chip.eg_timer>>chip.eg_cycle)|
+		uint16((chip.pin_test_in&chip.eg_custom_timer)))&
+		uint16(chip.eg_cycle_stop) != 0 {
+		chip.eg_shift = chip.eg_cycle
+		chip.eg_cycle_stop = 0
+	}
+
+	/* DoIO, with no write in progress it only clears the signals */
+	if chip.write_a|chip.write_d|chip.write_busy != 0 {
+		OPN2_DoIO(chip)
+	} else {
+		chip.write_a_en = 0
+		chip.write_d_en = 0
+		chip.busy = 0
+		chip.write_busy_cnt &= 0x1f
+	}
+
+	OPN2_DoTimerA(chip)
+	OPN2_DoTimerB(chip)
+
+	/* KeyOn */
+	{
+		var slot uint32 = cycles
+		chip.eg_kon_latch[slot] = chip.mode_kon[slot]
+		chip.eg_kon_csm[slot] = 0
+		if channel == 2 && chip.mode_kon_csm != 0 {
+			/* CSM Key On */
+			chip.eg_kon_latch[slot] = 1
+			chip.eg_kon_csm[slot] = 1
+		}
+		if cycles == uint32(chip.mode_kon_channel) {
+			chip.mode_kon[channel] = chip.mode_kon_operator[0]
+			chip.mode_kon[channel+12] = chip.mode_kon_operator[1]
+			chip.mode_kon[channel+6] = chip.mode_kon_operator[2]
+			chip.mode_kon[channel+18] = chip.mode_kon_operator[3]
+		}
+	}
+
+	var test_dac uint8 = chip.mode_test_2c[5]
+
+	/* ChOutput */
+	{
+		var ch uint32 = s.ch
+		var out, sign int16
+		chip.ch_read = chip.ch_lock
+		if (cycles & 3) == 0 {
+			if test_dac == 0 {
+				/* Lock value */
+				chip.ch_lock = chip.ch_out[ch]
+			}
+			chip.ch_lock_l = chip.pan_l[ch]
+			chip.ch_lock_r = chip.pan_r[ch]
+		}
+		/* Ch 6 */
+		if ((cycles>>2) == 1 && chip.dacen != 0) || test_dac != 0 {
+			out = SIGN_EXTEND(8, chip.dacdata)
+		} else {
+			out = chip.ch_lock
+		}
+		chip.mol = 0
+		chip.mor = 0
+
+		if chip.chip_type&ModeYM2612 != 0 {
+			out_en := (cycles&3) == 3 || test_dac != 0
+			/* YM2612 DAC emulation(not verified) */
+			sign = out >> 8
+			if out >= 0 {
+				out++
+				sign++
+			}
+			if chip.ch_lock_l != 0 && out_en {
+				chip.mol = out
+			} else {
+				chip.mol = sign
+			}
+			if chip.ch_lock_r != 0 && out_en {
+				chip.mor = out
+			} else {
+				chip.mor = sign
+			}
+			/* Amplify signal */
+			chip.mol *= 3
+			chip.mor *= 3
+		} else {
+			out_en := (cycles&3) != 0 || test_dac != 0
+			if chip.ch_lock_l != 0 && out_en {
+				chip.mol = out
+			}
+			if chip.ch_lock_r != 0 && out_en {
+				chip.mor = out
+			}
+		}
+	}
+
+	/* ChGenerate */
+	{
+		var slot uint32 = s.prev
+		var op uint32 = slot / 6
+		var acc int16 = chip.ch_acc[channel]
+		var add int16 = int16(test_dac)
+		var sum int16
+		if op == 0 && test_dac == 0 {
+			acc = 0
+		}
+		if fm_algorithm[op][5][chip.connect[channel]] != 0 && test_dac == 0 {
+			add += chip.fm_out[slot] >> 5
+		}
+		sum = acc + add
+		/* Clamp */
+		if sum > 255 {
+			sum = 255
+		} else if sum < -256 {
+			sum = -256
+		}
+		if op == 0 || test_dac != 0 {
+			chip.ch_out[channel] = chip.ch_acc[channel]
+		}
+		chip.ch_acc[channel] = sum
+	}
+
+	/* FMPrepare */
+	{
+		var slot uint32 = s.fm
+		var op uint32 = slot / 6
+		var connect uint8 = chip.connect[channel]
+		var prevslot uint32 = s.prev
+		var mod, mod1, mod2 int16
+		var m *[5]int16 = &frameMods[op][connect]
+
+		mod2 = chip.fm_op1[channel][0]&m[0] | chip.fm_out[prevslot]&m[3]
+		mod1 = chip.fm_op1[channel][1]&m[1] | chip.fm_op2[channel]&m[2] |
+			chip.fm_out[prevslot]&m[4]
+		mod = mod1 + mod2
+		if op == 0 {
+			/* Feedback */
+			mod = mod >> (10 - chip.fb[channel])
+			if chip.fb[channel] == 0 {
+				mod = 0
+			}
+		} else {
+			mod >>= 1
+		}
+		chip.fm_mod[slot] = uint16(mod)
+
+		switch prevslot / 6 {
+		case 0: /* OP1 */
+			chip.fm_op1[channel][1] = chip.fm_op1[channel][0]
+			chip.fm_op1[channel][0] = chip.fm_out[prevslot]
+		case 2: /* OP2 */
+			chip.fm_op2[channel] = chip.fm_out[prevslot]
+		}
+	}
+
+	/* FMGenerate */
+	{
+		var slot uint32 = s.gen
+		var phase uint16 = uint16((uint32(chip.fm_mod[slot]) + (chip.pg_phase[slot] >> 10)) & 0x3ff)
+		var quarter uint8 = uint8(phase ^ -(phase >> 8 & 0x01))
+		var sign int16 = -int16(phase >> 9 & 0x01)
+		/* Apply envelope, the level stays below 0x1855 */
+		var output int16 = fastExp[(logsinrom[quarter]+chip.eg_out[slot]<<2)&0x1fff]
+		output = (output ^ sign ^ int16(chip.mode_test_21[4])<<13) - sign
+		output <<= 2
+		output >>= 2
+		chip.fm_out[slot] = output
+	}
+
+	/* PhaseGenerate */
+	{
+		/* Mask increment */
+		if chip.pg_reset[s.mask] != 0 {
+			chip.pg_inc[s.mask] = 0
+		}
+		/* Phase step */
+		var slot uint32 = s.gen
+		if chip.pg_reset[slot] != 0 || chip.mode_test_21[3] != 0 {
+			chip.pg_phase[slot] = 0
+		}
+		chip.pg_phase[slot] += chip.pg_inc[slot]
+		chip.pg_phase[slot] &= 0xfffff
+	}
+
+	/* PhaseCalcIncrement */
+	{
+		var slot uint32 = cycles
+		var fnum uint32 = uint32(chip.pg_fnum)
+		var fnum_h uint32 = fnum >> 4
+		var fm, basefreq uint32
+		var lfo uint8 = chip.lfo_pm
+		var lfo_l uint8 = lfo & 0x0f
+		var pms uint8 = chip.pms[channel]
+		var dt uint8 = chip.dt[slot]
+		var dt_l uint8 = dt & 0x03
+		var detune uint8
+		var kcode uint8 = chip.pg_kcode
+
+		fnum <<= 1
+		/* Apply LFO */
+		if lfo_l&0x08 != 0 {
+			lfo_l ^= 0x0f
+		}
+		fm = (fnum_h >> pg_lfo_sh1[pms][lfo_l]) + (fnum_h >> pg_lfo_sh2[pms][lfo_l])
+		if pms > 5 {
+			fm <<= pms - 5
+		}
+		fm >>= 2
+		if lfo&0x10 != 0 {
+			fnum -= fm
+		} else {
+			fnum += fm
+		}
+		fnum &= 0xfff
+
+		basefreq = (fnum << chip.pg_block) >> 2
+
+		/* Apply detune */
+		if dt_l != 0 {
+			if kcode > 0x1c {
+				kcode = 0x1c
+			}
+			block := kcode >> 2
+			note := kcode & 0x03
+			sum := block + 9 + (cbool.ToInt[uint8](dt_l == 3) | (dt_l & 0x02))
+			detune = uint8(pg_detune[((sum&0x01)<<2)|note] >> (9 - sum>>1))
+		}
+		if dt&0x04 != 0 {
+			basefreq -= uint32(detune)
+		} else {
+			basefreq += uint32(detune)
+		}
+		basefreq &= 0x1ffff
+		chip.pg_inc[slot] = ((basefreq * uint32(chip.multi[slot])) >> 1) & 0xfffff
+	}
+
+	/* EnvelopeADSR */
+	{
+		var slot uint32 = s.adsr
+		var nkon uint8 = chip.eg_kon_latch[slot]
+		var okon uint8 = chip.eg_kon[slot]
+		var state uint8 = chip.eg_state[slot]
+		var nextstate uint8 = state
+		var eg_off bool
+		var level, nextlevel, ssg_level, inc int16
+
+		chip.eg_read[0] = uint32(chip.eg_read_inc)
+		chip.eg_read_inc = cbool.ToInt[uint8](chip.eg_inc > 0)
+
+		/* Reset phase generator */
+		chip.pg_reset[slot] = cbool.ToInt[uint8]((nkon != 0 && okon == 0) || chip.eg_ssg_pgrst_latch[slot] != 0)
+
+		/* KeyOn/Off */
+		kon_event := (nkon != 0 && okon == 0) || (okon != 0 && chip.eg_ssg_repeat_latch[slot] != 0)
+		koff_event := okon != 0 && nkon == 0
+
+		level = int16(chip.eg_level[slot])
+		ssg_level = level
+
+		if chip.eg_ssg_inv[slot] != 0 {
+			/* Inverse */
+			ssg_level = 512 - level
+			ssg_level &= 0x3ff
+		}
+		if koff_event {
+			level = ssg_level
+		}
+		if chip.eg_ssg_enable[slot] != 0 {
+			eg_off = level>>9 != 0
+		} else {
+			eg_off = (level & 0x3f0) == 0x3f0
+		}
+		nextlevel = level
+		if kon_event {
+			nextstate = eg_num_attack
+			/* Instant attack */
+			if chip.eg_ratemax != 0 {
+				nextlevel = 0
+			} else if state == eg_num_attack && level != 0 &&
+				chip.eg_inc != 0 && nkon != 0 {
+				inc = (^level << chip.eg_inc) >> 5
+			}
+		} else {
+			switch state {
+			case eg_num_attack:
+				if level == 0 {
+					nextstate = eg_num_decay
+				} else if chip.eg_inc != 0 && chip.eg_ratemax == 0 && nkon != 0 {
+					inc = (^level << chip.eg_inc) >> 5
+				}
+			case eg_num_decay:
+				if (level >> 4) == int16(chip.eg_sl[1]<<1) {
+					nextstate = eg_num_sustain
+				} else if !eg_off && chip.eg_inc != 0 {
+					inc = 1 << (chip.eg_inc - 1)
+					if chip.eg_ssg_enable[slot] != 0 {
+						inc <<= 2
+					}
+				}
+			case eg_num_sustain, eg_num_release:
+				if !eg_off && chip.eg_inc != 0 {
+					inc = 1 << (chip.eg_inc - 1)
+					if chip.eg_ssg_enable[slot] != 0 {
+						inc <<= 2
+					}
+				}
+			}
+			if nkon == 0 {
+				nextstate = eg_num_release
+			}
+		}
+		if chip.eg_kon_csm[slot] != 0 {
+			nextlevel |= int16(chip.eg_tl[1]) << 3
+		}
+
+		/* Envelope off */
+		if !kon_event && chip.eg_ssg_hold_up_latch[slot] == 0 &&
+			state != eg_num_attack && eg_off {
+			nextstate = eg_num_release
+			nextlevel = 0x3ff
+		}
+
+		nextlevel += inc
+
+		chip.eg_kon[slot] = nkon
+		chip.eg_level[slot] = uint16(nextlevel) & 0x3ff
+		chip.eg_state[slot] = nextstate
+	}
+
+	/* EnvelopeGenerate */
+	{
+		var slot uint32 = s.level
+		var level uint16 = chip.eg_level[slot]
+
+		if chip.eg_ssg_inv[slot] != 0 {
+			/* Inverse */
+			level = 512 - level
+		}
+		if chip.mode_test_21[5] != 0 {
+			level = 0
+		}
+		level &= 0x3ff
+
+		/* Apply AM LFO */
+		level += uint16(chip.eg_lfo_am)
+
+		/* Apply TL */
+		if !(chip.mode_csm != 0 && channel == 2+1) {
+			level += uint16(chip.eg_tl[0]) << 3
+		}
+		if level > 0x3ff {
+			level = 0x3ff
+		}
+		chip.eg_out[slot] = level
+	}
+
+	/* EnvelopeSSGEG */
+	{
+		var slot uint32 = cycles
+		var ssg_eg uint8 = chip.ssg_eg[slot]
+		var direction uint8
+		chip.eg_ssg_pgrst_latch[slot] = 0
+		chip.eg_ssg_repeat_latch[slot] = 0
+		chip.eg_ssg_hold_up_latch[slot] = 0
+		if ssg_eg&0x08 != 0 {
+			direction = chip.eg_ssg_dir[slot]
+			if chip.eg_level[slot]&0x200 != 0 {
+				/* Reset */
+				if (ssg_eg & 0x03) == 0x00 {
+					chip.eg_ssg_pgrst_latch[slot] = 1
+				}
+				/* Repeat */
+				if (ssg_eg & 0x01) == 0x00 {
+					chip.eg_ssg_repeat_latch[slot] = 1
+				}
+				/* Inverse */
+				if (ssg_eg & 0x03) == 0x02 {
+					direction ^= 1
+				}
+				if (ssg_eg & 0x03) == 0x03 {
+					direction = 1
+				}
+			}
+			/* Hold up */
+			if chip.eg_kon_latch[slot] != 0 && ((ssg_eg&0x07) == 0x05 ||
+				(ssg_eg&0x07) == 0x03) {
+				chip.eg_ssg_hold_up_latch[slot] = 1
+			}
+			direction &= chip.eg_kon[slot]
+		}
+		chip.eg_ssg_dir[slot] = direction
+		chip.eg_ssg_enable[slot] = (ssg_eg >> 3) & 0x01
+		chip.eg_ssg_inv[slot] =
+			(direction ^ (((ssg_eg >> 2) & 0x01) & ((ssg_eg >> 3) & 0x01))) &
+				chip.eg_kon[slot]
+	}
+
+	/* EnvelopePrepare */
+	{
+		var slot uint32 = cycles
+		var rate uint8 = min((chip.eg_rate<<1)+chip.eg_ksv, 0x3f)
+		var sum uint8 = ((rate >> 2) + chip.eg_shift_lock) & 0x0f
+		var inc uint8
+
+		/* Prepare increment */
+		if chip.eg_rate != 0 && chip.eg_quotient == 2 {
+			if rate < 48 {
+				switch sum {
+				case 12:
+					inc = 1
+				case 13:
+					inc = (rate >> 1) & 0x01
+				case 14:
+					inc = rate & 0x01
+				}
+			} else {
+				inc = uint8(eg_stephi[rate&0x03][chip.eg_timer_low_lock] + uint32(rate)>>2 - 11)
+				inc = min(inc, 4)
+			}
+		}
+		chip.eg_inc = inc
+		chip.eg_ratemax = cbool.ToInt[uint8]((rate >> 1) == 0x1f)
+
+		/* Prepare rate & ksv */
+		rate_sel := chip.eg_state[slot]
+		if (chip.eg_kon[slot] != 0 && chip.eg_ssg_repeat_latch[slot] != 0) ||
+			(chip.eg_kon[slot] == 0 && chip.eg_kon_latch[slot] != 0) {
+			rate_sel = eg_num_attack
+		}
+		switch rate_sel {
+		case eg_num_attack:
+			chip.eg_rate = chip.ar[slot]
+		case eg_num_decay:
+			chip.eg_rate = chip.dr[slot]
+		case eg_num_sustain:
+			chip.eg_rate = chip.sr[slot]
+		case eg_num_release:
+			chip.eg_rate = (chip.rr[slot] << 1) | 0x01
+		}
+		chip.eg_ksv = chip.pg_kcode >> (chip.ks[slot] ^ 0x03)
+		if chip.am[slot] != 0 {
+			chip.eg_lfo_am = chip.lfo_am >> eg_am_shift[chip.ams[channel]]
+		} else {
+			chip.eg_lfo_am = 0
+		}
+		/* Delay TL & SL value */
+		chip.eg_tl[1] = chip.eg_tl[0]
+		chip.eg_tl[0] = chip.tl[slot]
+		chip.eg_sl[1] = chip.eg_sl[0]
+		chip.eg_sl[0] = chip.sl[slot]
+	}
+
+	/* Prepare fnum & block */
+	if chip.mode_ch3 != 0 && (cycles == 1 || cycles == 7 || cycles == 13) {
+		/* Channel 3 special mode, OP1, OP3 and OP2 */
+		i := [3]uint8{1, 0, 2}[cycles/6]
+		chip.pg_fnum = chip.fnum_3ch[i]
+		chip.pg_block = chip.block_3ch[i]
+		chip.pg_kcode = chip.kcode_3ch[i]
+	} else {
+		chip.pg_fnum = chip.fnum[s.next]
+		chip.pg_block = chip.block[s.next]
+		chip.pg_kcode = chip.kcode[s.next]
+	}
+
+	/* UpdateLFO */
+	if (uint32(chip.lfo_quotient) & lfo_cycles[chip.lfo_freq]) ==
+		lfo_cycles[chip.lfo_freq] {
+		chip.lfo_quotient = 0
+		chip.lfo_cnt++
+	} else {
+		chip.lfo_quotient += chip.lfo_inc
+	}
+	chip.lfo_cnt &= chip.lfo_en
+
+	if chip.write_fm_data|chip.write_a_en|chip.write_d_en != 0 {
+		OPN2_DoRegWrite(chip)
+	}
+	chip.cycles = s.cycle
+	chip.channel = s.next
+
+	buffer[0] = int32(chip.mol)
+	buffer[1] = int32(chip.mor)
+
+	if chip.status_time != 0 {
+		chip.status_time--
+	}
+}
+
+// frameMute maps the cycle to the channel muted by OPN2_SetMute, 5 is
+// channel 6 and the DAC.
+var frameMute = [6]uint8{1, 5, 3, 0, 4, 2}
+
+// frameReady reports whether the next frame can be clocked with
+// OPN2_ClockFrame: no buffered write is due before its end and channel 6
+// and the DAC are muted alike, so writes to 0x2B do not change what is mixed.
+func frameReady(chip *YM3438) bool {
+	next := &chip.writebuf[chip.writebuf_cur]
+	return (next.port&0x04 == 0 || next.time > chip.writebuf_samplecnt+23) &&
+		chip.mute[5] == chip.mute[6]
+}
+
+// generateFrame adds a frame of output to the resampler like the cycle loop
+// of OPN2_GenerateResampledHook.
+func generateFrame(chip *YM3438) {
+	var buffer [24][2]int32
+	var cycles uint32 = chip.cycles
+
+	if chip.idle_skip != 0 && frameIdle(chip) {
+		idleFrame(chip, &buffer)
+	} else {
+		OPN2_ClockFrame(chip, &buffer)
+	}
+	for i := range buffer {
+		if chip.mute[frameMute[cycles>>2]] == 0 {
+			chip.samples[0] += buffer[i][0]
+			chip.samples[1] += buffer[i][1]
+		}
+		cycles = (cycles + 1) % 24
+	}
+	chip.writebuf_samplecnt += 24
+}
+
+// frameIdle reports whether the chip is silent and stays so for the next
+// frame: every operator is released and fully attenuated, the FM, feedback
+// and channel pipelines hold zeros, no key-on, CSM, DAC or test mode is
+// active and no write is in progress. Registers written before the busy
+// flag cleared have been updated by then, so register writes can be skipped
+// too.
+func frameIdle(chip *YM3438) bool {
+	if chip.write_a|chip.write_d|chip.write_busy != 0 ||
+		chip.mode_csm|chip.mode_kon_csm|chip.dacen != 0 ||
+		chip.ch_lock|chip.ch_read != 0 ||
+		chip.mode_test_21 != [8]uint8{} || chip.mode_test_2c != [8]uint8{} ||
+		chip.mode_kon_operator != [4]uint8{} {
+		return false
+	}
+	for i := range 24 {
+		if chip.mode_kon[i]|chip.eg_kon[i]|chip.eg_kon_latch[i]|chip.eg_ssg_inv[i] != 0 ||
+			chip.eg_state[i] != eg_num_release ||
+			chip.eg_level[i] != 0x3ff || chip.eg_out[i] != 0x3ff ||
+			chip.fm_out[i] != 0 || chip.fm_mod[i] != 0 {
+			return false
+		}
+	}
+	for i := range 6 {
+		if chip.ch_acc[i]|chip.ch_out[i]|chip.fm_op2[i] != 0 || chip.fm_op1[i] != [2]int16{} {
+			return false
+		}
+	}
+	return true
+}
+
+// idleFrame clocks a silent frame. Only the envelope timer, the LFO, the
+// timers and the status decay are advanced, everything else stays as it is:
+// attenuated operators output zero whatever their phase, and the phase and
+// envelope latches are refreshed by a key-on before they reach the output.
+func idleFrame(chip *YM3438, buffer *[24][2]int32) {
+	var out int32
+	if chip.chip_type&ModeYM2612 != 0 {
+		/* The DAC offset of a zero sample */
+		out = 3
+	}
+
+	for i := range buffer {
+		var cycles uint32 = chip.cycles
+
+		chip.lfo_inc = 0
+		chip.pg_read >>= 1
+		chip.eg_read[1] >>= 1
+		chip.eg_cycle++
+		if cycles == 1 && chip.eg_quotient == 2 {
+			if chip.eg_cycle_stop != 0 {
+				chip.eg_shift_lock = 0
+			} else {
+				chip.eg_shift_lock = chip.eg_shift + 1
+			}
+			chip.eg_timer_low_lock = uint8(chip.eg_timer & 0x03)
+		}
+		switch cycles {
+		case 0:
+			chip.lfo_pm = chip.lfo_cnt >> 2
+			if chip.lfo_cnt&0x40 != 0 {
+				chip.lfo_am = chip.lfo_cnt & 0x3f
+			} else {
+				chip.lfo_am = chip.lfo_cnt ^ 0x3f
+			}
+			chip.lfo_am <<= 1
+		case 1:
+			chip.eg_quotient++
+			chip.eg_quotient %= 3
+			chip.eg_cycle = 0
+			chip.eg_cycle_stop = 1
+			chip.eg_shift = 0
+			chip.eg_timer_inc |= uint8(chip.eg_quotient >> 1)
+			chip.eg_timer = chip.eg_timer + uint16(chip.eg_timer_inc)
+			chip.eg_timer_inc = uint8(chip.eg_timer >> 12)
+			chip.eg_timer &= 0xfff
+		case 2:
+			chip.pg_read = chip.pg_phase[21] & 0x3ff
+			chip.eg_read[1] = uint32(chip.eg_out[0])
+		case 13:
+			chip.eg_cycle = 0
+			chip.eg_cycle_stop = 1
+			chip.eg_shift = 0
+			chip.eg_timer = chip.eg_timer + uint16(chip.eg_timer_inc)
+			chip.eg_timer_inc = uint8(chip.eg_timer >> 12)
+			chip.eg_timer &= 0xfff
+		case 23:
+			chip.lfo_inc = 1
+		}
+		if (chip.eg_timer>>chip.eg_cycle)&uint16(chip.eg_cycle_stop) != 0 {
+			chip.eg_shift = chip.eg_cycle
+			chip.eg_cycle_stop = 0
+		}
+
+		chip.write_a_en = 0
+		chip.write_d_en = 0
+		chip.busy = 0
+		chip.write_busy_cnt &= 0x1f
+
+		OPN2_DoTimerA(chip)
+		OPN2_DoTimerB(chip)
+
+		if (uint32(chip.lfo_quotient) & lfo_cycles[chip.lfo_freq]) ==
+			lfo_cycles[chip.lfo_freq] {
+			chip.lfo_quotient = 0
+			chip.lfo_cnt++
+		} else {
+			chip.lfo_quotient += chip.lfo_inc
+		}
+		chip.lfo_cnt &= chip.lfo_en
+
+		chip.cycles = frameSlots[cycles].cycle
+		chip.channel = frameSlots[cycles].next
+
+		buffer[i] = [2]int32{out, out}
+		if chip.status_time != 0 {
+			chip.status_time--
+		}
+	}
+	chip.mol = int16(out)
+	chip.mor = int16(out)
+}
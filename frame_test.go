@@ -0,0 +1,216 @@
+package nukeykt
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// frameChips returns two chips of the given type reset alike and set up with
+// a voice on every channel.
+func frameChips(typ uint32) (*YM3438, *YM3438) {
+	a := voiceChip(typ, 44100)
+	b := &YM3438{}
+	b.LoadState(a.SaveState())
+	return a, b
+}
+
+// voiceChip returns a chip of the given type at the given output rate with a
+// voice on every channel.
+func voiceChip(typ uint32, rate uint32) *YM3438 {
+	a := &YM3438{chip_type: typ, use_filter: 1}
+	a.Reset(rate, 7670453)
+	for ch := range uint8(6) {
+		port := uint32(ch/3) << 1
+		for _, w := range [][2]uint8{{0xb0, 0x32}, {0xb4, 0xc0 | ch}, {0xa4, 0x22}, {0xa0, 0x69 + ch*8},
+			{0x30, 0x71}, {0x34, 0x0d}, {0x38, 0x33}, {0x3c, 0x01},
+			{0x40, 0x23}, {0x44, 0x2d}, {0x48, 0x26}, {0x4c, 0x00},
+			{0x50, 0x1f}, {0x54, 0x19}, {0x58, 0x1f}, {0x5c, 0x14},
+			{0x80, 0x07}, {0x84, 0x07}, {0x88, 0x07}, {0x8c, 0x07}} {
+			OPN2_WriteBuffered(a, port, w[0]+ch%3)
+			OPN2_WriteBuffered(a, port|1, w[1])
+		}
+		OPN2_WriteBuffered(a, 0, 0x28)
+		OPN2_WriteBuffered(a, 1, 0xf0|ch/3<<2|ch%3)
+	}
+	for range 100 {
+		var buf [2]int32
+		OPN2_GenerateResampled(a, buf[:])
+	}
+	return a
+}
+
+// noWrite marks a frame without a write.
+const noWrite = 0xff
+
+// checkFrames clocks a with OPN2_ClockFrame and b with OPN2_Clock, making
+// the same write of port and data at the start of each frame, and compares
+// the output and, every 256 frames and at the end, the state.
+func checkFrames(t *testing.T, a, b *YM3438, writes [][2]uint8) {
+	t.Helper()
+
+	var frame [24][2]int32
+	var buf [2]int32
+	for i, w := range writes {
+		if w[0] != noWrite {
+			OPN2_Write(a, uint32(w[0]), w[1])
+			OPN2_Write(b, uint32(w[0]), w[1])
+		}
+
+		OPN2_ClockFrame(a, &frame)
+		for c := range frame {
+			OPN2_Clock(b, buf[:])
+			if frame[c] != buf {
+				t.Fatalf("frame %d cycle %d: output %v, want %v", i, c, frame[c], buf)
+			}
+		}
+		if (i%256 == 255 || i == len(writes)-1) && !bytes.Equal(a.SaveState(), b.SaveState()) {
+			t.Fatalf("frame %d: state differs", i)
+		}
+	}
+}
+
+func TestClockFrame(t *testing.T) {
+	for _, typ := range []uint32{ModeYM2612, ModeReadmode} {
+		a, b := frameChips(typ)
+		r := rand.New(rand.NewPCG(1, uint64(typ)))
+
+		var writes [][2]uint8
+		for range 20000 {
+			// Mostly idle frames, then address and data writes to registers
+			// in use, with the test registers now and then
+			switch n := r.IntN(16); {
+			case n < 8:
+				writes = append(writes, [2]uint8{noWrite, 0})
+			case n < 14:
+				port := uint8(r.IntN(2)) << 1
+				addr := uint8(0x22 + r.IntN(0xb7-0x22))
+				if n == 13 && r.IntN(8) == 0 {
+					addr = [2]uint8{0x21, 0x2c}[r.IntN(2)]
+				}
+				writes = append(writes, [2]uint8{port, addr}, [2]uint8{port | 1, uint8(r.Uint32())})
+			default:
+				writes = append(writes, [2]uint8{0, 0x28}, [2]uint8{1, uint8(r.Uint32())})
+			}
+		}
+		checkFrames(t, a, b, writes)
+	}
+}
+
+func TestIdleSkip(t *testing.T) {
+	for _, typ := range []uint32{ModeYM2612, ModeReadmode} {
+		a, b := frameChips(typ)
+		OPN2_SetIdleSkip(b, 0)
+
+		buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+		out := [][]int32{make([]int32, 64), make([]int32, 64)}
+		idle := false
+		render := func(blocks int) {
+			t.Helper()
+			for range blocks {
+				OPN2_GenerateStream(a, buf, 64)
+				OPN2_GenerateStream(b, out, 64)
+				if !slices.Equal(buf[0], out[0]) || !slices.Equal(buf[1], out[1]) {
+					t.Fatalf("type %d: output differs with idle skip", typ)
+				}
+				if sa, sb := OPN2_Read(a, 0), OPN2_Read(b, 0); sa != sb {
+					t.Fatalf("type %d: status %#x, want %#x", typ, sa, sb)
+				}
+				idle = idle || frameIdle(a)
+			}
+		}
+		write := func(port uint32, addr, data uint8) {
+			for _, chip := range []*YM3438{a, b} {
+				OPN2_WriteBuffered(chip, port, addr)
+				OPN2_WriteBuffered(chip, port|1, data)
+			}
+		}
+
+		// Key everything off with the LFO and both timers running, let the
+		// release finish, then key on again with feedback
+		write(0, 0x22, 0x0b)
+		write(0, 0x24, 0xf0)
+		write(0, 0x26, 0xc0)
+		write(0, 0x27, 0x3f)
+		for ch := range uint8(6) {
+			for op := range uint8(4) {
+				write(uint32(ch/3)<<1, 0x80+op*4+ch%3, 0x0f)
+			}
+			write(0, 0x28, ch/3<<2|ch%3)
+		}
+		render(100)
+		if !idle {
+			t.Fatalf("type %d: chip never went idle", typ)
+		}
+		write(0, 0x27, 0x15)
+		render(20)
+		for ch := range uint8(6) {
+			write(uint32(ch/3)<<1, 0xb0+ch%3, 0x3f)
+			write(0, 0x28, 0xf0|ch/3<<2|ch%3)
+		}
+		render(50)
+	}
+}
+
+func FuzzClockFrame(f *testing.F) {
+	f.Add([]byte{0, 0x22, 1, 0x0f, 0, 0x28, 1, 0xf2, 0, 0x90, 1, 0x0b})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a, b := frameChips(ModeYM2612)
+
+		var writes [][2]uint8
+		for ; len(data) >= 2; data = data[2:] {
+			writes = append(writes, [2]uint8{data[0] & 3, data[1]})
+		}
+		checkFrames(t, a, b, writes)
+	})
+}
+
+// BenchmarkClockFrame compares OPN2_ClockFrame with 24 calls of OPN2_Clock
+// and reports its speedup.
+func BenchmarkClockFrame(b *testing.B) {
+	var clock float64
+	b.Run("clock", func(b *testing.B) {
+		chip, _ := frameChips(ModeYM2612)
+		var buf [2]int32
+		for b.Loop() {
+			for range 24 {
+				OPN2_Clock(chip, buf[:])
+			}
+		}
+		clock = float64(b.Elapsed()) / float64(b.N)
+	})
+	b.Run("frame", func(b *testing.B) {
+		chip, _ := frameChips(ModeYM2612)
+		var frame [24][2]int32
+		for b.Loop() {
+			OPN2_ClockFrame(chip, &frame)
+		}
+		if clock != 0 {
+			b.ReportMetric(clock/(float64(b.Elapsed())/float64(b.N)), "speedup")
+		}
+	})
+}
+
+func BenchmarkGenerateStream(b *testing.B) {
+	chip, _ := frameChips(ModeYM2612)
+	buf := [][]int32{make([]int32, 1024), make([]int32, 1024)}
+	for b.Loop() {
+		OPN2_GenerateStream(chip, buf, 1024)
+	}
+}
+
+func BenchmarkGenerateStreamIdle(b *testing.B) {
+	for _, skip := range []uint32{0, 1} {
+		b.Run([]string{"noskip", "skip"}[skip], func(b *testing.B) {
+			chip := NewYM2612()
+			chip.Reset(44100, 7670453)
+			OPN2_SetIdleSkip(chip, skip)
+			buf := [][]int32{make([]int32, 1024), make([]int32, 1024)}
+			for b.Loop() {
+				OPN2_GenerateStream(chip, buf, 1024)
+			}
+		})
+	}
+}
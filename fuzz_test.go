@@ -0,0 +1,101 @@
+package nukeykt
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzRates = [4]uint32{44100, 48000, 53267, 8000}
+
+// FuzzChip runs the chip through a sequence of operations decoded from the
+// input. The first byte selects the chip type and output rate, then every
+// pair of bytes is an operation and its argument:
+//
+//	op&3 == 0  write arg to port op>>2, clock a cycle
+//	op&3 == 1  clock arg+1 cycles
+//	op&3 == 2  read port op>>2, set the test pin to op>>4
+//	op&3 == 3  buffered write of arg to port op>>2, generate op>>4+1 samples
+func FuzzChip(f *testing.F) {
+	f.Add([]byte{0x00,
+		0x00, 0x28, 0x01, 0, 0x04, 0xf0, 0x01, 0xff,
+	})
+	f.Add([]byte{0x01,
+		0x03, 0xb0, 0x17, 0x07, 0x03, 0xa4, 0x17, 0x22, 0x03, 0xa0, 0x17, 0x69,
+		0x03, 0x28, 0x17, 0xf0, 0x01, 0xff, 0x02, 0, 0x01, 0xff,
+	})
+	f.Add([]byte{0x06,
+		0x00, 0x21, 0x04, 0xff, 0x00, 0x2c, 0x04, 0xff, 0x12, 0, 0x01, 0x80,
+		0x00, 0x27, 0x04, 0x4f, 0x00, 0x24, 0x04, 0xff, 0x01, 0xff, 0x02, 0,
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+
+		chip := NewYM3438()
+		if data[0]&1 != 0 {
+			chip = NewYM2612()
+		}
+		chip.Reset(fuzzRates[data[0]>>1&3], 7670453)
+
+		var buf [2]int32
+		for ops := data[1:]; len(ops) >= 2; ops = ops[2:] {
+			op, arg := ops[0], ops[1]
+			port := uint32(op >> 2 & 3)
+
+			switch op & 3 {
+			case 0:
+				OPN2_Write(chip, port, arg)
+				OPN2_Clock(chip, buf[:])
+			case 1:
+				for range int(arg) + 1 {
+					OPN2_Clock(chip, buf[:])
+				}
+			case 2:
+				OPN2_Read(chip, port)
+				OPN2_SetTestPin(chip, uint32(op>>4))
+			case 3:
+				OPN2_WriteBuffered(chip, port, arg)
+				for range op>>4 + 1 {
+					OPN2_GenerateResampled(chip, buf[:])
+				}
+			}
+			checkRanges(t, chip)
+		}
+
+		state := chip.SaveState()
+		restored := &YM3438{}
+		if err := restored.LoadState(state); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored.SaveState(), state) {
+			t.Fatal("state changed by save and restore")
+		}
+
+		var out [2]int32
+		for range 48 {
+			OPN2_Clock(chip, buf[:])
+			OPN2_Clock(restored, out[:])
+			if buf != out {
+				t.Fatalf("restored chip output %v, want %v", out, buf)
+			}
+		}
+	})
+}
+
+func checkRanges(t *testing.T, chip *YM3438) {
+	t.Helper()
+
+	for i := range 24 {
+		if chip.eg_level[i] > 0x3ff {
+			t.Fatalf("eg_level[%d] = %#x", i, chip.eg_level[i])
+		}
+		if chip.eg_out[i] > 0x3ff {
+			t.Fatalf("eg_out[%d] = %#x", i, chip.eg_out[i])
+		}
+		if chip.pg_phase[i] > 0xfffff {
+			t.Fatalf("pg_phase[%d] = %#x", i, chip.pg_phase[i])
+		}
+	}
+}
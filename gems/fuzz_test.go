@@ -0,0 +1,29 @@
+package gems
+
+import (
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzPlayer(f *testing.F) {
+	f.Add(patchBank, envelopeBank, sampleBank,
+		sequenceBank([]byte{cmdPatch, 0, cmdEnvelope, 0, cmdDuration | 2, cmdDelay | 1, 0x30, cmdPatch, 1, 1, cmdGoto, 0xf6, 0xff}))
+
+	f.Fuzz(func(t *testing.T, patches, envelopes, samples, sequences []byte) {
+		b := &Banks{}
+		b.Patches, _ = ParsePatches(patches)
+		b.Envelopes, _ = ParseEnvelopes(envelopes)
+		b.Samples, _ = ParseSamples(samples)
+		b.Sequences, _ = ParseSequences(sequences)
+
+		p, err := NewPlayer(b, 0, nukeykt.NewYM2612(), 7670453, 8000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+// Package gems plays sequences of the GEMS 2.x sound driver from the four
+// banks its tools build: the patch, envelope, sequence and sample banks.
+//
+// The patch, envelope and sequence banks start with a table of little endian
+// 16 bit offsets of their entries, relative to the bank start. The table ends
+// where the first entry starts.
+//
+//   - A patch starts with its type. FM patches are 39 bytes: the type, the
+//     LFO (0x22), channel 3 mode (0x27), FB/ALG (0xB0) and L/R/AMS/FMS
+//     (0xB4) registers, the 0x30, 0x40, 0x50, 0x60, 0x70 and 0x80 registers
+//     of each operator in register order, the four channel 3 operator
+//     frequencies with the block and high bits first, the key on operators
+//     in the high nibble and a reserved byte. DAC patches are only their
+//     type, the note selects the sample. PSG patches are 7 bytes: the type,
+//     the noise mode, attack rate, sustain level, attack level, decay rate
+//     and release rate.
+//   - An envelope is a list of segments of a tick count and a signed 16 bit
+//     pitch change per tick in 1/256 semitones, ended by a zero tick count.
+//   - A sequence is its channel count followed by the offsets of the channel
+//     streams.
+//
+// The sample bank is a table of 12 byte headers ending where the first
+// sample data starts: the flags, the 24 bit offset of the data in the bank,
+// and the 16 bit skip, first, loop and end lengths. A sample skips skip
+// bytes, plays first bytes, then plays the loop bytes repeatedly if loop is
+// not zero. The end bytes follow the loop and are not played. Samples are
+// unsigned 8 bit.
+//
+// Channel streams are timed in ticks of a 24th of a beat.
+package gems
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/elemir/nukeykt"
+)
+
+// Patch types
+const (
+	PatchFM = iota
+	PatchDAC
+	PatchPSGTone
+	PatchPSGNoise
+)
+
+const (
+	// FMPatchSize is the size of an FM patch including its type.
+	FMPatchSize = 39
+	// DACPatchSize is the size of a DAC patch including its type.
+	DACPatchSize = 1
+	// PSGPatchSize is the size of a PSG patch including its type.
+	PSGPatchSize = 7
+
+	// SampleHeaderSize is the size of a sample bank header.
+	SampleHeaderSize = 12
+
+	TicksPerBeat = 24
+	DefaultTempo = 120
+	// DefaultDACRate is the rate samples are streamed at.
+	DefaultDACRate = 10400
+)
+
+var ErrFormat = errors.New("gems: invalid bank")
+
+// Patch is the raw data of a patch starting with its type.
+type Patch []byte
+
+// Type returns the patch type.
+func (p Patch) Type() uint8 {
+	return p[0]
+}
+
+// EnvelopeSegment changes the pitch by Rate 1/256 semitones for each of
+// Ticks ticks.
+type EnvelopeSegment struct {
+	Ticks uint8
+	Rate  int16
+}
+
+// Envelope is a pitch envelope.
+type Envelope []EnvelopeSegment
+
+// Sequence is a sequence of a bank, made of the offsets of its channel
+// streams in the bank data.
+type Sequence struct {
+	Channels []int
+}
+
+// SequenceBank is a parsed sequence bank.
+type SequenceBank struct {
+	Sequences []Sequence
+	Data      []byte
+}
+
+// Sample is a sample of the sample bank.
+type Sample struct {
+	Flags uint8
+	// PCM is the played part of the sample, its loop start is set for
+	// looping samples.
+	PCM  *nukeykt.PCM
+	Loop bool
+}
+
+// Banks are the banks a sequence is played with.
+type Banks struct {
+	Patches   []Patch
+	Envelopes []Envelope
+	Sequences *SequenceBank
+	Samples   []Sample
+}
+
+// ParsePatches parses a patch bank.
+func ParsePatches(data []byte) ([]Patch, error) {
+	offsets, err := table(data)
+	if err != nil {
+		return nil, err
+	}
+
+	patches := make([]Patch, len(offsets))
+	for i, off := range offsets {
+		var size int
+		switch data[off] {
+		case PatchFM:
+			size = FMPatchSize
+		case PatchDAC:
+			size = DACPatchSize
+		case PatchPSGTone, PatchPSGNoise:
+			size = PSGPatchSize
+		default:
+			return nil, fmt.Errorf("%w: patch %d has type %d", ErrFormat, i, data[off])
+		}
+		if off+size > len(data) {
+			return nil, fmt.Errorf("%w: short patch %d", ErrFormat, i)
+		}
+		patches[i] = Patch(data[off : off+size])
+	}
+
+	return patches, nil
+}
+
+// ParseEnvelopes parses an envelope bank.
+func ParseEnvelopes(data []byte) ([]Envelope, error) {
+	offsets, err := table(data)
+	if err != nil {
+		return nil, err
+	}
+
+	envelopes := make([]Envelope, len(offsets))
+	for i, off := range offsets {
+		env := Envelope{}
+		for {
+			if off >= len(data) {
+				return nil, fmt.Errorf("%w: unterminated envelope %d", ErrFormat, i)
+			}
+			if data[off] == 0 {
+				break
+			}
+			if off+3 > len(data) {
+				return nil, fmt.Errorf("%w: short envelope %d", ErrFormat, i)
+			}
+			env = append(env, EnvelopeSegment{
+				Ticks: data[off],
+				Rate:  int16(binary.LittleEndian.Uint16(data[off+1:])),
+			})
+			off += 3
+		}
+		envelopes[i] = env
+	}
+
+	return envelopes, nil
+}
+
+// ParseSequences parses a sequence bank.
+func ParseSequences(data []byte) (*SequenceBank, error) {
+	offsets, err := table(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &SequenceBank{Data: data}
+	for _, off := range offsets {
+		n := int(data[off])
+		if off+1+2*n > len(data) {
+			return nil, fmt.Errorf("%w: short sequence at %#x", ErrFormat, off)
+		}
+		var seq Sequence
+		for i := range n {
+			ch := int(binary.LittleEndian.Uint16(data[off+1+2*i:]))
+			if ch >= len(data) {
+				return nil, fmt.Errorf("%w: channel offset %#x out of range", ErrFormat, ch)
+			}
+			seq.Channels = append(seq.Channels, ch)
+		}
+		b.Sequences = append(b.Sequences, seq)
+	}
+
+	return b, nil
+}
+
+// ParseSamples parses a sample bank.
+func ParseSamples(data []byte) ([]Sample, error) {
+	if len(data) < SampleHeaderSize {
+		return nil, fmt.Errorf("%w: short sample table", ErrFormat)
+	}
+
+	n := int(uint24(data[1:])) / SampleHeaderSize
+	if n == 0 || n*SampleHeaderSize > len(data) {
+		return nil, fmt.Errorf("%w: bad sample table size", ErrFormat)
+	}
+	samples := make([]Sample, n)
+	for i := range samples {
+		h := data[i*SampleHeaderSize:]
+		start := int(uint24(h[1:]))
+		skip := int(binary.LittleEndian.Uint16(h[4:]))
+		first := int(binary.LittleEndian.Uint16(h[6:]))
+		loop := int(binary.LittleEndian.Uint16(h[8:]))
+		if start < n*SampleHeaderSize || start+skip+first+loop > len(data) {
+			return nil, fmt.Errorf("%w: sample %d out of range", ErrFormat, i)
+		}
+
+		pcm := data[start+skip : start+skip+first+loop]
+		samples[i] = Sample{
+			Flags: h[0],
+			PCM:   nukeykt.NewPCM(pcm, nukeykt.PCMUnsigned8, DefaultDACRate),
+			Loop:  loop != 0,
+		}
+		samples[i].PCM.LoopStart = first
+	}
+
+	return samples, nil
+}
+
+// table reads an offset table ending where the first entry points.
+func table(data []byte) ([]int, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: short table", ErrFormat)
+	}
+
+	n := int(binary.LittleEndian.Uint16(data)) / 2
+	if n == 0 || 2*n > len(data) {
+		return nil, fmt.Errorf("%w: bad table size", ErrFormat)
+	}
+	offsets := make([]int, n)
+	for i := range offsets {
+		off := int(binary.LittleEndian.Uint16(data[2*i:]))
+		if off < 2*n || off >= len(data) {
+			return nil, fmt.Errorf("%w: offset %#x out of range", ErrFormat, off)
+		}
+		offsets[i] = off
+	}
+
+	return offsets, nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
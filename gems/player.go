@@ -0,0 +1,511 @@
+package gems
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/internal/driver"
+)
+
+// Sequence commands
+const (
+	cmdNoteMax   = 0x5f
+	cmdEnd       = 0x60
+	cmdPatch     = 0x61
+	cmdEnvelope  = 0x62
+	cmdNop       = 0x63
+	cmdLoop      = 0x64
+	cmdLoopEnd   = 0x65
+	cmdRetrigger = 0x66
+	cmdSustain   = 0x67
+	cmdTempo     = 0x68
+	cmdMute      = 0x69
+	cmdPriority  = 0x6a
+	cmdSequence  = 0x6b
+	cmdBend      = 0x6c
+	cmdSFX       = 0x6d
+	cmdRate      = 0x6e
+	cmdGoto      = 0x6f
+	cmdStore     = 0x70
+	cmdDuration  = 0x80
+	cmdDelay     = 0xc0
+
+	loopForever = 0x7f
+	tempoBase   = 40
+	noEnvelope  = 0xff
+	dacVoice    = 5
+
+	// maxCommands bounds the commands a channel runs in a tick, streams
+	// jumping around without a delay stop instead of hanging the player
+	maxCommands = 0x1000
+)
+
+type loop struct {
+	pos   int
+	count int
+}
+
+type channel struct {
+	pos     int
+	playing bool
+	patch   Patch
+	muted   bool
+	sustain bool
+	bend    int16
+
+	envelope Envelope
+	segment  int
+	segLeft  int
+	pitch    int
+
+	duration int
+	delay    int
+	wait     int
+	durCmd   bool
+	delayCmd bool
+
+	loops []loop
+}
+
+type voice struct {
+	left    int
+	age     uint64
+	keyed   bool
+	patch   Patch
+	channel int
+	note    uint8
+}
+
+// Player plays a sequence through an OPN2, allocating FM channels to notes
+// like the driver does. PSG patches are interpreted but not rendered.
+type Player struct {
+	banks *Banks
+	chip  *nukeykt.YM3438
+	dac   *nukeykt.DACStream
+	rate  uint32
+
+	channels []channel
+	voices   [driver.FMChannels]voice
+	dacLeft  int
+	tempo    int
+	loops    int
+	age      uint64
+	mailbox  [256]uint8
+
+	frac uint64
+	left uint64
+	out  [2][]int32
+}
+
+// NewPlayer resets the chip with the given clock and output rate and returns
+// a player for a sequence of the banks. It fails if the clock is too slow to
+// stream samples at DefaultDACRate.
+func NewPlayer(banks *Banks, seq int, chip *nukeykt.YM3438, clock, rate uint32) (*Player, error) {
+	chip.Reset(rate, clock)
+	dac, err := nukeykt.NewDACStream(chip, DefaultDACRate, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Player{
+		banks: banks,
+		chip:  chip,
+		dac:   dac,
+		rate:  rate,
+		tempo: DefaultTempo,
+	}
+
+	p.write(0, 0x22, 0x00)
+	p.write(0, 0x27, 0x00)
+	p.write(0, 0x2b, 0x00)
+	for v := range p.voices {
+		p.write(0, 0x28, driver.KeyChannel(v))
+	}
+
+	if banks.Sequences != nil && seq >= 0 && seq < len(banks.Sequences.Sequences) {
+		for _, pos := range banks.Sequences.Sequences[seq].Channels {
+			p.channels = append(p.channels, channel{pos: pos, playing: true})
+		}
+	}
+
+	return p, nil
+}
+
+// Loops returns how many times the first channel jumped back forever.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether all channels ended.
+func (p *Player) Done() bool {
+	for i := range p.channels {
+		if p.channels[i].playing {
+			return false
+		}
+	}
+	return true
+}
+
+// Mailbox returns a value stored by the sequence for the game to read.
+func (p *Player) Mailbox(i uint8) uint8 {
+	return p.mailbox[i]
+}
+
+// Generate renders numsamples stereo samples.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		if p.left == 0 {
+			p.tick()
+			// Carry the remainder so ticks average the exact tempo
+			div := uint64(p.tempo) * TicksPerBeat
+			p.frac += uint64(p.rate) * 60
+			p.left = max(p.frac/div, 1)
+			p.frac %= div
+		}
+		n := min(p.left, uint64(numsamples)-off)
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.dac.Generate(p.out[:], uint32(n))
+		p.left -= n
+		off += n
+	}
+}
+
+// tick advances all channels and voices by one tick.
+func (p *Player) tick() {
+	for v := range p.voices {
+		vc := &p.voices[v]
+		if vc.keyed && vc.left > 0 {
+			vc.left--
+			if vc.left == 0 && !p.channels[vc.channel].sustain {
+				p.keyOff(v)
+			}
+		}
+	}
+	if p.dacLeft > 0 {
+		p.dacLeft--
+		if p.dacLeft == 0 {
+			p.dac.Stop(0)
+		}
+	}
+
+	for i := range p.channels {
+		c := &p.channels[i]
+		if p.envelope(c) {
+			for v := range p.voices {
+				if p.voices[v].keyed && p.voices[v].channel == i {
+					p.writeFreq(v)
+				}
+			}
+		}
+		if !c.playing {
+			continue
+		}
+		if c.wait > 0 {
+			c.wait--
+		}
+		for n := 0; c.playing && c.wait == 0; n++ {
+			if n == maxCommands {
+				c.playing = false
+				break
+			}
+			p.command(i)
+		}
+	}
+}
+
+// envelope steps the pitch envelope of a channel and reports whether its
+// pitch changed.
+func (p *Player) envelope(c *channel) bool {
+	for c.segment < len(c.envelope) && c.segLeft == 0 {
+		c.segment++
+		if c.segment < len(c.envelope) {
+			c.segLeft = int(c.envelope[c.segment].Ticks)
+		}
+	}
+	if c.segment >= len(c.envelope) {
+		return false
+	}
+	c.pitch += int(c.envelope[c.segment].Rate)
+	c.segLeft--
+	return true
+}
+
+// startEnvelope restarts the pitch envelope of a channel.
+func (c *channel) startEnvelope() {
+	c.pitch = 0
+	c.segment = 0
+	c.segLeft = 0
+	if len(c.envelope) > 0 {
+		c.segLeft = int(c.envelope[0].Ticks)
+	}
+}
+
+func (p *Player) command(i int) {
+	c := &p.channels[i]
+	cmd, ok := p.next(c)
+	if !ok {
+		return
+	}
+
+	// Consecutive duration or delay bytes hold 6 more bits of the value
+	if cmd&0xc0 != cmdDuration {
+		c.durCmd = false
+	}
+	if cmd&0xc0 != cmdDelay {
+		c.delayCmd = false
+	}
+
+	switch {
+	case cmd <= cmdNoteMax:
+		p.note(i, cmd)
+		c.wait = c.delay
+	case cmd&0xc0 == cmdDuration:
+		if !c.durCmd {
+			c.duration = 0
+		}
+		c.duration = c.duration<<6 | int(cmd&0x3f)
+		c.durCmd = true
+	case cmd&0xc0 == cmdDelay:
+		if !c.delayCmd {
+			c.delay = 0
+		}
+		c.delay = c.delay<<6 | int(cmd&0x3f)
+		c.delayCmd = true
+	case cmd == cmdEnd:
+		c.playing = false
+	case cmd == cmdPatch:
+		b, _ := p.next(c)
+		if int(b) < len(p.banks.Patches) {
+			c.patch = p.banks.Patches[b]
+		}
+	case cmd == cmdEnvelope:
+		b, _ := p.next(c)
+		c.envelope = nil
+		if b != noEnvelope && int(b) < len(p.banks.Envelopes) {
+			c.envelope = p.banks.Envelopes[b]
+		}
+		// The envelope starts with the next note
+		c.segment = len(c.envelope)
+	case cmd == cmdLoop:
+		b, _ := p.next(c)
+		c.loops = append(c.loops, loop{pos: c.pos, count: int(b)})
+	case cmd == cmdLoopEnd:
+		if len(c.loops) == 0 {
+			return
+		}
+		l := &c.loops[len(c.loops)-1]
+		switch {
+		case l.count == loopForever:
+			if i == 0 {
+				p.loops++
+			}
+			c.pos = l.pos
+		case l.count > 0:
+			l.count--
+			c.pos = l.pos
+		default:
+			c.loops = c.loops[:len(c.loops)-1]
+		}
+	case cmd == cmdSustain:
+		b, _ := p.next(c)
+		c.sustain = b != 0
+	case cmd == cmdTempo:
+		b, _ := p.next(c)
+		p.tempo = int(b) + tempoBase
+	case cmd == cmdMute:
+		b, _ := p.next(c)
+		c.muted = b != 0
+	case cmd == cmdBend:
+		lo, _ := p.next(c)
+		hi, _ := p.next(c)
+		c.bend = int16(uint16(hi)<<8 | uint16(lo))
+	case cmd == cmdGoto:
+		lo, _ := p.next(c)
+		hi, ok := p.next(c)
+		if !ok {
+			return
+		}
+		to := c.pos + int(int16(uint16(hi)<<8|uint16(lo)))
+		if to < 0 || to >= len(p.banks.Sequences.Data) {
+			c.playing = false
+			return
+		}
+		if to < c.pos && i == 0 {
+			p.loops++
+		}
+		c.pos = to
+	case cmd == cmdStore:
+		box, _ := p.next(c)
+		value, _ := p.next(c)
+		p.mailbox[box] = value
+	case cmd == cmdRetrigger, cmd == cmdPriority, cmd == cmdSequence, cmd == cmdRate:
+		p.next(c)
+	case cmd == cmdNop, cmd == cmdSFX:
+	default:
+		c.playing = false
+	}
+}
+
+func (p *Player) next(c *channel) (uint8, bool) {
+	if c.pos >= len(p.banks.Sequences.Data) {
+		c.playing = false
+		return 0, false
+	}
+	b := p.banks.Sequences.Data[c.pos]
+	c.pos++
+	return b, true
+}
+
+func (p *Player) note(i int, note uint8) {
+	c := &p.channels[i]
+	if c.muted || c.patch == nil {
+		return
+	}
+
+	switch c.patch.Type() {
+	case PatchDAC:
+		if int(note) >= len(p.banks.Samples) {
+			return
+		}
+		s := p.banks.Samples[note]
+		p.keyOff(dacVoice)
+		p.dac.Play(0, s.PCM, 1, s.Loop)
+		p.dacLeft = 0
+		if s.Loop {
+			p.dacLeft = max(c.duration, 1)
+		}
+	case PatchFM:
+		// Sustained notes hold until the next note of their channel
+		if c.sustain {
+			for v := range p.voices {
+				if p.voices[v].channel == i && p.voices[v].left == 0 {
+					p.keyOff(v)
+				}
+			}
+		}
+		v := p.allocate()
+		vc := &p.voices[v]
+		p.keyOff(v)
+		if !samePatch(vc.patch, c.patch) {
+			vc.patch = c.patch
+			p.loadPatch(v)
+		}
+		vc.left = max(c.duration, 1)
+		vc.channel = i
+		vc.note = note
+		p.age++
+		vc.age = p.age
+
+		c.startEnvelope()
+		p.writeFreq(v)
+		p.write(0, 0x28, vc.patch[37]&0xf0|driver.KeyChannel(v))
+		vc.keyed = true
+	}
+}
+
+// allocate returns a free FM channel or steals the oldest note.
+func (p *Player) allocate() int {
+	voices := driver.FMChannels
+	if p.dac.Playing(0) {
+		voices = dacVoice
+	}
+
+	best := 0
+	for v := range voices {
+		vc := &p.voices[v]
+		if !vc.keyed {
+			return v
+		}
+		if vc.age < p.voices[best].age {
+			best = v
+		}
+	}
+	return best
+}
+
+func (p *Player) keyOff(v int) {
+	if p.voices[v].keyed {
+		p.voices[v].keyed = false
+		p.write(0, 0x28, driver.KeyChannel(v))
+	}
+}
+
+// writeFreq writes the frequency of the note of a voice, bent by its channel
+// bend and envelope. Channel 3 in special mode keeps the patch frequencies.
+func (p *Player) writeFreq(v int) {
+	vc := &p.voices[v]
+	if v == 2 && ch3Special(vc.patch) {
+		return
+	}
+	c := &p.channels[vc.channel]
+
+	pitch := max(int(vc.note)<<8+int(c.bend)+c.pitch, 0)
+	semitone := pitch >> 8
+	fnum := float64(driver.Freqs[semitone%12]) * math.Pow(2, float64(pitch&0xff)/(256*12))
+	block := semitone / 12
+	for fnum >= 0x800 && block < 7 {
+		fnum /= 2
+		block++
+	}
+	freq := uint16(min(block, 7))<<11 | min(uint16(fnum), 0x7ff)
+	p.writeCh(v, 0xa4, uint8(freq>>8))
+	p.writeCh(v, 0xa0, uint8(freq))
+}
+
+// Special mode frequency registers of OP1 to OP3, less 0xA8
+var ch3Regs = [3]uint8{1, 2, 0}
+
+func (p *Player) loadPatch(v int) {
+	patch := p.voices[v].patch
+	p.write(0, 0x22, patch[1])
+	if v == 2 {
+		p.write(0, 0x27, patch[2]&0xc0)
+	}
+	p.writeCh(v, 0xb0, patch[3])
+	p.writeCh(v, 0xb4, patch[4])
+
+	for op := range 4 {
+		regs := patch[5+op*6:]
+		off := uint8(op * 4)
+		p.writeCh(v, 0x30+off, regs[0])
+		p.writeCh(v, 0x40+off, regs[1])
+		p.writeCh(v, 0x50+off, regs[2])
+		p.writeCh(v, 0x60+off, regs[3])
+		p.writeCh(v, 0x70+off, regs[4])
+		p.writeCh(v, 0x80+off, regs[5])
+	}
+
+	if v == 2 && ch3Special(patch) {
+		freqs := patch[29:37]
+		for op, reg := range ch3Regs {
+			freq := binary.BigEndian.Uint16(freqs[op*2:])
+			p.write(0, 0xac+reg, uint8(freq>>8))
+			p.write(0, 0xa8+reg, uint8(freq))
+		}
+		freq := binary.BigEndian.Uint16(freqs[6:])
+		p.writeCh(v, 0xa4, uint8(freq>>8))
+		p.writeCh(v, 0xa0, uint8(freq))
+	}
+}
+
+// ch3Special reports whether an FM patch sets channel 3 special mode.
+func ch3Special(patch Patch) bool {
+	return patch[2]&0x40 != 0
+}
+
+func samePatch(a, b Patch) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
+}
+
+func (p *Player) writeCh(v int, reg, data uint8) {
+	p.write(uint32(v/3), reg+uint8(v%3), data)
+}
+
+func (p *Player) write(port uint32, addr, data uint8) {
+	nukeykt.OPN2_WriteBuffered(p.chip, port<<1, addr)
+	nukeykt.OPN2_WriteBuffered(p.chip, port<<1|1, data)
+}
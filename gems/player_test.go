@@ -0,0 +1,270 @@
+package gems
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// Banks laid out like the GEMS 2.x tools write them, offsets relative to
+// the bank start.
+var (
+	patchBank = []byte{
+		// Offsets of an FM, a DAC and a PSG tone patch
+		0x06, 0x00, 0x2d, 0x00, 0x2e, 0x00,
+		// FM: type, LFO, channel 3 mode, FB/ALG 4, L/R
+		0x00, 0x00, 0x00, 0x3c, 0xc0,
+		// OP1, OP3, OP2, OP4: DT/MUL, TL, RS/AR, AM/D1R, D2R, D1L/RR
+		0x01, 0x20, 0x1f, 0x05, 0x02, 0x16,
+		0x01, 0x7f, 0x1f, 0x05, 0x02, 0x16,
+		0x01, 0x20, 0x1f, 0x05, 0x02, 0x16,
+		0x01, 0x00, 0x1f, 0x05, 0x02, 0x16,
+		// Channel 3 frequencies, key on operators and the reserved byte
+		0x22, 0x84, 0x22, 0x84, 0x22, 0x84, 0x22, 0x84,
+		0xf0, 0x00,
+		// DAC
+		0x01,
+		// PSG tone: type, noise mode, AR, SL, AL, DR, RR
+		0x02, 0x00, 0x10, 0x08, 0x00, 0x02, 0x04,
+	}
+
+	envelopeBank = []byte{
+		// Offsets of a vibrato and an empty envelope
+		0x04, 0x00, 0x0e, 0x00,
+		// Up a semitone in 2 ticks, back down in 2 ticks, end
+		0x02, 0x80, 0x00,
+		0x02, 0x80, 0xff,
+		0x01, 0x00, 0x00,
+		0x00,
+		0x00,
+	}
+
+	sampleBank = []byte{
+		// Flags, offset, skip, first, loop and end lengths of a one shot
+		// and a looping sample
+		0x00, 0x18, 0x00, 0x00, 0x01, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x02, 0x00, 0x01, 0x00,
+		0x7f, 0x80, 0x90, 0xa0,
+		0x80, 0xc0, 0x40, 0x80,
+	}
+)
+
+// sequenceBank returns a bank with one sequence of the given channels.
+func sequenceBank(channels ...[]byte) []byte {
+	bank := []byte{0x02, 0x00, byte(len(channels))}
+	pos := len(bank) + 2*len(channels)
+	for _, ch := range channels {
+		bank = append(bank, byte(pos), byte(pos>>8))
+		pos += len(ch)
+	}
+	for _, ch := range channels {
+		bank = append(bank, ch...)
+	}
+	return bank
+}
+
+func parseBanks(t *testing.T, seq []byte) *Banks {
+	t.Helper()
+	patches, err := ParsePatches(patchBank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes, err := ParseEnvelopes(envelopeBank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := ParseSamples(sampleBank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequences, err := ParseSequences(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Banks{Patches: patches, Envelopes: envelopes, Sequences: sequences, Samples: samples}
+}
+
+func TestParse(t *testing.T) {
+	seq := sequenceBank([]byte{cmdEnd}, []byte{cmdNop, cmdEnd})
+	b := parseBanks(t, seq)
+
+	var types []uint8
+	for _, p := range b.Patches {
+		types = append(types, p.Type())
+	}
+	if !slices.Equal(types, []uint8{PatchFM, PatchDAC, PatchPSGTone}) || len(b.Patches[0]) != FMPatchSize {
+		t.Errorf("patch types %v, FM patch of %d bytes", types, len(b.Patches[0]))
+	}
+
+	if len(b.Envelopes) != 2 || !slices.Equal(b.Envelopes[0], Envelope{{2, 0x80}, {2, -0x80}, {1, 0}}) || len(b.Envelopes[1]) != 0 {
+		t.Errorf("envelopes %v", b.Envelopes)
+	}
+
+	if len(b.Sequences.Sequences) != 1 || !slices.Equal(b.Sequences.Sequences[0].Channels, []int{7, 8}) {
+		t.Errorf("sequences %v", b.Sequences.Sequences)
+	}
+
+	if len(b.Samples) != 2 {
+		t.Fatalf("%d samples", len(b.Samples))
+	}
+	if s := b.Samples[0]; s.Loop || !slices.Equal(s.PCM.Samples, []int16{0, 0x1000, 0x2000}) {
+		t.Errorf("one shot sample %+v %#x", s, s.PCM.Samples)
+	}
+	if s := b.Samples[1]; !s.Loop || s.PCM.LoopStart != 1 || !slices.Equal(s.PCM.Samples, []int16{0, 0x4000, -0x4000}) {
+		t.Errorf("looping sample %+v %#x", s, s.PCM.Samples)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		parse func([]byte) error
+		data  []byte
+	}{
+		{"unknown patch type", func(d []byte) error { _, err := ParsePatches(d); return err }, []byte{0x02, 0x00, 0x09}},
+		{"short FM patch", func(d []byte) error { _, err := ParsePatches(d); return err }, []byte{0x02, 0x00, 0x00, 0x00}},
+		{"unterminated envelope", func(d []byte) error { _, err := ParseEnvelopes(d); return err }, []byte{0x02, 0x00, 0x01, 0x00, 0x00}},
+		{"short sequence", func(d []byte) error { _, err := ParseSequences(d); return err }, []byte{0x02, 0x00, 0x02, 0x05, 0x00}},
+		{"sample out of range", func(d []byte) error { _, err := ParseSamples(d); return err }, sampleBank[:len(sampleBank)-2]},
+		{"offset in the table", func(d []byte) error { _, err := ParseSequences(d); return err }, []byte{0x04, 0x00, 0x00, 0x00, 0x00}},
+	} {
+		if err := tc.parse(tc.data); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+// play renders the first sequence of the banks for the given ticks at the
+// default tempo and returns the player.
+func play(t *testing.T, b *Banks, ticks int) *Player {
+	t.Helper()
+	const rate = 9600
+	p, err := NewPlayer(b, 0, nukeykt.NewYM2612(), 7670453, rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A tick is rate*60/(120*24) samples, less one so the last tick ran
+	n := ticks*rate*60/(DefaultTempo*TicksPerBeat) - 1
+	buf := [][]int32{make([]int32, n), make([]int32, n)}
+	p.Generate(buf, uint32(n))
+	return p
+}
+
+func TestPlayerNote(t *testing.T) {
+	// FM patch, duration 4, delay 8, C4
+	seq := sequenceBank([]byte{cmdPatch, 0, cmdDuration | 4, cmdDelay | 8, 0x30, cmdEnd})
+
+	p := play(t, parseBanks(t, seq), 2)
+	ch := p.chip.State().Channels[0]
+	if ch.FNum != 644 || ch.Block != 4 || ch.Algorithm != 4 || !ch.PanL || !ch.PanR {
+		t.Errorf("channel %+v", ch)
+	}
+	if !ch.Operators[0].KeyOn || p.Done() {
+		t.Error("note not playing")
+	}
+
+	p = play(t, parseBanks(t, seq), 6)
+	if p.chip.State().Channels[0].Operators[0].KeyOn {
+		t.Error("note playing after its duration")
+	}
+	p = play(t, parseBanks(t, seq), 10)
+	if !p.Done() {
+		t.Error("sequence not done after its delay")
+	}
+}
+
+func TestPlayerAllocation(t *testing.T) {
+	// Seven notes at once on a channel each, the first one is stolen
+	var channels [][]byte
+	for i := range 7 {
+		channels = append(channels, []byte{cmdPatch, 0, cmdDuration | 0x20, cmdDelay | 0x20, 0x30 + byte(i)})
+	}
+
+	p := play(t, parseBanks(t, sequenceBank(channels...)), 2)
+	s := p.chip.State()
+	if s.Channels[0].FNum != 910 {
+		t.Errorf("stolen channel plays fnum %d, want the seventh note", s.Channels[0].FNum)
+	}
+	for v, ch := range s.Channels {
+		if !ch.Operators[0].KeyOn {
+			t.Errorf("channel %d not keyed on", v)
+		}
+	}
+}
+
+func TestPlayerEnvelope(t *testing.T) {
+	seq := sequenceBank([]byte{cmdPatch, 0, cmdEnvelope, 0, cmdDuration | 0x20, cmdDelay | 0x20, 0x30})
+
+	var fnums []uint16
+	for ticks := 1; ticks <= 6; ticks++ {
+		p := play(t, parseBanks(t, seq), ticks)
+		fnums = append(fnums, p.chip.State().Channels[0].FNum)
+	}
+	// Half a semitone a tick up to C#, then back down
+	if want := []uint16{644, 662, 681, 662, 644, 644}; !slices.Equal(fnums, want) {
+		t.Errorf("fnums %v, want %v", fnums, want)
+	}
+}
+
+func TestPlayerDAC(t *testing.T) {
+	// The looping sample plays for its duration, FM notes avoid channel 6
+	seq := sequenceBank(
+		[]byte{cmdPatch, 1, cmdDuration | 2, cmdDelay | 8, 1, cmdEnd},
+		[]byte{cmdPatch, 0, cmdDuration | 8, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, cmdEnd},
+	)
+
+	p := play(t, parseBanks(t, seq), 1)
+	if !p.chip.State().DACEnabled || !p.dac.Playing(0) {
+		t.Error("sample not playing")
+	}
+	if p.voices[dacVoice].keyed {
+		t.Error("FM note on the DAC channel")
+	}
+	p = play(t, parseBanks(t, seq), 4)
+	if p.dac.Playing(0) {
+		t.Error("looping sample playing after its duration")
+	}
+}
+
+func TestPlayerLoops(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ch    []byte
+		done  bool
+		loops bool
+	}{
+		{"end", []byte{cmdEnd}, true, false},
+		{"end of bank", []byte{cmdNop}, true, false},
+		{"unknown command", []byte{0x7f}, true, false},
+		{"goto itself", []byte{cmdGoto, 0xfd, 0xff}, true, true},
+		{"loop forever without a delay", []byte{cmdLoop, loopForever, cmdLoopEnd}, true, true},
+		{"counted loop", []byte{cmdDelay | 1, cmdLoop, 2, 0x30, cmdLoopEnd, cmdEnd}, true, false},
+		{"loop forever", []byte{cmdDelay | 1, cmdLoop, loopForever, 0x30, cmdLoopEnd}, false, true},
+		{"goto back", []byte{cmdDelay | 1, 0x30, cmdGoto, 0xfc, 0xff}, false, true},
+	} {
+		p := play(t, parseBanks(t, sequenceBank(tc.ch)), 16)
+		if p.Done() != tc.done || (p.Loops() > 0) != tc.loops {
+			t.Errorf("%s: done %v after %d loops", tc.name, p.Done(), p.Loops())
+		}
+	}
+}
+
+// TestPlayerTempo counts the beats of a second at a tempo.
+func TestPlayerTempo(t *testing.T) {
+	const rate = 44100
+	// 180 BPM, a beat per loop
+	seq := sequenceBank([]byte{cmdTempo, 180 - tempoBase, cmdDelay | TicksPerBeat, cmdLoop, loopForever, 0x30, cmdLoopEnd})
+	p, err := NewPlayer(parseBanks(t, seq), 0, nukeykt.NewYM2612(), 7670453, rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := [][]int32{make([]int32, rate), make([]int32, rate)}
+	p.Generate(buf, rate)
+
+	// The first beat starts at the first tick
+	if p.Loops() != 2 {
+		t.Errorf("%d loops in a second, want 2", p.Loops())
+	}
+	if p.Mailbox(0) != 0 {
+		t.Error("mailbox written")
+	}
+}
@@ -0,0 +1,200 @@
+package nukeykt_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/reglog"
+)
+
+// The golden tests render the register scripts of testdata/golden and
+// compare hashes of the output with testdata/golden.sum. The runs only use
+// functions of the C Nuked OPN2 1.0.12, and testdata/golden.c renders the
+// same hashes with it:
+//
+//	cc -std=c99 -O2 -I$NUKED -o golden testdata/golden.c $NUKED/ym3438.c
+//	./golden testdata/golden/*.log > testdata/golden.sum
+//
+// After an intended change of the output, rewrite the sums with
+//
+//	go test -run Golden -update
+//
+// and check them against the C sums.
+var update = flag.Bool("update", false, "rewrite testdata/golden.sum")
+
+const (
+	goldenSum  = "testdata/golden.sum"
+	goldenRate = 44100
+	// goldenTail is the number of cycles rendered after the last write.
+	goldenTail = 24 * 2000
+)
+
+var goldenModes = []struct {
+	name string
+	new  func() *nukeykt.YM3438
+}{
+	{"ym2612", nukeykt.NewYM2612},
+	{"ym3438", nukeykt.NewYM3438},
+}
+
+var goldenRuns = []struct {
+	name   string
+	render func(h hash.Hash64, chip *nukeykt.YM3438, l *reglog.Log)
+}{
+	{"clock", goldenClock},
+	{"stream", goldenStream},
+}
+
+func TestGolden(t *testing.T) {
+	scripts, err := filepath.Glob("testdata/golden/*.log")
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no golden scripts: %v", err)
+	}
+	want, err := readSums(goldenSum)
+	if err != nil && !*update {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+
+	for _, script := range scripts {
+		data, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := reglog.Parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", script, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(script), ".log")
+
+		for _, mode := range goldenModes {
+			for _, run := range goldenRuns {
+				key := name + " " + mode.name + " " + run.name
+				t.Run(strings.ReplaceAll(key, " ", "/"), func(t *testing.T) {
+					h := fnv.New64a()
+					chip := mode.new()
+					chip.Reset(goldenRate, l.Clock)
+					run.render(h, chip, l)
+
+					got[key] = fmt.Sprintf("%016x", h.Sum64())
+					if !*update && got[key] != want[key] {
+						t.Errorf("hash %s, want %q", got[key], want[key])
+					}
+				})
+			}
+		}
+	}
+
+	if *update {
+		if err := writeSums(goldenSum, got); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// goldenClock clocks the chip cycle by cycle, writing the address of each
+// write at its cycle and the data at the next one, and hashes the output,
+// the IRQ pin and the status read once per sample.
+func goldenClock(h hash.Hash64, chip *nukeykt.YM3438, l *reglog.Log) {
+	var buf [2]int32
+	var b [9]byte
+
+	end := goldenTail
+	if n := len(l.Writes); n > 0 {
+		end += int(l.Writes[n-1].Cycle) + 1
+	}
+
+	pos := 0
+	data := -1
+	for cycle := range end {
+		if data >= 0 {
+			w := l.Writes[data]
+			nukeykt.OPN2_Write(chip, uint32(w.Port)<<1|1, w.Data)
+			data = -1
+		} else if pos < len(l.Writes) && l.Writes[pos].Cycle <= uint64(cycle) {
+			w := l.Writes[pos]
+			nukeykt.OPN2_Write(chip, uint32(w.Port)<<1, w.Addr)
+			data = pos
+			pos++
+		}
+
+		nukeykt.OPN2_Clock(chip, buf[:])
+
+		binary.LittleEndian.PutUint32(b[0:], uint32(buf[0]))
+		binary.LittleEndian.PutUint32(b[4:], uint32(buf[1]))
+		b[8] = uint8(nukeykt.OPN2_ReadIRQPin(chip))
+		if cycle%24 == 23 {
+			b[8] |= nukeykt.OPN2_Read(chip, 0) << 1
+		}
+		h.Write(b[:])
+	}
+}
+
+// goldenStream queues each write with OPN2_WriteBuffered before the output
+// sample its cycle falls in and hashes the output of OPN2_GenerateStream.
+func goldenStream(h hash.Hash64, chip *nukeykt.YM3438, l *reglog.Log) {
+	var b [8]byte
+	buf := [][]int32{make([]int32, 1), make([]int32, 1)}
+
+	// A cycle is six master clocks
+	end := uint64(goldenTail)
+	if n := len(l.Writes); n > 0 {
+		end += l.Writes[n-1].Cycle
+	}
+	samples := end * 6 * goldenRate / uint64(l.Clock)
+
+	pos := 0
+	for i := range samples {
+		for pos < len(l.Writes) && l.Writes[pos].Cycle*6*goldenRate <= i*uint64(l.Clock) {
+			w := l.Writes[pos]
+			port := uint32(w.Port) << 1
+			nukeykt.OPN2_WriteBuffered(chip, port, w.Addr)
+			nukeykt.OPN2_WriteBuffered(chip, port|1, w.Data)
+			pos++
+		}
+
+		nukeykt.OPN2_GenerateStream(chip, buf, 1)
+
+		binary.LittleEndian.PutUint32(b[0:], uint32(buf[0][0]))
+		binary.LittleEndian.PutUint32(b[4:], uint32(buf[1][0]))
+		h.Write(b[:])
+	}
+}
+
+func readSums(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s: bad line %q", name, s.Text())
+		}
+		sums[strings.Join(fields[:3], " ")] = fields[3]
+	}
+	return sums, s.Err()
+}
+
+func writeSums(name string, sums map[string]string) error {
+	var b strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(sums)) {
+		fmt.Fprintf(&b, "%s %s\n", key, sums[key])
+	}
+	return os.WriteFile(name, []byte(b.String()), 0o644)
+}
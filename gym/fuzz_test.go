@@ -0,0 +1,39 @@
+package gym
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzParse(f *testing.F) {
+	body := []byte{CmdPort0, 0x28, 0xf0, CmdPSG, 0x9f, CmdWait, CmdPort1, 0x30, 0x01, CmdWait}
+	f.Add(body)
+
+	var packed bytes.Buffer
+	w := zlib.NewWriter(&packed)
+	w.Write(body)
+	w.Close()
+	hdr := make([]byte, headerSize)
+	copy(hdr, headerMagic)
+	binary.LittleEndian.PutUint32(hdr[420:], 2)
+	binary.LittleEndian.PutUint32(hdr[424:], uint32(len(body)))
+	f.Add(append(hdr, packed.Bytes()...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := Parse(data)
+		if err != nil {
+			return
+		}
+		file.Frames()
+
+		p := NewPlayer(file, nukeykt.NewYM2612(), NTSC, 8000)
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
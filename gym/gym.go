@@ -0,0 +1,158 @@
+// Package gym reads and plays Genecyst GYM register logs.
+package gym
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	CmdWait  = 0x00 // Wait for the next frame
+	CmdPort0 = 0x01 // YM2612 port 0 write: address, data
+	CmdPort1 = 0x02 // YM2612 port 1 write: address, data
+	CmdPSG   = 0x03 // PSG write: data
+
+	headerMagic = "GYMX"
+	headerSize  = 428
+)
+
+var ErrFormat = errors.New("gym: invalid file")
+
+// Header is the optional GYMX header.
+type Header struct {
+	Title     string
+	Game      string
+	Publisher string
+	Emulator  string
+	Dumper    string
+	Comment   string
+	// Loop is the number of the frame the song loops to, counted from 1.
+	// Zero means the song does not loop.
+	Loop uint32
+}
+
+// File is a parsed GYM log.
+type File struct {
+	// Header is nil for plain logs without a GYMX header.
+	Header *Header
+	// Data is the uncompressed command stream.
+	Data []byte
+}
+
+// Parse parses a GYM log, decompressing it if needed.
+func Parse(data []byte) (*File, error) {
+	if !bytes.HasPrefix(data, []byte(headerMagic)) {
+		return &File{Data: data}, nil
+	}
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%w: short GYMX header", ErrFormat)
+	}
+
+	hdr := &Header{
+		Title:     field(data[4:36]),
+		Game:      field(data[36:68]),
+		Publisher: field(data[68:100]),
+		Emulator:  field(data[100:132]),
+		Dumper:    field(data[132:164]),
+		Comment:   field(data[164:420]),
+		Loop:      binary.LittleEndian.Uint32(data[420:]),
+	}
+	packed := binary.LittleEndian.Uint32(data[424:])
+	body := data[headerSize:]
+
+	if packed != 0 {
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFormat, err)
+		}
+		defer r.Close()
+
+		body, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFormat, err)
+		}
+	}
+
+	return &File{Header: hdr, Data: body}, nil
+}
+
+// Frames returns the number of frames in the log.
+func (f *File) Frames() int {
+	frames := 0
+	for pos := 0; pos < len(f.Data); pos += cmdLen(f.Data[pos]) {
+		if f.Data[pos] == CmdWait {
+			frames++
+		}
+	}
+	return frames
+}
+
+// Write is a YM2612 write of a log, made in the given frame.
+type Write struct {
+	Frame uint64
+	Port  uint8
+	Addr  uint8
+	Data  uint8
+}
+
+// Writes returns the YM2612 writes of the log from its start to its end.
+func (f *File) Writes() []Write {
+	var writes []Write
+	var frame uint64
+
+	data := f.Data
+	for pos := 0; pos < len(data); pos += cmdLen(data[pos]) {
+		cmd := data[pos]
+		if pos+cmdLen(cmd) > len(data) {
+			break
+		}
+		switch cmd {
+		case CmdWait:
+			frame++
+		case CmdPort0, CmdPort1:
+			writes = append(writes, Write{frame, cmd - CmdPort0, data[pos+1], data[pos+2]})
+		}
+	}
+
+	return writes
+}
+
+// loopOffset returns the offset of the loop frame in the command stream or
+// -1 if the log does not loop.
+func (f *File) loopOffset() int {
+	if f.Header == nil || f.Header.Loop == 0 {
+		return -1
+	}
+
+	frame := uint32(1)
+	for pos := 0; pos < len(f.Data); pos += cmdLen(f.Data[pos]) {
+		if frame == f.Header.Loop {
+			return pos
+		}
+		if f.Data[pos] == CmdWait {
+			frame++
+		}
+	}
+	return -1
+}
+
+func cmdLen(cmd byte) int {
+	switch cmd {
+	case CmdPort0, CmdPort1:
+		return 3
+	case CmdPSG:
+		return 2
+	}
+	return 1
+}
+
+func field(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
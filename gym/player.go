@@ -0,0 +1,160 @@
+package gym
+
+import "github.com/elemir/nukeykt"
+
+// Region selects the console timing a log was recorded with.
+type Region int
+
+const (
+	NTSC Region = iota
+	PAL
+)
+
+const (
+	MasterNTSC = 53693175
+	MasterPAL  = 53203424
+
+	// YM2612 clocks are the master clock divided by 7
+	ClockNTSC = MasterNTSC / 7
+	ClockPAL  = MasterPAL / 7
+
+	// A frame lasts 3420 master clocks per line, 262 (NTSC) or 313 (PAL) lines
+	frameNTSC = 3420 * 262
+	framePAL  = 3420 * 313
+)
+
+// Clock returns the YM2612 clock of the region.
+func (r Region) Clock() uint32 {
+	if r == PAL {
+		return ClockPAL
+	}
+	return ClockNTSC
+}
+
+// Timing returns the master clock of the region and the length of a frame in
+// master clocks.
+func (r Region) Timing() (master, frame uint64) {
+	if r == PAL {
+		return MasterPAL, framePAL
+	}
+	return MasterNTSC, frameNTSC
+}
+
+// Player renders a GYM log through a chip.
+type Player struct {
+	file   *File
+	chip   nukeykt.Chip
+	rate   uint32
+	master uint64
+	frame  uint64
+	pacer  *nukeykt.Pacer
+
+	pos      int
+	loop     int
+	loops    int
+	done     bool
+	ticks    uint64
+	rendered uint64
+	left     uint64
+	out      [2][]int32
+}
+
+// NewPlayer resets the chip with the region clock and the given output rate
+// and returns a player for the log. PSG writes are skipped.
+func NewPlayer(f *File, chip nukeykt.Chip, region Region, rate uint32) *Player {
+	chip.Reset(rate, region.Clock())
+
+	p := &Player{
+		file:  f,
+		chip:  chip,
+		rate:  rate,
+		pacer: nukeykt.NewPacer(chip, region.Clock(), rate),
+		loop:  f.loopOffset(),
+	}
+	p.master, p.frame = region.Timing()
+
+	return p
+}
+
+// Loops returns how many times playback jumped to the loop point.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether all commands of a non-looping log were played and
+// their writes given to the chip.
+func (p *Player) Done() bool {
+	return p.done && !p.pacer.Pending()
+}
+
+// Next runs the commands due at the current sample and returns how many
+// samples render before the next ones, so a renderer can stop exactly where
+// the log loops or ends.
+func (p *Player) Next() uint64 {
+	if p.left == 0 {
+		p.step()
+	}
+	return p.left
+}
+
+// Generate renders numsamples stereo samples. Once the log is over the chip
+// keeps running, so release tails are rendered.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		if p.left == 0 {
+			p.step()
+		}
+		n := min(p.left, uint64(numsamples)-off, p.pacer.Flush(p.rendered))
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.chip.Generate(p.out[:], uint32(n))
+		p.left -= n
+		p.rendered += n
+		off += n
+	}
+}
+
+// step runs commands up to the next frame wait and computes the frame length.
+func (p *Player) step() {
+	data := p.file.Data
+	wrapped := false
+
+	for !p.done {
+		if p.pos >= len(data) {
+			if p.loop < 0 || wrapped {
+				p.done = true
+				break
+			}
+			p.pos = p.loop
+			p.loops++
+			wrapped = true
+			continue
+		}
+
+		cmd := data[p.pos]
+		if p.pos+cmdLen(cmd) > len(data) {
+			p.pos = len(data)
+			continue
+		}
+		switch cmd {
+		case CmdWait:
+			p.pos++
+			p.tick()
+			return
+		case CmdPort0:
+			p.pacer.Write(0, data[p.pos+1], data[p.pos+2])
+		case CmdPort1:
+			p.pacer.Write(2, data[p.pos+1], data[p.pos+2])
+		}
+		p.pos += cmdLen(cmd)
+	}
+
+	p.tick()
+}
+
+func (p *Player) tick() {
+	p.ticks++
+	p.left = p.ticks*p.frame*uint64(p.rate)/p.master - p.rendered
+}
@@ -0,0 +1,196 @@
+package gym
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// logChip records the port writes it is given and the sample they are given
+// before.
+type logChip struct {
+	nukeykt.Chip
+	rendered uint64
+	writes   []logWrite
+}
+
+type logWrite struct {
+	sample uint64
+	port   uint32
+	data   uint8
+}
+
+func (c *logChip) Reset(rate, clock uint32) {}
+
+func (c *logChip) Write(port uint32, data uint8) {
+	c.writes = append(c.writes, logWrite{c.rendered, port, data})
+}
+
+func (c *logChip) Generate(sndptr [][]int32, numsamples uint32) {
+	c.rendered += uint64(numsamples)
+}
+
+func gymx(t *testing.T, loop uint32, packed bool, body []byte) []byte {
+	t.Helper()
+	hdr := make([]byte, headerSize)
+	copy(hdr, headerMagic)
+	copy(hdr[4:], "Title")
+	copy(hdr[36:], "Game")
+	binary.LittleEndian.PutUint32(hdr[420:], loop)
+	if !packed {
+		return append(hdr, body...)
+	}
+
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(body)
+	w.Close()
+	binary.LittleEndian.PutUint32(hdr[424:], uint32(len(body)))
+	return append(hdr, b.Bytes()...)
+}
+
+func TestParse(t *testing.T) {
+	body := []byte{CmdPort0, 0x28, 0xf0, CmdWait, CmdPSG, 0x9f, CmdWait, CmdPort1, 0x30, 0x01, CmdWait}
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		header bool
+		loop   int
+	}{
+		{"plain", body, false, -1},
+		{"gymx", gymx(t, 0, false, body), true, -1},
+		{"packed", gymx(t, 2, true, body), true, 4},
+		{"loop past the end", gymx(t, 9, false, body), true, -1},
+	} {
+		file, err := Parse(tc.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(file.Data, body) {
+			t.Errorf("%s: data %x, want %x", tc.name, file.Data, body)
+		}
+		if (file.Header != nil) != tc.header {
+			t.Errorf("%s: header %+v", tc.name, file.Header)
+		}
+		if tc.header && (file.Header.Title != "Title" || file.Header.Game != "Game") {
+			t.Errorf("%s: title %q, game %q", tc.name, file.Header.Title, file.Header.Game)
+		}
+		if got := file.Frames(); got != 3 {
+			t.Errorf("%s: %d frames, want 3", tc.name, got)
+		}
+		if got := file.loopOffset(); got != tc.loop {
+			t.Errorf("%s: loops to %d, want %d", tc.name, got, tc.loop)
+		}
+		if got, want := file.Writes(), []Write{{0, 0, 0x28, 0xf0}, {2, 1, 0x30, 0x01}}; !slices.Equal(got, want) {
+			t.Errorf("%s: writes %v, want %v", tc.name, got, want)
+		}
+	}
+
+	// A write cut short by the end of the log is dropped
+	file := &File{Data: []byte{CmdPort0, 0x28, 0xf0, CmdWait, CmdPort1, 0x30}}
+	if got, want := file.Writes(), []Write{{0, 0, 0x28, 0xf0}}; !slices.Equal(got, want) {
+		t.Errorf("truncated log: writes %v, want %v", got, want)
+	}
+
+	for _, data := range [][]byte{
+		[]byte(headerMagic + "short"),
+		append(gymx(t, 0, false, nil)[:424], 1, 0, 0, 0, 0xde, 0xad),
+	} {
+		if _, err := Parse(data); !errors.Is(err, ErrFormat) {
+			t.Errorf("Parse(%x...) error %v, want ErrFormat", data[:8], err)
+		}
+	}
+}
+
+func TestPlayerFrames(t *testing.T) {
+	body := []byte{
+		CmdPort0, 0x28, 0xf0, CmdPSG, 0x9f, CmdWait,
+		CmdPort1, 0x30, 0x01, CmdWait,
+		CmdWait,
+		CmdPort0, 0x28, 0x00,
+	}
+	for _, region := range []Region{NTSC, PAL} {
+		chip := &logChip{}
+		p := NewPlayer(&File{Data: body}, chip, region, 44100)
+		buf := [][]int32{make([]int32, 4096), make([]int32, 4096)}
+		p.Generate(buf, 4096)
+
+		master, frame := region.Timing()
+		at := func(n uint64) uint64 { return n * frame * 44100 / master }
+		want := []logWrite{{0, 0, 0x28}, {0, 1, 0xf0}, {at(1), 2, 0x30}, {at(1), 3, 0x01}, {at(3), 0, 0x28}, {at(3), 1, 0x00}}
+		if !slices.Equal(chip.writes, want) {
+			t.Errorf("region %d: writes %v, want %v", region, chip.writes, want)
+		}
+		if !p.Done() || p.Loops() != 0 {
+			t.Errorf("region %d: done %v after %d loops", region, p.Done(), p.Loops())
+		}
+	}
+}
+
+func TestPlayerLoop(t *testing.T) {
+	body := []byte{CmdPort0, 0x28, 0xf0, CmdWait, CmdPort0, 0x28, 0x00, CmdWait}
+	file, err := Parse(gymx(t, 2, false, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chip := &logChip{}
+	p := NewPlayer(file, chip, NTSC, 44100)
+	buf := [][]int32{make([]int32, 4000), make([]int32, 4000)}
+	p.Generate(buf, 4000)
+
+	// 4000 samples are 5.4 frames, the second frame plays from the second on
+	if p.Done() || p.Loops() != 4 {
+		t.Errorf("done %v after %d loops, want 4", p.Done(), p.Loops())
+	}
+	if len(chip.writes) != 2*6 || chip.writes[len(chip.writes)-1].data != 0x00 {
+		t.Errorf("writes %v", chip.writes)
+	}
+}
+
+// TestPlayerPacing plays a frame with more writes than the chip write buffer
+// holds. The writes are given to the chip no faster than its buffer drains.
+func TestPlayerPacing(t *testing.T) {
+	const count = 3 * nukeykt.OPN_WRITEBUF_SIZE
+	var body []byte
+	for i := range count {
+		body = append(body, CmdPort0, 0x30+byte(i%16), byte(i))
+	}
+	body = append(body, CmdWait, CmdPort1, 0x28, 0x01)
+
+	const rate = 44100
+	chip := &logChip{}
+	p := NewPlayer(&File{Data: body}, chip, NTSC, rate)
+	buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+	for !p.Done() {
+		p.Generate(buf, 64)
+	}
+
+	if len(chip.writes) != 2*count+2 {
+		t.Fatalf("%d writes, want %d", len(chip.writes), 2*count+2)
+	}
+	for i, w := range chip.writes[:2*count] {
+		if w.port != uint32(i&1) || w.data != [2]byte{0x30 + byte(i/2%16), byte(i / 2)}[i&1] {
+			t.Fatalf("write %d is %+v", i, w)
+		}
+		// Writes queued ahead of the cycles clocked fit in the buffer
+		cycle := w.sample * ClockNTSC / (6 * rate)
+		if queued := i - int(cycle/nukeykt.OPN_WRITEBUF_DELAY); queued > nukeykt.OPN_WRITEBUF_SIZE {
+			t.Fatalf("write %d at sample %d with %d writes queued", i, w.sample, queued)
+		}
+	}
+	// The frame takes longer than its wait, the next frame follows it
+	master, frame := NTSC.Timing()
+	end := chip.writes[2*count-1].sample
+	if end < frame*rate/master {
+		t.Errorf("paced writes end at sample %d, within the frame", end)
+	}
+	if last := chip.writes[len(chip.writes)-1]; last.sample < end || last.port != 3 {
+		t.Errorf("last write %+v", last)
+	}
+}
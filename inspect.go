@@ -0,0 +1,134 @@
+package nukeykt
+
+import (
+	"fmt"
+	"math"
+)
+
+// EnvelopePhase is the phase of an operator envelope.
+type EnvelopePhase uint8
+
+const (
+	PhaseAttack  EnvelopePhase = eg_num_attack
+	PhaseDecay   EnvelopePhase = eg_num_decay
+	PhaseSustain EnvelopePhase = eg_num_sustain
+	PhaseRelease EnvelopePhase = eg_num_release
+)
+
+func (p EnvelopePhase) String() string {
+	switch p {
+	case PhaseAttack:
+		return "attack"
+	case PhaseDecay:
+		return "decay"
+	case PhaseSustain:
+		return "sustain"
+	case PhaseRelease:
+		return "release"
+	}
+	return fmt.Sprintf("EnvelopePhase(%d)", uint8(p))
+}
+
+// OperatorState is the visible state of an operator.
+type OperatorState struct {
+	KeyOn bool
+	Phase EnvelopePhase
+	// Attenuation is the envelope output, 0 loudest to 0x3FF silent.
+	Attenuation uint16
+}
+
+// ChannelState is the visible state of a channel.
+type ChannelState struct {
+	// Operators are OP1 to OP4.
+	Operators [4]OperatorState
+	FNum      uint16
+	Block     uint8
+	Algorithm uint8
+	Feedback  uint8
+	PanL      bool
+	PanR      bool
+}
+
+// ChipState is a snapshot of the state of a chip for display.
+type ChipState struct {
+	Channels   [6]ChannelState
+	LFOEnabled bool
+	LFORate    uint8
+	// LFOCounter is the LFO step driving the AM and PM waveforms.
+	LFOCounter uint8
+	// Ch3Mode is the channel 3 mode: 0 normal, 1 special, 2 CSM.
+	Ch3Mode uint8
+	// Ch3FNum and Ch3Block are the special mode frequencies of OP1 to OP3.
+	Ch3FNum    [3]uint16
+	Ch3Block   [3]uint8
+	DACEnabled bool
+	// DACData is the 9 bit signed DAC value.
+	DACData int16
+}
+
+// Slots of OP1 to OP4 relative to the channel
+var operatorSlots = [4]int{0, 12, 6, 18}
+
+// Special mode frequency indices of OP1 to OP3
+var ch3Slots = [3]int{1, 2, 0}
+
+// State returns a snapshot of the chip state.
+func (chip *YM3438) State() ChipState {
+	var s ChipState
+
+	for ch := range s.Channels {
+		c := &s.Channels[ch]
+		for op, off := range operatorSlots {
+			slot := ch + off
+			c.Operators[op] = OperatorState{
+				KeyOn:       chip.mode_kon[slot] != 0,
+				Phase:       EnvelopePhase(chip.eg_state[slot]),
+				Attenuation: chip.eg_out[slot],
+			}
+		}
+		c.FNum = chip.fnum[ch]
+		c.Block = chip.block[ch]
+		c.Algorithm = chip.connect[ch]
+		c.Feedback = chip.fb[ch]
+		c.PanL = chip.pan_l[ch] != 0
+		c.PanR = chip.pan_r[ch] != 0
+	}
+
+	s.LFOEnabled = chip.lfo_en != 0
+	s.LFORate = chip.lfo_freq
+	s.LFOCounter = chip.lfo_cnt
+	s.Ch3Mode = chip.mode_ch3
+	if s.Ch3Mode == 3 {
+		s.Ch3Mode = 1
+	}
+	for op, i := range ch3Slots {
+		s.Ch3FNum[op] = chip.fnum_3ch[i]
+		s.Ch3Block[op] = chip.block_3ch[i]
+	}
+	s.DACEnabled = chip.dacen != 0
+	s.DACData = chip.dacdata << 7 >> 7
+
+	return s
+}
+
+var noteNames = [12]string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// Frequency returns the frequency in Hz of a block and frequency number on
+// a chip clocked at clock.
+func Frequency(fnum uint16, block uint8, clock uint32) float64 {
+	return float64(fnum) * float64(clock) / 144 / float64(uint32(1)<<(21-block))
+}
+
+// NoteName returns the nearest note name of a block and frequency number,
+// like "A4", or "" for a zero frequency.
+func NoteName(fnum uint16, block uint8, clock uint32) string {
+	freq := Frequency(fnum, block, clock)
+	if freq <= 0 {
+		return ""
+	}
+	note := int(math.Round(69 + 12*math.Log2(freq/440)))
+	if note < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s%d", noteNames[note%12], note/12-1)
+}
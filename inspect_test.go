@@ -0,0 +1,94 @@
+package nukeykt
+
+import (
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	chip := NewYM2612()
+	chip.Reset(44100, 7670453)
+	for _, w := range [][3]uint8{
+		{0, 0x22, 0x0b}, {0, 0x27, 0x40}, {0, 0x2b, 0x80}, {0, 0x2a, 0x40},
+		{0, 0xad, 0x0a}, {0, 0xa9, 0x10},
+		// A voice on channel 5 holding its attenuation at 0 after the attack
+		{2, 0xb1, 0x3a}, {2, 0xb5, 0x80}, {2, 0xa5, 0x22}, {2, 0xa1, 0x69},
+		{2, 0x41, 0x00}, {2, 0x45, 0x00}, {2, 0x49, 0x00}, {2, 0x4d, 0x00},
+		{2, 0x51, 0x1f}, {2, 0x55, 0x1f}, {2, 0x59, 0x1f}, {2, 0x5d, 0x1f},
+		{2, 0x81, 0xff}, {2, 0x85, 0xff}, {2, 0x89, 0xff}, {2, 0x8d, 0xff},
+		{0, 0x28, 0xf5},
+	} {
+		OPN2_WriteBuffered(chip, uint32(w[0]), w[1])
+		OPN2_WriteBuffered(chip, uint32(w[0])|1, w[2])
+	}
+	buf := [][]int32{make([]int32, 200), make([]int32, 200)}
+	chip.Generate(buf, 200)
+
+	s := chip.State()
+	if !s.LFOEnabled || s.LFORate != 3 || s.Ch3Mode != 1 {
+		t.Errorf("LFO %v rate %d, ch3 mode %d", s.LFOEnabled, s.LFORate, s.Ch3Mode)
+	}
+	if s.Ch3FNum[0] != 0x210 || s.Ch3Block[0] != 1 {
+		t.Errorf("ch3 OP1 at %#x block %d", s.Ch3FNum[0], s.Ch3Block[0])
+	}
+	if !s.DACEnabled || s.DACData != -128 {
+		t.Errorf("DAC %v data %d", s.DACEnabled, s.DACData)
+	}
+
+	want := ChannelState{FNum: 0x269, Block: 4, Algorithm: 2, Feedback: 7, PanL: true}
+	for op := range want.Operators {
+		want.Operators[op] = OperatorState{KeyOn: true, Phase: PhaseDecay}
+	}
+	if s.Channels[4] != want {
+		t.Errorf("channel 5 is\n%+v, want\n%+v", s.Channels[4], want)
+	}
+	for ch, c := range s.Channels {
+		if ch == 4 {
+			continue
+		}
+		for op, o := range c.Operators {
+			if o != (OperatorState{Phase: PhaseRelease, Attenuation: 0x3ff}) {
+				t.Errorf("channel %d OP%d is %+v", ch+1, op+1, o)
+			}
+		}
+	}
+
+	// Key off releases all operators
+	OPN2_WriteBuffered(chip, 0, 0x28)
+	OPN2_WriteBuffered(chip, 1, 0x05)
+	chip.Generate(buf, 200)
+	for op, o := range chip.State().Channels[4].Operators {
+		if o.KeyOn || o.Phase != PhaseRelease || o.Attenuation == 0 {
+			t.Errorf("released OP%d is %+v", op+1, o)
+		}
+	}
+}
+
+func TestNoteName(t *testing.T) {
+	for _, tc := range []struct {
+		fnum  uint16
+		block uint8
+		want  string
+	}{
+		{1083, 4, "A4"},
+		{1083, 3, "A3"},
+		{1083, 5, "A5"},
+		{644, 4, "C4"},
+		{1288, 3, "C4"},
+		// The same frequency across a block boundary
+		{0x7ff, 3, "G#4"},
+		{0x400, 4, "G#4"},
+		// Rounding between G#4 and A4
+		{1051, 4, "G#4"},
+		{1052, 4, "A4"},
+		// The ends of the range
+		{0x7ff, 7, "G#8"},
+		{0x7ff, 0, "G#1"},
+		{0x3ff, 0, "G#0"},
+		{1, 7, ""},
+		{0, 4, ""},
+	} {
+		if got := NoteName(tc.fnum, tc.block, 7670453); got != tc.want {
+			t.Errorf("FNUM %#x block %d is %q, want %q", tc.fnum, tc.block, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package driver holds the tables and the timer pacing shared by the players
+// of sound driver formats.
+package driver
+
+const (
+	// FMChannels is the number of FM channels of the chip
+	FMChannels = 6
+
+	// Status flags of the timer overflows
+	StatusTimerA = 0x01
+	StatusTimerB = 0x02
+)
+
+// Carriers are the carrier operators in register order for each algorithm,
+// bit n set for operator n.
+var Carriers = [8]uint8{0x8, 0x8, 0x8, 0x8, 0xc, 0xe, 0xe, 0xf}
+
+// Freqs are the FM frequencies of an octave starting at C.
+var Freqs = [12]uint16{
+	644, 681, 722, 765, 810, 858, 910, 964, 1021, 1081, 1146, 1214,
+}
+
+// KeyChannel returns the channel bits of FM channel 0-5 in key on writes.
+func KeyChannel(fm int) uint8 {
+	return uint8(fm/3<<2 | fm%3)
+}
+
+// Timer paces a driver ticked by the overflows of Timer A or Timer B. After
+// a restart the overflow flag is not polled again before the timer counted a
+// period, less one step of its prescaler, as the buffered reset may not have
+// reached the chip.
+type Timer struct {
+	flag  uint8
+	reset uint8
+	// frames is how many 144 clock frames the timer counts less one step
+	frames uint64
+	clock  uint64
+	rate   uint64
+
+	// quiet is how many samples are rendered before the timer can overflow
+	// again
+	quiet uint64
+}
+
+// NewTimerA returns a Timer A counting from value to 1024 on a chip with the
+// given clock, with time counted in samples at the given output rate.
+func NewTimerA(value uint16, clock, rate uint32) *Timer {
+	return &Timer{
+		flag:   StatusTimerA,
+		reset:  0x15,
+		frames: 1024 - uint64(value) - 1,
+		clock:  uint64(clock),
+		rate:   uint64(rate),
+	}
+}
+
+// NewTimerB returns a Timer B counting from value to 256 on a chip with the
+// given clock, with time counted in samples at the given output rate.
+func NewTimerB(value uint8, clock, rate uint32) *Timer {
+	return &Timer{
+		flag:   StatusTimerB,
+		reset:  0x2a,
+		frames: (256 - uint64(value) - 1) * 16,
+		clock:  uint64(clock),
+		rate:   uint64(rate),
+	}
+}
+
+// Restart returns the data written to register 0x27 to clear the overflow
+// flag and keep the timer running, and stops polling for a period.
+func (t *Timer) Restart() uint8 {
+	// A frame is 144 clocks, the last sample is rounded off
+	t.quiet = t.frames * 144 * t.rate / t.clock
+	t.quiet -= min(t.quiet, 1)
+	return t.reset
+}
+
+// Ready reports whether the overflow flag can be polled.
+func (t *Timer) Ready() bool {
+	return t.quiet == 0
+}
+
+// Overflow reports whether the overflow flag of the timer is set in status.
+func (t *Timer) Overflow(status uint8) bool {
+	return status&t.flag != 0
+}
+
+// Left returns how many samples can be rendered before the flag is polled,
+// at least one.
+func (t *Timer) Left() uint64 {
+	return max(t.quiet, 1)
+}
+
+// Advance counts n rendered samples.
+func (t *Timer) Advance(n uint64) {
+	t.quiet -= min(t.quiet, n)
+}
@@ -0,0 +1,54 @@
+package driver
+
+import "testing"
+
+func TestKeyChannel(t *testing.T) {
+	want := [FMChannels]uint8{0, 1, 2, 4, 5, 6}
+	for fm, w := range want {
+		if got := KeyChannel(fm); got != w {
+			t.Errorf("KeyChannel(%d) = %d, want %d", fm, got, w)
+		}
+	}
+}
+
+// TestTimer checks that the flag is polled again one sample before the
+// timer period ends.
+func TestTimer(t *testing.T) {
+	const (
+		clock = 7670453
+		rate  = 44100
+	)
+	for _, tc := range []struct {
+		name   string
+		timer  *Timer
+		reset  uint8
+		status uint8
+		period uint64
+	}{
+		{"A", NewTimerA(0x3f0, clock, rate), 0x15, StatusTimerA, (1024 - 0x3f0) * 144},
+		{"B", NewTimerB(0xc8, clock, rate), 0x2a, StatusTimerB, (256 - 0xc8) * 16 * 144},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			timer := tc.timer
+			if !timer.Ready() {
+				t.Fatal("new timer not ready")
+			}
+			if reset := timer.Restart(); reset != tc.reset {
+				t.Errorf("restart writes %#x, want %#x", reset, tc.reset)
+			}
+			if !timer.Overflow(tc.status) || timer.Overflow(^tc.status) {
+				t.Errorf("overflow flag is not %#x", tc.status)
+			}
+
+			var rendered uint64
+			for !timer.Ready() {
+				n := timer.Left()
+				timer.Advance(n)
+				rendered += n
+			}
+			if end := tc.period * rate / clock; rendered >= end {
+				t.Errorf("polled after %d samples, period ends at %d", rendered, end)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Package mdsound runs sound driver code on the Mega Drive sound subsystem:
+// a Z80 with 8 KB of RAM driving a YM2612, clocked from the console master
+// clock like the hardware.
+package mdsound
+
+import (
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/z80"
+)
+
+const (
+	MasterNTSC = 53693175
+	MasterPAL  = 53203424
+
+	// Master clock dividers
+	DividerZ80 = 15
+	DividerYM  = 7
+
+	RAMSize = 0x2000
+
+	// Master clocks of a frame
+	frameNTSC = 3420 * 262
+	framePAL  = 3420 * 313
+	// The VBlank interrupt is held for about a scanline
+	intLength = 171 * DividerZ80
+
+	// Master clocks of an OPN2_Clock cycle
+	cycleYM = 6 * DividerYM
+)
+
+// Z80 address space
+const (
+	addrYM      = 0x4000
+	addrBank    = 0x6000
+	addrBankEnd = 0x6100
+	addrVDP     = 0x7f00
+	addrPSG     = 0x7f11
+	addrWindow  = 0x8000
+	openBus     = 0xff
+)
+
+// System is the sound subsystem: the Z80, its RAM, the bank window into the
+// 68000 address space and the chip.
+type System struct {
+	CPU *z80.CPU
+	RAM [RAMSize]uint8
+	// ROM is the 68000 address space visible through the bank window.
+	ROM []byte
+	// Bank is the 9 bit bank register selecting the 32 KB of ROM mapped at
+	// 0x8000.
+	Bank uint16
+	// PSG receives writes to the SN76489 port.
+	PSG func(data uint8)
+
+	chip   *nukeykt.YM3438
+	master uint32
+	frame  uint64
+	step   func(cycle uint64)
+
+	// Z80 time in master clocks since reset
+	time uint64
+	// Next VBlank interrupt in master clocks
+	vblank uint64
+}
+
+type bus System
+
+// New resets the chip for the given master clock and output rate and returns
+// a system with the Z80 held at its reset state. Use MasterNTSC or MasterPAL
+// for the master clock.
+func New(chip *nukeykt.YM3438, master, rate uint32) *System {
+	chip.Reset(rate, master/DividerYM)
+
+	s := &System{
+		chip:   chip,
+		master: master,
+		frame:  frameNTSC,
+	}
+	if master == MasterPAL {
+		s.frame = framePAL
+	}
+	s.CPU = z80.New((*bus)(s))
+	s.vblank = s.frame
+	s.step = func(cycle uint64) {
+		s.run((cycle + 1) * cycleYM)
+	}
+
+	return s
+}
+
+// Load copies a driver or its data into RAM at addr.
+func (s *System) Load(addr uint16, data []byte) {
+	copy(s.RAM[addr&(RAMSize-1):], data)
+}
+
+// Chip returns the chip driven by the Z80.
+func (s *System) Chip() *nukeykt.YM3438 {
+	return s.chip
+}
+
+// Cycles returns the number of Z80 cycles run since reset.
+func (s *System) Cycles() uint64 {
+	return s.time / DividerZ80
+}
+
+// Generate renders numsamples stereo samples, running the Z80 up to each
+// chip cycle before it is clocked. Chip writes land at the cycle they are
+// made unless they come faster than the chip write buffer accepts them.
+func (s *System) Generate(sndptr [][]int32, numsamples uint32) {
+	var buffer [2]int32
+
+	for i := range numsamples {
+		nukeykt.OPN2_GenerateResampledHook(s.chip, buffer[:], s.step)
+		sndptr[0][i] = buffer[0]
+		sndptr[1][i] = buffer[1]
+	}
+}
+
+// run executes instructions until the Z80 reaches the given master time.
+func (s *System) run(until uint64) {
+	for s.time < until {
+		if s.time >= s.vblank+intLength {
+			s.CPU.SetINT(false)
+			s.vblank += s.frame
+		} else if s.time >= s.vblank {
+			s.CPU.SetINT(true)
+		}
+		s.time += uint64(s.CPU.Step()) * DividerZ80
+	}
+}
+
+func (b *bus) Read(addr uint16) uint8 {
+	switch {
+	case addr < 0x4000:
+		return b.RAM[addr&(RAMSize-1)]
+	case addr < addrBank:
+		return nukeykt.OPN2_Read(b.chip, uint32(addr&0x03))
+	case addr >= addrWindow:
+		off := int(b.Bank)<<15 | int(addr&0x7fff)
+		if off < len(b.ROM) {
+			return b.ROM[off]
+		}
+	}
+	return openBus
+}
+
+func (b *bus) Write(addr uint16, data uint8) {
+	switch {
+	case addr < 0x4000:
+		b.RAM[addr&(RAMSize-1)] = data
+	case addr < addrBank:
+		nukeykt.OPN2_WriteBufferedAt(b.chip, uint32(addr&0x03), data, b.time/cycleYM)
+	case addr < addrBankEnd:
+		// Each write shifts bit 0 into the top of the bank register
+		b.Bank = b.Bank>>1 | uint16(data&0x01)<<8
+	case addr == addrPSG:
+		if b.PSG != nil {
+			b.PSG(data)
+		}
+	}
+}
+
+func (b *bus) In(port uint16) uint8 {
+	return openBus
+}
+
+func (b *bus) Out(port uint16, data uint8) {}
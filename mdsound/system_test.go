@@ -0,0 +1,131 @@
+package mdsound
+
+import (
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// run loads a driver ending in a HALT and renders until it halted.
+func run(t *testing.T, s *System, code []byte) {
+	t.Helper()
+	s.Load(0, code)
+	buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+	for range 100 {
+		if s.CPU.Halted {
+			return
+		}
+		s.Generate(buf, 64)
+	}
+	t.Fatal("driver did not halt")
+}
+
+// setBank returns code writing the 9 bank bits to the bank register, low bit
+// first.
+func setBank(bank uint16) []byte {
+	// LD HL,6000h
+	code := []byte{0x21, 0x00, 0x60}
+	for i := range 9 {
+		// LD (HL),bit
+		code = append(code, 0x36, uint8(bank>>i&1))
+	}
+	return code
+}
+
+func TestBank(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		bank uint16
+		addr uint16
+		want uint8
+	}{
+		{"bank 0", 0x000, 0x8000, 0x00},
+		{"bank 3", 0x003, 0x8005, 0x1d},
+		{"window end", 0x003, 0xffff, 0x17},
+		// Past the end of the ROM the bus floats
+		{"open bus", 0x100, 0x8000, openBus},
+	} {
+		s := New(nukeykt.NewYM2612(), MasterNTSC, 44100)
+		s.ROM = make([]byte, 0x20000)
+		for i := range s.ROM {
+			s.ROM[i] = uint8(i>>15)*8 + uint8(i)
+		}
+
+		code := setBank(tc.bank)
+		// LD A,(addr); LD (1000h),A; LD (addr),A; HALT
+		code = append(code, 0x3a, uint8(tc.addr), uint8(tc.addr>>8), 0x32, 0x00, 0x10,
+			0x32, uint8(tc.addr), uint8(tc.addr>>8), 0x76)
+		rom := append([]byte(nil), s.ROM...)
+		run(t, s, code)
+
+		if s.Bank != tc.bank {
+			t.Errorf("%s: bank %#x, want %#x", tc.name, s.Bank, tc.bank)
+		}
+		if s.RAM[0x1000] != tc.want {
+			t.Errorf("%s: read %#x, want %#x", tc.name, s.RAM[0x1000], tc.want)
+		}
+		// The 68000 ROM is read only
+		if string(s.ROM) != string(rom) {
+			t.Errorf("%s: window write changed the ROM", tc.name)
+		}
+	}
+}
+
+func TestBankShift(t *testing.T) {
+	// Every write shifts a bit in, the last 9 writes set the bank
+	s := New(nukeykt.NewYM2612(), MasterNTSC, 44100)
+	code := append(setBank(0x1ff), setBank(0x0a5)[3:]...)
+	run(t, s, append(code, 0x76))
+	if s.Bank != 0x0a5 {
+		t.Errorf("bank %#x, want 0xa5", s.Bank)
+	}
+}
+
+func TestBankRange(t *testing.T) {
+	// LD A,01h; LD (60FFh),A; LD (6100h),A; LD (7EFFh),A; HALT
+	s := New(nukeykt.NewYM2612(), MasterNTSC, 44100)
+	run(t, s, []byte{0x3e, 0x01, 0x32, 0xff, 0x60, 0x32, 0x00, 0x61, 0x32, 0xff, 0x7e, 0x76})
+	if s.Bank != 0x100 {
+		t.Errorf("bank %#x, want 0x100 from the write to 60FFh only", s.Bank)
+	}
+}
+
+func TestRAMMirror(t *testing.T) {
+	s := New(nukeykt.NewYM2612(), MasterNTSC, 44100)
+	// LD A,55h; LD (3000h),A; LD A,(1000h); LD (1001h),A; HALT
+	run(t, s, []byte{0x3e, 0x55, 0x32, 0x00, 0x30, 0x3a, 0x00, 0x10, 0x32, 0x01, 0x10, 0x76})
+	if s.RAM[0x1000] != 0x55 || s.RAM[0x1001] != 0x55 {
+		t.Errorf("RAM %#x %#x, want 0x55 0x55", s.RAM[0x1000], s.RAM[0x1001])
+	}
+}
+
+func TestYMMirror(t *testing.T) {
+	for _, base := range []uint16{0x4000, 0x4ffc, 0x5ffc} {
+		s := New(nukeykt.NewYM2612(), MasterNTSC, 44100)
+		// Set the frequency of channel 1 through ports 0 and 1 and the one
+		// of channel 6 through ports 2 and 3, then start Timer A
+		var code []byte
+		for _, w := range [][3]uint8{
+			{0, 0xa4, 0x22}, {0, 0xa0, 0x69},
+			{2, 0xa6, 0x1c}, {2, 0xa2, 0x3b},
+			{0, 0x24, 0xff}, {0, 0x25, 0x03}, {0, 0x27, 0x05},
+		} {
+			addr := base + uint16(w[0])
+			// LD A,reg; LD (addr),A; LD A,data; LD (addr+1),A
+			code = append(code, 0x3e, w[1], 0x32, uint8(addr), uint8(addr>>8),
+				0x3e, w[2], 0x32, uint8(addr+1), uint8(addr>>8))
+		}
+		// Read the status until Timer A overflows: LD A,(base); AND 1;
+		// JR Z,-7; HALT
+		code = append(code, 0x3a, uint8(base), uint8(base>>8), 0xe6, 0x01, 0x28, 0xf9, 0x76)
+		run(t, s, code)
+
+		st := s.Chip().State()
+		if ch := st.Channels[0]; ch.FNum != 0x269 || ch.Block != 4 {
+			t.Errorf("base %#x: channel 1 at %#x block %d", base, ch.FNum, ch.Block)
+		}
+		if ch := st.Channels[5]; ch.FNum != 0x43b || ch.Block != 3 {
+			t.Errorf("base %#x: channel 6 at %#x block %d", base, ch.FNum, ch.Block)
+		}
+	}
+}
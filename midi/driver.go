@@ -0,0 +1,145 @@
+package midi
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/elemir/nukeykt"
+)
+
+// TimedEvent is an event scheduled at an output sample.
+type TimedEvent struct {
+	Time uint64
+	Event
+}
+
+// Driver plays timestamped MIDI events on an OPN2 in real time. Events may be
+// sent from any goroutine while a single other one generates audio.
+type Driver struct {
+	synth *Synth
+	chip  nukeykt.Chip
+
+	mu    sync.Mutex
+	queue []TimedEvent
+	now   uint64
+	ch3   *bool
+
+	due []TimedEvent
+	out [2][]int32
+}
+
+// NewDriver resets the chip with the given clock and output rate and returns
+// a driver playing it with the bank.
+func NewDriver(chip nukeykt.Chip, bank *Bank, clock, rate uint32) *Driver {
+	chip.Reset(rate, clock)
+
+	return &Driver{
+		synth: NewSynth(chip, bank, clock),
+		chip:  chip,
+	}
+}
+
+// Now returns the number of samples generated so far, the time base of Send.
+func (d *Driver) Now() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.now
+}
+
+// Send schedules an event at the given output sample. Events in the past are
+// played at the start of the next Generate call, events with the same time
+// are played in the order they were sent.
+func (d *Driver) Send(time uint64, ev Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := sort.Search(len(d.queue), func(i int) bool {
+		return d.queue[i].Time > time
+	})
+	d.queue = append(d.queue, TimedEvent{})
+	copy(d.queue[i+1:], d.queue[i:])
+	d.queue[i] = TimedEvent{Time: time, Event: ev}
+}
+
+// NoteOn schedules a note on.
+func (d *Driver) NoteOn(time uint64, ch, note, velocity uint8) {
+	d.Send(time, Event{Status: NoteOn | ch&0x0f, Data1: note, Data2: velocity})
+}
+
+// NoteOff schedules a note off.
+func (d *Driver) NoteOff(time uint64, ch, note uint8) {
+	d.Send(time, Event{Status: NoteOff | ch&0x0f, Data1: note})
+}
+
+// ControlChange schedules a control change.
+func (d *Driver) ControlChange(time uint64, ch, cc, value uint8) {
+	d.Send(time, Event{Status: ControlChange | ch&0x0f, Data1: cc, Data2: value})
+}
+
+// ProgramChange schedules a program change.
+func (d *Driver) ProgramChange(time uint64, ch, program uint8) {
+	d.Send(time, Event{Status: ProgramChange | ch&0x0f, Data1: program})
+}
+
+// PitchBend schedules a pitch bend, value ranges from -8192 to 8191.
+func (d *Driver) PitchBend(time uint64, ch uint8, value int16) {
+	v := uint16(int32(value) + 8192)
+	d.Send(time, Event{Status: PitchBend | ch&0x0f, Data1: uint8(v & 0x7f), Data2: uint8(v >> 7 & 0x7f)})
+}
+
+// BendRange schedules the RPN messages setting the pitch bend range.
+func (d *Driver) BendRange(time uint64, ch, semitones, cents uint8) {
+	d.ControlChange(time, ch, CCRPNMSB, 0)
+	d.ControlChange(time, ch, CCRPNLSB, 0)
+	d.ControlChange(time, ch, CCDataEntryMSB, semitones)
+	d.ControlChange(time, ch, CCDataEntryLSB, cents)
+	d.ControlChange(time, ch, CCRPNMSB, 0x7f)
+	d.ControlChange(time, ch, CCRPNLSB, 0x7f)
+}
+
+// SetCh3Voices enables the channel 3 special mode operator voices at the
+// start of the next Generate call, see Synth.SetCh3Voices.
+func (d *Driver) SetCh3Voices(enable bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.ch3 = &enable
+}
+
+// Generate renders numsamples stereo samples playing every event at the
+// sample it was scheduled at. The chip is rendered without holding the lock,
+// so Send does not wait for generation.
+func (d *Driver) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint32
+
+	for off < numsamples {
+		d.mu.Lock()
+		now := d.now
+		ch3 := d.ch3
+		d.ch3 = nil
+		d.due = d.due[:0]
+		for len(d.queue) > 0 && d.queue[0].Time <= now {
+			d.due = append(d.due, d.queue[0])
+			d.queue = d.queue[1:]
+		}
+		n := numsamples - off
+		if len(d.queue) > 0 && d.queue[0].Time-now < uint64(n) {
+			n = uint32(d.queue[0].Time - now)
+		}
+		d.now += uint64(n)
+		d.mu.Unlock()
+
+		if ch3 != nil {
+			d.synth.SetCh3Voices(*ch3)
+		}
+		for _, ev := range d.due {
+			d.synth.Event(ev.Event)
+		}
+
+		d.out[0] = sndptr[0][off:]
+		d.out[1] = sndptr[1][off:]
+		d.chip.Generate(d.out[:], n)
+		off += n
+	}
+}
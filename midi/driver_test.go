@@ -0,0 +1,114 @@
+package midi
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDriverTiming(t *testing.T) {
+	for _, chunk := range []uint32{1, 64, 1000, 4096} {
+		chip := &regChip{}
+		d := NewDriver(chip, nil, 7670453, 44100)
+		// Sent out of order, and a note in the past of the first call
+		d.NoteOn(1000, 0, 62, 100)
+		d.NoteOn(100, 0, 61, 100)
+		d.NoteOn(100, 0, 60, 100)
+		d.NoteOn(2047, 1, 63, 100)
+		d.NoteOff(3000, 0, 60)
+
+		buf := [][]int32{make([]int32, chunk), make([]int32, chunk)}
+		for d.Now() < 4096 {
+			d.Generate(buf, chunk)
+		}
+		if want := []uint64{100, 100, 1000, 2047}; !slices.Equal(chip.keyOns, want) {
+			t.Errorf("chunks of %d: notes at samples %v, want %v", chunk, chip.keyOns, want)
+		}
+		if chip.rendered != d.Now() {
+			t.Errorf("chunks of %d: chip rendered %d samples, driver at %d", chunk, chip.rendered, d.Now())
+		}
+
+		d.NoteOn(0, 0, 64, 100)
+		d.Generate(buf, 1)
+		if n := len(chip.keyOns); n != 5 || chip.keyOns[n-1] != d.Now()-1 {
+			t.Errorf("chunks of %d: late note at %v, want %d", chunk, chip.keyOns[n-1], d.Now()-1)
+		}
+	}
+}
+
+func TestDriverBendRange(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		set   func(d *Driver)
+		note  uint8
+		bend  int16
+		block uint8
+		fnum  uint16
+	}{
+		{"default", func(d *Driver) {}, 71, -8192, 4, 1083},
+		{"octave", func(d *Driver) { d.BendRange(0, 0, 12, 0) }, 81, -8192, 4, 1083},
+		{"two octaves", func(d *Driver) { d.BendRange(0, 0, 24, 0) }, 93, -8192, 4, 1083},
+		{"cents", func(d *Driver) { d.BendRange(0, 0, 0, 50) }, 69, 8191, 4, 1114},
+		// Cents are limited to 99
+		{"cents clamped", func(d *Driver) { d.BendRange(0, 0, 0, 120) }, 69, 8191, 4, 1146},
+		// Data entry without the RPN selected keeps the range
+		{"no RPN", func(d *Driver) { d.ControlChange(0, 0, CCDataEntryMSB, 12) }, 71, -8192, 4, 1083},
+		{"null RPN", func(d *Driver) {
+			d.BendRange(0, 0, 12, 0)
+			d.ControlChange(0, 0, CCDataEntryMSB, 1)
+		}, 81, -8192, 4, 1083},
+		{"reset", func(d *Driver) {
+			d.BendRange(0, 0, 12, 0)
+			d.ControlChange(0, 0, CCResetAll, 0)
+		}, 71, -8192, 4, 1083},
+	} {
+		chip := &regChip{}
+		d := NewDriver(chip, nil, 7670453, 44100)
+		tc.set(d)
+		d.PitchBend(0, 0, tc.bend)
+		d.NoteOn(0, 0, tc.note, 100)
+		buf := [][]int32{make([]int32, 1), make([]int32, 1)}
+		d.Generate(buf, 1)
+
+		block, fnum := chip.fnum(0)
+		if block != tc.block || fnum < tc.fnum-1 || fnum > tc.fnum+1 {
+			t.Errorf("%s: block %d F-number %d, want %d %d", tc.name, block, fnum, tc.block, tc.fnum)
+		}
+	}
+}
+
+func TestDriverCh3Voices(t *testing.T) {
+	chip := &regChip{}
+	d := NewDriver(chip, nil, 7670453, 44100)
+	d.SetCh3Voices(true)
+	for i := range 9 {
+		d.NoteOn(0, uint8(i), 60+uint8(i), 100)
+	}
+	buf := [][]int32{make([]int32, 1), make([]int32, 1)}
+	d.Generate(buf, 1)
+
+	if mode := chip.regs[0][0x27]; mode&0xc0 != 0x40 {
+		t.Errorf("channel 3 mode %#x, want special mode", mode)
+	}
+	// The operator voices are used once the 4-op voices play
+	if key := chip.regs[0][0x28]; key != 0xf2 {
+		t.Errorf("channel 3 keyed %#x, want all operators", key)
+	}
+	if len(chip.keyOns) != 9 {
+		t.Errorf("%d notes keyed, want 9", len(chip.keyOns))
+	}
+	// Every operator has a frequency of its own
+	var fnums []uint16
+	for _, reg := range ch3FnumRegs {
+		fnums = append(fnums, uint16(chip.regs[0][reg+4]&0x07)<<8|uint16(chip.regs[0][reg]))
+	}
+	slices.Sort(fnums)
+	if len(slices.Compact(fnums)) != 4 {
+		t.Errorf("operator F-numbers %v", fnums)
+	}
+
+	d.SetCh3Voices(false)
+	d.Generate(buf, 1)
+	if mode := chip.regs[0][0x27]; mode&0xc0 != 0 {
+		t.Errorf("channel 3 mode %#x after disabling the voices", mode)
+	}
+}
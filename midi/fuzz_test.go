@@ -0,0 +1,48 @@
+package midi
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60" +
+		"MTrk\x00\x00\x00\x13\x00\xff\x51\x03\x07\xa1\x20\x00\x90\x3c\x64\x60\x80\x3c\x00\x00\xff\x2f\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		r := NewRenderer(file, &Bank{}, nukeykt.NewYM2612(), 7670453, 8000)
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			r.Generate(buf, 256)
+		}
+	})
+}
+
+func FuzzParseBank(f *testing.F) {
+	bank := []byte(wopnMagic2)
+	bank = binary.LittleEndian.AppendUint16(bank, 2)
+	bank = append(bank, 0, 1, 0, 0, 0)
+	bank = append(bank, make([]byte, wopnMetaSize+128*wopnPatchSize2)...)
+	f.Add(bank)
+	f.Add([]byte(wopnMagic1 + "\x00\x00\x00\x00\x08"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := ParseBank(data)
+		if err != nil {
+			return
+		}
+
+		s := NewSynth(nukeykt.NewYM2612(), b, 7670453)
+		for note := uint8(0); note < 128; note += 13 {
+			s.NoteOn(0, note, 100)
+			s.NoteOn(9, note, 100)
+		}
+	})
+}
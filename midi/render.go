@@ -0,0 +1,95 @@
+package midi
+
+import (
+	"github.com/elemir/nukeykt"
+)
+
+// Renderer renders a MIDI file through a Synth.
+type Renderer struct {
+	file  *File
+	synth *Synth
+	chip  nukeykt.Chip
+	rate  uint32
+
+	pos   int
+	tempo uint64
+	// Time of the last tempo change in samples * 1000000 * division
+	base     uint64
+	baseTick uint64
+	rendered uint64
+	done     bool
+	out      [2][]int32
+}
+
+// NewRenderer resets the chip with the given clock and output rate and
+// returns a renderer playing the file with the bank.
+func NewRenderer(f *File, bank *Bank, chip nukeykt.Chip, clock, rate uint32) *Renderer {
+	chip.Reset(rate, clock)
+
+	return &Renderer{
+		file:  f,
+		synth: NewSynth(chip, bank, clock),
+		chip:  chip,
+		rate:  rate,
+		tempo: DefaultTempo,
+	}
+}
+
+// Synth returns the synth the file is played with.
+func (r *Renderer) Synth() *Synth {
+	return r.synth
+}
+
+// Loops always returns zero as MIDI files do not loop.
+func (r *Renderer) Loops() int {
+	return 0
+}
+
+// Done reports whether all events were played.
+func (r *Renderer) Done() bool {
+	return r.done
+}
+
+// Generate renders numsamples stereo samples.
+func (r *Renderer) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		n := uint64(numsamples) - off
+		for r.pos < len(r.file.Events) {
+			ev := r.file.Events[r.pos]
+			at := r.sample(ev.Tick)
+			if at > r.rendered {
+				n = min(n, at-r.rendered)
+				break
+			}
+			r.event(ev)
+			r.pos++
+		}
+		r.done = r.pos >= len(r.file.Events)
+
+		r.out[0] = sndptr[0][off:]
+		r.out[1] = sndptr[1][off:]
+		r.chip.Generate(r.out[:], uint32(n))
+		r.rendered += n
+		off += n
+	}
+}
+
+func (r *Renderer) event(ev Event) {
+	if tempo, ok := ev.Tempo(); ok {
+		r.base += (ev.Tick - r.baseTick) * r.tempo * uint64(r.rate)
+		r.baseTick = ev.Tick
+		r.tempo = uint64(tempo)
+		return
+	}
+	if ev.Status < SysEx {
+		r.synth.Event(ev)
+	}
+}
+
+// sample returns the output sample an event tick is played at.
+func (r *Renderer) sample(tick uint64) uint64 {
+	t := r.base + (tick-r.baseTick)*r.tempo*uint64(r.rate)
+	return t / (1000000 * uint64(r.file.Division))
+}
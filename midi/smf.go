@@ -0,0 +1,226 @@
+// Package midi renders MIDI through the OPN2 using 4-operator patch banks.
+package midi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	NoteOff         = 0x80
+	NoteOn          = 0x90
+	PolyPressure    = 0xa0
+	ControlChange   = 0xb0
+	ProgramChange   = 0xc0
+	ChannelPressure = 0xd0
+	PitchBend       = 0xe0
+	SysEx           = 0xf0
+	Meta            = 0xff
+
+	MetaEndOfTrack = 0x2f
+	MetaTempo      = 0x51
+
+	// Tempo of files without tempo events, in microseconds per quarter note
+	DefaultTempo = 500000
+)
+
+var ErrFormat = errors.New("midi: invalid file")
+
+// Event is a MIDI event. For channel messages Status holds the message type
+// and channel, for meta events it is Meta and Type holds the meta type.
+type Event struct {
+	Tick   uint64
+	Track  int
+	Status uint8
+	Type   uint8
+	Data1  uint8
+	Data2  uint8
+	Data   []byte
+}
+
+// Channel returns the channel of a channel message.
+func (e Event) Channel() uint8 {
+	return e.Status & 0x0f
+}
+
+// Command returns the message type of a channel message.
+func (e Event) Command() uint8 {
+	return e.Status & 0xf0
+}
+
+// File is a parsed Standard MIDI File with all tracks merged.
+type File struct {
+	Format int
+	Tracks int
+	// Division is the number of ticks per quarter note. SMPTE based files
+	// are converted to 1 tick per microsecond at DefaultTempo.
+	Division uint32
+	// Events are ordered by tick, events of the same tick keep track order.
+	Events []Event
+}
+
+// Parse parses a Standard MIDI File of format 0 or 1.
+func Parse(data []byte) (*File, error) {
+	chunk, data, err := readChunk(data, "MThd")
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) < 6 {
+		return nil, fmt.Errorf("%w: short header", ErrFormat)
+	}
+
+	f := &File{
+		Format:   int(binary.BigEndian.Uint16(chunk)),
+		Tracks:   int(binary.BigEndian.Uint16(chunk[2:])),
+		Division: uint32(binary.BigEndian.Uint16(chunk[4:])),
+	}
+	if f.Format > 1 {
+		return nil, fmt.Errorf("%w: unsupported format %d", ErrFormat, f.Format)
+	}
+	if div := f.Division; div&0x8000 != 0 {
+		// Ticks per second scaled to the default tempo
+		fps := uint32(-int8(div >> 8))
+		f.Division = fps * (div & 0xff) * DefaultTempo / 1000000
+	}
+	if f.Division == 0 {
+		return nil, fmt.Errorf("%w: bad division", ErrFormat)
+	}
+
+	for track := range f.Tracks {
+		for {
+			var id string
+			if len(data) >= 8 {
+				id = string(data[:4])
+			}
+			chunk, data, err = readChunk(data, id)
+			if err != nil {
+				return nil, err
+			}
+			if id == "MTrk" {
+				break
+			}
+		}
+
+		events, err := parseTrack(chunk, track)
+		if err != nil {
+			return nil, err
+		}
+		f.Events = append(f.Events, events...)
+	}
+
+	sort.SliceStable(f.Events, func(i, j int) bool {
+		return f.Events[i].Tick < f.Events[j].Tick
+	})
+
+	return f, nil
+}
+
+func readChunk(data []byte, id string) ([]byte, []byte, error) {
+	if len(data) < 8 || !bytes.Equal(data[:4], []byte(id)) {
+		return nil, nil, fmt.Errorf("%w: missing %s chunk", ErrFormat, id)
+	}
+	size := binary.BigEndian.Uint32(data[4:])
+	data = data[8:]
+	if uint64(size) > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("%w: truncated %s chunk", ErrFormat, id)
+	}
+	return data[:size], data[size:], nil
+}
+
+func parseTrack(data []byte, track int) ([]Event, error) {
+	var (
+		events  []Event
+		tick    uint64
+		running uint8
+	)
+
+	for len(data) > 0 {
+		delta, n := readVarLen(data)
+		if n == 0 {
+			return nil, fmt.Errorf("%w: bad delta time", ErrFormat)
+		}
+		tick += uint64(delta)
+		data = data[n:]
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: truncated event", ErrFormat)
+		}
+
+		ev := Event{Tick: tick, Track: track, Status: data[0]}
+		if ev.Status < 0x80 {
+			if running == 0 {
+				return nil, fmt.Errorf("%w: data without status", ErrFormat)
+			}
+			ev.Status = running
+		} else {
+			data = data[1:]
+		}
+
+		switch {
+		case ev.Status == Meta:
+			if len(data) == 0 {
+				return nil, fmt.Errorf("%w: truncated meta event", ErrFormat)
+			}
+			ev.Type = data[0]
+			size, n := readVarLen(data[1:])
+			if n == 0 || uint64(size) > uint64(len(data)-1-n) {
+				return nil, fmt.Errorf("%w: truncated meta event", ErrFormat)
+			}
+			ev.Data = data[1+n : 1+n+int(size)]
+			data = data[1+n+int(size):]
+			running = 0
+		case ev.Status == SysEx || ev.Status == 0xf7:
+			size, n := readVarLen(data)
+			if n == 0 || uint64(size) > uint64(len(data)-n) {
+				return nil, fmt.Errorf("%w: truncated sysex", ErrFormat)
+			}
+			ev.Data = data[n : n+int(size)]
+			data = data[n+int(size):]
+			running = 0
+		case ev.Status >= 0xf0:
+			return nil, fmt.Errorf("%w: unexpected status %#x", ErrFormat, ev.Status)
+		default:
+			running = ev.Status
+			size := 2
+			if cmd := ev.Command(); cmd == ProgramChange || cmd == ChannelPressure {
+				size = 1
+			}
+			if len(data) < size {
+				return nil, fmt.Errorf("%w: truncated event", ErrFormat)
+			}
+			ev.Data1 = data[0] & 0x7f
+			if size == 2 {
+				ev.Data2 = data[1] & 0x7f
+			}
+			data = data[size:]
+		}
+
+		events = append(events, ev)
+		if ev.Status == Meta && ev.Type == MetaEndOfTrack {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// Tempo returns the tempo set by a tempo meta event.
+func (e Event) Tempo() (uint32, bool) {
+	if e.Status != Meta || e.Type != MetaTempo || len(e.Data) < 3 {
+		return 0, false
+	}
+	return uint32(e.Data[0])<<16 | uint32(e.Data[1])<<8 | uint32(e.Data[2]), true
+}
+
+func readVarLen(data []byte) (uint32, int) {
+	var v uint32
+	for i := 0; i < len(data) && i < 4; i++ {
+		v = v<<7 | uint32(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,523 @@
+package midi
+
+import (
+	"math"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/internal/driver"
+)
+
+const (
+	Voices = 6
+
+	DrumChannel = 9
+
+	CCBankMSB       = 0
+	CCModulation    = 1
+	CCDataEntryMSB  = 6
+	CCVolume        = 7
+	CCPan           = 10
+	CCExpression    = 11
+	CCBankLSB       = 32
+	CCDataEntryLSB  = 38
+	CCSustain       = 64
+	CCNRPNLSB       = 98
+	CCNRPNMSB       = 99
+	CCRPNLSB        = 100
+	CCRPNMSB        = 101
+	CCAllSoundOff   = 120
+	CCResetAll      = 121
+	CCAllNotesOff   = 123
+	RPNBendRange    = 0x0000
+	RPNNull         = 0x3fff
+	DefaultBendMax  = 2
+	ch3VoiceChannel = 2
+
+	// LFO at 6.02Hz used for modulation when the bank does not enable it
+	modulationLFO = 0x0b
+)
+
+// Channel 3 special mode registers of the operators in register order
+var (
+	ch3KeyBits  = [4]uint8{0x10, 0x40, 0x20, 0x80}
+	ch3FnumRegs = [4]uint8{0xa9, 0xa8, 0xaa, 0xa2}
+)
+
+type voice struct {
+	fm int
+	// op is the operator of a channel 3 special mode voice, -1 for 4-op voices
+	op        int
+	channel   int
+	note      uint8
+	key       uint8
+	velocity  uint8
+	patch     *Patch
+	on        bool
+	sustained bool
+	age       uint64
+}
+
+type channel struct {
+	program    uint8
+	msb, lsb   uint8
+	volume     uint8
+	expression uint8
+	pan        uint8
+	modulation uint8
+	sustain    bool
+	bend       int16
+	// bendRange is in cents
+	bendRange uint16
+	rpn       uint16
+}
+
+// Synth plays MIDI channel messages on the six FM channels of an OPN2.
+type Synth struct {
+	chip     nukeykt.Chip
+	clock    uint32
+	bank     *Bank
+	ch3      bool
+	voices   []voice
+	channels [16]channel
+	lfo      uint8
+	ch3Keys  uint8
+	counter  uint64
+}
+
+// NewSynth creates a synth for a chip running at the given clock. A nil bank
+// plays DefaultPatch for every melodic program and no drums.
+func NewSynth(chip nukeykt.Chip, bank *Bank, clock uint32) *Synth {
+	s := &Synth{
+		chip:  chip,
+		clock: clock,
+		bank:  bank,
+	}
+	s.Reset()
+
+	return s
+}
+
+// SetCh3Voices switches FM channel 3 to special mode and plays its four
+// operators as separate single operator voices, giving nine voices in total.
+// The operator voices use the last carrier of the patch. It resets the synth.
+func (s *Synth) SetCh3Voices(enable bool) {
+	s.ch3 = enable
+	s.Reset()
+}
+
+// Reset silences all voices, resets the controllers and initializes the
+// global chip registers.
+func (s *Synth) Reset() {
+	for i := range s.voices {
+		s.keyOff(i)
+	}
+	s.voices = s.voices[:0]
+	for fm := range Voices {
+		if s.ch3 && fm == ch3VoiceChannel {
+			for op := range 4 {
+				s.voices = append(s.voices, voice{fm: fm, op: op, channel: -1})
+			}
+			continue
+		}
+		s.voices = append(s.voices, voice{fm: fm, op: -1, channel: -1})
+	}
+
+	if s.ch3 {
+		s.write(0, 0x27, 0x40)
+		s.write(0, 0xb0+ch3VoiceChannel, 0x07)
+	} else {
+		s.write(0, 0x27, 0x00)
+	}
+	s.write(0, 0x2b, 0x00)
+	s.write(0, 0x28, ch3VoiceChannel)
+	s.ch3Keys = 0
+
+	s.lfo = 0xff
+	for i := range s.channels {
+		s.channels[i] = channel{}
+		s.resetControllers(i)
+	}
+	s.updateLFO()
+}
+
+// Event plays a channel message, other events are ignored.
+func (s *Synth) Event(ev Event) {
+	ch := ev.Channel()
+
+	switch ev.Command() {
+	case NoteOn:
+		if ev.Data2 == 0 {
+			s.NoteOff(ch, ev.Data1)
+		} else {
+			s.NoteOn(ch, ev.Data1, ev.Data2)
+		}
+	case NoteOff:
+		s.NoteOff(ch, ev.Data1)
+	case ControlChange:
+		s.ControlChange(ch, ev.Data1, ev.Data2)
+	case ProgramChange:
+		s.ProgramChange(ch, ev.Data1)
+	case PitchBend:
+		s.PitchBend(ch, int16(uint16(ev.Data2)<<7|uint16(ev.Data1))-8192)
+	}
+}
+
+// NoteOn starts a note, stealing a voice when all of them are busy.
+func (s *Synth) NoteOn(ch, note, velocity uint8) {
+	ch &= 0x0f
+	patch, key := s.patch(ch, note)
+	if patch == nil {
+		return
+	}
+
+	i := s.allocate(int(ch), note, patch)
+	v := &s.voices[i]
+	if v.on || v.sustained {
+		s.keyOff(i)
+	}
+	if v.patch != patch {
+		s.loadPatch(i, patch)
+	}
+
+	s.counter++
+	v.channel = int(ch)
+	v.note = note
+	v.key = key
+	v.velocity = velocity
+	v.patch = patch
+	v.on = true
+	v.sustained = false
+	v.age = s.counter
+
+	s.updateLevel(i)
+	s.updatePan(i)
+	s.updatePitch(i)
+	s.keyOn(i)
+}
+
+// NoteOff releases a note, or marks it sustained while the pedal is down.
+func (s *Synth) NoteOff(ch, note uint8) {
+	ch &= 0x0f
+	for i := range s.voices {
+		v := &s.voices[i]
+		if v.channel != int(ch) || v.note != note || !v.on {
+			continue
+		}
+		if s.channels[ch].sustain {
+			v.sustained = true
+			continue
+		}
+		s.release(i)
+	}
+}
+
+// ControlChange handles bank select, modulation, volume, pan, expression,
+// sustain, the pitch bend range RPN and the channel mode messages.
+func (s *Synth) ControlChange(ch, cc, value uint8) {
+	ch &= 0x0f
+	c := &s.channels[ch]
+
+	switch cc {
+	case CCBankMSB:
+		c.msb = value
+	case CCBankLSB:
+		c.lsb = value
+	case CCModulation:
+		c.modulation = value
+		s.updateLFO()
+		s.update(ch, s.updatePan)
+	case CCVolume:
+		c.volume = value
+		s.update(ch, s.updateLevel)
+	case CCExpression:
+		c.expression = value
+		s.update(ch, s.updateLevel)
+	case CCPan:
+		c.pan = value
+		s.update(ch, s.updatePan)
+	case CCSustain:
+		c.sustain = value >= 64
+		if !c.sustain {
+			for i := range s.voices {
+				if s.voices[i].channel == int(ch) && s.voices[i].sustained {
+					s.release(i)
+				}
+			}
+		}
+	case CCRPNMSB:
+		c.rpn = c.rpn&0x7f | uint16(value)<<7
+	case CCRPNLSB:
+		c.rpn = c.rpn&0x3f80 | uint16(value)
+	case CCNRPNMSB, CCNRPNLSB:
+		c.rpn = RPNNull
+	case CCDataEntryMSB:
+		if c.rpn == RPNBendRange {
+			c.bendRange = uint16(value)*100 + c.bendRange%100
+			s.update(ch, s.updatePitch)
+		}
+	case CCDataEntryLSB:
+		if c.rpn == RPNBendRange {
+			c.bendRange = c.bendRange/100*100 + uint16(min(value, 99))
+			s.update(ch, s.updatePitch)
+		}
+	case CCResetAll:
+		s.resetControllers(int(ch))
+		s.updateLFO()
+		s.update(ch, s.updateAll)
+	case CCAllSoundOff, CCAllNotesOff:
+		for i := range s.voices {
+			if s.voices[i].channel == int(ch) && (s.voices[i].on || s.voices[i].sustained) {
+				s.release(i)
+			}
+		}
+	}
+}
+
+// ProgramChange selects the patch of the following notes.
+func (s *Synth) ProgramChange(ch, program uint8) {
+	s.channels[ch&0x0f].program = program & 0x7f
+}
+
+// PitchBend bends all notes of the channel, value ranges from -8192 to 8191.
+func (s *Synth) PitchBend(ch uint8, value int16) {
+	ch &= 0x0f
+	s.channels[ch].bend = value
+	s.update(ch, s.updatePitch)
+}
+
+func (s *Synth) resetControllers(ch int) {
+	c := &s.channels[ch]
+	c.volume = 100
+	c.expression = 127
+	c.pan = 64
+	c.modulation = 0
+	c.sustain = false
+	c.bend = 0
+	c.bendRange = DefaultBendMax * 100
+	c.rpn = RPNNull
+}
+
+func (s *Synth) patch(ch, note uint8) (*Patch, uint8) {
+	c := &s.channels[ch]
+	if ch == DrumChannel {
+		if s.bank == nil {
+			return nil, 0
+		}
+		p := s.bank.Drum(c.msb, c.lsb, note)
+		if p != nil && p.PercussionKey != 0 {
+			return p, p.PercussionKey
+		}
+		return p, note
+	}
+	if s.bank == nil {
+		return &DefaultPatch, note
+	}
+	if p := s.bank.Melody(c.msb, c.lsb, c.program); p != nil {
+		return p, note
+	}
+	return &DefaultPatch, note
+}
+
+// allocate picks the voice for a new note: the voice already playing it, a
+// released voice (preferring one with the same patch, then the oldest one),
+// or the oldest sustained or held voice. Channel 3 operator voices are only
+// used when no 4-op voice is released.
+func (s *Synth) allocate(ch int, note uint8, patch *Patch) int {
+	best, bestScore := 0, uint64(math.MaxUint64)
+
+	for i := range s.voices {
+		v := &s.voices[i]
+		if v.channel == ch && v.note == note && (v.on || v.sustained) {
+			return i
+		}
+
+		var score uint64
+		switch {
+		case v.on && !v.sustained:
+			score = 4 << 60
+		case v.sustained:
+			score = 3 << 60
+		case v.op >= 0:
+			score = 2 << 60
+		case v.patch != patch:
+			score = 1 << 60
+		}
+		score += v.age
+		if score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best
+}
+
+func (s *Synth) release(i int) {
+	s.counter++
+	s.voices[i].on = false
+	s.voices[i].sustained = false
+	s.voices[i].age = s.counter
+	s.keyOff(i)
+}
+
+func (s *Synth) update(ch uint8, fn func(int)) {
+	for i := range s.voices {
+		if s.voices[i].channel == int(ch) && s.voices[i].patch != nil {
+			fn(i)
+		}
+	}
+}
+
+func (s *Synth) updateAll(i int) {
+	s.updateLevel(i)
+	s.updatePan(i)
+	s.updatePitch(i)
+}
+
+func (s *Synth) loadPatch(i int, p *Patch) {
+	v := &s.voices[i]
+	if v.op >= 0 {
+		s.loadOperator(i, v.op, p.Ops[3])
+		return
+	}
+	for op, o := range p.Ops {
+		s.loadOperator(i, op, o)
+	}
+	s.writeCh(i, 0xb0, p.FbAlg)
+}
+
+func (s *Synth) loadOperator(i, op int, o Operator) {
+	off := uint8(op * 4)
+	s.writeCh(i, 0x30+off, o.DtMul)
+	s.writeCh(i, 0x50+off, o.RsAr)
+	s.writeCh(i, 0x60+off, o.AmD1r)
+	s.writeCh(i, 0x70+off, o.D2r)
+	s.writeCh(i, 0x80+off, o.D1lRr)
+	s.writeCh(i, 0x90+off, o.SsgEg)
+}
+
+// updateLevel scales the total level of the carriers by velocity, volume
+// and expression, 40log10 like General MIDI volume curves.
+func (s *Synth) updateLevel(i int) {
+	v := &s.voices[i]
+	c := &s.channels[v.channel]
+
+	level := float64(v.velocity) * float64(c.volume) * float64(c.expression) / (127 * 127 * 127)
+	atten := 127.0
+	if level > 0 {
+		atten = -40 * math.Log10(level) / 0.75
+	}
+	scale := func(tl uint8) uint8 {
+		return uint8(min(float64(tl&0x7f)+math.Round(atten), 127))
+	}
+
+	if v.op >= 0 {
+		s.writeCh(i, 0x40+uint8(v.op*4), scale(v.patch.Ops[3].Tl))
+		return
+	}
+	for op, o := range v.patch.Ops {
+		tl := o.Tl & 0x7f
+		if v.patch.Carrier(op) {
+			tl = scale(tl)
+		}
+		s.writeCh(i, 0x40+uint8(op*4), tl)
+	}
+}
+
+// updatePan writes the pan and LFO sensitivity. Channel 3 operator voices
+// share them, the last note wins.
+func (s *Synth) updatePan(i int) {
+	v := &s.voices[i]
+	c := &s.channels[v.channel]
+
+	var reg uint8
+	switch {
+	case c.pan < 43:
+		reg = 0x80
+	case c.pan > 85:
+		reg = 0x40
+	default:
+		reg = 0xc0
+	}
+	fms := v.patch.LfoSens & 0x07
+	if c.modulation > 0 {
+		fms = max(fms, uint8((uint32(c.modulation)*7+126)/127))
+	}
+	s.writeCh(i, 0xb4, reg|v.patch.LfoSens&0x30|fms)
+}
+
+func (s *Synth) updatePitch(i int) {
+	v := &s.voices[i]
+	c := &s.channels[v.channel]
+
+	note := float64(v.key) + float64(v.patch.NoteOffset) +
+		float64(c.bend)*float64(c.bendRange)/(8192*100)
+	fnum, block := s.frequency(440 * math.Pow(2, (note-69)/12))
+
+	reg := uint8(0xa0)
+	if v.op >= 0 {
+		reg = ch3FnumRegs[v.op] - ch3VoiceChannel
+	}
+	s.writeCh(i, reg+4, block<<3|uint8(fnum>>8))
+	s.writeCh(i, reg, uint8(fnum))
+}
+
+// frequency returns the F-number and block of a frequency in Hz, keeping the
+// F-number as large as possible for precision.
+func (s *Synth) frequency(hz float64) (uint16, uint8) {
+	fnum := hz * 144 * (1 << 21) / float64(s.clock)
+	block := uint8(0)
+	for fnum >= 2048 && block < 7 {
+		fnum /= 2
+		block++
+	}
+	return uint16(min(math.Round(fnum), 2047)), block
+}
+
+func (s *Synth) updateLFO() {
+	lfo := uint8(0)
+	if s.bank != nil {
+		lfo = s.bank.LFO & 0x0f
+	}
+	if lfo&0x08 == 0 {
+		for _, c := range s.channels {
+			if c.modulation > 0 {
+				lfo = modulationLFO
+				break
+			}
+		}
+	}
+	if lfo != s.lfo {
+		s.lfo = lfo
+		s.write(0, 0x22, lfo)
+	}
+}
+
+func (s *Synth) keyOn(i int) {
+	v := &s.voices[i]
+	if v.op >= 0 {
+		s.ch3Keys |= ch3KeyBits[v.op]
+		s.write(0, 0x28, s.ch3Keys|ch3VoiceChannel)
+		return
+	}
+	s.write(0, 0x28, 0xf0|driver.KeyChannel(v.fm))
+}
+
+func (s *Synth) keyOff(i int) {
+	v := &s.voices[i]
+	if v.op >= 0 {
+		s.ch3Keys &^= ch3KeyBits[v.op]
+		s.write(0, 0x28, s.ch3Keys|ch3VoiceChannel)
+		return
+	}
+	s.write(0, 0x28, driver.KeyChannel(v.fm))
+}
+
+func (s *Synth) writeCh(i int, reg, data uint8) {
+	fm := s.voices[i].fm
+	s.write(uint32(fm/3), reg+uint8(fm%3), data)
+}
+
+func (s *Synth) write(port uint32, addr, data uint8) {
+	s.chip.Write(port<<1, addr)
+	s.chip.Write(port<<1|1, data)
+}
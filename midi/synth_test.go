@@ -0,0 +1,153 @@
+package midi
+
+import (
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// regChip keeps the last value written to every register and counts the
+// samples generated.
+type regChip struct {
+	nukeykt.Chip
+	addr     [2]uint8
+	regs     [2][256]uint8
+	rendered uint64
+	// keyOns records the sample of every key on write
+	keyOns []uint64
+}
+
+func (c *regChip) Reset(rate, clock uint32) {}
+
+func (c *regChip) Write(port uint32, data uint8) {
+	if port&1 == 0 {
+		c.addr[port>>1&1] = data
+		return
+	}
+	c.regs[port>>1&1][c.addr[port>>1&1]] = data
+	if port>>1&1 == 0 && c.addr[0] == 0x28 && data&0xf0 != 0 {
+		c.keyOns = append(c.keyOns, c.rendered)
+	}
+}
+
+func (c *regChip) Generate(sndptr [][]int32, numsamples uint32) {
+	c.rendered += uint64(numsamples)
+}
+
+// fnum returns the block and F-number written for an FM channel.
+func (c *regChip) fnum(fm int) (uint8, uint16) {
+	regs := &c.regs[fm/3]
+	hi := regs[0xa4+fm%3]
+	return hi >> 3, uint16(hi&0x07)<<8 | uint16(regs[0xa0+fm%3])
+}
+
+func TestNotePitch(t *testing.T) {
+	for _, tc := range []struct {
+		note  uint8
+		bend  int16
+		block uint8
+		fnum  uint16
+	}{
+		{0, 0, 0, 322},
+		{12, 0, 0, 644},
+		{60, 0, 3, 1288},
+		{69, 0, 4, 1083},
+		{81, 0, 5, 1083},
+		// The F-number saturates above the range of block 7
+		{127, 0, 7, 2047},
+		// Two semitones at full bend, one and a half at three quarters
+		{69, 8192 - 1, 4, 1215},
+		{69, 6144, 4, 1181},
+		{71, -8192, 4, 1083},
+	} {
+		chip := &regChip{}
+		s := NewSynth(chip, nil, 7670453)
+		s.PitchBend(0, tc.bend)
+		s.NoteOn(0, tc.note, 100)
+
+		// The bend is rounded to the nearest F-number
+		block, fnum := chip.fnum(0)
+		if block != tc.block || fnum < tc.fnum-1 || fnum > tc.fnum+1 {
+			t.Errorf("note %d bent %d: block %d F-number %d, want %d %d", tc.note, tc.bend, block, fnum, tc.block, tc.fnum)
+		}
+	}
+}
+
+func TestNoteLevel(t *testing.T) {
+	// DefaultPatch uses algorithm 4, OP2 and OP4 are the carriers
+	for _, tc := range []struct {
+		velocity, volume, expression uint8
+		atten                        uint8
+	}{
+		{127, 127, 127, 0},
+		{64, 127, 127, 16},
+		{127, 64, 127, 16},
+		{127, 127, 64, 16},
+		{127, 100, 127, 6},
+		// Attenuation saturates at the lowest level
+		{1, 1, 127, 127},
+		{127, 0, 127, 127},
+	} {
+		chip := &regChip{}
+		s := NewSynth(chip, nil, 7670453)
+		s.ControlChange(0, CCVolume, tc.volume)
+		s.ControlChange(0, CCExpression, tc.expression)
+		s.NoteOn(0, 60, tc.velocity)
+
+		var got, want [4]uint8
+		for op, o := range DefaultPatch.Ops {
+			got[op] = chip.regs[0][0x40+op*4]
+			want[op] = o.Tl
+			if DefaultPatch.Carrier(op) {
+				want[op] = min(o.Tl+tc.atten, 127)
+			}
+		}
+		if got != want {
+			t.Errorf("velocity %d, volume %d, expression %d: levels %#x, want %#x",
+				tc.velocity, tc.volume, tc.expression, got, want)
+		}
+	}
+}
+
+func TestNotePan(t *testing.T) {
+	for _, tc := range []struct {
+		pan, modulation uint8
+		reg             uint8
+	}{
+		{0, 0, 0x80},
+		{42, 0, 0x80},
+		{43, 0, 0xc0},
+		{64, 0, 0xc0},
+		{86, 0, 0x40},
+		{127, 0, 0x40},
+		// Modulation raises the FM sensitivity
+		{64, 127, 0xc7},
+		{64, 1, 0xc1},
+	} {
+		chip := &regChip{}
+		s := NewSynth(chip, nil, 7670453)
+		s.ControlChange(3, CCPan, tc.pan)
+		s.ControlChange(3, CCModulation, tc.modulation)
+		s.NoteOn(3, 60, 100)
+
+		if got := chip.regs[0][0xb4]; got != tc.reg {
+			t.Errorf("pan %d, modulation %d: register 0xb4 %#x, want %#x", tc.pan, tc.modulation, got, tc.reg)
+		}
+	}
+}
+
+func TestVoiceChannels(t *testing.T) {
+	// Notes fill the FM channels in order, the first one is stolen next
+	chip := &regChip{}
+	s := NewSynth(chip, nil, 7670453)
+	for i, key := range []uint8{0xf0, 0xf1, 0xf2, 0xf4, 0xf5, 0xf6, 0xf0} {
+		s.NoteOn(0, 60+uint8(i), 100)
+		if got := chip.regs[0][0x28]; got != key {
+			t.Errorf("note %d keyed %#x, want %#x", i, got, key)
+		}
+		fm := int(key&0x03) + 3*int(key>>2&1)
+		if _, fnum := chip.fnum(fm); fnum == 0 {
+			t.Errorf("note %d: no frequency on FM channel %d", i, fm+1)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package midi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/elemir/nukeykt/internal/driver"
+)
+
+const (
+	wopnMagic1 = "WOPN2-BANK\x00"
+	wopnMagic2 = "WOPN2-B2NK\x00"
+
+	wopnPatchSize1 = 65
+	wopnPatchSize2 = 69
+	wopnMetaSize   = 34
+)
+
+// Operator holds the operator registers 0x30-0x90 of a patch.
+type Operator struct {
+	DtMul uint8 // 0x30 detune, multiple
+	Tl    uint8 // 0x40 total level
+	RsAr  uint8 // 0x50 rate scaling, attack rate
+	AmD1r uint8 // 0x60 amplitude modulation, decay rate
+	D2r   uint8 // 0x70 sustain rate
+	D1lRr uint8 // 0x80 sustain level, release rate
+	SsgEg uint8 // 0x90 SSG-EG
+}
+
+// Patch is a 4-operator instrument. Operators are in register order:
+// OP1, OP3, OP2, OP4.
+type Patch struct {
+	Name       string
+	NoteOffset int16
+	// PercussionKey is the note percussion patches are played at.
+	PercussionKey uint8
+	FbAlg         uint8 // 0xB0 feedback, algorithm
+	LfoSens       uint8 // 0xB4 AMS, FMS
+	Ops           [4]Operator
+	DelayOn       uint16 // milliseconds
+	DelayOff      uint16 // milliseconds
+}
+
+// Set is a bank of 128 patches selected by bank select MSB and LSB.
+type Set struct {
+	Name    string
+	LSB     uint8
+	MSB     uint8
+	Patches [128]Patch
+}
+
+// Bank is an instrument bank in the WOPN format of libOPNMIDI.
+type Bank struct {
+	Version int
+	// LFO is the value of the LFO register 0x22.
+	LFO        uint8
+	Melodic    []Set
+	Percussion []Set
+}
+
+// DefaultPatch is played when no bank is loaded.
+var DefaultPatch = Patch{
+	Name:  "Default",
+	FbAlg: 0x3c, // Two FM pairs, feedback 7
+	Ops: [4]Operator{
+		{DtMul: 0x71, Tl: 0x23, RsAr: 0x1f, AmD1r: 0x05, D2r: 0x02, D1lRr: 0x16},
+		{DtMul: 0x02, Tl: 0x28, RsAr: 0x1f, AmD1r: 0x05, D2r: 0x02, D1lRr: 0x16},
+		{DtMul: 0x31, Tl: 0x0c, RsAr: 0x1f, AmD1r: 0x08, D2r: 0x03, D1lRr: 0x27},
+		{DtMul: 0x01, Tl: 0x0a, RsAr: 0x1f, AmD1r: 0x08, D2r: 0x03, D1lRr: 0x27},
+	},
+}
+
+// ParseBank parses a WOPN bank of version 1 or 2.
+func ParseBank(data []byte) (*Bank, error) {
+	b := &Bank{Version: 1}
+
+	switch {
+	case bytes.HasPrefix(data, []byte(wopnMagic1)):
+		data = data[len(wopnMagic1):]
+	case bytes.HasPrefix(data, []byte(wopnMagic2)):
+		data = data[len(wopnMagic2):]
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: short bank header", ErrFormat)
+		}
+		b.Version = int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+	default:
+		return nil, fmt.Errorf("%w: bad bank magic", ErrFormat)
+	}
+
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%w: short bank header", ErrFormat)
+	}
+	melodic := int(binary.BigEndian.Uint16(data))
+	percussion := int(binary.BigEndian.Uint16(data[2:]))
+	b.LFO = data[4]
+	data = data[5:]
+
+	patchSize, setSize := wopnPatchSize1, 128*wopnPatchSize1
+	if b.Version >= 2 {
+		patchSize, setSize = wopnPatchSize2, wopnMetaSize+128*wopnPatchSize2
+	}
+	// Check the size before allocating the sets a corrupt header asks for
+	if (melodic+percussion)*setSize > len(data) {
+		return nil, fmt.Errorf("%w: truncated bank", ErrFormat)
+	}
+	b.Melodic = make([]Set, melodic)
+	b.Percussion = make([]Set, percussion)
+
+	if b.Version >= 2 {
+		for _, sets := range [][]Set{b.Melodic, b.Percussion} {
+			for i := range sets {
+				sets[i].Name = cstring(data[:32])
+				sets[i].LSB = data[32]
+				sets[i].MSB = data[33]
+				data = data[wopnMetaSize:]
+			}
+		}
+	}
+
+	for _, sets := range [][]Set{b.Melodic, b.Percussion} {
+		for i := range sets {
+			for j := range sets[i].Patches {
+				sets[i].Patches[j] = parsePatch(data[:patchSize])
+				data = data[patchSize:]
+			}
+		}
+	}
+
+	return b, nil
+}
+
+func parsePatch(data []byte) Patch {
+	p := Patch{
+		Name:          cstring(data[:32]),
+		NoteOffset:    int16(binary.BigEndian.Uint16(data[32:])),
+		PercussionKey: data[34],
+		FbAlg:         data[35],
+		LfoSens:       data[36],
+	}
+	for i := range p.Ops {
+		op := data[37+7*i:]
+		p.Ops[i] = Operator{
+			DtMul: op[0],
+			Tl:    op[1],
+			RsAr:  op[2],
+			AmD1r: op[3],
+			D2r:   op[4],
+			D1lRr: op[5],
+			SsgEg: op[6],
+		}
+	}
+	if len(data) >= wopnPatchSize2 {
+		p.DelayOn = binary.BigEndian.Uint16(data[65:])
+		p.DelayOff = binary.BigEndian.Uint16(data[67:])
+	}
+	return p
+}
+
+// Blank reports whether the patch has no operator data.
+func (p *Patch) Blank() bool {
+	return p.FbAlg == 0 && p.Ops == [4]Operator{}
+}
+
+// Carrier reports whether the operator, in register order, is a carrier of
+// the patch algorithm.
+func (p *Patch) Carrier(op int) bool {
+	return driver.Carriers[p.FbAlg&0x07]&(1<<op) != 0
+}
+
+// Melody returns the melodic patch for the bank select and program numbers.
+func (b *Bank) Melody(msb, lsb, program uint8) *Patch {
+	return lookup(b.Melodic, msb, lsb, program)
+}
+
+// Drum returns the percussion patch for the bank select and note numbers.
+func (b *Bank) Drum(msb, lsb, note uint8) *Patch {
+	return lookup(b.Percussion, msb, lsb, note)
+}
+
+func lookup(sets []Set, msb, lsb, n uint8) *Patch {
+	if len(sets) == 0 || n >= 128 {
+		return nil
+	}
+	set := &sets[0]
+	for i := range sets {
+		if sets[i].MSB == msb && sets[i].LSB == lsb {
+			set = &sets[i]
+			break
+		}
+	}
+	if set.Patches[n].Blank() {
+		return nil
+	}
+	return &set.Patches[n]
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
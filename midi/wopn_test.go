@@ -0,0 +1,162 @@
+package midi
+
+import (
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"testing"
+)
+
+// TestParseBankTruncated checks that a header asking for more sets than the
+// bank holds is rejected before the sets are allocated.
+func TestParseBankTruncated(t *testing.T) {
+	for _, magic := range []string{wopnMagic1, wopnMagic2 + "\x02\x00"} {
+		data := []byte(magic + "\xff\xff\xff\xff\x00")
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ParseBank(data)
+		runtime.ReadMemStats(&after)
+
+		if !errors.Is(err, ErrFormat) {
+			t.Errorf("%q: error %v, want ErrFormat", magic, err)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%q: %d bytes allocated for a truncated bank", magic, n)
+		}
+	}
+}
+
+// wopnPatch encodes a patch in the bank format of the given version.
+func wopnPatch(p Patch, version int) []byte {
+	b := make([]byte, 37, wopnPatchSize2)
+	copy(b, p.Name)
+	binary.BigEndian.PutUint16(b[32:], uint16(p.NoteOffset))
+	b[34] = p.PercussionKey
+	b[35] = p.FbAlg
+	b[36] = p.LfoSens
+	for _, o := range p.Ops {
+		b = append(b, o.DtMul, o.Tl, o.RsAr, o.AmD1r, o.D2r, o.D1lRr, o.SsgEg)
+	}
+	if version >= 2 {
+		b = binary.BigEndian.AppendUint16(b, p.DelayOn)
+		b = binary.BigEndian.AppendUint16(b, p.DelayOff)
+	}
+	return b
+}
+
+// wopnBank encodes a bank, the LFO register is 0x0a.
+func wopnBank(version int, melodic, percussion []Set) []byte {
+	var b []byte
+	if version == 1 {
+		b = []byte(wopnMagic1)
+	} else {
+		b = binary.LittleEndian.AppendUint16([]byte(wopnMagic2), uint16(version))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(melodic)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(percussion)))
+	b = append(b, 0x0a)
+
+	sets := append(melodic[:len(melodic):len(melodic)], percussion...)
+	if version >= 2 {
+		for _, s := range sets {
+			meta := make([]byte, wopnMetaSize)
+			copy(meta, s.Name)
+			meta[32], meta[33] = s.LSB, s.MSB
+			b = append(b, meta...)
+		}
+	}
+	for _, s := range sets {
+		for _, p := range s.Patches {
+			b = append(b, wopnPatch(p, version)...)
+		}
+	}
+	return b
+}
+
+func TestParseBank(t *testing.T) {
+	piano := Patch{
+		Name: "Piano", NoteOffset: -12, FbAlg: 0x32, LfoSens: 0x11,
+		Ops: [4]Operator{
+			{0x71, 0x23, 0x1f, 0x05, 0x02, 0x16, 0x00},
+			{0x02, 0x28, 0x1f, 0x05, 0x02, 0x16, 0x00},
+			{0x31, 0x0c, 0x1f, 0x08, 0x03, 0x27, 0x08},
+			{0x01, 0x0a, 0x1f, 0x08, 0x03, 0x27, 0x00},
+		},
+		DelayOn: 500, DelayOff: 40,
+	}
+	kick := Patch{Name: "Kick", PercussionKey: 36, FbAlg: 0x07, Ops: piano.Ops}
+	bass := Patch{Name: "Bass", FbAlg: 0x04, Ops: piano.Ops}
+
+	var gm, alt, drums Set
+	gm.Patches[0] = piano
+	alt.Name, alt.MSB, alt.LSB = "Alt", 1, 2
+	alt.Patches[0] = bass
+	drums.Name = "Drums"
+	drums.Patches[35] = kick
+
+	for _, version := range []int{1, 2} {
+		b, err := ParseBank(wopnBank(version, []Set{gm, alt}, []Set{drums}))
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if b.Version != version || b.LFO != 0x0a || len(b.Melodic) != 2 || len(b.Percussion) != 1 {
+			t.Fatalf("version %d: bank version %d, LFO %#x, %d melodic and %d percussion sets",
+				version, b.Version, b.LFO, len(b.Melodic), len(b.Percussion))
+		}
+
+		want := map[string]Patch{"piano": piano, "bass": bass, "kick": kick}
+		if version == 1 {
+			// Version 1 has no delays and no set numbers, every bank
+			// select plays the first set
+			for name, p := range want {
+				p.DelayOn, p.DelayOff = 0, 0
+				want[name] = p
+			}
+			want["bass"] = want["piano"]
+		}
+		for _, tc := range []struct {
+			name string
+			got  *Patch
+		}{
+			{"piano", b.Melody(0, 0, 0)},
+			{"bass", b.Melody(1, 2, 0)},
+			// Unknown bank numbers fall back to the first set
+			{"piano", b.Melody(5, 5, 0)},
+			{"kick", b.Drum(1, 2, 35)},
+			// Blank patches and missing notes play nothing
+			{"", b.Melody(0, 0, 1)},
+			{"", b.Drum(0, 0, 36)},
+			{"", b.Drum(0, 0, 200)},
+		} {
+			var got Patch
+			if tc.got != nil {
+				got = *tc.got
+			}
+			if got != want[tc.name] {
+				t.Errorf("version %d %q: patch %+v, want %+v", version, tc.name, got, want[tc.name])
+			}
+		}
+		if version == 2 && (b.Melodic[1].Name != "Alt" || b.Percussion[0].Name != "Drums") {
+			t.Errorf("set names %q, %q", b.Melodic[1].Name, b.Percussion[0].Name)
+		}
+	}
+}
+
+func TestParseBankErrors(t *testing.T) {
+	bank := wopnBank(2, make([]Set, 1), nil)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"magic", []byte("WOPN2-BANK")},
+		{"short header", []byte(wopnMagic1 + "\x00\x01")},
+		{"short version", []byte(wopnMagic2 + "\x02")},
+		{"truncated", bank[:len(bank)-1]},
+		{"version 1 sizes", wopnBank(1, make([]Set, 1), nil)[:len(wopnMagic1)+5+128*wopnPatchSize1-1]},
+	} {
+		if _, err := ParseBank(tc.data); !errors.Is(err, ErrFormat) {
+			t.Errorf("%s: error %v, want ErrFormat", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package nukeykt
+
+import (
+	"math"
+)
+
+const (
+	mixerFrac     = 16
+	mixerMaxLevel = math.MaxInt16
+	mixerMinLevel = math.MinInt16
+)
+
+// Mixer renders several chips running at different clocks into a single
+// stereo stream at a common output rate.
+type Mixer struct {
+	rate     uint32
+	inputs   []*MixerInput
+	master   int64
+	clip     bool
+	scratch  [2][]int32
+	scratchp [][]int32
+	// Inputs are summed in 64 bits, the headroom brings the sum back
+	sum [2][]int64
+}
+
+// MixerInput is a chip owned by a Mixer together with its mixing settings.
+type MixerInput struct {
+	Chip  Chip
+	Clock uint32
+
+	gain, pan float64
+	mute      bool
+	left      int64
+	right     int64
+}
+
+// NewMixer creates a mixer producing samples at the given rate. The output is
+// clipped to the signed 16 bit range until SetClip(false) is called.
+func NewMixer(rate uint32) *Mixer {
+	return &Mixer{
+		rate:   rate,
+		master: 1 << mixerFrac,
+		clip:   true,
+	}
+}
+
+// Rate returns the mixer output rate.
+func (m *Mixer) Rate() uint32 {
+	return m.rate
+}
+
+// Add resets the chip with the given clock and the mixer output rate and adds
+// it to the mix with unity gain and center pan.
+func (m *Mixer) Add(chip Chip, clock uint32) *MixerInput {
+	chip.Reset(m.rate, clock)
+
+	in := &MixerInput{Chip: chip, Clock: clock}
+	in.SetGain(1)
+	m.inputs = append(m.inputs, in)
+
+	return in
+}
+
+// Inputs returns the chips in the order they were added.
+func (m *Mixer) Inputs() []*MixerInput {
+	return m.inputs
+}
+
+// Reset resets all chips keeping their clocks and mixing settings.
+func (m *Mixer) Reset() {
+	for _, in := range m.inputs {
+		in.Chip.Reset(m.rate, in.Clock)
+	}
+}
+
+// SetHeadroom attenuates the sum of all inputs by the given number of
+// decibels before clipping.
+func (m *Mixer) SetHeadroom(db float64) {
+	m.master = int64(math.Round(math.Pow(10, -db/20) * (1 << mixerFrac)))
+}
+
+// SetClip enables or disables clipping of the output to 16 bits.
+func (m *Mixer) SetClip(clip bool) {
+	m.clip = clip
+}
+
+// Generate renders numsamples stereo samples mixing all inputs.
+func (m *Mixer) Generate(sndptr [][]int32, numsamples uint32) {
+	if numsamples == 0 {
+		return
+	}
+	if uint32(len(m.scratch[0])) < numsamples {
+		m.scratch[0] = make([]int32, numsamples)
+		m.scratch[1] = make([]int32, numsamples)
+		m.scratchp = m.scratch[:]
+		m.sum[0] = make([]int64, numsamples)
+		m.sum[1] = make([]int64, numsamples)
+	}
+
+	suml := m.sum[0][:numsamples]
+	sumr := m.sum[1][:numsamples]
+	clear(suml)
+	clear(sumr)
+
+	for _, in := range m.inputs {
+		// Muted chips are still clocked to keep them in sync
+		in.Chip.Generate(m.scratchp, numsamples)
+		if in.mute {
+			continue
+		}
+		for i := range numsamples {
+			suml[i] += (int64(m.scratch[0][i]) * in.left) >> mixerFrac
+			sumr[i] += (int64(m.scratch[1][i]) * in.right) >> mixerFrac
+		}
+	}
+
+	smpl := sndptr[0][:numsamples]
+	smpr := sndptr[1][:numsamples]
+	for i := range numsamples {
+		smpl[i] = m.level(suml[i])
+		smpr[i] = m.level(sumr[i])
+	}
+}
+
+func (m *Mixer) level(sample int64) int32 {
+	out := (sample * m.master) >> mixerFrac
+	if m.clip {
+		return int32(min(max(out, mixerMinLevel), mixerMaxLevel))
+	}
+	return int32(min(max(out, math.MinInt32), math.MaxInt32))
+}
+
+// SetGain sets the linear gain of the input.
+func (in *MixerInput) SetGain(gain float64) {
+	in.gain = gain
+	in.update()
+}
+
+// SetPan sets the balance of the input from -1 (left) to 1 (right).
+func (in *MixerInput) SetPan(pan float64) {
+	in.pan = min(max(pan, -1), 1)
+	in.update()
+}
+
+// SetMute mutes or unmutes the input.
+func (in *MixerInput) SetMute(mute bool) {
+	in.mute = mute
+}
+
+func (in *MixerInput) Gain() float64 { return in.gain }
+func (in *MixerInput) Pan() float64  { return in.pan }
+func (in *MixerInput) Muted() bool   { return in.mute }
+
+func (in *MixerInput) update() {
+	in.left = int64(math.Round(in.gain * min(1, 1-in.pan) * (1 << mixerFrac)))
+	in.right = int64(math.Round(in.gain * min(1, 1+in.pan) * (1 << mixerFrac)))
+}
@@ -0,0 +1,121 @@
+package nukeykt
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// levelChip outputs the same sample on both channels and counts the samples
+// it renders.
+type levelChip struct {
+	level    int32
+	rendered uint32
+}
+
+func (c *levelChip) Reset(rate, clock uint32)      {}
+func (c *levelChip) Write(port uint32, data uint8) {}
+func (c *levelChip) Read(port uint32) uint8        { return 0 }
+func (c *levelChip) NativeRate() uint32            { return 44100 }
+func (c *levelChip) SaveState() []byte             { return nil }
+func (c *levelChip) LoadState(data []byte) error   { return nil }
+
+func (c *levelChip) Generate(sndptr [][]int32, numsamples uint32) {
+	for i := range numsamples {
+		sndptr[0][i] = c.level
+		sndptr[1][i] = c.level
+	}
+	c.rendered += numsamples
+}
+
+func TestMixerGenerateEmpty(t *testing.T) {
+	m := NewMixer(44100)
+	chip := &levelChip{level: 1000}
+	m.Add(chip, 7670453)
+
+	// Nothing is rendered and nothing is indexed
+	buf := [][]int32{{1, 2, 3}, {4, 5, 6}}
+	m.Generate(buf, 0)
+	if chip.rendered != 0 {
+		t.Errorf("rendered %d samples for an empty request", chip.rendered)
+	}
+	if !slices.Equal(buf[0], []int32{1, 2, 3}) || !slices.Equal(buf[1], []int32{4, 5, 6}) {
+		t.Errorf("empty request changed the buffers to %v", buf)
+	}
+	m.Generate([][]int32{nil, nil}, 0)
+}
+
+func TestMixerGenerateChip(t *testing.T) {
+	// A lone chip at unity gain and center pan is mixed unchanged
+	a, b := frameChips(ModeYM2612)
+	m := NewMixer(44100)
+	m.Add(a, 7670453)
+	a.LoadState(b.SaveState())
+
+	buf := [][]int32{make([]int32, 16), make([]int32, 16)}
+	want := [][]int32{make([]int32, 16), make([]int32, 16)}
+	m.Generate(buf, 16)
+	b.Generate(want, 16)
+	if !slices.Equal(buf[0], want[0]) || !slices.Equal(buf[1], want[1]) {
+		t.Errorf("mixed %v, want %v", buf, want)
+	}
+	if slices.Equal(want[0], make([]int32, 16)) {
+		t.Error("chip rendered silence")
+	}
+}
+
+func TestMixerLevels(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		levels      []int32
+		setup       func(m *Mixer, in []*MixerInput)
+		left, right int32
+	}{
+		{"unity", []int32{1000, 2000}, nil, 3000, 3000},
+		{"gain", []int32{1000, 2000}, func(m *Mixer, in []*MixerInput) {
+			in[0].SetGain(0.5)
+			in[1].SetGain(2)
+		}, 4500, 4500},
+		{"pan left", []int32{1000}, func(m *Mixer, in []*MixerInput) { in[0].SetPan(-1) }, 1000, 0},
+		{"pan right", []int32{1000}, func(m *Mixer, in []*MixerInput) { in[0].SetPan(0.5) }, 500, 1000},
+		{"pan clamped", []int32{1000}, func(m *Mixer, in []*MixerInput) { in[0].SetPan(-3) }, 1000, 0},
+		{"mute", []int32{1000, 2000}, func(m *Mixer, in []*MixerInput) { in[1].SetMute(true) }, 1000, 1000},
+		{"headroom", []int32{1000, 1000}, func(m *Mixer, in []*MixerInput) { m.SetHeadroom(20) }, 200, 200},
+		{"clip", []int32{30000, 30000, -1000}, nil, math.MaxInt16, math.MaxInt16},
+		{"clip negative", []int32{-30000, -30000}, nil, math.MinInt16, math.MinInt16},
+		{"no clip", []int32{30000, 30000}, func(m *Mixer, in []*MixerInput) { m.SetClip(false) }, 60000, 60000},
+		// The sum overflows 32 bits before the headroom brings it back
+		{"overflow", []int32{1 << 30, 1 << 30, 1 << 30, 1 << 30}, func(m *Mixer, in []*MixerInput) {
+			m.SetClip(false)
+			m.SetHeadroom(20 * math.Log10(8))
+		}, 1 << 29, 1 << 29},
+		{"saturate", []int32{math.MaxInt32, math.MaxInt32}, func(m *Mixer, in []*MixerInput) { m.SetClip(false) },
+			math.MaxInt32, math.MaxInt32},
+	} {
+		m := NewMixer(44100)
+		var chips []*levelChip
+		for _, level := range tc.levels {
+			chip := &levelChip{level: level}
+			chips = append(chips, chip)
+			m.Add(chip, 7670453)
+		}
+		if tc.setup != nil {
+			tc.setup(m, m.Inputs())
+		}
+
+		buf := [][]int32{make([]int32, 8), make([]int32, 8)}
+		m.Generate(buf, 8)
+		for i := range 8 {
+			if buf[0][i] != tc.left || buf[1][i] != tc.right {
+				t.Errorf("%s: sample %d is %d, %d, want %d, %d", tc.name, i, buf[0][i], buf[1][i], tc.left, tc.right)
+				break
+			}
+		}
+		// Muted chips are clocked all the same
+		for i, chip := range chips {
+			if chip.rendered != 8 {
+				t.Errorf("%s: input %d rendered %d samples, want 8", tc.name, i, chip.rendered)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package reglog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("# test\nclock 7670453\n0 0 0x28 0xf0\n48 1 30 01\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		l, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		text, err := l.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l2, err := Parse(text)
+		if err != nil {
+			t.Fatalf("marshaled log does not parse: %v", err)
+		}
+		if !reflect.DeepEqual(l, l2) {
+			t.Fatalf("round trip changed the log:\n%+v\n%+v", l, l2)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package reglog
+
+import (
+	"github.com/elemir/nukeykt"
+)
+
+// Player renders a register log through a chip.
+type Player struct {
+	log  *Log
+	chip nukeykt.Chip
+	rate uint32
+
+	pos      int
+	rendered uint64
+	left     uint64
+	out      [2][]int32
+}
+
+// NewPlayer resets the chip with the log clock and the given output rate and
+// returns a player for the log.
+func NewPlayer(l *Log, chip nukeykt.Chip, rate uint32) *Player {
+	chip.Reset(rate, l.Clock)
+
+	return &Player{
+		log:  l,
+		chip: chip,
+		rate: rate,
+	}
+}
+
+// Loops always returns 0, logs do not loop.
+func (p *Player) Loops() int {
+	return 0
+}
+
+// Done reports whether all writes were made.
+func (p *Player) Done() bool {
+	return p.pos >= len(p.log.Writes)
+}
+
+// Next runs the commands due at the current sample and returns how many
+// samples render before the next ones, so a renderer can stop exactly where
+// the log loops or ends.
+func (p *Player) Next() uint64 {
+	if p.left == 0 {
+		p.step()
+	}
+	return p.left
+}
+
+// Generate renders numsamples stereo samples. Once the log is over the chip
+// keeps running, so release tails are rendered.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		if p.left == 0 {
+			p.step()
+		}
+		n := min(p.left, uint64(numsamples)-off)
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.chip.Generate(p.out[:], uint32(n))
+		p.left -= n
+		p.rendered += n
+		off += n
+	}
+}
+
+// step makes the writes due before the next output sample and computes how
+// many samples to render until the following write.
+func (p *Player) step() {
+	writes := p.log.Writes
+	for p.pos < len(writes) && p.sample(writes[p.pos].Cycle) <= p.rendered {
+		w := writes[p.pos]
+		port := uint32(w.Port&0x01) << 1
+		p.chip.Write(port, w.Addr)
+		p.chip.Write(port|1, w.Data)
+		p.pos++
+	}
+
+	p.left = 1
+	if p.pos < len(writes) {
+		p.left = max(p.sample(writes[p.pos].Cycle)-p.rendered, 1)
+	}
+}
+
+// sample converts a chip cycle to an output sample.
+func (p *Player) sample(cycle uint64) uint64 {
+	return cycle * 6 * uint64(p.rate) / uint64(p.log.Clock)
+}
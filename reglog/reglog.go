@@ -0,0 +1,119 @@
+// Package reglog reads, writes and plays plain text OPN2 register logs.
+//
+// Each line of a log is a write:
+//
+//	<cycle> <port> <address> <data>
+//
+// where cycle is the decimal chip cycle (six master clocks, 24 per native
+// sample) the write is made at, port is 0 or 1 and address and data are hex
+// bytes with an optional 0x prefix. Lines may be empty or comments starting
+// with '#', and a "clock <hz>" line sets the chip clock. Cycles must not
+// decrease.
+package reglog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultClock is the clock of logs without a clock line.
+const DefaultClock = 7670453
+
+var ErrFormat = errors.New("reglog: invalid log")
+
+// Write is a register write.
+type Write struct {
+	Cycle uint64
+	Port  uint8
+	Addr  uint8
+	Data  uint8
+}
+
+// Log is a register log.
+type Log struct {
+	Clock  uint32
+	Writes []Write
+}
+
+// Parse parses a text log.
+func Parse(data []byte) (*Log, error) {
+	l := &Log{Clock: DefaultClock}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 2 && fields[0] == "clock":
+			clock, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil || clock == 0 {
+				return nil, fmt.Errorf("%w: line %d: bad clock", ErrFormat, line)
+			}
+			l.Clock = uint32(clock)
+		case len(fields) == 4:
+			w, err := parseWrite(fields)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %w", ErrFormat, line, err)
+			}
+			if n := len(l.Writes); n > 0 && w.Cycle < l.Writes[n-1].Cycle {
+				return nil, fmt.Errorf("%w: line %d: cycle goes back", ErrFormat, line)
+			}
+			l.Writes = append(l.Writes, w)
+		default:
+			return nil, fmt.Errorf("%w: line %d: expected 4 fields", ErrFormat, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, err)
+	}
+
+	return l, nil
+}
+
+func parseWrite(fields []string) (Write, error) {
+	cycle, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return Write{}, errors.New("bad cycle")
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 1)
+	if err != nil {
+		return Write{}, errors.New("bad port")
+	}
+	addr, err := parseHex(fields[2])
+	if err != nil {
+		return Write{}, errors.New("bad address")
+	}
+	data, err := parseHex(fields[3])
+	if err != nil {
+		return Write{}, errors.New("bad data")
+	}
+	return Write{Cycle: cycle, Port: uint8(port), Addr: addr, Data: data}, nil
+}
+
+func parseHex(s string) (uint8, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	v, err := strconv.ParseUint(s, 16, 8)
+	return uint8(v), err
+}
+
+// MarshalText formats the log.
+func (l *Log) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "clock %d\n", l.Clock)
+	for _, w := range l.Writes {
+		fmt.Fprintf(&b, "%d %d 0x%02x 0x%02x\n", w.Cycle, w.Port, w.Addr, w.Data)
+	}
+
+	return b.Bytes(), nil
+}
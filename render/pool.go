@@ -0,0 +1,116 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/elemir/nukeykt/wav"
+)
+
+// Job is a song rendered by a Pool.
+type Job struct {
+	// Input is the path of the song file.
+	Input string
+	// Settings configures the rendering of the song.
+	Settings Settings
+	// Output receives the song as a stereo WAV file.
+	Output io.Writer
+}
+
+// Progress reports a finished job of a Pool.
+type Progress struct {
+	Job *Job
+	// Err is the error of the job, nil if it rendered.
+	Err error
+	// Done is how many jobs have finished, Total how many were given.
+	Done, Total int
+}
+
+// Pool renders jobs on several goroutines. Every job renders on chips of its
+// own, so jobs may use different settings.
+type Pool struct {
+	// Workers is how many jobs render at once, runtime.GOMAXPROCS by
+	// default.
+	Workers int
+	// Progress is called after every finished job. Calls do not overlap.
+	Progress func(p Progress)
+}
+
+// Run renders the jobs and returns their errors joined. Jobs not started
+// when ctx is done are skipped and jobs in progress stop, and Run returns
+// the context error with the errors of the finished jobs.
+func (p *Pool) Run(ctx context.Context, jobs []Job) error {
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		done int
+		wg   sync.WaitGroup
+	)
+	sem := make(chan struct{}, workers)
+
+	finish := func(job *Job, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil && !errors.Is(err, ctx.Err()) {
+			errs = append(errs, fmt.Errorf("%s: %w", job.Input, err))
+		}
+		done++
+		if p.Progress != nil {
+			p.Progress(Progress{Job: job, Err: err, Done: done, Total: len(jobs)})
+		}
+	}
+
+	for i := range jobs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			finish(job, runJob(ctx, job))
+		}(&jobs[i])
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func runJob(ctx context.Context, job *Job) error {
+	data, err := os.ReadFile(job.Input)
+	if err != nil {
+		return err
+	}
+	song, err := Load(job.Input, data)
+	if err != nil {
+		return err
+	}
+
+	set := job.Settings.withDefaults()
+	samples, err := render(ctx, song, set)
+	if err != nil {
+		return err
+	}
+
+	return wav.Encode(job.Output, set.Rate, 2, samples)
+}
@@ -0,0 +1,128 @@
+package render_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/render"
+	"github.com/elemir/nukeykt/wav"
+)
+
+// poolSettings are rendered concurrently, they differ in every setting that
+// used to be global to the emulator.
+var poolSettings = []render.Settings{
+	{Chip: nukeykt.KindYM2612},
+	{Chip: nukeykt.KindYM3438, Filter: render.FilterNone},
+	{Chip: nukeykt.KindYM2612, Filter: render.FilterNone, Rate: 48000},
+	{Chip: nukeykt.KindYM3438, Mute: 0x15},
+	{Chip: nukeykt.KindYM2612, Fast: true, Filter: render.FilterNone},
+}
+
+var poolInputs = []string{
+	"../testdata/golden/algorithms.log",
+	"../testdata/golden/dac.log",
+	"../testdata/golden/lfo.log",
+	"../testdata/golden/ssgeg.log",
+}
+
+// TestPoolIsolation renders every input with every setting on a pool and
+// compares the output to rendering the jobs one at a time. Run with -race.
+func TestPoolIsolation(t *testing.T) {
+	var jobs []render.Job
+	var want [][]byte
+	for _, input := range poolInputs {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		song, err := render.Load(input, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, set := range poolSettings {
+			set.MaxLength = 0.02
+			rate := set.Rate
+			if rate == 0 {
+				rate = render.DefaultRate
+			}
+
+			var b bytes.Buffer
+			if err := wav.Encode(&b, rate, 2, render.Render(song, set)); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, b.Bytes())
+			jobs = append(jobs, render.Job{Input: input, Settings: set, Output: &bytes.Buffer{}})
+		}
+	}
+
+	var calls []render.Progress
+	pool := render.Pool{
+		Workers:  4,
+		Progress: func(p render.Progress) { calls = append(calls, p) },
+	}
+	if err := pool.Run(context.Background(), jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, job := range jobs {
+		if !bytes.Equal(job.Output.(*bytes.Buffer).Bytes(), want[i]) {
+			t.Errorf("%s %+v: output differs from a sequential render", job.Input, job.Settings)
+		}
+	}
+	if len(calls) != len(jobs) {
+		t.Fatalf("%d progress calls, want %d", len(calls), len(jobs))
+	}
+	for i, p := range calls {
+		if p.Done != i+1 || p.Total != len(jobs) || p.Err != nil {
+			t.Errorf("progress call %d: done %d of %d, error %v", i, p.Done, p.Total, p.Err)
+		}
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	jobs := []render.Job{
+		{Input: "../testdata/golden/dac.log", Settings: render.Settings{MaxLength: 0.02}, Output: &bytes.Buffer{}},
+		{Input: "missing.vgm", Output: &bytes.Buffer{}},
+	}
+	pool := render.Pool{Workers: 2}
+	err := pool.Run(context.Background(), jobs)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error %v, want a missing file", err)
+	}
+	if jobs[0].Output.(*bytes.Buffer).Len() == 0 {
+		t.Error("the job without error has no output")
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var once sync.Once
+	var jobs []render.Job
+	for range 4 {
+		for _, input := range poolInputs {
+			jobs = append(jobs, render.Job{Input: input, Settings: render.Settings{MaxLength: 0.1}, Output: &bytes.Buffer{}})
+		}
+	}
+
+	var finished int
+	pool := render.Pool{
+		Workers: 2,
+		Progress: func(p render.Progress) {
+			finished++
+			once.Do(cancel)
+		},
+	}
+	err := pool.Run(ctx, jobs)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want context.Canceled", err)
+	}
+	if finished >= len(jobs) {
+		t.Errorf("all %d jobs ran after the cancel", finished)
+	}
+}
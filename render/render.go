@@ -0,0 +1,374 @@
+// Package render renders register logs of any supported format to PCM.
+package render
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/gym"
+	"github.com/elemir/nukeykt/reglog"
+	"github.com/elemir/nukeykt/vgm"
+)
+
+// Format is the format of a song.
+type Format int
+
+const (
+	FormatVGM Format = iota
+	FormatGYM
+	FormatLog
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatVGM:
+		return "VGM"
+	case FormatGYM:
+		return "GYM"
+	case FormatLog:
+		return "register log"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Filter is the output filter model.
+type Filter int
+
+const (
+	// FilterLowPass is the single pole low pass of the original emulator.
+	FilterLowPass Filter = iota
+	FilterNone
+)
+
+// Mute bits of Settings.Mute, FM1 to FM6 are bits 0 to 5
+const (
+	MuteDAC = 1 << 6
+	MuteAll = 0x7f
+)
+
+const (
+	chunk = 4096
+
+	DefaultRate      = 44100
+	DefaultLoops     = 2
+	DefaultFade      = 8
+	DefaultTail      = 1
+	DefaultMaxLength = 20 * 60
+)
+
+var ErrUnknown = errors.New("render: unknown file format")
+
+// Settings configures rendering. Zero values select the defaults.
+type Settings struct {
+	Rate uint32
+	// Chip is KindYM2612 or KindYM3438, by default the chip the song was
+	// logged from or the YM2612.
+	Chip   nukeykt.Kind
+	Filter Filter
+	// Loops is how many times the looped part of a song is played before
+	// fading out, DefaultLoops if nil. With zero loops a looping song ends
+	// without a fade where it would jump back to its loop point.
+	Loops *int
+	// Fade is the fade out length of looping songs in seconds.
+	Fade float64
+	// Tail is how long the chip keeps running after a song that does not
+	// loop ends, in seconds.
+	Tail float64
+	// MaxLength caps the rendered length in seconds.
+	MaxLength float64
+	// Mute silences channels by bit.
+	Mute uint32
+	// Region is the console timing of GYM logs.
+	Region gym.Region
+	// Fast renders with the sample based engine, see nukeykt.Fast.
+	Fast bool
+}
+
+func (set Settings) withDefaults() Settings {
+	if set.Rate == 0 {
+		set.Rate = DefaultRate
+	}
+	if set.Loops == nil {
+		loops := DefaultLoops
+		set.Loops = &loops
+	}
+	if set.Fade == 0 {
+		set.Fade = DefaultFade
+	}
+	if set.Tail == 0 {
+		set.Tail = DefaultTail
+	}
+	if set.MaxLength == 0 {
+		set.MaxLength = DefaultMaxLength
+	}
+	return set
+}
+
+// Song is a loaded song of any format.
+type Song struct {
+	Format Format
+	VGM    *vgm.File
+	GYM    *gym.File
+	Log    *reglog.Log
+}
+
+// Tag is a named tag of a song.
+type Tag struct {
+	Name, Value string
+}
+
+// Source is a player of a song.
+type Source interface {
+	Generate(sndptr [][]int32, numsamples uint32)
+	Loops() int
+	Done() bool
+}
+
+// Load parses a song, choosing the format by file name or content.
+func Load(name string, data []byte) (*Song, error) {
+	format, ok := detect(name, data)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknown, name)
+	}
+
+	s := &Song{Format: format}
+	var err error
+	switch format {
+	case FormatVGM:
+		s.VGM, err = vgm.Parse(data)
+	case FormatGYM:
+		s.GYM, err = gym.Parse(data)
+	case FormatLog:
+		s.Log, err = reglog.Parse(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func detect(name string, data []byte) (Format, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".vgm", ".vgz":
+		return FormatVGM, true
+	case ".gym":
+		return FormatGYM, true
+	case ".log", ".txt":
+		return FormatLog, true
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("Vgm ")), bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		return FormatVGM, true
+	case bytes.HasPrefix(data, []byte("GYMX")):
+		return FormatGYM, true
+	}
+	return 0, false
+}
+
+// Tags returns the non-empty tags of the song.
+func (s *Song) Tags() []Tag {
+	var tags []Tag
+	add := func(name, value string) {
+		if value != "" {
+			tags = append(tags, Tag{name, value})
+		}
+	}
+
+	switch {
+	case s.VGM != nil && s.VGM.GD3 != nil:
+		g := s.VGM.GD3
+		add("Title", g.Title)
+		add("Title (JP)", g.TitleJP)
+		add("Game", g.Game)
+		add("Game (JP)", g.GameJP)
+		add("System", g.System)
+		add("System (JP)", g.SystemJP)
+		add("Author", g.Author)
+		add("Author (JP)", g.AuthorJP)
+		add("Date", g.Date)
+		add("Ripper", g.Ripper)
+		add("Notes", g.Notes)
+	case s.GYM != nil && s.GYM.Header != nil:
+		h := s.GYM.Header
+		add("Title", h.Title)
+		add("Game", h.Game)
+		add("Publisher", h.Publisher)
+		add("Emulator", h.Emulator)
+		add("Dumper", h.Dumper)
+		add("Comment", h.Comment)
+	}
+
+	return tags
+}
+
+// Kind returns the chip the song was logged from.
+func (s *Song) Kind() nukeykt.Kind {
+	if s.VGM != nil && s.VGM.Header.YM3438 {
+		return nukeykt.KindYM3438
+	}
+	return nukeykt.KindYM2612
+}
+
+// Clock returns the chip clock the song plays at.
+func (s *Song) Clock(set Settings) uint32 {
+	switch s.Format {
+	case FormatGYM:
+		return set.Region.Clock()
+	case FormatLog:
+		return s.Log.Clock
+	}
+	if s.VGM.Header.Clock != 0 {
+		return s.VGM.Header.Clock
+	}
+	return vgm.DefaultClock
+}
+
+// NewChip creates the chip selected by the settings.
+func (s *Song) NewChip(set Settings) *nukeykt.YM3438 {
+	kind := set.Chip
+	if kind == 0 {
+		kind = s.Kind()
+	}
+	if kind == nukeykt.KindYM3438 {
+		return nukeykt.NewYM3438()
+	}
+	return nukeykt.NewYM2612()
+}
+
+// newChip creates the chip selected by the settings, the fast engine if
+// they ask for it.
+func (s *Song) newChip(set Settings) nukeykt.Chip {
+	if !set.Fast {
+		return s.NewChip(set)
+	}
+	kind := set.Chip
+	if kind == 0 {
+		kind = s.Kind()
+	}
+	if kind == nukeykt.KindYM3438 {
+		return nukeykt.NewFastYM3438()
+	}
+	return nukeykt.NewFastYM2612()
+}
+
+// Player resets the chip and returns a player of the song rendering at the
+// settings rate.
+func (s *Song) Player(chip nukeykt.Chip, set Settings) Source {
+	set = set.withDefaults()
+
+	switch s.Format {
+	case FormatVGM:
+		return vgm.NewPlayer(s.VGM, chip, set.Rate)
+	case FormatGYM:
+		return gym.NewPlayer(s.GYM, chip, set.Region, set.Rate)
+	}
+	return reglog.NewPlayer(s.Log, chip, set.Rate)
+}
+
+// Render renders the song to interleaved stereo 16 bit samples. Looping
+// songs fade out after their loop count, others end after the tail.
+func Render(s *Song, set Settings) []int16 {
+	out, _ := render(context.Background(), s, set)
+	return out
+}
+
+// render is Render stopping with the context error when ctx is done.
+func render(ctx context.Context, s *Song, set Settings) ([]int16, error) {
+	set = set.withDefaults()
+
+	chip := s.newChip(set)
+	src := s.Player(chip, set)
+	for _, c := range s.chips(src, chip) {
+		if f, ok := c.(interface{ SetFilter(on bool) }); ok {
+			f.SetFilter(set.Filter == FilterLowPass)
+		}
+		switch c := c.(type) {
+		case *nukeykt.YM3438:
+			nukeykt.OPN2_SetMute(c, set.Mute)
+		case *nukeykt.Fast:
+			c.SetMute(set.Mute)
+		}
+	}
+	loops := s.loops(*set.Loops)
+
+	rate := float64(set.Rate)
+	maxLen := uint64(set.MaxLength * rate)
+	fadeLen := uint64(set.Fade * rate)
+	tailLen := uint64(set.Tail * rate)
+
+	var out []int16
+	var buf [2][]int32
+	buf[0] = make([]int32, chunk)
+	buf[1] = make([]int32, chunk)
+
+	next, _ := src.(interface{ Next() uint64 })
+
+	var total, end, fadeStart uint64
+	fading := false
+	end = maxLen
+	for total < end {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n := min(end-total, chunk)
+		if !fading && end == maxLen {
+			// Stop at the sample the player loops or ends at
+			if next != nil {
+				n = min(n, next.Next())
+			}
+			switch {
+			case loops == 0 && src.Loops() > 0:
+				end = total
+			case loops > 0 && src.Loops() >= loops:
+				fading = true
+				fadeStart = total
+				end = min(total+fadeLen, maxLen)
+			case src.Done():
+				end = min(total+tailLen, maxLen)
+			}
+			n = min(n, end-total)
+		}
+
+		src.Generate(buf[:], uint32(n))
+		for i := range n {
+			gain := 1.0
+			if fading {
+				gain = 1 - float64(total+i-fadeStart)/float64(fadeLen)
+			}
+			out = append(out, clip(buf[0][i], gain), clip(buf[1][i], gain))
+		}
+		total += n
+	}
+
+	return out, nil
+}
+
+// chips returns the chips a player renders through.
+func (s *Song) chips(src Source, chip nukeykt.Chip) []nukeykt.Chip {
+	if p, ok := src.(interface{ Chips() []nukeykt.Chip }); ok {
+		return p.Chips()
+	}
+	return []nukeykt.Chip{chip}
+}
+
+// loops applies the loop modifiers of VGM logs to a loop count.
+func (s *Song) loops(n int) int {
+	if s.VGM == nil || n == 0 {
+		return n
+	}
+	h := s.VGM.Header
+	return max(n*int(h.LoopModifier)/0x10-int(h.LoopBase), 1)
+}
+
+func clip(s int32, gain float64) int16 {
+	v := math.Round(float64(s) * gain)
+	return int16(min(max(v, math.MinInt16), math.MaxInt16))
+}
@@ -0,0 +1,43 @@
+package render_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/elemir/nukeykt/render"
+)
+
+// loopingVGM returns a VGM log of a second looping back to its start.
+func loopingVGM() []byte {
+	log := make([]byte, 0x40)
+	copy(log, "Vgm ")
+	binary.LittleEndian.PutUint32(log[0x08:], 0x150)
+	binary.LittleEndian.PutUint32(log[0x1c:], 0x40-0x1c)
+	binary.LittleEndian.PutUint32(log[0x2c:], 7670453)
+	binary.LittleEndian.PutUint32(log[0x34:], 0x40-0x34)
+	return append(log, 0x52, 0x28, 0x00, 0x61, 0x22, 0x56, 0x61, 0x22, 0x56, 0x66)
+}
+
+func TestRenderLoops(t *testing.T) {
+	song, err := render.Load("loop.vgm", loopingVGM())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zero, one := 0, 1
+	for _, tc := range []struct {
+		name  string
+		loops *int
+		want  int
+	}{
+		// The song ends or fades at the sample of its loop point
+		{"no loops", &zero, 44100},
+		{"one loop", &one, 44100 + render.DefaultFade*44100},
+		{"default", nil, (render.DefaultLoops + render.DefaultFade) * 44100},
+	} {
+		out := render.Render(song, render.Settings{Loops: tc.loops})
+		if n := len(out) / 2; n != tc.want {
+			t.Errorf("%s: rendered %d samples, want %d", tc.name, n, tc.want)
+		}
+	}
+}
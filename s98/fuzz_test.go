@@ -0,0 +1,34 @@
+package s98
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	log := make([]byte, headerSize+deviceSize)
+	copy(log, "S983")
+	binary.LittleEndian.PutUint32(log[0x14:], headerSize+deviceSize)
+	binary.LittleEndian.PutUint32(log[0x18:], headerSize+deviceSize)
+	binary.LittleEndian.PutUint32(log[0x1c:], 1)
+	binary.LittleEndian.PutUint32(log[headerSize:], uint32(DeviceOPN2))
+	binary.LittleEndian.PutUint32(log[headerSize+4:], 7670453)
+	log = append(log, 0x00, 0x28, 0xf0, CmdSync, CmdNSync, 0x05, 0x01, 0x30, 0x01, CmdEnd)
+	f.Add(log)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		p, err := NewPlayer(file, 8000)
+		if err != nil {
+			return
+		}
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package s98
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/elemir/nukeykt"
+)
+
+// Player renders an S98 log through a mixer of emulated chips.
+type Player struct {
+	file   *File
+	mixer  *nukeykt.Mixer
+	chips  []nukeykt.Chip
+	rate   uint32
+	pacers []*nukeykt.Pacer
+
+	pos      int
+	loops    int
+	done     bool
+	syncs    uint64
+	rendered uint64
+	left     uint64
+	out      [2][]int32
+}
+
+// NewPlayer creates a chip for every device of the log, panned as the device
+// table says, and returns a player rendering at the given rate. Writes to
+// devices without an emulator are skipped, and an error wrapping
+// nukeykt.ErrUnsupported is returned if no device has one.
+func NewPlayer(f *File, rate uint32) (*Player, error) {
+	p := &Player{
+		file:   f,
+		mixer:  nukeykt.NewMixer(rate),
+		chips:  make([]nukeykt.Chip, len(f.Devices)),
+		rate:   rate,
+		pacers: make([]*nukeykt.Pacer, len(f.Devices)),
+	}
+
+	for i, dev := range f.Devices {
+		kind, ok := dev.Type.Kind()
+		if !ok {
+			continue
+		}
+		chip, err := nukeykt.New(kind)
+		if err != nil {
+			continue
+		}
+		in := p.mixer.Add(chip, dev.Clock)
+		switch dev.Pan & (PanMuteLeft | PanMuteRight) {
+		case PanMuteLeft:
+			in.SetPan(1)
+		case PanMuteRight:
+			in.SetPan(-1)
+		case PanMuteLeft | PanMuteRight:
+			in.SetMute(true)
+		}
+		p.chips[i] = chip
+		p.pacers[i] = nukeykt.NewPacer(chip, dev.Clock, rate)
+	}
+	if len(p.mixer.Inputs()) == 0 {
+		return nil, fmt.Errorf("%w: no device of the log has an emulator", nukeykt.ErrUnsupported)
+	}
+
+	return p, nil
+}
+
+// Mixer returns the mixer the chips are rendered through.
+func (p *Player) Mixer() *nukeykt.Mixer {
+	return p.mixer
+}
+
+// Chips returns the chip of each device, nil for unsupported devices.
+func (p *Player) Chips() []nukeykt.Chip {
+	return p.chips
+}
+
+// Loops returns how many times playback jumped to the loop point.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether all commands of a non-looping log were played and
+// their writes given to the chips.
+func (p *Player) Done() bool {
+	if !p.done {
+		return false
+	}
+	for _, pacer := range p.pacers {
+		if pacer != nil && pacer.Pending() {
+			return false
+		}
+	}
+	return true
+}
+
+// Next runs the commands due at the current sample and returns how many
+// samples render before the next ones, so a renderer can stop exactly where
+// the log loops or ends.
+func (p *Player) Next() uint64 {
+	if p.left == 0 {
+		p.step()
+	}
+	return p.left
+}
+
+// Generate renders numsamples stereo samples.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		if p.left == 0 {
+			p.step()
+		}
+		n := min(p.left, uint64(numsamples)-off, p.flush())
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.mixer.Generate(p.out[:], uint32(n))
+		p.left -= n
+		p.rendered += n
+		off += n
+	}
+}
+
+// step runs commands up to the next wait and computes its length.
+func (p *Player) step() {
+	data := p.file.Data
+	wrapped := false
+
+	for !p.done {
+		if p.pos >= len(data) || data[p.pos] == CmdEnd {
+			if p.file.Loop < 0 || wrapped {
+				p.done = true
+				break
+			}
+			p.pos = p.file.Loop
+			p.loops++
+			wrapped = true
+			continue
+		}
+
+		switch cmd := data[p.pos]; {
+		case cmd == CmdSync:
+			p.pos++
+			p.wait(1)
+			return
+		case cmd == CmdNSync:
+			n, size := varint(data[p.pos+1:])
+			p.pos += 1 + size
+			p.wait(n + 2)
+			return
+		case cmd < 0x80:
+			if p.pos+3 > len(data) {
+				p.pos = len(data)
+				continue
+			}
+			p.write(int(cmd>>1), uint32(cmd&1), data[p.pos+1], data[p.pos+2])
+			p.pos += 3
+		default:
+			p.pos++
+		}
+	}
+
+	// Nothing is left to wait for
+	p.left = math.MaxUint64
+}
+
+func (p *Player) write(dev int, port uint32, addr, data uint8) {
+	if dev >= len(p.chips) || p.chips[dev] == nil {
+		return
+	}
+	p.pacers[dev].Write(port<<1, addr, data)
+}
+
+// flush gives the chips the pending writes due by now and returns how many
+// samples can be rendered before the next one is due.
+func (p *Player) flush() uint64 {
+	next := uint64(math.MaxUint64)
+	for _, pacer := range p.pacers {
+		if pacer != nil {
+			next = min(next, pacer.Flush(p.rendered))
+		}
+	}
+	return next
+}
+
+func (p *Player) wait(syncs uint64) {
+	p.syncs += syncs
+	hi, lo := bits.Mul64(p.syncs, uint64(p.file.TimerNum)*uint64(p.rate))
+	if hi >= uint64(p.file.TimerDen) {
+		p.left = math.MaxUint64
+		return
+	}
+	end, _ := bits.Div64(hi, lo, uint64(p.file.TimerDen))
+	p.left = end - p.rendered
+}
+
+// varint decodes the little endian base 128 length of CmdNSync.
+func varint(b []byte) (uint64, int) {
+	var n uint64
+	for i, c := range b {
+		if i >= 9 {
+			return n, i
+		}
+		n |= uint64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return n, i + 1
+		}
+	}
+	return n, len(b)
+}
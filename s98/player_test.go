@@ -0,0 +1,205 @@
+package s98
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// logChip records the port writes it is given and the sample they are given
+// before.
+type logChip struct {
+	nukeykt.Chip
+	rendered uint64
+	writes   []logWrite
+}
+
+type logWrite struct {
+	sample uint64
+	port   uint32
+	data   uint8
+}
+
+func (c *logChip) Reset(rate, clock uint32) {}
+
+func (c *logChip) Write(port uint32, data uint8) {
+	c.writes = append(c.writes, logWrite{c.rendered, port, data})
+}
+
+func (c *logChip) Generate(sndptr [][]int32, numsamples uint32) {
+	c.rendered += uint64(numsamples)
+}
+
+// s98 builds a version 3 log of the given devices.
+func s98(num, den uint32, devices []Device, data ...byte) []byte {
+	size := headerSize + len(devices)*deviceSize
+	log := make([]byte, size)
+	copy(log, "S983")
+	binary.LittleEndian.PutUint32(log[0x04:], num)
+	binary.LittleEndian.PutUint32(log[0x08:], den)
+	binary.LittleEndian.PutUint32(log[0x14:], uint32(size))
+	binary.LittleEndian.PutUint32(log[0x1c:], uint32(len(devices)))
+	for i, dev := range devices {
+		b := log[headerSize+i*deviceSize:]
+		binary.LittleEndian.PutUint32(b, uint32(dev.Type))
+		binary.LittleEndian.PutUint32(b[4:], dev.Clock)
+		binary.LittleEndian.PutUint32(b[8:], dev.Pan)
+	}
+	return append(log, data...)
+}
+
+func TestParseErrors(t *testing.T) {
+	opn2 := []Device{{Type: DeviceOPN2, Clock: 7670453}}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"magic", []byte("S99")},
+		{"clock zero", s98(0, 0, []Device{{Type: DeviceOPN2}})},
+		{"clock too fast", s98(0, 0, []Device{{Type: DeviceOPN2, Clock: MaxClock + 1}})},
+		{"timer too fast", s98(1, 10000000, opn2)},
+		{"device count", s98(0, 0, opn2)[:headerSize]},
+	} {
+		if _, err := Parse(tc.data); !errors.Is(err, ErrFormat) {
+			t.Errorf("%s: error %v, want ErrFormat", tc.name, err)
+		}
+	}
+}
+
+func TestPlayerPan(t *testing.T) {
+	for _, tc := range []struct {
+		pan  uint32
+		want float64
+		mute bool
+	}{
+		{0, 0, false},
+		{PanMuteLeft, 1, false},
+		{PanMuteRight, -1, false},
+		{PanMuteLeft | PanMuteRight, 0, true},
+	} {
+		file, err := Parse(s98(0, 0, []Device{{Type: DeviceOPN2, Clock: 7670453, Pan: tc.pan}}, CmdEnd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewPlayer(file, 44100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := p.Mixer().Inputs()[0]
+		if in.Pan() != tc.want || in.Muted() != tc.mute {
+			t.Errorf("pan %d: mixed at %v, muted %v, want %v, %v", tc.pan, in.Pan(), in.Muted(), tc.want, tc.mute)
+		}
+	}
+}
+
+func TestPlayerUnsupported(t *testing.T) {
+	// Version 1 logs are for the OPNA
+	log := make([]byte, headerSize)
+	copy(log, "S981")
+	binary.LittleEndian.PutUint32(log[0x14:], headerSize)
+	file, err := Parse(append(log, CmdEnd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Devices) != 1 || file.Devices[0] != (Device{Type: DeviceOPNA, Clock: DefaultClock}) {
+		t.Fatalf("devices %+v", file.Devices)
+	}
+	if _, err := NewPlayer(file, 44100); !errors.Is(err, nukeykt.ErrUnsupported) {
+		t.Errorf("error %v, want ErrUnsupported", err)
+	}
+
+	// Devices without an emulator are skipped
+	file, err = Parse(s98(0, 0, []Device{{Type: DevicePSG, Clock: 4000000}, {Type: DeviceOPN2, Clock: 7670453}},
+		0x00, 0x07, 0x38, 0x02, 0x28, 0xf0, CmdSync, CmdEnd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPlayer(file, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chips := p.Chips(); chips[0] != nil || chips[1] == nil {
+		t.Errorf("chips %v", chips)
+	}
+	buf := [][]int32{make([]int32, 1024), make([]int32, 1024)}
+	p.Generate(buf, 1024)
+	if !p.Done() {
+		t.Error("player not done")
+	}
+}
+
+func TestPlayerTiming(t *testing.T) {
+	// Two syncs of a millisecond, then 2+3 syncs
+	data := []byte{CmdSync, CmdSync, 0x00, 0x28, 0xf0, CmdNSync, 0x03, CmdEnd}
+	file, err := Parse(s98(1, 1000, []Device{{Type: DeviceOPN2, Clock: 7670453}}, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPlayer(file, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := [][]int32{make([]int32, 7*48), make([]int32, 7*48)}
+	p.Generate(buf, 7*48)
+	if p.Done() {
+		t.Error("player done before the last wait")
+	}
+	// The end is reached with the next sample
+	p.Generate(buf, 1)
+	if !p.Done() {
+		t.Error("player not done after the last wait")
+	}
+}
+
+// TestPlayerPacing plays a sync with more writes than the chip write buffer
+// holds. The writes are given to the chip no faster than its buffer drains.
+func TestPlayerPacing(t *testing.T) {
+	chip := &logChip{}
+	defer nukeykt.Register(nukeykt.KindYM2612, func() nukeykt.Chip { return nukeykt.NewYM2612() })
+	nukeykt.Register(nukeykt.KindYM2612, func() nukeykt.Chip { return chip })
+
+	const count = 3 * nukeykt.OPN_WRITEBUF_SIZE
+	var data []byte
+	for i := range count {
+		data = append(data, 0x00, 0x30+byte(i%16), byte(i))
+	}
+	data = append(data, CmdSync, 0x01, 0x28, 0x01, CmdEnd)
+
+	const clock, rate = 7670453, 44100
+	file, err := Parse(s98(1, 1000, []Device{{Type: DeviceOPN2, Clock: clock}}, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPlayer(file, rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+	for !p.Done() {
+		p.Generate(buf, 64)
+	}
+
+	if len(chip.writes) != 2*count+2 {
+		t.Fatalf("%d writes, want %d", len(chip.writes), 2*count+2)
+	}
+	for i, w := range chip.writes[:2*count] {
+		if w.port != uint32(i&1) || w.data != [2]byte{0x30 + byte(i/2%16), byte(i / 2)}[i&1] {
+			t.Fatalf("write %d is %+v", i, w)
+		}
+		// Writes queued ahead of the cycles clocked fit in the buffer
+		cycle := w.sample * clock / (6 * rate)
+		if queued := i - int(cycle/nukeykt.OPN_WRITEBUF_DELAY); queued > nukeykt.OPN_WRITEBUF_SIZE {
+			t.Fatalf("write %d at sample %d with %d writes queued", i, w.sample, queued)
+		}
+	}
+	// The burst takes longer than the sync, the next write follows it
+	end := chip.writes[2*count-1].sample
+	if end < rate/1000 {
+		t.Errorf("paced writes end at sample %d, within the sync", end)
+	}
+	if last := chip.writes[len(chip.writes)-1]; last.sample < end || last.port != 3 {
+		t.Errorf("last write %+v", last)
+	}
+}
@@ -0,0 +1,202 @@
+// Package s98 reads and plays S98 register logs.
+package s98
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/elemir/nukeykt"
+)
+
+const (
+	CmdSync  = 0xff // Wait for one sync
+	CmdNSync = 0xfe // Wait for n+2 syncs, n is a variable length integer
+	CmdEnd   = 0xfd // End of data or jump to the loop point
+
+	DefaultTimerNum = 10
+	DefaultTimerDen = 1000
+
+	// Clock of the OPNA assumed when no devices are listed
+	DefaultClock = 7987200
+	// MaxClock is the fastest device clock accepted
+	MaxClock = 50000000
+
+	headerSize = 0x20
+	deviceSize = 0x10
+)
+
+var ErrFormat = errors.New("s98: invalid file")
+
+// DeviceType is the type of a chip listed in the device table.
+type DeviceType uint32
+
+const (
+	DeviceNone DeviceType = 0
+	DevicePSG  DeviceType = 1 // YM2149
+	DeviceOPN  DeviceType = 2 // YM2203
+	DeviceOPN2 DeviceType = 3 // YM2612
+	DeviceOPNA DeviceType = 4 // YM2608
+	DeviceOPM  DeviceType = 5 // YM2151
+	DeviceOPLL DeviceType = 6 // YM2413
+	DeviceOPL  DeviceType = 7 // YM3526
+	DeviceOPL2 DeviceType = 8 // YM3812
+	DeviceOPL3 DeviceType = 9 // YMF262
+	DeviceAY   DeviceType = 15
+	DeviceDCSG DeviceType = 16 // SN76489
+)
+
+var deviceKinds = map[DeviceType]nukeykt.Kind{
+	DevicePSG:  nukeykt.KindAY8910,
+	DeviceOPN:  nukeykt.KindYM2203,
+	DeviceOPN2: nukeykt.KindYM2612,
+	DeviceOPNA: nukeykt.KindYM2608,
+	DeviceOPM:  nukeykt.KindYM2151,
+	DeviceAY:   nukeykt.KindAY8910,
+	DeviceDCSG: nukeykt.KindSN76489,
+}
+
+// Kind returns the chip kind of the device.
+func (t DeviceType) Kind() (nukeykt.Kind, bool) {
+	kind, ok := deviceKinds[t]
+	return kind, ok
+}
+
+// Pan bits of a device
+const (
+	PanMuteLeft  = 1 << 0
+	PanMuteRight = 1 << 1
+)
+
+// Device is an entry of the device table.
+type Device struct {
+	Type  DeviceType
+	Clock uint32
+	Pan   uint32
+}
+
+// File is a parsed S98 log.
+type File struct {
+	Version  int
+	TimerNum uint32
+	TimerDen uint32
+	Devices  []Device
+	Tags     map[string]string
+	// Data is the command stream.
+	Data []byte
+	// Loop is the offset of the loop point in Data or -1.
+	Loop int
+}
+
+// Parse parses an S98 log of version 1, 2 or 3.
+func Parse(data []byte) (*File, error) {
+	if len(data) < headerSize || !bytes.HasPrefix(data, []byte("S98")) {
+		return nil, fmt.Errorf("%w: bad magic", ErrFormat)
+	}
+
+	f := &File{
+		Version:  int(data[3] - '0'),
+		TimerNum: binary.LittleEndian.Uint32(data[0x04:]),
+		TimerDen: binary.LittleEndian.Uint32(data[0x08:]),
+		Loop:     -1,
+	}
+	if f.Version < 1 || f.Version > 3 {
+		return nil, fmt.Errorf("%w: unknown version %q", ErrFormat, data[3])
+	}
+	if binary.LittleEndian.Uint32(data[0x0c:]) != 0 {
+		return nil, fmt.Errorf("%w: compressed logs are not supported", ErrFormat)
+	}
+	if f.TimerNum == 0 {
+		f.TimerNum = DefaultTimerNum
+	}
+	if f.TimerDen == 0 {
+		f.TimerDen = DefaultTimerDen
+	}
+	// Syncs shorter than a microsecond would take longer to play than to
+	// render
+	if uint64(f.TimerNum)*1000000 < uint64(f.TimerDen) {
+		return nil, fmt.Errorf("%w: timer %d/%d too fast", ErrFormat, f.TimerNum, f.TimerDen)
+	}
+
+	tagOffset := binary.LittleEndian.Uint32(data[0x10:])
+	dataOffset := binary.LittleEndian.Uint32(data[0x14:])
+	loopOffset := binary.LittleEndian.Uint32(data[0x18:])
+	if dataOffset < headerSize || dataOffset > uint32(len(data)) {
+		return nil, fmt.Errorf("%w: bad data offset", ErrFormat)
+	}
+
+	switch f.Version {
+	case 2:
+		for pos := uint32(headerSize); pos+deviceSize <= dataOffset; pos += deviceSize {
+			dev := device(data[pos:])
+			if dev.Type == DeviceNone {
+				break
+			}
+			f.Devices = append(f.Devices, dev)
+		}
+	case 3:
+		count := binary.LittleEndian.Uint32(data[0x1c:])
+		if headerSize+uint64(count)*deviceSize > uint64(dataOffset) {
+			return nil, fmt.Errorf("%w: bad device count", ErrFormat)
+		}
+		for i := range count {
+			f.Devices = append(f.Devices, device(data[headerSize+i*deviceSize:]))
+		}
+	}
+	if len(f.Devices) == 0 {
+		f.Devices = []Device{{Type: DeviceOPNA, Clock: DefaultClock}}
+	}
+	for i, dev := range f.Devices {
+		if dev.Clock == 0 || dev.Clock > MaxClock {
+			return nil, fmt.Errorf("%w: device %d clock %d", ErrFormat, i, dev.Clock)
+		}
+	}
+
+	end := uint32(len(data))
+	if tagOffset > dataOffset && tagOffset < end {
+		end = tagOffset
+	}
+	f.Data = data[dataOffset:end]
+	if loopOffset != 0 {
+		if loopOffset < dataOffset || loopOffset >= end {
+			return nil, fmt.Errorf("%w: bad loop offset", ErrFormat)
+		}
+		f.Loop = int(loopOffset - dataOffset)
+	}
+	if tagOffset != 0 && tagOffset < uint32(len(data)) {
+		f.Tags = tags(data[tagOffset:], f.Version)
+	}
+
+	return f, nil
+}
+
+func device(b []byte) Device {
+	return Device{
+		Type:  DeviceType(binary.LittleEndian.Uint32(b)),
+		Clock: binary.LittleEndian.Uint32(b[4:]),
+		Pan:   binary.LittleEndian.Uint32(b[8:]),
+	}
+}
+
+// tags parses the "[S98]" key=value list of version 3 logs. Older versions
+// only store a title.
+func tags(b []byte, version int) map[string]string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	if version < 3 || !bytes.HasPrefix(b, []byte("[S98]")) {
+		return map[string]string{"title": string(b)}
+	}
+
+	b = bytes.TrimPrefix(b[5:], []byte("\xef\xbb\xbf"))
+	res := map[string]string{}
+	for line := range strings.SplitSeq(string(b), "\n") {
+		key, value, ok := strings.Cut(strings.TrimRight(line, "\r"), "=")
+		if ok {
+			res[strings.ToLower(key)] = value
+		}
+	}
+	return res
+}
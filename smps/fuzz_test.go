@@ -0,0 +1,43 @@
+package smps
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzParse(f *testing.F) {
+	// One FM track with a voice, a note and a jump back to the note
+	f.Add([]byte{
+		0x00, 0x1f, 0x02, 0x00, 0x01, 0x02,
+		0x00, 0x0e, 0x00, 0x00, 0x00, 0x0e, 0x00, 0x00,
+		0xef, 0x00, 0xa1, 0x10, 0xf6, 0xff, 0xfc,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x3a, 0x01, 0x07, 0x01, 0x01, 0x8e, 0x8e, 0x8d, 0x53, 0x0e, 0x0e, 0x0e,
+		0x03, 0x00, 0x00, 0x00, 0x00, 0x1f, 0xff, 0x1f, 0x0f, 0x17, 0x28, 0x27, 0x80,
+	}, false)
+
+	f.Fuzz(func(t *testing.T, data []byte, z80 bool) {
+		variant := Variant68k
+		if z80 {
+			variant = VariantZ80
+		}
+		s, err := Parse(data, variant, 0)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(s.Bytes(), data) {
+			t.Fatal("Bytes changed an unedited song")
+		}
+
+		p, err := NewPlayer(s, nukeykt.NewYM2612(), 7670453, 8000, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
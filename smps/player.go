@@ -0,0 +1,558 @@
+package smps
+
+import (
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/internal/driver"
+)
+
+// TempoMode selects how the main tempo slows down the frame updates.
+type TempoMode int
+
+const (
+	// TempoTimeout counts the tempo down every frame and delays all tracks
+	// by a frame when it expires (Sonic 1).
+	TempoTimeout TempoMode = iota
+	// TempoOverflow adds the tempo to an accumulator every frame and updates
+	// the tracks only when it overflows (Sonic 3 & Knuckles).
+	TempoOverflow
+	// TempoOverflow2 adds the tempo to an accumulator every frame and skips
+	// the track update when it overflows (Sonic 2).
+	TempoOverflow2
+)
+
+// Coordination flags
+const (
+	cfPan          = 0xe0
+	cfDetune       = 0xe1
+	cfComm         = 0xe2
+	cfReturn       = 0xe3
+	cfFadeIn       = 0xe4
+	cfTickMult     = 0xe5
+	cfVolume       = 0xe6
+	cfHold         = 0xe7
+	cfNoteFill     = 0xe8
+	cfTranspose    = 0xe9
+	cfTempo        = 0xea
+	cfTickMultAll  = 0xeb
+	cfPSGVolume    = 0xec
+	cfClearPush    = 0xed
+	cfStopFM4      = 0xee
+	cfVoice        = 0xef
+	cfModSetup     = 0xf0
+	cfModOn        = 0xf1
+	cfStop         = 0xf2
+	cfPSGNoise     = 0xf3
+	cfModOff       = 0xf4
+	cfPSGTone      = 0xf5
+	cfJump         = 0xf6
+	cfLoop         = 0xf7
+	cfCall         = 0xf8
+	cfSilence      = 0xf9
+	noteRest       = 0x80
+	noteFirst      = 0x81
+	coordFirst     = 0xe0
+	defaultDACRate = 22050
+	defaultFPS     = 60
+
+	// Tracks reading more flags without a note or duration, or nesting more
+	// calls, would hang or overflow the driver and are stopped
+	maxCoords    = 1024
+	maxCallDepth = 16
+)
+
+// Parameter bytes of the coordination flags
+var cfParams = [32]int{
+	1, 1, 1, 0, 0, 1, 1, 0, 1, 1, 1, 1, 1, 0, 0, 1,
+	4, 0, 0, 1, 0, 1, 2, 4, 2, 0, 0, 0, 0, 0, 0, 0,
+}
+
+// FM frequencies of an octave starting at C, SMPS uses its own table
+var fmFreqs = [12]uint16{
+	0x25e, 0x284, 0x2ab, 0x2d3, 0x2fe, 0x32d, 0x35c, 0x38f, 0x3c5, 0x3ff, 0x43c, 0x47c,
+}
+
+type trackKind int
+
+const (
+	trackDAC trackKind = iota
+	trackFM
+	trackPSG
+)
+
+type track struct {
+	kind    trackKind
+	fm      int
+	pos     int
+	playing bool
+
+	transpose int8
+	volume    int8
+	tickMult  uint8
+	voice     []byte
+	pan       uint8
+
+	duration uint8
+	timeout  int
+	fill     uint8
+	fillCnt  uint8
+	freq     uint16
+	detune   int8
+	hold     bool
+	keyed    bool
+
+	stack []int
+	loops [256]uint8
+
+	modOn    bool
+	mod      [4]uint8
+	modWait  uint8
+	modSpeed uint8
+	modDelta int8
+	modSteps uint8
+	modAccum int16
+}
+
+// Options configures a Player.
+type Options struct {
+	Tempo TempoMode
+	// Samples maps DAC notes (0x81 and up) to samples.
+	Samples map[uint8]*nukeykt.PCM
+	// DACRate is the rate DAC samples are streamed at, 22050 by default.
+	DACRate uint32
+	// FrameRate is the rate of driver updates, 60 by default.
+	FrameRate uint32
+}
+
+// Player interprets a song, driving an OPN2. PSG tracks are interpreted for
+// timing but not rendered.
+type Player struct {
+	song *Song
+	chip *nukeykt.YM3438
+	dac  *nukeykt.DACStream
+	opts Options
+	rate uint32
+
+	tracks   []*track
+	tempo    uint8
+	tempoCnt uint8
+	tempoAcc uint8
+	loops    int
+
+	frames   uint64
+	rendered uint64
+	left     uint64
+	out      [2][]int32
+}
+
+// NewPlayer resets the chip with the given clock and output rate and returns
+// a player for the song. It fails if the chip cannot stream the DAC rate.
+func NewPlayer(s *Song, chip *nukeykt.YM3438, clock, rate uint32, opts Options) (*Player, error) {
+	if opts.DACRate == 0 {
+		opts.DACRate = defaultDACRate
+	}
+	if opts.FrameRate == 0 {
+		opts.FrameRate = defaultFPS
+	}
+
+	chip.Reset(rate, clock)
+	dac, err := nukeykt.NewDACStream(chip, opts.DACRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	p := &Player{
+		song:     s,
+		chip:     chip,
+		dac:      dac,
+		opts:     opts,
+		rate:     rate,
+		tempo:    s.Tempo,
+		tempoCnt: s.Tempo,
+	}
+
+	p.write(0, 0x22, 0x00)
+	p.write(0, 0x27, 0x00)
+	p.write(0, 0x2b, 0x00)
+	for fm := range driver.FMChannels {
+		p.write(0, 0x28, driver.KeyChannel(fm))
+	}
+
+	p.addTrack(trackDAC, 0, s.DAC)
+	for i, t := range s.FM {
+		p.addTrack(trackFM, i, t)
+	}
+	for i, t := range s.PSG {
+		p.addTrack(trackPSG, i, t)
+	}
+
+	return p, nil
+}
+
+func (p *Player) addTrack(kind trackKind, fm int, t Track) {
+	if kind == trackFM && fm >= driver.FMChannels {
+		return
+	}
+	p.tracks = append(p.tracks, &track{
+		kind:      kind,
+		fm:        fm,
+		pos:       p.song.offset(t.Pointer),
+		playing:   true,
+		transpose: t.Transpose,
+		volume:    t.Volume,
+		tickMult:  p.song.TempoDivider,
+		pan:       0xc0,
+		timeout:   1,
+	})
+}
+
+// Loops returns how many times the first playing track jumped back.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether all tracks stopped.
+func (p *Player) Done() bool {
+	for _, t := range p.tracks {
+		if t.playing {
+			return false
+		}
+	}
+	return true
+}
+
+// Generate renders numsamples stereo samples.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		if p.left == 0 {
+			p.frame()
+			p.frames++
+			p.left = p.frames*uint64(p.rate)/uint64(p.opts.FrameRate) - p.rendered
+		}
+		n := min(p.left, uint64(numsamples)-off)
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.dac.Generate(p.out[:], uint32(n))
+		p.left -= n
+		p.rendered += n
+		off += n
+	}
+}
+
+// frame runs one driver update.
+func (p *Player) frame() {
+	switch p.opts.Tempo {
+	case TempoTimeout:
+		p.tempoCnt--
+		if p.tempoCnt == 0 {
+			p.tempoCnt = p.tempo
+			for _, t := range p.tracks {
+				t.timeout++
+			}
+		}
+	case TempoOverflow:
+		acc := uint16(p.tempoAcc) + uint16(p.tempo)
+		p.tempoAcc = uint8(acc)
+		if acc < 0x100 {
+			return
+		}
+	case TempoOverflow2:
+		acc := uint16(p.tempoAcc) + uint16(p.tempo)
+		p.tempoAcc = uint8(acc)
+		if acc >= 0x100 {
+			return
+		}
+	}
+
+	for _, t := range p.tracks {
+		if t.playing {
+			p.update(t)
+		}
+	}
+}
+
+func (p *Player) update(t *track) {
+	t.timeout--
+	if t.timeout > 0 {
+		if t.fill != 0 && t.fillCnt != 0 {
+			t.fillCnt--
+			if t.fillCnt == 0 {
+				p.keyOff(t)
+			}
+		}
+		if p.modulate(t) {
+			p.writeFreq(t)
+		}
+		return
+	}
+
+	data := p.song.Data
+	b, ok := p.next(t)
+	for n := 0; ok && b >= coordFirst; n++ {
+		if n == maxCoords {
+			ok = false
+			break
+		}
+		p.coord(t, b)
+		if !t.playing {
+			return
+		}
+		b, ok = p.next(t)
+	}
+	if !ok {
+		t.playing = false
+		p.keyOff(t)
+		return
+	}
+
+	if !t.hold {
+		p.keyOff(t)
+	}
+	if b >= noteRest {
+		p.note(t, b)
+		if t.pos < len(data) && data[t.pos] < noteRest {
+			t.duration = data[t.pos]
+			t.pos++
+		}
+	} else {
+		t.duration = b
+	}
+	t.timeout = int(t.duration) * int(max(t.tickMult, 1))
+	if t.timeout == 0 {
+		t.timeout = 256 * int(max(t.tickMult, 1))
+	}
+	t.fillCnt = t.fill
+
+	if !t.hold {
+		t.modWait = t.mod[0]
+		t.modSpeed = t.mod[1]
+		t.modDelta = int8(t.mod[2])
+		t.modSteps = t.mod[3] / 2
+		t.modAccum = 0
+		p.writeFreq(t)
+		p.keyOn(t)
+	}
+	t.hold = false
+}
+
+func (p *Player) next(t *track) (uint8, bool) {
+	if t.pos < 0 || t.pos >= len(p.song.Data) {
+		return 0, false
+	}
+	b := p.song.Data[t.pos]
+	t.pos++
+	return b, true
+}
+
+func (p *Player) note(t *track, b uint8) {
+	if b == noteRest {
+		t.freq = 0
+		return
+	}
+
+	switch t.kind {
+	case trackDAC:
+		t.freq = 0
+		if pcm, ok := p.opts.Samples[b]; ok {
+			p.dac.Play(0, pcm, 1, false)
+		}
+	case trackFM:
+		idx := max(int(b)-noteFirst+int(t.transpose), 0)
+		octave := min(idx/12, 7)
+		t.freq = uint16(octave)<<11 | fmFreqs[idx%12]
+	case trackPSG:
+		t.freq = uint16(b)
+	}
+}
+
+func (p *Player) coord(t *track, cf uint8) {
+	data := p.song.Data
+	n := cfParams[cf-coordFirst]
+	if t.pos+n > len(data) {
+		t.playing = false
+		return
+	}
+	args := data[t.pos : t.pos+n]
+	t.pos += n
+
+	switch cf {
+	case cfPan:
+		t.pan = args[0]&0xc0 | t.pan&0x37
+		p.writePan(t)
+	case cfDetune:
+		t.detune = int8(args[0])
+	case cfReturn:
+		if len(t.stack) == 0 {
+			t.playing = false
+			return
+		}
+		t.pos = t.stack[len(t.stack)-1]
+		t.stack = t.stack[:len(t.stack)-1]
+	case cfFadeIn, cfStop:
+		t.playing = false
+		p.keyOff(t)
+	case cfTickMult:
+		t.tickMult = args[0]
+	case cfVolume:
+		t.volume += int8(args[0])
+		p.writeLevel(t)
+	case cfHold:
+		t.hold = true
+	case cfNoteFill:
+		t.fill = args[0]
+	case cfTranspose:
+		t.transpose += int8(args[0])
+	case cfTempo:
+		p.tempo = args[0]
+		p.tempoCnt = args[0]
+	case cfTickMultAll:
+		for _, o := range p.tracks {
+			o.tickMult = args[0]
+		}
+	case cfVoice:
+		if t.kind == trackFM {
+			if voice, ok := p.song.Voice(args[0]); ok {
+				t.voice = voice
+				p.loadVoice(t)
+			}
+		}
+	case cfModSetup:
+		copy(t.mod[:], args)
+		t.modOn = true
+	case cfModOn:
+		t.modOn = true
+	case cfModOff:
+		t.modOn = false
+	case cfJump:
+		target := p.song.jump(t.pos - 2)
+		if target < t.pos && p.isFirst(t) {
+			p.loops++
+		}
+		t.pos = target
+	case cfLoop:
+		idx := args[0]
+		if t.loops[idx] == 0 {
+			t.loops[idx] = args[1]
+		}
+		t.loops[idx]--
+		if t.loops[idx] != 0 {
+			t.pos = p.song.jump(t.pos - 2)
+		}
+	case cfCall:
+		if len(t.stack) == maxCallDepth {
+			t.playing = false
+			p.keyOff(t)
+			return
+		}
+		t.stack = append(t.stack, t.pos)
+		t.pos = p.song.jump(t.pos - 2)
+	case cfSilence:
+		if t.kind == trackFM {
+			for op := range 4 {
+				p.writeCh(t, 0x80+uint8(op*4), 0x0f)
+			}
+		}
+	}
+}
+
+func (p *Player) isFirst(t *track) bool {
+	for _, o := range p.tracks {
+		if o.playing {
+			return o == t
+		}
+	}
+	return false
+}
+
+// modulate advances the modulation and reports whether the frequency changed.
+func (p *Player) modulate(t *track) bool {
+	if !t.modOn || t.freq == 0 || t.mod[1] == 0 {
+		return false
+	}
+	if t.modWait > 0 {
+		t.modWait--
+		return false
+	}
+	t.modSpeed--
+	if t.modSpeed > 0 {
+		return false
+	}
+	t.modSpeed = t.mod[1]
+	if t.modSteps == 0 {
+		t.modSteps = t.mod[3]
+		t.modDelta = -t.modDelta
+		return false
+	}
+	t.modSteps--
+	t.modAccum += int16(t.modDelta)
+	return true
+}
+
+func (p *Player) loadVoice(t *track) {
+	v := t.voice
+	p.writeCh(t, 0xb0, v[0])
+	for op := range 4 {
+		off := uint8(op * 4)
+		p.writeCh(t, 0x30+off, v[1+op])
+		p.writeCh(t, 0x50+off, v[5+op])
+		p.writeCh(t, 0x60+off, v[9+op])
+		p.writeCh(t, 0x70+off, v[13+op])
+		p.writeCh(t, 0x80+off, v[17+op])
+	}
+	p.writeLevel(t)
+	p.writePan(t)
+}
+
+// writeLevel adds the track volume to the total level of the carriers.
+func (p *Player) writeLevel(t *track) {
+	if t.kind != trackFM || t.voice == nil {
+		return
+	}
+	mask := driver.Carriers[t.voice[0]&0x07]
+	for op := range 4 {
+		tl := int(t.voice[21+op] & 0x7f)
+		if mask&(1<<op) != 0 {
+			tl = min(max(tl+int(t.volume), 0), 0x7f)
+		}
+		p.writeCh(t, 0x40+uint8(op*4), uint8(tl))
+	}
+}
+
+func (p *Player) writePan(t *track) {
+	if t.kind == trackFM {
+		p.writeCh(t, 0xb4, t.pan)
+	}
+}
+
+func (p *Player) writeFreq(t *track) {
+	if t.kind != trackFM || t.freq == 0 {
+		return
+	}
+	freq := uint16(int16(t.freq) + int16(t.detune) + t.modAccum)
+	p.writeCh(t, 0xa4, uint8(freq>>8)&0x3f)
+	p.writeCh(t, 0xa0, uint8(freq))
+}
+
+func (p *Player) keyOn(t *track) {
+	if t.kind == trackFM && t.freq != 0 && t.voice != nil {
+		t.keyed = true
+		p.write(0, 0x28, 0xf0|driver.KeyChannel(t.fm))
+	}
+}
+
+func (p *Player) keyOff(t *track) {
+	if t.kind == trackFM && t.keyed {
+		t.keyed = false
+		p.write(0, 0x28, driver.KeyChannel(t.fm))
+	}
+}
+
+func (p *Player) writeCh(t *track, reg, data uint8) {
+	ch := driver.KeyChannel(t.fm)
+	p.write(uint32(ch>>2), reg+ch&0x03, data)
+}
+
+func (p *Player) write(port uint32, addr, data uint8) {
+	nukeykt.OPN2_WriteBuffered(p.chip, port<<1, addr)
+	nukeykt.OPN2_WriteBuffered(p.chip, port<<1|1, data)
+}
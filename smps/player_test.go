@@ -0,0 +1,52 @@
+package smps
+
+import (
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// song68k returns a song with a single DAC track made of the given bytes.
+func song68k(track ...byte) []byte {
+	header := []byte{0x00, 0x00, 0x01, 0x00, 0x01, 0x10, 0x00, 0x0a, 0x00, 0x00}
+	return append(header, track...)
+}
+
+// TestTrackLoops plays tracks that never reach a note or keep calling
+// themselves. They stop instead of hanging the player.
+func TestTrackLoops(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		done bool
+	}{
+		{"jump to itself", song68k(0xf6, 0xff, 0xfe), true},
+		{"call itself", song68k(0xf8, 0xff, 0xfe), true},
+		{"call itself after a rest", song68k(0x80, 0x01, 0xf8, 0xff, 0xfc), true},
+		{"jump between flags", song68k(0xe0, 0xc0, 0xf6, 0xff, 0xfc), true},
+		{"return without a call", song68k(0xe3), true},
+		{"jump back to a rest", song68k(0x80, 0x01, 0xf6, 0xff, 0xfc), false},
+		{"call a rest", song68k(0xf8, 0x00, 0x04, 0xf6, 0xff, 0xfb, 0x80, 0x01, 0xe3), false},
+	} {
+		s, err := Parse(tc.data, Variant68k, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		p, err := NewPlayer(s, nukeykt.NewYM2612(), 7670453, 8000, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := [][]int32{make([]int32, 8000), make([]int32, 8000)}
+		p.Generate(buf, 8000)
+
+		if p.Done() != tc.done {
+			t.Errorf("%s: done %v, want %v", tc.name, p.Done(), tc.done)
+		}
+		if depth := len(p.tracks[0].stack); depth > maxCallDepth {
+			t.Errorf("%s: %d nested calls", tc.name, depth)
+		}
+		if !tc.done && p.Loops() == 0 {
+			t.Errorf("%s: no loops", tc.name)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package smps interprets SMPS song data of Sega first-party sound drivers.
+package smps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Variant selects the byte order and pointer format of the song data.
+type Variant int
+
+const (
+	// Variant68k is the 68000 driver of Sonic 1: big endian, header pointers
+	// relative to the song start and jump pointers relative to themselves.
+	Variant68k Variant = iota
+	// VariantZ80 is the Z80 driver of Sonic 2 and later: little endian
+	// absolute Z80 addresses.
+	VariantZ80
+)
+
+const (
+	voiceSize  = 25
+	fmHeader   = 4
+	psgHeader  = 6
+	songHeader = 6
+)
+
+var ErrFormat = errors.New("smps: invalid song")
+
+// Track is a track entry of the song header.
+type Track struct {
+	Pointer   uint16
+	Transpose int8
+	Volume    int8
+	// ModEnv and Tone are only used by PSG tracks.
+	ModEnv uint8
+	Tone   uint8
+}
+
+// Song is SMPS song data with its parsed header. Header fields may be edited
+// and written back with Bytes.
+type Song struct {
+	Variant Variant
+	// Base is the Z80 address the song is loaded at.
+	Base         uint16
+	Voices       uint16
+	TempoDivider uint8
+	Tempo        uint8
+	// DAC is the first FM entry of the header, FM tracks play on FM1 and up.
+	DAC  Track
+	FM   []Track
+	PSG  []Track
+	Data []byte
+}
+
+// Parse parses the header of a song loaded at base. Base is ignored for
+// Variant68k songs.
+func Parse(data []byte, variant Variant, base uint16) (*Song, error) {
+	if len(data) < songHeader {
+		return nil, fmt.Errorf("%w: short header", ErrFormat)
+	}
+
+	s := &Song{
+		Variant:      variant,
+		Base:         base,
+		Voices:       s16(variant, data),
+		TempoDivider: data[4],
+		Tempo:        data[5],
+		Data:         data,
+	}
+	if variant == Variant68k {
+		s.Base = 0
+	}
+
+	fm, psg := int(data[2]), int(data[3])
+	if fm == 0 || fm > 7 || psg > 3 {
+		return nil, fmt.Errorf("%w: bad channel count %d/%d", ErrFormat, fm, psg)
+	}
+	if len(data) < songHeader+fm*fmHeader+psg*psgHeader {
+		return nil, fmt.Errorf("%w: short header", ErrFormat)
+	}
+
+	pos := songHeader
+	for i := range fm {
+		t := Track{
+			Pointer:   s16(variant, data[pos:]),
+			Transpose: int8(data[pos+2]),
+			Volume:    int8(data[pos+3]),
+		}
+		if i == 0 {
+			s.DAC = t
+		} else {
+			s.FM = append(s.FM, t)
+		}
+		pos += fmHeader
+	}
+	for range psg {
+		s.PSG = append(s.PSG, Track{
+			Pointer:   s16(variant, data[pos:]),
+			Transpose: int8(data[pos+2]),
+			Volume:    int8(data[pos+3]),
+			ModEnv:    data[pos+4],
+			Tone:      data[pos+5],
+		})
+		pos += psgHeader
+	}
+
+	for _, t := range append([]Track{s.DAC}, append(s.FM, s.PSG...)...) {
+		if off := s.offset(t.Pointer); off < 0 || off >= len(data) {
+			return nil, fmt.Errorf("%w: track pointer %#x out of range", ErrFormat, t.Pointer)
+		}
+	}
+
+	return s, nil
+}
+
+// Bytes returns the song data with the header fields written back.
+func (s *Song) Bytes() []byte {
+	data := append([]byte(nil), s.Data...)
+
+	put16(s.Variant, data, s.Voices)
+	data[2] = uint8(1 + len(s.FM))
+	data[3] = uint8(len(s.PSG))
+	data[4] = s.TempoDivider
+	data[5] = s.Tempo
+
+	pos := songHeader
+	for _, t := range append([]Track{s.DAC}, s.FM...) {
+		put16(s.Variant, data[pos:], t.Pointer)
+		data[pos+2] = uint8(t.Transpose)
+		data[pos+3] = uint8(t.Volume)
+		pos += fmHeader
+	}
+	for _, t := range s.PSG {
+		put16(s.Variant, data[pos:], t.Pointer)
+		data[pos+2] = uint8(t.Transpose)
+		data[pos+3] = uint8(t.Volume)
+		data[pos+4] = t.ModEnv
+		data[pos+5] = t.Tone
+		pos += psgHeader
+	}
+
+	return data
+}
+
+// Voice returns the 25 byte FM voice: feedback/algorithm, then DT/MUL,
+// RS/AR, AM/D1R, D2R, D1L/RR and TL of the operators in register order.
+func (s *Song) Voice(n uint8) ([]byte, bool) {
+	off := s.offset(s.Voices) + int(n)*voiceSize
+	if off < 0 || off+voiceSize > len(s.Data) {
+		return nil, false
+	}
+	return s.Data[off : off+voiceSize], true
+}
+
+// offset converts a header pointer to an offset in Data.
+func (s *Song) offset(ptr uint16) int {
+	return int(ptr) - int(s.Base)
+}
+
+// jump returns the offset of the target of the jump pointer at pos.
+func (s *Song) jump(pos int) int {
+	ptr := s16(s.Variant, s.Data[pos:])
+	if s.Variant == Variant68k {
+		return pos + 1 + int(int16(ptr))
+	}
+	return s.offset(ptr)
+}
+
+func s16(variant Variant, b []byte) uint16 {
+	if variant == Variant68k {
+		return binary.BigEndian.Uint16(b)
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func put16(variant Variant, b []byte, v uint16) {
+	if variant == Variant68k {
+		binary.BigEndian.PutUint16(b, v)
+	} else {
+		binary.LittleEndian.PutUint16(b, v)
+	}
+}
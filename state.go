@@ -0,0 +1,185 @@
+package nukeykt
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/elemir/cbool"
+)
+
+// ErrState is returned when a saved state does not match the chip layout.
+var ErrState = errors.New("nukeykt: invalid chip state")
+
+// The state of an emulated chip is the plain data of its structure: integers,
+// booleans and fixed arrays or structs of them. Everything else (callbacks,
+// pointers, slices) is configuration and is neither saved nor restored.
+
+func saveState(v any) []byte {
+	return appendState(nil, reflect.ValueOf(v).Elem())
+}
+
+func loadState(v any, data []byte) error {
+	rv := reflect.ValueOf(v).Elem()
+	if len(data) != len(appendState(nil, rv)) {
+		return ErrState
+	}
+	readState(data, rv)
+	return nil
+}
+
+func appendState(buf []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Bool:
+		return append(buf, cbool.ToInt[uint8](v.Bool()))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendUint(buf, v.Uint(), v.Type().Size())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendUint(buf, uint64(v.Int()), v.Type().Size())
+	case reflect.Array:
+		for i := range v.Len() {
+			buf = appendState(buf, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			buf = appendState(buf, v.Field(i))
+		}
+	}
+	return buf
+}
+
+func readState(data []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Bool:
+		settable(v).SetBool(data[0] != 0)
+		return data[1:]
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size := v.Type().Size()
+		settable(v).SetUint(readUint(data, size))
+		return data[size:]
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size := v.Type().Size()
+		settable(v).SetInt(int64(readUint(data, size)) << (64 - 8*size) >> (64 - 8*size))
+		return data[size:]
+	case reflect.Array:
+		for i := range v.Len() {
+			data = readState(data, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			data = readState(data, v.Field(i))
+		}
+	}
+	return data
+}
+
+func settable(v reflect.Value) reflect.Value {
+	if v.CanSet() {
+		return v
+	}
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+func appendUint(buf []byte, x uint64, size uintptr) []byte {
+	switch size {
+	case 1:
+		return append(buf, uint8(x))
+	case 2:
+		return binary.LittleEndian.AppendUint16(buf, uint16(x))
+	case 4:
+		return binary.LittleEndian.AppendUint32(buf, uint32(x))
+	}
+	return binary.LittleEndian.AppendUint64(buf, x)
+}
+
+func readUint(data []byte, size uintptr) uint64 {
+	switch size {
+	case 1:
+		return uint64(data[0])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(data))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(data))
+	}
+	return binary.LittleEndian.Uint64(data)
+}
+
+// Hashing digests the same data as saveState, in the same order and byte
+// order, but reads it in place. Fields tagged hash:"-" are left out.
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// stateSpan is a run of n integers of the given size in memory
+type stateSpan struct {
+	off, n, size uintptr
+}
+
+var (
+	stateLayouts sync.Map // reflect.Type to []stateSpan
+	littleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+)
+
+func hashState(h uint64, v any) uint64 {
+	rv := reflect.ValueOf(v).Elem()
+	base := unsafe.Pointer(rv.UnsafeAddr())
+	for _, s := range stateLayout(rv.Type()) {
+		p := unsafe.Slice((*byte)(unsafe.Add(base, s.off)), s.n*s.size)
+		if littleEndian || s.size == 1 {
+			h = hashBytes(h, p)
+			continue
+		}
+		for ; len(p) > 0; p = p[s.size:] {
+			for i := int(s.size) - 1; i >= 0; i-- {
+				h = (h ^ uint64(p[i])) * fnvPrime
+			}
+		}
+	}
+	return h
+}
+
+func hashBytes(h uint64, p []byte) uint64 {
+	for _, b := range p {
+		h = (h ^ uint64(b)) * fnvPrime
+	}
+	return h
+}
+
+func stateLayout(t reflect.Type) []stateSpan {
+	if l, ok := stateLayouts.Load(t); ok {
+		return l.([]stateSpan)
+	}
+	l := appendLayout(nil, t, 0)
+	stateLayouts.Store(t, l)
+	return l
+}
+
+func appendLayout(spans []stateSpan, t reflect.Type, off uintptr) []stateSpan {
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := len(spans); n > 0 {
+			if last := &spans[n-1]; last.size == t.Size() && last.off+last.n*last.size == off {
+				last.n++
+				return spans
+			}
+		}
+		return append(spans, stateSpan{off: off, n: 1, size: t.Size()})
+	case reflect.Array:
+		for i := range t.Len() {
+			spans = appendLayout(spans, t.Elem(), off+uintptr(i)*t.Elem().Size())
+		}
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if f := t.Field(i); f.Tag.Get("hash") != "-" {
+				spans = appendLayout(spans, f.Type, off+f.Offset)
+			}
+		}
+	}
+	return spans
+}
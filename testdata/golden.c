@@ -0,0 +1,243 @@
+// Renders the golden hashes of the register scripts with the C Nuked OPN2
+// 1.0.12, the version ym3438.go is ported from, whose OPN2_Reset takes the
+// output rate and clock:
+//
+//	cc -std=c99 -O2 -I$NUKED -o golden testdata/golden.c $NUKED/ym3438.c
+//	./golden testdata/golden/*.log > testdata/golden.sum
+//
+// The runs are those of golden_test.go and print the same lines, in the
+// order of the scripts given. Outputs are hashed as 32 bit little endian
+// samples with 64 bit FNV-1a.
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "ym3438.h"
+
+#define RATE 44100
+/* Cycles rendered after the last write */
+#define TAIL (24 * 2000)
+#define DEFAULT_CLOCK 7670453
+
+typedef struct {
+    unsigned long long cycle;
+    Bit32u port;
+    Bit8u addr;
+    Bit8u data;
+} write_t;
+
+static write_t *writes;
+static size_t nwrites;
+static Bit32u clock_hz;
+
+static ym3438_t chip;
+static unsigned long long hash;
+
+static void hash_bytes(const Bit8u *b, size_t n)
+{
+    size_t i;
+    for (i = 0; i < n; i++)
+    {
+        hash ^= b[i];
+        hash *= 0x100000001b3ULL;
+    }
+}
+
+static void put32(Bit8u *b, Bit32s v)
+{
+    Bit32u u = (Bit32u)v;
+    b[0] = u & 0xff;
+    b[1] = (u >> 8) & 0xff;
+    b[2] = (u >> 16) & 0xff;
+    b[3] = (u >> 24) & 0xff;
+}
+
+/* Parses a script in the reglog format, see reglog/reglog.go */
+static int parse(const char *name)
+{
+    FILE *f;
+    char line[256];
+    size_t cap = 0;
+    int n = 0;
+
+    f = fopen(name, "r");
+    if (!f)
+    {
+        perror(name);
+        return -1;
+    }
+    nwrites = 0;
+    clock_hz = DEFAULT_CLOCK;
+    while (fgets(line, sizeof(line), f))
+    {
+        char *hash_mark = strchr(line, '#');
+        char f0[32], f1[32], f2[32], f3[32];
+        int fields;
+
+        n++;
+        if (hash_mark)
+        {
+            *hash_mark = '\0';
+        }
+        fields = sscanf(line, "%31s %31s %31s %31s", f0, f1, f2, f3);
+        if (fields <= 0)
+        {
+            continue;
+        }
+        if (fields == 2 && strcmp(f0, "clock") == 0)
+        {
+            clock_hz = strtoul(f1, NULL, 10);
+            continue;
+        }
+        if (fields != 4)
+        {
+            fprintf(stderr, "%s:%d: expected 4 fields\n", name, n);
+            fclose(f);
+            return -1;
+        }
+        if (nwrites == cap)
+        {
+            cap = cap ? cap * 2 : 1024;
+            writes = realloc(writes, cap * sizeof(*writes));
+        }
+        writes[nwrites].cycle = strtoull(f0, NULL, 10);
+        writes[nwrites].port = strtoul(f1, NULL, 10);
+        writes[nwrites].addr = strtoul(f2, NULL, 16);
+        writes[nwrites].data = strtoul(f3, NULL, 16);
+        nwrites++;
+    }
+    fclose(f);
+    return 0;
+}
+
+static unsigned long long end_cycle(void)
+{
+    if (nwrites == 0)
+    {
+        return TAIL;
+    }
+    return writes[nwrites - 1].cycle + TAIL;
+}
+
+/*
+ * Clocks the chip cycle by cycle, writing the address of each write at its
+ * cycle and the data at the next one, and hashes the output, the IRQ pin and
+ * the status read once per sample.
+ */
+static void run_clock(void)
+{
+    unsigned long long cycle, end = end_cycle() + (nwrites != 0);
+    size_t pos = 0;
+    long data = -1;
+    Bit16s buffer[2];
+    Bit8u b[9];
+
+    for (cycle = 0; cycle < end; cycle++)
+    {
+        if (data >= 0)
+        {
+            OPN2_Write(&chip, (writes[data].port << 1) | 1, writes[data].data);
+            data = -1;
+        }
+        else if (pos < nwrites && writes[pos].cycle <= cycle)
+        {
+            OPN2_Write(&chip, writes[pos].port << 1, writes[pos].addr);
+            data = pos;
+            pos++;
+        }
+
+        OPN2_Clock(&chip, buffer);
+
+        put32(b, buffer[0]);
+        put32(b + 4, buffer[1]);
+        b[8] = OPN2_ReadIRQPin(&chip);
+        if (cycle % 24 == 23)
+        {
+            b[8] |= OPN2_Read(&chip, 0) << 1;
+        }
+        hash_bytes(b, sizeof(b));
+    }
+}
+
+/*
+ * Queues each write with OPN2_WriteBuffered before the output sample its
+ * cycle falls in and hashes the output of OPN2_GenerateStream.
+ */
+static void run_stream(void)
+{
+    /* A cycle is six master clocks */
+    unsigned long long i, samples = end_cycle() * 6 * RATE / clock_hz;
+    size_t pos = 0;
+    Bit32s left, right;
+    Bit32s *sndptr[2] = { &left, &right };
+    Bit8u b[8];
+
+    for (i = 0; i < samples; i++)
+    {
+        while (pos < nwrites && writes[pos].cycle * 6 * RATE <= i * clock_hz)
+        {
+            OPN2_WriteBuffered(&chip, writes[pos].port << 1, writes[pos].addr);
+            OPN2_WriteBuffered(&chip, (writes[pos].port << 1) | 1, writes[pos].data);
+            pos++;
+        }
+
+        OPN2_GenerateStream(&chip, sndptr, 1);
+
+        put32(b, left);
+        put32(b + 4, right);
+        hash_bytes(b, sizeof(b));
+    }
+}
+
+static const struct {
+    const char *name;
+    Bit32u type;
+} modes[] = {
+    { "ym2612", ym3438_mode_ym2612 },
+    { "ym3438", ym3438_mode_readmode },
+};
+
+static const struct {
+    const char *name;
+    void (*render)(void);
+} runs[] = {
+    { "clock", run_clock },
+    { "stream", run_stream },
+};
+
+int main(int argc, char **argv)
+{
+    int i;
+    size_t m, r;
+
+    for (i = 1; i < argc; i++)
+    {
+        const char *base = strrchr(argv[i], '/');
+        size_t len;
+
+        if (parse(argv[i]) != 0)
+        {
+            return 1;
+        }
+        base = base ? base + 1 : argv[i];
+        len = strlen(base);
+        if (len > 4 && strcmp(base + len - 4, ".log") == 0)
+        {
+            len -= 4;
+        }
+
+        for (m = 0; m < sizeof(modes) / sizeof(modes[0]); m++)
+        {
+            for (r = 0; r < sizeof(runs) / sizeof(runs[0]); r++)
+            {
+                OPN2_SetChipType(modes[m].type);
+                OPN2_Reset(&chip, RATE, clock_hz);
+                hash = 0xcbf29ce484222325ULL;
+                runs[r].render();
+                printf("%.*s %s %s %016llx\n", (int)len, base, modes[m].name,
+                       runs[r].name, hash);
+            }
+        }
+    }
+    return 0;
+}
@@ -0,0 +1,36 @@
+package tracker
+
+import (
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzParse(f *testing.F) {
+	text, err := NewSong().MarshalText()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(text)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		text, err := s.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(text); err != nil {
+			t.Fatalf("marshaled song does not parse: %v", err)
+		}
+
+		p := NewPlayer(s, nukeykt.NewYM2612(), 7670453, 8000)
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
@@ -0,0 +1,441 @@
+package tracker
+
+import (
+	"math"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/internal/driver"
+)
+
+const pitchFrac = 16
+
+// Vibrato waveform, a quarter of a sine scaled to 255
+var vibratoTable = [16]uint8{
+	0, 24, 49, 74, 97, 120, 141, 161, 180, 197, 212, 224, 235, 244, 250, 253,
+}
+
+type channel struct {
+	note       uint8
+	pitch      int
+	target     int
+	instrument int
+	loaded     int
+	volume     int
+	pan        uint8
+	keyed      bool
+
+	effect     byte
+	param      uint8
+	arpeggio   uint8
+	portaSpeed uint8
+	vibSpeed   uint8
+	vibDepth   uint8
+	vibPos     uint8
+	volSlide   uint8
+}
+
+// Player renders a song through an OPN2, clocking the song ticks from the
+// chip timer overflows.
+type Player struct {
+	song  *Song
+	chip  nukeykt.Chip
+	clock uint32
+	rate  uint32
+	timer *driver.Timer
+
+	speed     int
+	tick      int
+	row       int
+	order     int
+	loops     int
+	nextOrder int
+	nextRow   int
+
+	channels [Channels]channel
+
+	sample    *Sample
+	samplePos uint64
+	sampleIdx int
+
+	out [2][]int32
+}
+
+// NewPlayer resets the chip with the given clock and output rate and returns
+// a player for the song. The song must be valid.
+func NewPlayer(s *Song, chip nukeykt.Chip, clock, rate uint32) *Player {
+	chip.Reset(rate, clock)
+
+	p := &Player{
+		song:      s,
+		chip:      chip,
+		clock:     clock,
+		rate:      rate,
+		speed:     s.Speed,
+		nextOrder: -1,
+		nextRow:   -1,
+	}
+	for i := range p.channels {
+		p.channels[i] = channel{instrument: NoValue, loaded: NoValue, volume: 0x7f, pan: 0xc0}
+	}
+
+	p.write(0, 0x22, 0x00)
+	p.write(0, 0x2b, 0x00)
+	for ch := range Channels {
+		p.write(0, 0x28, driver.KeyChannel(ch))
+	}
+	if s.Timer == TimerA {
+		p.timer = driver.NewTimerA(s.TimerValue, clock, rate)
+		p.write(0, 0x24, uint8(s.TimerValue>>2))
+		p.write(0, 0x25, uint8(s.TimerValue&0x03))
+	} else {
+		p.timer = driver.NewTimerB(uint8(s.TimerValue), clock, rate)
+		p.write(0, 0x26, uint8(s.TimerValue))
+	}
+	p.restartTimer()
+	p.step()
+
+	return p
+}
+
+// Loops returns how many times the order list was played through.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether the song has nothing to play.
+func (p *Player) Done() bool {
+	return len(p.song.Order) == 0
+}
+
+// Position returns the current order and row.
+func (p *Player) Position() (order, row int) {
+	return p.order, p.row
+}
+
+// Generate renders numsamples stereo samples. The chip is rendered in chunks
+// up to the next tick or DAC byte, the timer is polled every sample once it
+// can overflow.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+	for off < uint64(numsamples) {
+		if p.timer.Ready() && p.timer.Overflow(p.chip.Read(0)) {
+			p.restartTimer()
+			p.step()
+		}
+		n := min(uint64(numsamples)-off, p.timer.Left(), p.playSample())
+
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.chip.Generate(p.out[:], uint32(n))
+		if p.sample != nil {
+			p.samplePos += n * uint64(p.sample.Rate)
+		}
+		p.timer.Advance(n)
+		off += n
+	}
+}
+
+// restartTimer clears the overflow flag and keeps the timer running.
+func (p *Player) restartTimer() {
+	p.write(0, 0x27, p.timer.Restart())
+}
+
+func (p *Player) step() {
+	if len(p.song.Order) == 0 {
+		return
+	}
+
+	if p.tick == 0 {
+		p.playRow()
+	} else {
+		for ch := range p.channels {
+			p.playEffect(ch)
+		}
+	}
+
+	p.tick++
+	if p.tick >= p.speed {
+		p.tick = 0
+		p.advance()
+	}
+}
+
+func (p *Player) advance() {
+	rows := len(p.song.Patterns[p.song.Order[p.order]].Rows)
+
+	switch {
+	case p.nextOrder >= 0 || p.nextRow >= 0:
+		if p.nextOrder >= 0 {
+			if p.nextOrder <= p.order {
+				p.loops++
+			}
+			p.order = p.nextOrder
+		} else {
+			p.order++
+		}
+		p.row = max(p.nextRow, 0)
+		p.nextOrder, p.nextRow = -1, -1
+	case p.row+1 < rows:
+		p.row++
+		return
+	default:
+		p.order++
+		p.row = 0
+	}
+
+	if p.order >= len(p.song.Order) {
+		p.order = 0
+		p.loops++
+	}
+	if p.row >= len(p.song.Patterns[p.song.Order[p.order]].Rows) {
+		p.row = 0
+	}
+}
+
+func (p *Player) playRow() {
+	rows := p.song.Patterns[p.song.Order[p.order]].Rows
+	if p.row >= len(rows) {
+		return
+	}
+	row := &rows[p.row]
+
+	for i := range p.channels {
+		c := &p.channels[i]
+		cell := &row[i]
+
+		c.effect, c.param = cell.Effect, cell.Param
+		if cell.Instrument != NoValue {
+			c.instrument = cell.Instrument
+			c.volume = 0x7f
+		}
+		if cell.Volume != NoValue {
+			c.volume = cell.Volume
+		}
+
+		switch cell.Effect {
+		case EffectArpeggio:
+			c.arpeggio = cell.Param
+		case EffectPortaUp, EffectPortaDown:
+			if cell.Param != 0 {
+				c.portaSpeed = cell.Param
+			}
+		case EffectTonePorta:
+			if cell.Param != 0 {
+				c.portaSpeed = cell.Param
+			}
+		case EffectVibrato:
+			if cell.Param>>4 != 0 {
+				c.vibSpeed = cell.Param >> 4
+			}
+			if cell.Param&0x0f != 0 {
+				c.vibDepth = cell.Param & 0x0f
+			}
+		case EffectVolumeSlide:
+			if cell.Param != 0 {
+				c.volSlide = cell.Param
+			}
+		case EffectPan:
+			switch {
+			case cell.Param < 0x40:
+				c.pan = 0x80
+			case cell.Param < 0xc0:
+				c.pan = 0xc0
+			default:
+				c.pan = 0x40
+			}
+		case EffectSpeed:
+			if cell.Param != 0 {
+				p.speed = int(cell.Param)
+			}
+		case EffectJump:
+			p.nextOrder = min(int(cell.Param), len(p.song.Order)-1)
+		case EffectBreak:
+			p.nextRow = int(cell.Param)
+		case EffectSample:
+			if i == DACChannel && int(cell.Param) < len(p.song.Samples) {
+				p.startSample(&p.song.Samples[cell.Param])
+			}
+		}
+
+		switch {
+		case cell.Note == NoteOff:
+			p.keyOff(i)
+		case cell.Note <= NoteMax && cell.Effect == EffectTonePorta && c.keyed:
+			c.target = int(cell.Note) * pitchFrac
+		case cell.Note <= NoteMax && c.instrument != NoValue:
+			p.keyOff(i)
+			if c.loaded != c.instrument {
+				p.loadInstrument(i)
+			}
+			if i == DACChannel && p.sample != nil {
+				p.stopSample()
+			}
+			c.note = cell.Note
+			c.pitch = int(cell.Note) * pitchFrac
+			c.target = c.pitch
+			c.vibPos = 0
+			p.updatePitch(i, 0)
+			p.updateLevel(i)
+			p.keyOn(i)
+		}
+
+		if c.loaded != NoValue {
+			p.updateLevel(i)
+			p.writeCh(i, 0xb4, c.pan|p.song.Instruments[c.loaded].LfoSens&0x37)
+		}
+	}
+}
+
+func (p *Player) playEffect(i int) {
+	c := &p.channels[i]
+	if c.loaded == NoValue {
+		return
+	}
+
+	switch c.effect {
+	case EffectArpeggio:
+		if c.arpeggio == 0 {
+			return
+		}
+		offsets := [3]int{0, int(c.arpeggio >> 4), int(c.arpeggio & 0x0f)}
+		p.updatePitch(i, offsets[p.tick%3]*pitchFrac)
+	case EffectPortaUp:
+		c.pitch = min(c.pitch+int(c.portaSpeed), NoteMax*pitchFrac)
+		p.updatePitch(i, 0)
+	case EffectPortaDown:
+		c.pitch = max(c.pitch-int(c.portaSpeed), 0)
+		p.updatePitch(i, 0)
+	case EffectTonePorta:
+		if c.pitch < c.target {
+			c.pitch = min(c.pitch+int(c.portaSpeed), c.target)
+		} else {
+			c.pitch = max(c.pitch-int(c.portaSpeed), c.target)
+		}
+		p.updatePitch(i, 0)
+	case EffectVibrato:
+		c.vibPos += c.vibSpeed
+		pos := c.vibPos & 0x3f
+		delta := int(vibratoTable[pos&0x0f])
+		if pos&0x10 != 0 {
+			delta = int(vibratoTable[0x0f-pos&0x0f])
+		}
+		if pos&0x20 != 0 {
+			delta = -delta
+		}
+		p.updatePitch(i, delta*int(c.vibDepth)/255)
+	case EffectVolumeSlide:
+		if c.volSlide>>4 != 0 {
+			c.volume = min(c.volume+int(c.volSlide>>4), 0x7f)
+		} else {
+			c.volume = max(c.volume-int(c.volSlide&0x0f), 0)
+		}
+		p.updateLevel(i)
+	}
+}
+
+func (p *Player) loadInstrument(i int) {
+	c := &p.channels[i]
+	in := &p.song.Instruments[c.instrument]
+
+	for op, o := range in.Ops {
+		off := uint8(op * 4)
+		p.writeCh(i, 0x30+off, o.DtMul)
+		p.writeCh(i, 0x50+off, o.RsAr)
+		p.writeCh(i, 0x60+off, o.AmD1r)
+		p.writeCh(i, 0x70+off, o.D2r)
+		p.writeCh(i, 0x80+off, o.D1lRr)
+		p.writeCh(i, 0x90+off, o.SsgEg)
+	}
+	p.writeCh(i, 0xb0, in.FbAlg)
+	c.loaded = c.instrument
+}
+
+// updateLevel scales the carrier total levels by the channel volume.
+func (p *Player) updateLevel(i int) {
+	c := &p.channels[i]
+	in := &p.song.Instruments[c.loaded]
+
+	atten := 127.0
+	if c.volume > 0 {
+		atten = math.Round(-40 * math.Log10(float64(c.volume)/0x7f) / 0.75)
+	}
+	for op, o := range in.Ops {
+		tl := o.Tl & 0x7f
+		if in.Carrier(op) {
+			tl = uint8(min(float64(tl)+atten, 127))
+		}
+		p.writeCh(i, 0x40+uint8(op*4), tl)
+	}
+}
+
+// updatePitch writes the channel frequency offset by delta in 1/16 semitones.
+func (p *Player) updatePitch(i, delta int) {
+	c := &p.channels[i]
+	note := float64(c.pitch+delta) / pitchFrac
+	hz := 440 * math.Pow(2, (note-57)/12)
+
+	fnum := hz * 144 * (1 << 21) / float64(p.clock)
+	block := uint8(0)
+	for fnum >= 2048 && block < 7 {
+		fnum /= 2
+		block++
+	}
+	f := uint16(min(math.Round(fnum), 2047))
+
+	p.writeCh(i, 0xa4, block<<3|uint8(f>>8))
+	p.writeCh(i, 0xa0, uint8(f))
+}
+
+func (p *Player) keyOn(i int) {
+	p.channels[i].keyed = true
+	p.write(0, 0x28, 0xf0|driver.KeyChannel(i))
+}
+
+func (p *Player) keyOff(i int) {
+	p.channels[i].keyed = false
+	p.write(0, 0x28, driver.KeyChannel(i))
+}
+
+func (p *Player) startSample(s *Sample) {
+	p.sample = s
+	p.samplePos = 0
+	p.sampleIdx = -1
+	p.write(0, 0x2b, 0x80)
+}
+
+func (p *Player) stopSample() {
+	p.sample = nil
+	p.write(0, 0x2b, 0x00)
+}
+
+// playSample writes the DAC whenever the sample position reaches a new byte
+// and returns how many samples are rendered before the next one.
+func (p *Player) playSample() uint64 {
+	if p.sample == nil {
+		return math.MaxUint64
+	}
+
+	idx := int(p.samplePos / uint64(p.rate))
+	if idx >= len(p.sample.Data) {
+		p.stopSample()
+		return math.MaxUint64
+	}
+	if idx != p.sampleIdx {
+		p.sampleIdx = idx
+		p.write(0, 0x2a, p.sample.Data[idx])
+	}
+	if p.sample.Rate == 0 {
+		return math.MaxUint64
+	}
+	next := uint64(idx+1)*uint64(p.rate) - p.samplePos
+	return (next + uint64(p.sample.Rate) - 1) / uint64(p.sample.Rate)
+}
+
+func (p *Player) writeCh(i int, reg, data uint8) {
+	p.write(uint32(i/3), reg+uint8(i%3), data)
+}
+
+func (p *Player) write(port uint32, addr, data uint8) {
+	p.chip.Write(port<<1, addr)
+	p.chip.Write(port<<1|1, data)
+}
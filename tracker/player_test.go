@@ -0,0 +1,99 @@
+package tracker
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+	"github.com/elemir/nukeykt/midi"
+)
+
+// TestTimerTicks counts the ticks of an empty song played at speed 1 for a
+// second and compares them to the rate the timer reloads at.
+func TestTimerTicks(t *testing.T) {
+	const clock = 7670453
+	for _, tc := range []struct {
+		timer Timer
+		value uint16
+		// period is the number of 144 clock frames between overflows
+		period float64
+	}{
+		{TimerA, 0x000, 1024},
+		{TimerA, 0x200, 512},
+		{TimerA, 0x3c0, 64},
+		{TimerB, 0x00, 256 * 16},
+		{TimerB, 0xc8, 56 * 16},
+		{TimerB, 0xf0, 16 * 16},
+	} {
+		for _, rate := range []uint32{8000, 44100, 96000} {
+			s := NewSong()
+			s.Timer, s.TimerValue, s.Speed = tc.timer, tc.value, 1
+			s.Patterns = []Pattern{NewPattern(64)}
+			s.Order = []int{0}
+
+			p := NewPlayer(s, nukeykt.NewYM2612(), clock, rate)
+			buf := [][]int32{make([]int32, 1000), make([]int32, 1000)}
+			for range rate / 1000 {
+				p.Generate(buf, 1000)
+			}
+
+			_, row := p.Position()
+			ticks := p.Loops()*64 + row
+			// The resampler ratio of the chip is exact to 1% at 8000 Hz
+			want := clock / 144 / tc.period
+			if math.Abs(float64(ticks)-want) > 1+want/100 {
+				t.Errorf("timer %d value %#x at %d Hz: %d ticks a second, want %.1f", tc.timer, tc.value, rate, ticks, want)
+			}
+		}
+	}
+}
+
+func testSong() *Song {
+	s := NewSong()
+	s.Speed = 3
+	s.Instruments = []midi.Patch{midi.DefaultPatch}
+	s.Samples = []Sample{
+		{Rate: 8000, Data: []byte{0x80, 0xff, 0x00, 0x40, 0xc0, 0x10, 0x90}},
+		{Rate: 30000, Data: make([]byte, 300)},
+	}
+
+	p := NewPattern(16)
+	cell := func(note uint8, instrument int, effect byte, param uint8) Cell {
+		return Cell{Note: note, Instrument: instrument, Volume: NoValue, Effect: effect, Param: param}
+	}
+	p.Rows[0][0] = cell(48, 0, EffectVibrato, 0x48)
+	p.Rows[0][DACChannel] = cell(NoteNone, NoValue, EffectSample, 0)
+	p.Rows[2][1] = cell(52, 0, EffectArpeggio, 0x37)
+	p.Rows[4][0] = cell(55, NoValue, EffectTonePorta, 0x08)
+	p.Rows[6][DACChannel] = cell(NoteNone, NoValue, EffectSample, 1)
+	p.Rows[8][2] = cell(60, 0, EffectVolumeSlide, 0x02)
+	p.Rows[10][0] = cell(NoteOff, NoValue, EffectNone, 0)
+	p.Rows[12][3] = cell(40, 0, EffectSpeed, 2)
+	s.Patterns = []Pattern{p}
+	s.Order = []int{0, 0}
+
+	return s
+}
+
+// TestGenerateChunks renders a song playing notes, effects and DAC samples
+// one sample per call and in large chunks.
+func TestGenerateChunks(t *testing.T) {
+	const samples = 44100
+	var want [2][]int32
+	for _, chunk := range []uint32{1, 7, 1000, samples} {
+		p := NewPlayer(testSong(), nukeykt.NewYM2612(), 7670453, 44100)
+		buf := [][]int32{make([]int32, samples), make([]int32, samples)}
+		for off := uint32(0); off < samples; off += chunk {
+			p.Generate([][]int32{buf[0][off:], buf[1][off:]}, min(chunk, samples-off))
+		}
+
+		if want[0] == nil {
+			want = [2][]int32{buf[0], buf[1]}
+			continue
+		}
+		if !slices.Equal(buf[0], want[0]) || !slices.Equal(buf[1], want[1]) {
+			t.Errorf("chunks of %d render differently from single samples", chunk)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package tracker plays pattern based songs composed directly for the OPN2.
+package tracker
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/elemir/nukeykt/midi"
+)
+
+const (
+	Channels = 6
+
+	// DACChannel is the channel that triggers DAC samples.
+	DACChannel = 5
+
+	NoteNone = 0xff
+	NoteOff  = 0xfe
+	// Notes are numbered from C-0, A-4 (note 57) is 440 Hz
+	NoteMax = 8*12 - 1
+
+	NoValue = -1
+)
+
+// Effects, named after their column letter
+const (
+	EffectNone        = 0
+	EffectArpeggio    = '0' // xy: cycle note, note+x, note+y every tick
+	EffectPortaUp     = '1' // xx: slide pitch up by xx/16 semitones per tick
+	EffectPortaDown   = '2' // xx: slide pitch down by xx/16 semitones per tick
+	EffectTonePorta   = '3' // xx: slide to the row note by xx/16 semitones per tick
+	EffectVibrato     = '4' // xy: vibrato with speed x and depth y/16 semitones
+	EffectPan         = '8' // xx: 00-3F left, 40-BF center, C0-FF right
+	EffectVolumeSlide = 'A' // xy: raise volume by x or lower by y per tick
+	EffectJump        = 'B' // xx: jump to order xx
+	EffectBreak       = 'D' // xx: go to row xx of the next pattern
+	EffectSpeed       = 'F' // xx: set ticks per row
+	EffectSample      = 'S' // xx: play DAC sample xx on the DAC channel
+)
+
+var ErrFormat = errors.New("tracker: invalid song")
+
+// Timer selects the chip timer that clocks the song ticks.
+type Timer int
+
+const (
+	TimerA Timer = iota
+	TimerB
+)
+
+// Cell is one channel of a pattern row.
+type Cell struct {
+	Note       uint8
+	Instrument int
+	Volume     int
+	Effect     byte
+	Param      uint8
+}
+
+// EmptyCell is a cell with no note, instrument, volume or effect.
+var EmptyCell = Cell{Note: NoteNone, Instrument: NoValue, Volume: NoValue}
+
+// Row is a pattern row.
+type Row [Channels]Cell
+
+// Pattern is a list of rows.
+type Pattern struct {
+	Rows []Row
+}
+
+// Sample is unsigned 8 bit PCM played through the DAC.
+type Sample struct {
+	Name string
+	Rate uint32
+	Data []byte
+}
+
+// Song is a tracker song.
+type Song struct {
+	Name string
+	// Timer and TimerValue set the tick rate like a sound driver would
+	// program the chip: Timer A counts 144 clocks from TimerValue to 1024,
+	// Timer B counts 2304 clocks from TimerValue to 256.
+	Timer       Timer
+	TimerValue  uint16
+	Speed       int
+	Instruments []midi.Patch
+	Samples     []Sample
+	Patterns    []Pattern
+	Order       []int
+}
+
+// NewSong returns an empty song ticking at about 60 Hz with speed 6.
+func NewSong() *Song {
+	return &Song{
+		Timer:      TimerB,
+		TimerValue: 0xc8,
+		Speed:      6,
+	}
+}
+
+// NewPattern returns a pattern of empty rows.
+func NewPattern(rows int) Pattern {
+	p := Pattern{Rows: make([]Row, rows)}
+	for i := range p.Rows {
+		for ch := range p.Rows[i] {
+			p.Rows[i][ch] = EmptyCell
+		}
+	}
+	return p
+}
+
+// Validate checks that the orders, instruments and samples referenced by the
+// song exist.
+func (s *Song) Validate() error {
+	if s.Speed <= 0 {
+		return fmt.Errorf("%w: bad speed %d", ErrFormat, s.Speed)
+	}
+	if s.Timer == TimerA && s.TimerValue > 0x3ff || s.Timer == TimerB && s.TimerValue > 0xff {
+		return fmt.Errorf("%w: bad timer value %#x", ErrFormat, s.TimerValue)
+	}
+	for _, p := range s.Order {
+		if p < 0 || p >= len(s.Patterns) {
+			return fmt.Errorf("%w: order references missing pattern %d", ErrFormat, p)
+		}
+	}
+	for i, p := range s.Patterns {
+		for j, row := range p.Rows {
+			for _, c := range row {
+				if c.Instrument != NoValue && (c.Instrument < 0 || c.Instrument >= len(s.Instruments)) {
+					return fmt.Errorf("%w: pattern %d row %d: missing instrument %d", ErrFormat, i, j, c.Instrument)
+				}
+				if c.Effect == EffectSample && int(c.Param) >= len(s.Samples) {
+					return fmt.Errorf("%w: pattern %d row %d: missing sample %d", ErrFormat, i, j, c.Param)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/elemir/nukeykt/midi"
+)
+
+// The text format has one statement per line, '#' starts a comment:
+//
+//	name "Song"
+//	timer B C8
+//	speed 6
+//	instrument "Bass" B0 B4 {30 40 50 60 70 80 90} x 4 operators
+//	sample "Kick" 8000 8081...
+//	pattern
+//	C-4 00 7F ... | --- .. .. 801 | ...
+//	end
+//	order 00 01 00
+//
+// Instruments and samples are numbered in the order they appear. Instrument
+// registers and operators are hexadecimal, operators in register order. A
+// cell is a note (C-4, C#4, --- for none, OFF for key off), an instrument,
+// a volume from 00 to 7F and an effect letter with its parameter, empty
+// fields are dots.
+
+var noteNames = [12]string{"C-", "C#", "D-", "D#", "E-", "F-", "F#", "G-", "G#", "A-", "A#", "B-"}
+
+// Parse parses a song in the text format.
+func Parse(data []byte) (*Song, error) {
+	s := NewSong()
+	if err := s.UnmarshalText(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MarshalText encodes the song in the text format.
+func (s *Song) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "name %s\n", strconv.Quote(s.Name))
+	fmt.Fprintf(&b, "timer %c %X\n", "AB"[s.Timer&1], s.TimerValue)
+	fmt.Fprintf(&b, "speed %d\n", s.Speed)
+	for _, in := range s.Instruments {
+		fmt.Fprintf(&b, "instrument %s %02X %02X", strconv.Quote(in.Name), in.FbAlg, in.LfoSens)
+		for _, op := range in.Ops {
+			fmt.Fprintf(&b, "  %02X %02X %02X %02X %02X %02X %02X",
+				op.DtMul, op.Tl, op.RsAr, op.AmD1r, op.D2r, op.D1lRr, op.SsgEg)
+		}
+		b.WriteByte('\n')
+	}
+	for _, smp := range s.Samples {
+		fmt.Fprintf(&b, "sample %s %d %X\n", strconv.Quote(smp.Name), smp.Rate, smp.Data)
+	}
+	for _, p := range s.Patterns {
+		b.WriteString("pattern\n")
+		for _, row := range p.Rows {
+			for ch, c := range row {
+				if ch > 0 {
+					b.WriteString(" | ")
+				}
+				b.WriteString(c.String())
+			}
+			b.WriteByte('\n')
+		}
+		b.WriteString("end\n")
+	}
+	b.WriteString("order")
+	for _, p := range s.Order {
+		fmt.Fprintf(&b, " %02X", p)
+	}
+	b.WriteByte('\n')
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalText decodes a song in the text format.
+func (s *Song) UnmarshalText(data []byte) error {
+	*s = *NewSong()
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	line := 0
+	var pattern *Pattern
+
+	for sc.Scan() {
+		line++
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		var err error
+		if pattern != nil {
+			if text == "end" {
+				s.Patterns = append(s.Patterns, *pattern)
+				pattern = nil
+				continue
+			}
+			var row Row
+			row, err = parseRow(text)
+			pattern.Rows = append(pattern.Rows, row)
+		} else {
+			keyword, rest, _ := strings.Cut(text, " ")
+			rest = strings.TrimSpace(rest)
+			switch keyword {
+			case "name":
+				s.Name, err = strconv.Unquote(rest)
+			case "timer":
+				err = s.parseTimer(rest)
+			case "speed":
+				s.Speed, err = strconv.Atoi(rest)
+			case "instrument":
+				err = s.parseInstrument(rest)
+			case "sample":
+				err = s.parseSample(rest)
+			case "pattern":
+				pattern = &Pattern{}
+			case "order":
+				for _, f := range strings.Fields(rest) {
+					var p uint64
+					p, err = strconv.ParseUint(f, 16, 16)
+					if err != nil {
+						break
+					}
+					s.Order = append(s.Order, int(p))
+				}
+			default:
+				err = fmt.Errorf("unknown statement %q", keyword)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %w", ErrFormat, line, err)
+		}
+	}
+	if pattern != nil {
+		return fmt.Errorf("%w: unterminated pattern", ErrFormat)
+	}
+
+	return s.Validate()
+}
+
+func (s *Song) parseTimer(text string) error {
+	f := strings.Fields(text)
+	if len(f) != 2 || (f[0] != "A" && f[0] != "B") {
+		return fmt.Errorf("bad timer %q", text)
+	}
+	v, err := strconv.ParseUint(f[1], 16, 16)
+	if err != nil {
+		return err
+	}
+	s.Timer = Timer(f[0][0] - 'A')
+	s.TimerValue = uint16(v)
+	return nil
+}
+
+func (s *Song) parseInstrument(text string) error {
+	name, rest, err := quoted(text)
+	if err != nil {
+		return err
+	}
+	regs, err := hexBytes(strings.Fields(rest))
+	if err != nil {
+		return err
+	}
+	if len(regs) != 2+4*7 {
+		return fmt.Errorf("instrument has %d registers, want 30", len(regs))
+	}
+
+	in := midi.Patch{Name: name, FbAlg: regs[0], LfoSens: regs[1]}
+	for i := range in.Ops {
+		op := regs[2+7*i:]
+		in.Ops[i] = midi.Operator{
+			DtMul: op[0], Tl: op[1], RsAr: op[2], AmD1r: op[3], D2r: op[4], D1lRr: op[5], SsgEg: op[6],
+		}
+	}
+	s.Instruments = append(s.Instruments, in)
+	return nil
+}
+
+func (s *Song) parseSample(text string) error {
+	name, rest, err := quoted(text)
+	if err != nil {
+		return err
+	}
+	f := strings.Fields(rest)
+	if len(f) < 1 || len(f) > 2 {
+		return fmt.Errorf("bad sample %q", text)
+	}
+	rate, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil {
+		return err
+	}
+	smp := Sample{Name: name, Rate: uint32(rate)}
+	if len(f) == 2 {
+		if smp.Data, err = hex.DecodeString(f[1]); err != nil {
+			return err
+		}
+	}
+	s.Samples = append(s.Samples, smp)
+	return nil
+}
+
+func parseRow(text string) (Row, error) {
+	var row Row
+	for ch := range row {
+		row[ch] = EmptyCell
+	}
+
+	cells := strings.Split(text, "|")
+	if len(cells) > Channels {
+		return row, fmt.Errorf("row has %d channels", len(cells))
+	}
+	for ch, cell := range cells {
+		c, err := parseCell(strings.Fields(cell))
+		if err != nil {
+			return row, err
+		}
+		row[ch] = c
+	}
+	return row, nil
+}
+
+func parseCell(f []string) (Cell, error) {
+	c := EmptyCell
+	if len(f) != 4 {
+		return c, fmt.Errorf("cell has %d fields, want 4", len(f))
+	}
+
+	switch note := f[0]; {
+	case note == "---":
+	case note == "OFF":
+		c.Note = NoteOff
+	default:
+		n, err := parseNote(note)
+		if err != nil {
+			return c, err
+		}
+		c.Note = n
+	}
+
+	var err error
+	if c.Instrument, err = hexField(f[1]); err != nil {
+		return c, err
+	}
+	if c.Volume, err = hexField(f[2]); err != nil {
+		return c, err
+	}
+	if c.Volume > 0x7f {
+		return c, fmt.Errorf("volume %02X out of range", c.Volume)
+	}
+
+	if f[3] != "..." {
+		if len(f[3]) != 3 {
+			return c, fmt.Errorf("bad effect %q", f[3])
+		}
+		param, err := strconv.ParseUint(f[3][1:], 16, 8)
+		if err != nil {
+			return c, err
+		}
+		c.Effect = f[3][0]
+		c.Param = uint8(param)
+	}
+	return c, nil
+}
+
+func parseNote(s string) (uint8, error) {
+	if len(s) == 3 && s[2] >= '0' && s[2] <= '7' {
+		for i, name := range noteNames {
+			if s[:2] == name {
+				return uint8(int(s[2]-'0')*12 + i), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("bad note %q", s)
+}
+
+func hexField(s string) (int, error) {
+	if s == ".." {
+		return NoValue, nil
+	}
+	v, err := strconv.ParseUint(s, 16, 8)
+	return int(v), err
+}
+
+func hexBytes(f []string) ([]byte, error) {
+	res := make([]byte, len(f))
+	for i, s := range f {
+		v, err := strconv.ParseUint(s, 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = byte(v)
+	}
+	return res, nil
+}
+
+func quoted(text string) (string, string, error) {
+	q, err := strconv.QuotedPrefix(text)
+	if err != nil {
+		return "", "", err
+	}
+	name, err := strconv.Unquote(q)
+	return name, text[len(q):], err
+}
+
+// NoteName returns the name of a note, like C#4.
+func NoteName(note uint8) string {
+	switch {
+	case note == NoteNone:
+		return "---"
+	case note == NoteOff:
+		return "OFF"
+	case note > NoteMax:
+		return "???"
+	}
+	return fmt.Sprintf("%s%d", noteNames[note%12], note/12)
+}
+
+func (c Cell) String() string {
+	field := func(v int) string {
+		if v == NoValue {
+			return ".."
+		}
+		return fmt.Sprintf("%02X", v)
+	}
+	effect := "..."
+	if c.Effect != EffectNone {
+		effect = fmt.Sprintf("%c%02X", c.Effect, c.Param)
+	}
+	return fmt.Sprintf("%s %s %s %s", NoteName(c.Note), field(c.Instrument), field(c.Volume), effect)
+}
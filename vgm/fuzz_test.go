@@ -0,0 +1,48 @@
+package vgm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+func FuzzParse(f *testing.F) {
+	log := make([]byte, 0x40)
+	copy(log, magic)
+	binary.LittleEndian.PutUint32(log[offVersion:], 0x150)
+	binary.LittleEndian.PutUint32(log[offData:], 0x40-offData)
+	binary.LittleEndian.PutUint32(log[offYM2612:], 7670453|clockDual)
+	log = append(log,
+		0x52, 0x28, 0xf0, 0xa2, 0x28, 0xf1, 0x61, 0x00, 0x10,
+		0x67, 0x66, 0x00, 0x04, 0x00, 0x00, 0x00, 0x80, 0x40, 0x00, 0xc0,
+		0xe0, 0x00, 0x00, 0x00, 0x00, 0x81, 0x7f, 0x66)
+	binary.LittleEndian.PutUint32(log[offLoop:], 0x40-offLoop)
+	f.Add(log)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(log)
+	w.Close()
+	f.Add(gz.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := Parse(data)
+		if err != nil {
+			return
+		}
+		file.Writes()
+		// Clocks far above any real chip only make the run slow
+		if file.Header.Clock > 16000000 || file.Header.Clock2 > 16000000 {
+			return
+		}
+
+		p := NewPlayer(file, nukeykt.NewYM2612(), 8000)
+		buf := [][]int32{make([]int32, 256), make([]int32, 256)}
+		for range 4 {
+			p.Generate(buf, 256)
+		}
+	})
+}
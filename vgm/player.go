@@ -0,0 +1,239 @@
+package vgm
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/elemir/nukeykt"
+)
+
+const (
+	samples60 = 735
+	samples50 = 882
+)
+
+// Player renders the YM2612 writes of a VGM log through a chip, or two
+// chips for dual logs.
+type Player struct {
+	file   *File
+	chips  []nukeykt.Chip
+	pacers []*nukeykt.Pacer
+	mixer  *nukeykt.Mixer
+	rate   uint32
+
+	pcm    []byte
+	pcmPos int
+
+	pos      int
+	loops    int
+	done     bool
+	samples  uint64
+	loopAt   uint64
+	rendered uint64
+	left     uint64
+	out      [2][]int32
+}
+
+// NewPlayer resets the chip with the log clock and the given output rate and
+// returns a player for the log. For dual logs a second chip of the same kind
+// is created. The volume modifiers of the log are applied. Writes to other
+// chips are skipped.
+func NewPlayer(f *File, chip nukeykt.Chip, rate uint32) *Player {
+	p := &Player{
+		file:  f,
+		chips: []nukeykt.Chip{chip},
+		mixer: nukeykt.NewMixer(rate),
+		rate:  rate,
+		pos:   f.Start,
+	}
+	p.mixer.SetClip(false)
+
+	clock := f.Header.Clock
+	if clock == 0 {
+		clock = DefaultClock
+	}
+	p.mixer.Add(chip, clock).SetGain(f.Header.Volume * f.Header.ChipVolume[0])
+	p.pacers = append(p.pacers, nukeykt.NewPacer(chip, clock, rate))
+
+	if f.Header.Dual {
+		kind := nukeykt.KindYM2612
+		if k, ok := chip.(interface{ Kind() nukeykt.Kind }); ok {
+			kind = k.Kind()
+		}
+		second, err := nukeykt.New(kind)
+		if _, ok := chip.(*nukeykt.Fast); ok {
+			second, err = nukeykt.NewFastYM2612(), nil
+			if kind == nukeykt.KindYM3438 {
+				second = nukeykt.NewFastYM3438()
+			}
+		}
+		clock2 := f.Header.Clock2
+		if clock2 == 0 {
+			clock2 = clock
+		}
+		if err == nil {
+			p.mixer.Add(second, clock2).SetGain(f.Header.Volume * f.Header.ChipVolume[1])
+			p.chips = append(p.chips, second)
+			p.pacers = append(p.pacers, nukeykt.NewPacer(second, clock2, rate))
+		}
+	}
+
+	return p
+}
+
+// Chips returns the chips of the player, two for dual logs.
+func (p *Player) Chips() []nukeykt.Chip {
+	return p.chips
+}
+
+// Loops returns how many times playback jumped to the loop point.
+func (p *Player) Loops() int {
+	return p.loops
+}
+
+// Done reports whether all commands of a non-looping log were played.
+func (p *Player) Done() bool {
+	if !p.done {
+		return false
+	}
+	for _, pacer := range p.pacers {
+		if pacer.Pending() {
+			return false
+		}
+	}
+	return true
+}
+
+// Next runs the commands due at the current sample and returns how many
+// samples render before the next ones, so a renderer can stop exactly where
+// the log loops or ends.
+func (p *Player) Next() uint64 {
+	if p.left == 0 {
+		p.step()
+	}
+	return p.left
+}
+
+// Generate renders numsamples stereo samples. Once the log is over the chip
+// keeps running, so release tails are rendered.
+func (p *Player) Generate(sndptr [][]int32, numsamples uint32) {
+	var off uint64
+
+	for off < uint64(numsamples) {
+		if p.left == 0 {
+			p.step()
+		}
+		n := min(p.left, uint64(numsamples)-off, p.flush())
+		p.out[0] = sndptr[0][off:]
+		p.out[1] = sndptr[1][off:]
+		p.mixer.Generate(p.out[:], uint32(n))
+		p.left -= n
+		p.rendered += n
+		off += n
+	}
+}
+
+// step runs commands up to the next wait and computes its length.
+func (p *Player) step() {
+	data := p.file.Data
+	wrapped := false
+
+	for !p.done {
+		if p.pos >= len(data) || data[p.pos] == CmdEnd {
+			// A loop without waits would never render a sample
+			if p.file.Loop < 0 || wrapped || p.samples == p.loopAt {
+				p.done = true
+				break
+			}
+			p.pos = p.file.Loop
+			p.loops++
+			p.loopAt = p.samples
+			wrapped = true
+			continue
+		}
+
+		cmd := data[p.pos]
+		size := cmdLen(cmd)
+		if cmd == CmdDataBlock {
+			size = p.dataBlock()
+		}
+		if size == 0 || p.pos+size > len(data) {
+			p.pos = len(data)
+			continue
+		}
+		args := data[p.pos+1 : p.pos+size]
+		p.pos += size
+
+		switch {
+		case cmd == CmdPort0, cmd == CmdPort1:
+			p.write(0, uint32(cmd-CmdPort0), args[0], args[1])
+		case cmd == Cmd2Port0, cmd == Cmd2Port1:
+			p.write(1, uint32(cmd-Cmd2Port0), args[0], args[1])
+		case cmd == CmdWait:
+			p.wait(uint64(binary.LittleEndian.Uint16(args)))
+			return
+		case cmd == CmdWait60:
+			p.wait(samples60)
+			return
+		case cmd == CmdWait50:
+			p.wait(samples50)
+			return
+		case cmd&0xf0 == CmdWaitShort:
+			p.wait(uint64(cmd&0x0f) + 1)
+			return
+		case cmd&0xf0 == CmdDAC:
+			if p.pcmPos < len(p.pcm) {
+				p.write(0, 0, 0x2a, p.pcm[p.pcmPos])
+				p.pcmPos++
+			}
+			if cmd&0x0f != 0 {
+				p.wait(uint64(cmd & 0x0f))
+				return
+			}
+		case cmd == CmdSeekPCM:
+			p.pcmPos = int(binary.LittleEndian.Uint32(args))
+		}
+	}
+
+	p.wait(1)
+}
+
+// dataBlock stores the data of a YM2612 PCM block and returns the length of
+// the command.
+func (p *Player) dataBlock() int {
+	data := p.file.Data[p.pos:]
+	if len(data) < 7 {
+		return 0
+	}
+	size := int(binary.LittleEndian.Uint32(data[3:]) & 0x7fffffff)
+	if size > len(data)-7 {
+		return 0
+	}
+	// Blocks are read once, replaying the loop must not append them again
+	if data[2] == BlockYM2612 && p.loops == 0 {
+		p.pcm = append(p.pcm, data[7:7+size]...)
+	}
+	return 7 + size
+}
+
+func (p *Player) write(chip int, port uint32, addr, data uint8) {
+	if chip >= len(p.pacers) {
+		return
+	}
+	p.pacers[chip].Write(port<<1, addr, data)
+}
+
+// flush gives the chips the pending writes due by now and returns how many
+// samples can be rendered before the next one is due.
+func (p *Player) flush() uint64 {
+	next := uint64(math.MaxUint64)
+	for _, pacer := range p.pacers {
+		next = min(next, pacer.Flush(p.rendered))
+	}
+	return next
+}
+
+func (p *Player) wait(samples uint64) {
+	p.samples += samples
+	p.left = p.samples*uint64(p.rate)/Rate - p.rendered
+}
@@ -0,0 +1,89 @@
+package vgm
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// TestLoopWithoutWait plays a log whose looped part has no waits, which
+// would never render a sample if it was looped.
+func TestLoopWithoutWait(t *testing.T) {
+	log := make([]byte, 0x40)
+	copy(log, magic)
+	binary.LittleEndian.PutUint32(log[offVersion:], 0x150)
+	binary.LittleEndian.PutUint32(log[offData:], 0x40-offData)
+	binary.LittleEndian.PutUint32(log[offYM2612:], 7670453)
+	binary.LittleEndian.PutUint32(log[offLoop:], 0x43-offLoop)
+	log = append(log, CmdWaitShort, CmdWaitShort, CmdWaitShort, CmdPort0, 0x28, 0x00, CmdEnd)
+
+	file, err := Parse(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlayer(file, nukeykt.NewYM2612(), 44100)
+	buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+	p.Generate(buf, 64)
+	if !p.Done() {
+		t.Error("player not done after the loop")
+	}
+}
+
+// logChip records the port writes it is given and the sample they are given
+// before.
+type logChip struct {
+	nukeykt.Chip
+	rendered uint64
+	samples  []uint64
+}
+
+func (c *logChip) Reset(rate, clock uint32) {}
+
+func (c *logChip) Write(port uint32, data uint8) {
+	c.samples = append(c.samples, c.rendered)
+}
+
+func (c *logChip) Generate(sndptr [][]int32, numsamples uint32) {
+	c.rendered += uint64(numsamples)
+}
+
+// TestPlayerPacing plays a burst of more writes than the chip write buffer
+// holds. The writes are given to the chip no faster than its buffer drains.
+func TestPlayerPacing(t *testing.T) {
+	const (
+		clock = 7670453
+		count = 3 * nukeykt.OPN_WRITEBUF_SIZE
+	)
+	log := make([]byte, 0x40)
+	copy(log, magic)
+	binary.LittleEndian.PutUint32(log[offVersion:], 0x150)
+	binary.LittleEndian.PutUint32(log[offData:], 0x40-offData)
+	binary.LittleEndian.PutUint32(log[offYM2612:], clock)
+	binary.LittleEndian.PutUint32(log[offLoop:], 0)
+	for i := range count {
+		log = append(log, CmdPort0, 0x30+byte(i%16), byte(i))
+	}
+	log = append(log, CmdWaitShort, CmdEnd)
+
+	file, err := Parse(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chip := &logChip{}
+	p := NewPlayer(file, chip, Rate)
+	buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+	for !p.Done() {
+		p.Generate(buf, 64)
+	}
+
+	if len(chip.samples) != 2*count {
+		t.Fatalf("%d writes, want %d", len(chip.samples), 2*count)
+	}
+	for i, sample := range chip.samples {
+		cycle := sample * clock / (6 * Rate)
+		if queued := i - int(cycle/nukeykt.OPN_WRITEBUF_DELAY); queued > nukeykt.OPN_WRITEBUF_SIZE {
+			t.Fatalf("write %d at sample %d with %d writes queued", i, sample, queued)
+		}
+	}
+}
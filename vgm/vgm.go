@@ -0,0 +1,435 @@
+// Package vgm reads and plays the YM2612 part of VGM logs.
+package vgm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf16"
+)
+
+const (
+	CmdGGStereo  = 0x4f // Game Gear PSG stereo: data
+	CmdPSG       = 0x50 // PSG write: data
+	CmdPort0     = 0x52 // YM2612 port 0 write: address, data
+	CmdPort1     = 0x53 // YM2612 port 1 write: address, data
+	Cmd2Port0    = 0xa2 // Second YM2612 port 0 write: address, data
+	Cmd2Port1    = 0xa3 // Second YM2612 port 1 write: address, data
+	CmdWait      = 0x61 // Wait: 16 bit sample count
+	CmdWait60    = 0x62 // Wait 735 samples
+	CmdWait50    = 0x63 // Wait 882 samples
+	CmdEnd       = 0x66
+	CmdDataBlock = 0x67 // 0x66, type, 32 bit size, data
+	CmdPCMWrite  = 0x68 // PCM RAM write: 0x66, type, 24 bit read offset, write offset and size
+	CmdWaitShort = 0x70 // 0x70-0x7F: wait 1-16 samples
+	CmdDAC       = 0x80 // 0x80-0x8F: write the next PCM byte to 0x2A, wait 0-15 samples
+	CmdSeekPCM   = 0xe0 // Seek the PCM data bank: 32 bit offset
+
+	// BlockYM2612 is the data block type of YM2612 PCM data.
+	BlockYM2612 = 0x00
+
+	// Rate is the rate of VGM sample counts.
+	Rate = 44100
+
+	// DefaultClock is used by files with a zero YM2612 clock, which have
+	// no YM2612 writes.
+	DefaultClock = 7670453
+
+	magic     = "Vgm "
+	gzipMagic = "\x1f\x8b"
+	gd3Magic  = "Gd3 "
+
+	// Header fields
+	offVersion   = 0x08
+	offSNClock   = 0x0c
+	offGD3       = 0x14
+	offSamples   = 0x18
+	offLoop      = 0x1c
+	offLoopCount = 0x20
+	offYM2612    = 0x2c
+	offData      = 0x34
+	offVolume    = 0x7c
+	offLoopBase  = 0x7e
+	offLoopMod   = 0x7f
+	offExtra     = 0xbc
+	minHeader    = 0x40
+
+	// Flags of the YM2612 clock
+	clockDual   = 0x40000000
+	clockYM3438 = 0x80000000
+
+	// Chip ID of the YM2612 in the extra header
+	chipYM2612 = 0x02
+	// Volume flag of the second chip and relative volume bit
+	volumeSecond   = 0x01
+	volumeRelative = 0x8000
+	volumeOne      = 0x100
+)
+
+var ErrFormat = errors.New("vgm: invalid file")
+
+// Header holds the header fields of the log used for YM2612 playback.
+type Header struct {
+	Version uint32
+	// SNClock is the PSG clock.
+	SNClock uint32
+	// Clock is the YM2612 clock without its flags.
+	Clock uint32
+	// YM3438 is set for logs of a YM3438 rather than a YM2612.
+	YM3438 bool
+	// Dual is set for logs of two YM2612s.
+	Dual bool
+	// Clock2 is the clock of the second chip of dual logs, which may be
+	// overridden by the extra header.
+	Clock2  uint32
+	Samples uint32
+	// LoopSamples is the length of the looped part, zero for logs that do
+	// not loop.
+	LoopSamples uint32
+	// LoopBase and LoopModifier adjust the loop count of players: it is
+	// multiplied by LoopModifier/16, then LoopBase is subtracted.
+	LoopBase     int8
+	LoopModifier uint8
+	// Volume is the linear gain of the volume modifier.
+	Volume float64
+	// ChipVolume is the linear gain of each YM2612 from the extra header.
+	ChipVolume [2]float64
+}
+
+// GD3 holds the GD3 tags.
+type GD3 struct {
+	Title    string
+	TitleJP  string
+	Game     string
+	GameJP   string
+	System   string
+	SystemJP string
+	Author   string
+	AuthorJP string
+	Date     string
+	Ripper   string
+	Notes    string
+}
+
+// File is a parsed VGM log.
+type File struct {
+	Header Header
+	// GD3 is nil for logs without tags.
+	GD3 *GD3
+	// Data is the uncompressed log starting with its header.
+	Data []byte
+	// Start is the offset of the first command in Data.
+	Start int
+	// Loop is the offset of the loop point in Data or -1.
+	Loop int
+}
+
+// Parse parses a VGM log, decompressing gzip compressed (VGZ) logs.
+func Parse(data []byte) (*File, error) {
+	if bytes.HasPrefix(data, []byte(gzipMagic)) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFormat, err)
+		}
+		defer r.Close()
+
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFormat, err)
+		}
+	}
+
+	if len(data) < minHeader || !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, fmt.Errorf("%w: bad header", ErrFormat)
+	}
+
+	f := &File{
+		Header: Header{
+			Version:      u32(data, offVersion),
+			SNClock:      u32(data, offSNClock),
+			Samples:      u32(data, offSamples),
+			LoopSamples:  u32(data, offLoopCount),
+			LoopModifier: 0x10,
+			Volume:       1,
+			ChipVolume:   [2]float64{1, 1},
+		},
+		Start: 0x40,
+		Loop:  -1,
+	}
+	if f.Header.Version >= 0x150 {
+		if off := u32(data, offData); off != 0 {
+			f.Start = offData + int(off)
+		}
+	}
+	if f.Start >= len(data) {
+		return nil, fmt.Errorf("%w: data offset out of range", ErrFormat)
+	}
+	// Header fields past the data are not part of the header
+	hdr := data[:f.Start]
+
+	// Versions before 1.10 have the YM2612 clock in the YM2413 field
+	clock := u32(data, 0x10)
+	if f.Header.Version >= 0x110 {
+		clock = u32(data, offYM2612)
+	}
+	f.Header.Clock = clock &^ (clockDual | clockYM3438)
+	f.Header.YM3438 = clock&clockYM3438 != 0
+	f.Header.Dual = clock&clockDual != 0 && f.Header.Clock != 0
+	f.Header.Clock2 = f.Header.Clock
+
+	if f.Header.Version >= 0x160 && len(hdr) > offLoopMod {
+		f.Header.Volume = volumeModifier(hdr[offVolume])
+		f.Header.LoopBase = int8(hdr[offLoopBase])
+		if hdr[offLoopMod] != 0 {
+			f.Header.LoopModifier = hdr[offLoopMod]
+		}
+	}
+	if f.Header.Version >= 0x170 && len(hdr) >= offExtra+4 {
+		if off := u32(hdr, offExtra); off != 0 {
+			if err := f.parseExtra(data, offExtra+int(off)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if off := u32(data, offLoop); off != 0 {
+		f.Loop = offLoop + int(off)
+		if f.Loop < f.Start || f.Loop >= len(data) {
+			f.Loop = -1
+		}
+	}
+	if off := u32(data, offGD3); off != 0 && offGD3+int(off) < len(data) {
+		gd3, err := parseGD3(data[offGD3+int(off):])
+		if err != nil {
+			return nil, err
+		}
+		f.GD3 = gd3
+	}
+	f.Data = data
+
+	return f, nil
+}
+
+// volumeModifier converts the header volume modifier to a gain of
+// 2^(modifier/32), -63 standing for -64.
+func volumeModifier(b uint8) float64 {
+	v := int(b)
+	if v > 0xc0 {
+		v -= 0x100
+	}
+	if v == -63 {
+		v = -64
+	}
+	return math.Pow(2, float64(v)/32)
+}
+
+// parseExtra parses the extra header of VGM 1.70 at off: the header size, then
+// the offsets of the clock and volume blocks relative to their own fields.
+func (f *File) parseExtra(data []byte, off int) error {
+	if off < 0 || off+4 > len(data) {
+		return fmt.Errorf("%w: extra header out of range", ErrFormat)
+	}
+	size := int(u32(data, off))
+	if size < 4 || off+size > len(data) {
+		return fmt.Errorf("%w: bad extra header size", ErrFormat)
+	}
+
+	if size >= 8 {
+		if rel := u32(data, off+4); rel != 0 {
+			entries, err := block(data, off+4+int(rel), 5)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				// Clocks only apply to the second chip
+				if e[0] == chipYM2612 {
+					f.Header.Clock2 = binary.LittleEndian.Uint32(e[1:]) &^ (clockDual | clockYM3438)
+				}
+			}
+		}
+	}
+	if size >= 12 {
+		if rel := u32(data, off+8); rel != 0 {
+			entries, err := block(data, off+8+int(rel), 4)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				// Bit 7 of the chip ID selects the paired chip of chips like
+				// the YM2203, the YM2612 has none
+				if e[0] != chipYM2612 {
+					continue
+				}
+				chip := int(e[1] & volumeSecond)
+				vol := binary.LittleEndian.Uint16(e[2:])
+				if vol&volumeRelative != 0 {
+					f.Header.ChipVolume[chip] *= float64(vol&^volumeRelative) / volumeOne
+				} else {
+					f.Header.ChipVolume[chip] = float64(vol) / volumeOne
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// block returns the entries of a count prefixed block of the extra header.
+func block(data []byte, off, size int) ([][]byte, error) {
+	if off < 0 || off >= len(data) {
+		return nil, fmt.Errorf("%w: extra header block out of range", ErrFormat)
+	}
+	n := int(data[off])
+	if off+1+n*size > len(data) {
+		return nil, fmt.Errorf("%w: short extra header block", ErrFormat)
+	}
+	entries := make([][]byte, n)
+	for i := range entries {
+		entries[i] = data[off+1+i*size : off+1+(i+1)*size]
+	}
+	return entries, nil
+}
+
+func parseGD3(data []byte) (*GD3, error) {
+	if len(data) < 12 || !bytes.HasPrefix(data, []byte(gd3Magic)) {
+		return nil, fmt.Errorf("%w: bad GD3 header", ErrFormat)
+	}
+	size := int(u32(data, 8))
+	if size > len(data)-12 {
+		return nil, fmt.Errorf("%w: short GD3 tags", ErrFormat)
+	}
+
+	var fields []string
+	var units []uint16
+	body := data[12 : 12+size]
+	for i := 0; i+1 < len(body); i += 2 {
+		u := binary.LittleEndian.Uint16(body[i:])
+		if u == 0 {
+			fields = append(fields, string(utf16.Decode(units)))
+			units = units[:0]
+			continue
+		}
+		units = append(units, u)
+	}
+
+	g := &GD3{}
+	for i, p := range []*string{
+		&g.Title, &g.TitleJP, &g.Game, &g.GameJP, &g.System, &g.SystemJP,
+		&g.Author, &g.AuthorJP, &g.Date, &g.Ripper, &g.Notes,
+	} {
+		if i < len(fields) {
+			*p = fields[i]
+		}
+	}
+
+	return g, nil
+}
+
+// cmdLen returns the length of a command including its parameters, or 0 for
+// data blocks whose length is stored in the command.
+func cmdLen(cmd byte) int {
+	switch {
+	case cmd == CmdDataBlock:
+		return 0
+	case cmd >= 0x30 && cmd <= 0x3f, cmd == CmdGGStereo, cmd == CmdPSG:
+		return 2
+	case cmd >= 0x40 && cmd <= 0x5f, cmd >= 0xa0 && cmd <= 0xbf:
+		return 3
+	case cmd == CmdWait:
+		return 3
+	case cmd == 0x64:
+		return 4
+	case cmd == CmdPCMWrite:
+		return 12
+	case cmd >= 0xc0 && cmd <= 0xdf:
+		return 4
+	case cmd >= 0xe0:
+		return 5
+	case cmd == 0x90, cmd == 0x91, cmd == 0x95:
+		return 5
+	case cmd == 0x92:
+		return 6
+	case cmd == 0x93:
+		return 11
+	case cmd == 0x94:
+		return 2
+	}
+	return 1
+}
+
+func u32(data []byte, off int) uint32 {
+	return binary.LittleEndian.Uint32(data[off:])
+}
+
+// Write is a YM2612 register write of a log.
+type Write struct {
+	// Sample is the time of the write in samples at Rate.
+	Sample uint64
+	// Chip is 1 for writes to the second chip of dual logs.
+	Chip uint8
+	Port uint8
+	Addr uint8
+	Data uint8
+}
+
+// Writes returns the YM2612 writes of the log from its start to its end,
+// including the DAC writes of PCM bank commands.
+func (f *File) Writes() []Write {
+	var writes []Write
+	var pcm []byte
+	var sample uint64
+	pcmPos := 0
+
+	data := f.Data
+	for pos := f.Start; pos < len(data) && data[pos] != CmdEnd; {
+		cmd := data[pos]
+		size := cmdLen(cmd)
+		if cmd == CmdDataBlock {
+			if pos+7 > len(data) {
+				break
+			}
+			n := int(binary.LittleEndian.Uint32(data[pos+3:]) & 0x7fffffff)
+			if n > len(data)-pos-7 {
+				break
+			}
+			if data[pos+2] == BlockYM2612 {
+				pcm = append(pcm, data[pos+7:pos+7+n]...)
+			}
+			size = 7 + n
+		}
+		if pos+size > len(data) {
+			break
+		}
+		args := data[pos+1 : pos+size]
+		pos += size
+
+		switch {
+		case cmd == CmdPort0, cmd == CmdPort1:
+			writes = append(writes, Write{sample, 0, cmd - CmdPort0, args[0], args[1]})
+		case f.Header.Dual && (cmd == Cmd2Port0 || cmd == Cmd2Port1):
+			writes = append(writes, Write{sample, 1, cmd - Cmd2Port0, args[0], args[1]})
+		case cmd == CmdWait:
+			sample += uint64(binary.LittleEndian.Uint16(args))
+		case cmd == CmdWait60:
+			sample += samples60
+		case cmd == CmdWait50:
+			sample += samples50
+		case cmd&0xf0 == CmdWaitShort:
+			sample += uint64(cmd&0x0f) + 1
+		case cmd&0xf0 == CmdDAC:
+			if pcmPos < len(pcm) {
+				writes = append(writes, Write{sample, 0, 0, 0x2a, pcm[pcmPos]})
+				pcmPos++
+			}
+			sample += uint64(cmd & 0x0f)
+		case cmd == CmdSeekPCM:
+			pcmPos = int(binary.LittleEndian.Uint32(args))
+		}
+	}
+
+	return writes
+}
@@ -0,0 +1,182 @@
+package vgm
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/elemir/nukeykt"
+)
+
+// vgmLog builds a log of the given version with a YM2612 clock and a header
+// of size bytes followed by body.
+func vgmLog(version uint32, clock uint32, size int, body ...byte) []byte {
+	log := make([]byte, size)
+	copy(log, magic)
+	binary.LittleEndian.PutUint32(log[offVersion:], version)
+	binary.LittleEndian.PutUint32(log[offData:], uint32(size-offData))
+	binary.LittleEndian.PutUint32(log[offYM2612:], clock)
+	return append(log, body...)
+}
+
+func TestWritesCommandLengths(t *testing.T) {
+	// The parameters of the skipped commands look like YM2612 writes
+	body := []byte{
+		CmdPCMWrite, 0x66, 0x00, 0x52, 0x28, 0xf0, 0x00, 0x00, 0x00, 0x53, 0x28, 0xf1,
+		0x64, 0x62, 0x52, 0x28,
+		0x30, 0x52, 0x4f, 0x00, 0x40, 0x52, 0x28, 0xa1, 0x52, 0x28,
+		0xc9, 0x52, 0x28, 0xf2, 0xd7, 0x52, 0x28, 0xf3, 0xe2, 0x52, 0x28, 0xf4, 0x00,
+		CmdPort0, 0x28, 0x01, CmdWaitShort, CmdPort1, 0x30, 0x02, CmdEnd,
+	}
+	file, err := Parse(vgmLog(0x171, DefaultClock, 0x100, body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Write{{0, 0, 0, 0x28, 0x01}, {1, 0, 1, 0x30, 0x02}}
+	writes := file.Writes()
+	if len(writes) != len(want) {
+		t.Fatalf("writes %+v, want %+v", writes, want)
+	}
+	for i := range want {
+		if writes[i] != want[i] {
+			t.Errorf("write %d is %+v, want %+v", i, writes[i], want[i])
+		}
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	for _, tc := range []struct {
+		version  uint32
+		modifier uint8
+		want     float64
+	}{
+		{0x160, 0x00, 1},
+		{0x160, 0x20, 2},
+		{0x160, 0xc0, 64},
+		{0x160, 0xe0, 0.5},
+		// 0xC1 stands for -64
+		{0x160, 0xc1, 0.25},
+		// Older versions have no volume modifier
+		{0x151, 0x20, 1},
+	} {
+		log := vgmLog(tc.version, DefaultClock, 0x80, CmdEnd)
+		log[offVolume], log[offLoopBase], log[offLoopMod] = tc.modifier, 0xff, 0x20
+		file, err := Parse(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := file.Header
+		if h.Volume != tc.want {
+			t.Errorf("version %#x modifier %#x: volume %v, want %v", tc.version, tc.modifier, h.Volume, tc.want)
+		}
+		if tc.version >= 0x160 && (h.LoopBase != -1 || h.LoopModifier != 0x20) {
+			t.Errorf("version %#x: loop base %d, modifier %#x", tc.version, h.LoopBase, h.LoopModifier)
+		}
+	}
+}
+
+// extraHeader returns a version 1.70 log with an extra header holding the
+// given clock and volume blocks.
+func extraHeader(clocks, volumes []byte) []byte {
+	log := vgmLog(0x170, clockDual|DefaultClock, 0x100, CmdEnd)
+	binary.LittleEndian.PutUint32(log[offExtra:], 0xc0-offExtra)
+
+	extra := log[0xc0:]
+	binary.LittleEndian.PutUint32(extra, 12)
+	if clocks != nil {
+		binary.LittleEndian.PutUint32(extra[4:], 8)
+		copy(extra[12:], clocks)
+	}
+	if volumes != nil {
+		binary.LittleEndian.PutUint32(extra[8:], uint32(len(clocks)+4))
+		copy(extra[12+len(clocks):], volumes)
+	}
+	return log
+}
+
+func TestParseExtraHeader(t *testing.T) {
+	clocks := []byte{2, 0x01, 0x00, 0x00, 0x00, 0x00, chipYM2612, 0x99, 0x9e, 0x36, 0x80}
+	for _, tc := range []struct {
+		name    string
+		volumes []byte
+		want    [2]float64
+	}{
+		{"absolute", []byte{2, chipYM2612, 0x00, 0x80, 0x00, chipYM2612, volumeSecond, 0x00, 0x03}, [2]float64{0.5, 3}},
+		// Relative volumes scale the volume set before them
+		{"relative", []byte{3, chipYM2612, 0x00, 0x00, 0x02, chipYM2612, 0x00, 0x80, 0x80,
+			chipYM2612, volumeSecond, 0x80, 0x80}, [2]float64{1, 0.5}},
+		// Bit 7 of the chip ID is the paired chip, which the YM2612 has not
+		{"paired chip", []byte{2, chipYM2612 | 0x80, 0x00, 0x00, 0x02, chipYM2612 | 0x80, volumeSecond, 0x00, 0x03},
+			[2]float64{1, 1}},
+		{"other chips", []byte{1, 0x01, 0x00, 0x00, 0x02}, [2]float64{1, 1}},
+		{"no volumes", nil, [2]float64{1, 1}},
+	} {
+		file, err := Parse(extraHeader(clocks, tc.volumes))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		h := file.Header
+		// Only the second chip takes its clock from the extra header, the
+		// flags are dropped
+		if !h.Dual || h.Clock != DefaultClock || h.Clock2 != 3579545 {
+			t.Errorf("%s: dual %v, clocks %d and %d", tc.name, h.Dual, h.Clock, h.Clock2)
+		}
+		if h.ChipVolume != tc.want {
+			t.Errorf("%s: chip volumes %v, want %v", tc.name, h.ChipVolume, tc.want)
+		}
+	}
+
+	// Blocks past the end of the file
+	log := extraHeader(nil, nil)
+	binary.LittleEndian.PutUint32(log[0xc4:], 0x1000)
+	if _, err := Parse(log); !errors.Is(err, ErrFormat) {
+		t.Errorf("clock block out of range: error %v", err)
+	}
+}
+
+func TestDual(t *testing.T) {
+	body := []byte{Cmd2Port0, 0x28, 0xf0, CmdPort0, 0x28, 0xf1, Cmd2Port1, 0x30, 0x02, CmdWaitShort, CmdEnd}
+
+	// Single chip logs skip the writes to the second chip
+	file, err := Parse(vgmLog(0x151, DefaultClock, 0x40, body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := file.Writes(); file.Header.Dual || len(w) != 1 || w[0] != (Write{0, 0, 0, 0x28, 0xf1}) {
+		t.Errorf("single chip: dual %v, writes %+v", file.Header.Dual, w)
+	}
+
+	file, err = Parse(vgmLog(0x151, clockDual|DefaultClock, 0x40, body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Write{{0, 1, 0, 0x28, 0xf0}, {0, 0, 0, 0x28, 0xf1}, {0, 1, 1, 0x30, 0x02}}
+	writes := file.Writes()
+	if !file.Header.Dual || len(writes) != len(want) {
+		t.Fatalf("dual %v, writes %+v", file.Header.Dual, writes)
+	}
+	for i := range want {
+		if writes[i] != want[i] {
+			t.Errorf("write %d is %+v, want %+v", i, writes[i], want[i])
+		}
+	}
+
+	// The player keys on channel 1 of the second chip and channel 2 of the
+	// first
+	p := NewPlayer(file, nukeykt.NewYM2612(), 44100)
+	buf := [][]int32{make([]int32, 64), make([]int32, 64)}
+	p.Generate(buf, 64)
+	chips := p.Chips()
+	if len(chips) != 2 {
+		t.Fatalf("%d chips", len(chips))
+	}
+	for i, want := range [2][2]bool{{false, true}, {true, false}} {
+		st := chips[i].(*nukeykt.YM3438).State()
+		for ch := range want {
+			if on := st.Channels[ch].Operators[0].KeyOn; on != want[ch] {
+				t.Errorf("chip %d channel %d keyed on %v", i, ch+1, on)
+			}
+		}
+	}
+}
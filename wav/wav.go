@@ -0,0 +1,45 @@
+// Package wav writes 16 bit PCM WAV files.
+package wav
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const headerSize = 44
+
+// Encode writes interleaved 16 bit samples as a WAV file.
+func Encode(w io.Writer, rate uint32, channels int, samples []int16) error {
+	size := uint32(len(samples) * 2)
+	align := uint16(channels * 2)
+
+	hdr := make([]byte, 0, headerSize)
+	hdr = append(hdr, "RIFF"...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, headerSize-8+size)
+	hdr = append(hdr, "WAVEfmt "...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 16)
+	hdr = binary.LittleEndian.AppendUint16(hdr, 1) // PCM
+	hdr = binary.LittleEndian.AppendUint16(hdr, uint16(channels))
+	hdr = binary.LittleEndian.AppendUint32(hdr, rate)
+	hdr = binary.LittleEndian.AppendUint32(hdr, rate*uint32(align))
+	hdr = binary.LittleEndian.AppendUint16(hdr, align)
+	hdr = binary.LittleEndian.AppendUint16(hdr, 16)
+	hdr = append(hdr, "data"...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, size)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, 4096)
+	for _, s := range samples {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(s))
+		if len(buf) == cap(buf) {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,71 @@
+package nukeykt
+
+import "math"
+
+const (
+	// Register writes take two buffered port writes. Writes run ahead of the
+	// chip by at most half the write buffer, longer bursts are spread over
+	// the time the buffer takes to drain.
+	pacerCycles = 2 * OPN_WRITEBUF_DELAY
+	pacerLead   = OPN_WRITEBUF_SIZE / 2 * OPN_WRITEBUF_DELAY
+)
+
+// Pacer queues the register writes of a player for a chip and gives them to
+// it no faster than its write buffer drains, so bursts of writes made at one
+// output sample are spread over the following cycles instead of overflowing
+// the buffer.
+type Pacer struct {
+	chip  Chip
+	clock uint64
+	rate  uint64
+
+	// pending are the writes not yet given to the chip, due is the cycle
+	// the next one is paced to.
+	pending []pacedWrite
+	head    int
+	due     uint64
+}
+
+type pacedWrite struct {
+	port       uint32
+	addr, data uint8
+}
+
+// NewPacer returns a pacer of the writes to a chip running at the given
+// clock, with time counted in samples at the given output rate.
+func NewPacer(chip Chip, clock, rate uint32) *Pacer {
+	return &Pacer{chip: chip, clock: uint64(clock), rate: uint64(rate)}
+}
+
+// Write queues a write of data to register addr through the address port,
+// 0 or 2, and the data port after it.
+func (p *Pacer) Write(port uint32, addr, data uint8) {
+	p.pending = append(p.pending, pacedWrite{port, addr, data})
+}
+
+// Pending reports whether writes are queued.
+func (p *Pacer) Pending() bool {
+	return len(p.pending) != 0
+}
+
+// Flush gives the chip the queued writes due once rendered samples were
+// generated and returns how many samples can be rendered before the next
+// one is due, math.MaxUint64 if none is left.
+func (p *Pacer) Flush(rendered uint64) uint64 {
+	cycle := rendered * p.clock / (6 * p.rate)
+	for ; p.head < len(p.pending); p.head++ {
+		if p.due > cycle+pacerLead {
+			// Render up to the cycle the write is due at, at least a sample
+			wait := (p.due - cycle - pacerLead) * 6 * p.rate / p.clock
+			return max(wait, 1)
+		}
+		w := p.pending[p.head]
+		p.chip.Write(w.port, w.addr)
+		p.chip.Write(w.port|1, w.data)
+		p.due = max(p.due, cycle) + pacerCycles
+	}
+
+	p.pending = p.pending[:0]
+	p.head = 0
+	return math.MaxUint64
+}
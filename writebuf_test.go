@@ -0,0 +1,77 @@
+package nukeykt
+
+import (
+	"math"
+	"testing"
+)
+
+// TestWriteBufferFull queues more writes than the write buffer holds without
+// generating output. Every write past its size applies the oldest entry and
+// clocks the chip up to the time of that entry.
+func TestWriteBufferFull(t *testing.T) {
+	chip := &YM3438{}
+	OPN2_Reset(chip, 44100, 7670453)
+
+	const extra = 10
+	for range OPN_WRITEBUF_SIZE + extra {
+		OPN2_WriteBuffered(chip, 0, 0x30)
+	}
+
+	// Writes are spaced OPN_WRITEBUF_DELAY cycles apart from the first one
+	// at OPN_WRITEBUF_DELAY
+	want := uint64(extra * OPN_WRITEBUF_DELAY)
+	if chip.writebuf_samplecnt != want {
+		t.Errorf("write buffer time %d, want %d", chip.writebuf_samplecnt, want)
+	}
+	if chip.cycles != uint32(want%24) {
+		t.Errorf("chip clocked to cycle %d, want %d", chip.cycles, want%24)
+	}
+}
+
+// pacerChip records the sample each port write is given before.
+type pacerChip struct {
+	Chip
+	rendered uint64
+	samples  []uint64
+}
+
+func (c *pacerChip) Write(port uint32, data uint8) {
+	c.samples = append(c.samples, c.rendered)
+}
+
+// TestPacer queues more writes at once than the write buffer holds. The
+// writes are given to the chip no faster than its buffer drains.
+func TestPacer(t *testing.T) {
+	const (
+		rate  = 44100
+		clock = 7670453
+		count = 3 * OPN_WRITEBUF_SIZE
+	)
+	chip := &pacerChip{}
+	p := NewPacer(chip, clock, rate)
+	for range count {
+		p.Write(0, 0x30, 0)
+	}
+	for p.Pending() {
+		n := p.Flush(chip.rendered)
+		if n == 0 {
+			t.Fatal("pacer waits for no samples")
+		}
+		if p.Pending() {
+			chip.rendered += n
+		}
+	}
+
+	if len(chip.samples) != 2*count {
+		t.Fatalf("%d writes, want %d", len(chip.samples), 2*count)
+	}
+	for i, sample := range chip.samples {
+		cycle := sample * clock / (6 * rate)
+		if queued := i - int(cycle/OPN_WRITEBUF_DELAY); queued > OPN_WRITEBUF_SIZE {
+			t.Fatalf("write %d at sample %d with %d writes queued", i, sample, queued)
+		}
+	}
+	if p.Flush(chip.rendered) != math.MaxUint64 {
+		t.Error("pacer waits with no writes queued")
+	}
+}
@@ -44,6 +44,10 @@ const (
 
 	ModeYM2612   = 0x01 /* Enables YM2612 emulation (MD1, MD2 VA2) */
 	ModeReadmode = 0x02 /* Enables status read on any port (TeraDrive, MD1 VA7, MD2, etc) */
+
+	BusyIgnore = 0 /* Writes made while busy are applied */
+	BusyReport = 1 /* Writes made while busy are applied and reported */
+	BusyDrop   = 2 /* Writes made while busy are reported and dropped */
 )
 
 type YM3438 struct {
@@ -187,18 +191,32 @@ type YM3438 struct {
 	pms          [6]uint8
 	status       uint8
 	status_time  uint32
-
-	mute       [7]uint32
-	rateratio  int32
+	/* Status bus, the default of the chip type unless set */
+	status_bus     StatusBus `hash:"-"`
+	status_bus_set uint8     `hash:"-"`
+
+	chip_type  uint32 `hash:"-"`
+	use_filter uint8  `hash:"-"`
+	clock      uint32 `hash:"-"`
+	rate       uint32 `hash:"-"`
+
+	mute       [7]uint32 `hash:"-"`
+	idle_skip  uint8     `hash:"-"`
+	rateratio  int32     `hash:"-"`
 	samplecnt  int32
 	oldsamples [2]int32
 	samples    [2]int32
 
+	busy_mode    uint8  `hash:"-"`
+	busy_writes  uint32 `hash:"-"`
+	busy_dropped uint32 `hash:"-"`
+	busy_hook    func(port uint32, data uint8, dropped bool)
+
 	writebuf_samplecnt uint64
 	writebuf_cur       uint32
 	writebuf_last      uint32
 	writebuf_lasttime  uint64
-	writebuf           [OPN_WRITEBUF_SIZE]writebuf
+	writebuf           [OPN_WRITEBUF_SIZE]writebuf `hash:"-"`
 }
 
 type writebuf struct {
@@ -1029,7 +1047,7 @@ func OPN2_ChOutput(chip *YM3438) {
 	chip.mol = 0
 	chip.mor = 0
 
-	if chip_type&ModeYM2612 != 0 {
+	if chip.chip_type&ModeYM2612 != 0 {
 		out_en = cbool.ToInt[uint32](((cycles & 3) == 3) || test_dac != 0)
 		/* YM2612 DAC emulation(not verified) */
 		sign = out >> 8
@@ -1200,11 +1218,35 @@ func OPN2_Reset(chip *YM3438, rate uint32, clock uint32) {
 		chip.pan_r[i] = 1
 	}
 
+	chip.chip_type = chip_type
+	chip.use_filter = cbool.ToInt[uint8](use_filter != 0)
+	chip.clock = clock
+	chip.rate = rate
 	chip.rateratio = int32(((uint64(144 * rate)) << RSM_FRAC) / uint64(clock))
+	chip.idle_skip = 1
 }
 
+/*
+ * Sets the type of chips reset by OPN2_Reset afterwards. The default is shared
+ * by all goroutines, use OPN2_SetType to set the type of a single chip.
+ */
 func OPN2_SetChipType(typ uint32) { chip_type = typ }
 
+/* Overrides the type of an already reset chip */
+func OPN2_SetType(chip *YM3438, typ uint32) { chip.chip_type = typ }
+
+/*
+ * Enables or disables the output low pass filter of chips reset by OPN2_Reset
+ * afterwards. The default is shared by all goroutines, use OPN2_SetChipFilter
+ * to set the filter of a single chip.
+ */
+func OPN2_SetFilter(filter int) { use_filter = filter }
+
+/* Enables or disables the output low pass filter of an already reset chip */
+func OPN2_SetChipFilter(chip *YM3438, filter int) {
+	chip.use_filter = cbool.ToInt[uint8](filter != 0)
+}
+
 func OPN2_Clock(chip *YM3438, buffer []int32) {
 	var slot uint32 = chip.cycles
 	chip.lfo_inc = chip.mode_test_21[1]
@@ -1323,6 +1365,17 @@ func OPN2_Clock(chip *YM3438, buffer []int32) {
 
 func OPN2_Write(chip *YM3438, port uint32, data uint8) {
 	port &= 3
+	if chip.write_busy != 0 && chip.busy_mode != BusyIgnore {
+		drop := chip.busy_mode == BusyDrop
+		chip.busy_writes++
+		chip.busy_dropped += cbool.ToInt[uint32](drop)
+		if chip.busy_hook != nil {
+			chip.busy_hook(port, data, drop)
+		}
+		if drop {
+			return
+		}
+	}
 	chip.write_data = uint16(((port << 7) & 0x100) | uint32(data))
 	if port&1 != 0 {
 		/* Data */
@@ -1350,7 +1403,11 @@ func OPN2_ReadIRQPin(chip *YM3438) uint32 {
 }
 
 func OPN2_Read(chip *YM3438, port uint32) uint8 {
-	if (port&3) == 0 || (chip_type&ModeReadmode != 0) {
+	bus := chip.status_bus
+	if chip.status_bus_set == 0 {
+		bus = defaultStatusBus(chip.chip_type)
+	}
+	if (bus.Ports>>(port&3))&0x01 != 0 {
 		if chip.mode_test_21[6] != 0 {
 			/* Read test data */
 			var slot uint32 = (chip.cycles + 18) % 24
@@ -1370,19 +1427,34 @@ func OPN2_Read(chip *YM3438, port uint32) uint8 {
 			chip.status = (chip.busy << 7) | (chip.timer_b_overflow_flag << 1) |
 				chip.timer_a_overflow_flag
 		}
-		if chip_type&ModeYM2612 != 0 {
-			chip.status_time = 300000
-		} else {
-			chip.status_time = 40000000
-		}
+		chip.status_time = bus.Decay
 	}
 	if chip.status_time != 0 {
 		return chip.status
 	}
-	return 0
+	return bus.OpenBus
+}
+
+/*
+ * Overrides the status bus of the chip type, nil restores it. The type sets
+ * the ports reading the status with ModeReadmode and the decay time with
+ * ModeYM2612.
+ */
+func OPN2_SetStatusBus(chip *YM3438, bus *StatusBus) {
+	chip.status_bus = StatusBus{}
+	chip.status_bus_set = 0
+	if bus != nil {
+		chip.status_bus = *bus
+		chip.status_bus_set = 1
+	}
 }
 
 func OPN2_WriteBuffered(chip *YM3438, port uint32, data uint8) {
+	OPN2_WriteBufferedAt(chip, port, data, 0)
+}
+
+/* Queues a write at the given cycle or as soon after it as the buffer allows */
+func OPN2_WriteBufferedAt(chip *YM3438, port uint32, data uint8, time uint64) {
 	var time1, time2 uint64
 	var buffer [2]int32
 	var skip uint64
@@ -1394,7 +1466,7 @@ func OPN2_WriteBuffered(chip *YM3438, port uint32, data uint8) {
 		chip.writebuf_cur = (chip.writebuf_last + 1) % OPN_WRITEBUF_SIZE
 		skip = chip.writebuf[chip.writebuf_last].time - chip.writebuf_samplecnt
 		chip.writebuf_samplecnt = chip.writebuf[chip.writebuf_last].time
-		for ; skip >= 0; skip-- {
+		for ; skip > 0; skip-- {
 			OPN2_Clock(chip, buffer[:])
 		}
 	}
@@ -1407,6 +1479,9 @@ func OPN2_WriteBuffered(chip *YM3438, port uint32, data uint8) {
 	if time1 < time2 {
 		time1 = time2
 	}
+	if time1 < time {
+		time1 = time
+	}
 
 	chip.writebuf[chip.writebuf_last].time = time1
 	chip.writebuf_lasttime = time1
@@ -1414,10 +1489,15 @@ func OPN2_WriteBuffered(chip *YM3438, port uint32, data uint8) {
 }
 
 var (
-	use_filter = 1 // FIXME(evgenii.omelchenko): should be part of chip
+	use_filter = 1
 )
 
 func OPN2_GenerateResampled(chip *YM3438, buf []int32) {
+	OPN2_GenerateResampledHook(chip, buf, nil)
+}
+
+/* Calls hook with the write buffer time before each cycle is clocked */
+func OPN2_GenerateResampledHook(chip *YM3438, buf []int32, hook func(cycle uint64)) {
 	var buffer [2]int32
 	var mute uint32
 
@@ -1426,43 +1506,50 @@ func OPN2_GenerateResampled(chip *YM3438, buf []int32) {
 		chip.oldsamples[1] = chip.samples[1]
 		chip.samples[0] = 0
 		chip.samples[1] = 0
-		for range 24 {
-			switch chip.cycles >> 2 {
-			case 0: // Ch 2
-				mute = chip.mute[1]
-			case 1: // Ch 6, DAC
-				mute = chip.mute[5+chip.dacen]
-			case 2: // Ch 4
-				mute = chip.mute[3]
-			case 3: // Ch 1
-				mute = chip.mute[0]
-			case 4: // Ch 5
-				mute = chip.mute[4]
-			case 5: // Ch 3
-				mute = chip.mute[2]
-			default:
-				mute = 0
-			}
-			OPN2_Clock(chip, buffer[:])
-			if mute == 0 {
-				chip.samples[0] += buffer[0]
-				chip.samples[1] += buffer[1]
-			}
+		if hook == nil && frameReady(chip) {
+			generateFrame(chip)
+		} else {
+			for range 24 {
+				switch chip.cycles >> 2 {
+				case 0: // Ch 2
+					mute = chip.mute[1]
+				case 1: // Ch 6, DAC
+					mute = chip.mute[5+chip.dacen]
+				case 2: // Ch 4
+					mute = chip.mute[3]
+				case 3: // Ch 1
+					mute = chip.mute[0]
+				case 4: // Ch 5
+					mute = chip.mute[4]
+				case 5: // Ch 3
+					mute = chip.mute[2]
+				default:
+					mute = 0
+				}
+				if hook != nil {
+					hook(chip.writebuf_samplecnt)
+				}
+				OPN2_Clock(chip, buffer[:])
+				if mute == 0 {
+					chip.samples[0] += buffer[0]
+					chip.samples[1] += buffer[1]
+				}
 
-			for chip.writebuf[chip.writebuf_cur].time <=
-				chip.writebuf_samplecnt {
-				if chip.writebuf[chip.writebuf_cur].port&0x04 == 0 {
-					break
+				for chip.writebuf[chip.writebuf_cur].time <=
+					chip.writebuf_samplecnt {
+					if chip.writebuf[chip.writebuf_cur].port&0x04 == 0 {
+						break
+					}
+					chip.writebuf[chip.writebuf_cur].port &= 0x03
+					OPN2_Write(chip, uint32(chip.writebuf[chip.writebuf_cur].port),
+						chip.writebuf[chip.writebuf_cur].data)
+					chip.writebuf_cur = (chip.writebuf_cur + 1) % OPN_WRITEBUF_SIZE
 				}
-				chip.writebuf[chip.writebuf_cur].port &= 0x03
-				OPN2_Write(chip, uint32(chip.writebuf[chip.writebuf_cur].port),
-					chip.writebuf[chip.writebuf_cur].data)
-				chip.writebuf_cur = (chip.writebuf_cur + 1) % OPN_WRITEBUF_SIZE
+				chip.writebuf_samplecnt++
 			}
-			chip.writebuf_samplecnt++
 		}
 
-		if use_filter == 0 {
+		if chip.use_filter == 0 {
 			chip.samples[0] *= OUTPUT_FACTOR
 			chip.samples[1] *= OUTPUT_FACTOR
 		} else {
@@ -1486,6 +1573,38 @@ func OPN2_GenerateResampled(chip *YM3438, buf []int32) {
 	chip.samplecnt += 1 << RSM_FRAC
 }
 
+func OPN2_SetMute(chip *YM3438, mute uint32) {
+	for i := range 7 {
+		chip.mute[i] = (mute >> i) & 0x01
+	}
+}
+
+/*
+ * Enables or disables skipping the operator pipeline while the chip is silent,
+ * enabled after reset. Skipping does not change the output, but the phase and
+ * envelope pipeline latches are not updated until the chip leaves the silence.
+ */
+func OPN2_SetIdleSkip(chip *YM3438, skip uint32) {
+	chip.idle_skip = uint8(skip & 0x01)
+}
+
+/*
+ * Sets the handling of writes made while the busy flag is set, BusyIgnore
+ * after reset. With BusyReport and BusyDrop such writes are counted and
+ * passed to hook, if not nil. Address and data writes are treated alike. The
+ * write buffer spaces writes closer than the busy time, so strict modes are
+ * meant for writes timed by the caller.
+ */
+func OPN2_SetBusyMode(chip *YM3438, mode uint32, hook func(port uint32, data uint8, dropped bool)) {
+	chip.busy_mode = uint8(mode)
+	chip.busy_hook = hook
+}
+
+/* Returns the counts of writes made while busy and of those dropped */
+func OPN2_BusyWrites(chip *YM3438) (writes, dropped uint32) {
+	return chip.busy_writes, chip.busy_dropped
+}
+
 func OPN2_GenerateStream(chip *YM3438, sndptr [][]int32, numsamples uint32) {
 	var smpl, smpr []int32
 	var buffer [2]int32
@@ -0,0 +1,254 @@
+package nukeykt
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/elemir/cbool"
+)
+
+var benchRates = []uint32{44100, 48000, 96000}
+
+// allocChip returns a chip with a voice on every channel, at the given rate
+// and filter setting.
+func allocChip(rate uint32, filter int) *YM3438 {
+	chip := voiceChip(ModeYM2612, rate)
+	OPN2_SetChipFilter(chip, filter)
+	return chip
+}
+
+// traffic writes count frequency and level registers across the channels,
+// starting at the register pair i.
+func traffic(chip *YM3438, i, count int) {
+	for j := range count {
+		ch := uint8(i+j) % 6
+		port := uint32(ch/3) << 1
+		switch (i + j) % 3 {
+		case 0:
+			OPN2_WriteBuffered(chip, port, 0xa4+ch%3)
+			OPN2_WriteBuffered(chip, port|1, 0x22)
+		case 1:
+			OPN2_WriteBuffered(chip, port, 0xa0+ch%3)
+			OPN2_WriteBuffered(chip, port|1, uint8(i+j))
+		case 2:
+			OPN2_WriteBuffered(chip, port, 0x4c+ch%3)
+			OPN2_WriteBuffered(chip, port|1, uint8(i+j)&0x1f)
+		}
+	}
+}
+
+// TestGenerateAllocs checks that none of the clocking, generation and write
+// paths allocate.
+func TestGenerateAllocs(t *testing.T) {
+	var buf [2]int32
+	var frame [24][2]int32
+	stream := [][]int32{make([]int32, 256), make([]int32, 256)}
+	fast := NewFastYM2612()
+	fast.Reset(44100, 7670453)
+
+	for _, filter := range []int{0, 1} {
+		for _, rate := range benchRates {
+			chip := allocChip(rate, filter)
+			fast.SetFilter(filter != 0)
+			i := 0
+			for _, tc := range []struct {
+				name string
+				f    func()
+			}{
+				{"Clock", func() { OPN2_Clock(chip, buf[:]) }},
+				{"ClockFrame", func() { OPN2_ClockFrame(chip, &frame) }},
+				{"GenerateResampled", func() { OPN2_GenerateResampled(chip, buf[:]) }},
+				{"GenerateResampledHook", func() { OPN2_GenerateResampledHook(chip, buf[:], func(uint64) {}) }},
+				{"GenerateStream", func() { OPN2_GenerateStream(chip, stream, 256) }},
+				{"WriteBuffered", func() {
+					traffic(chip, i, 8)
+					OPN2_GenerateResampled(chip, buf[:])
+					i++
+				}},
+				{"Fast", func() { fast.Generate(stream, 256) }},
+			} {
+				if n := testing.AllocsPerRun(100, tc.f); n != 0 {
+					t.Errorf("%s at %d Hz, filter %d: %v allocations", tc.name, rate, filter, n)
+				}
+			}
+		}
+	}
+}
+
+func TestBusyMode(t *testing.T) {
+	type write struct {
+		port    uint32
+		data    uint8
+		dropped bool
+	}
+
+	for _, mode := range []uint32{BusyIgnore, BusyReport, BusyDrop} {
+		chip := NewYM2612()
+		var got []write
+		OPN2_SetBusyMode(chip, mode, func(port uint32, data uint8, dropped bool) {
+			got = append(got, write{port, data, dropped})
+		})
+		chip.Reset(44100, 7670453)
+
+		var buf [2]int32
+		clock := func(n int) {
+			for range n {
+				OPN2_Clock(chip, buf[:])
+			}
+		}
+		OPN2_Write(chip, 0, 0x30)
+		clock(2)
+		OPN2_Write(chip, 1, 0x71)
+		clock(2)
+		// Busy after the data write
+		OPN2_Write(chip, 0, 0x34)
+		if dropped := chip.write_a&1 == 0; dropped != (mode == BusyDrop) {
+			t.Errorf("mode %d: address write dropped %v", mode, dropped)
+		}
+		clock(2)
+		OPN2_Write(chip, 1, 0x0d)
+		clock(40)
+		// Idle again
+		OPN2_Write(chip, 0, 0x38)
+		OPN2_Write(chip, 1, 0x33)
+
+		var want []write
+		if mode != BusyIgnore {
+			want = []write{{0, 0x34, mode == BusyDrop}, {1, 0x0d, mode == BusyDrop}}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("mode %d: hook calls %v, want %v", mode, got, want)
+		}
+		writes, dropped := OPN2_BusyWrites(chip)
+		if writes != uint32(len(want)) || dropped != uint32(len(want))*cbool.ToInt[uint32](mode == BusyDrop) {
+			t.Errorf("mode %d: %d writes while busy, %d dropped", mode, writes, dropped)
+		}
+	}
+}
+
+func TestStatusBus(t *testing.T) {
+	var buf [2]int32
+	for _, tc := range []struct {
+		name string
+		typ  uint32
+		bus  *StatusBus
+		want StatusBus
+	}{
+		{"ym2612", ModeYM2612, nil, StatusMD1},
+		{"ym3438", ModeReadmode, nil, StatusYM3438},
+		{"md1 bus on a ym3438", ModeReadmode, &StatusMD1, StatusMD1},
+		{"ym3438 bus on a ym2612", ModeYM2612, &StatusYM3438, StatusYM3438},
+		{"custom", ModeYM2612, &StatusBus{Decay: 1000, OpenBus: 0xff, Ports: 0x0a},
+			StatusBus{Decay: 1000, OpenBus: 0xff, Ports: 0x0a}},
+	} {
+		chip := &YM3438{chip_type: tc.typ}
+		OPN2_SetStatusBus(chip, tc.bus)
+		chip.Reset(44100, 7670453)
+		chip.timer_a_overflow_flag = 1
+		chip.timer_b_overflow_flag = 1
+
+		read := func(status bool, want uint8) {
+			t.Helper()
+			for port := range uint32(4) {
+				if tc.want.Ports>>port&1 != 0 != status {
+					continue
+				}
+				if got := OPN2_Read(chip, port); got != want {
+					t.Errorf("%s: port %d read %#x, want %#x", tc.name, port, got, want)
+				}
+			}
+		}
+
+		// Nothing latched after reset
+		read(false, tc.want.OpenBus)
+		// Status ports latch the status, the others read it back
+		read(true, 0x03)
+		read(false, 0x03)
+		if chip.status_time != tc.want.Decay {
+			t.Errorf("%s: status decays in %d cycles, want %d", tc.name, chip.status_time, tc.want.Decay)
+		}
+
+		for range min(tc.want.Decay, 1000) {
+			OPN2_Clock(chip, buf[:])
+		}
+		chip.status_time = min(chip.status_time, 1)
+		OPN2_Clock(chip, buf[:])
+		read(false, tc.want.OpenBus)
+		read(true, 0x03)
+	}
+}
+
+func BenchmarkClockCycle(b *testing.B) {
+	chip, _ := frameChips(ModeYM2612)
+	var buf [2]int32
+	for b.Loop() {
+		OPN2_Clock(chip, buf[:])
+	}
+}
+
+// BenchmarkGenerateResampled measures a sample of resampled output for every
+// output rate and filter setting.
+func BenchmarkGenerateResampled(b *testing.B) {
+	for _, filter := range []int{0, 1} {
+		for _, rate := range benchRates {
+			b.Run(fmt.Sprintf("%s/%d", []string{"nofilter", "lowpass"}[filter], rate), func(b *testing.B) {
+				chip := allocChip(rate, filter)
+				var buf [2]int32
+				for b.Loop() {
+					OPN2_GenerateResampled(chip, buf[:])
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkGenerateStreamSize reports the time per sample of streams of
+// growing length, which stays flat while generation scales linearly.
+func BenchmarkGenerateStreamSize(b *testing.B) {
+	for _, size := range []uint32{64, 1024, 16384} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			chip := allocChip(44100, 1)
+			buf := [][]int32{make([]int32, size), make([]int32, size)}
+			for b.Loop() {
+				OPN2_GenerateStream(chip, buf, size)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/float64(size), "ns/sample")
+		})
+	}
+}
+
+// BenchmarkGenerateHook measures the cycle by cycle path taken with a write
+// hook against the frame path.
+func BenchmarkGenerateHook(b *testing.B) {
+	chip := allocChip(44100, 1)
+	var buf [2]int32
+	hook := func(uint64) {}
+	for b.Loop() {
+		OPN2_GenerateResampledHook(chip, buf[:], hook)
+	}
+}
+
+// BenchmarkWriteBuffered measures a sample of output with register writes
+// queued before it. Light traffic stays within the write buffer, heavy
+// traffic fills it and writes flush the oldest entry.
+func BenchmarkWriteBuffered(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		count int
+	}{
+		{"light", 2},
+		{"heavy", 32},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			chip := allocChip(44100, 1)
+			var buf [2]int32
+			i := 0
+			for b.Loop() {
+				traffic(chip, i, bench.count)
+				OPN2_GenerateResampled(chip, buf[:])
+				i += bench.count
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package z80
+
+func (c *CPU) add8(a, b, carry uint8) uint8 {
+	r := uint16(a) + uint16(b) + uint16(carry)
+	res := uint8(r)
+	f := szxy(res)
+	if (a^b^res)&0x10 != 0 {
+		f |= FlagH
+	}
+	if (a^b^0x80)&(a^res)&0x80 != 0 {
+		f |= FlagPV
+	}
+	if r > 0xff {
+		f |= FlagC
+	}
+	c.F = f
+	return res
+}
+
+func (c *CPU) sub8(a, b, carry uint8) uint8 {
+	r := uint16(a) - uint16(b) - uint16(carry)
+	res := uint8(r)
+	f := szxy(res) | FlagN
+	if (a^b^res)&0x10 != 0 {
+		f |= FlagH
+	}
+	if (a^b)&(a^res)&0x80 != 0 {
+		f |= FlagPV
+	}
+	if r > 0xff {
+		f |= FlagC
+	}
+	c.F = f
+	return res
+}
+
+// alu performs the operation y of the ADD, ADC, SUB, SBC, AND, XOR, OR, CP
+// table on the accumulator.
+func (c *CPU) alu(y, v uint8) {
+	carry := c.F & FlagC
+	switch y {
+	case 0:
+		c.A = c.add8(c.A, v, 0)
+	case 1:
+		c.A = c.add8(c.A, v, carry)
+	case 2:
+		c.A = c.sub8(c.A, v, 0)
+	case 3:
+		c.A = c.sub8(c.A, v, carry)
+	case 4:
+		c.A &= v
+		c.F = szxy(c.A) | parity(c.A) | FlagH
+	case 5:
+		c.A ^= v
+		c.F = szxy(c.A) | parity(c.A)
+	case 6:
+		c.A |= v
+		c.F = szxy(c.A) | parity(c.A)
+	case 7:
+		c.sub8(c.A, v, 0)
+		// The undocumented flags of CP come from the operand
+		c.F = c.F&^(FlagX|FlagY) | v&(FlagX|FlagY)
+	}
+}
+
+func (c *CPU) inc8(v uint8) uint8 {
+	r := v + 1
+	f := c.F&FlagC | szxy(r)
+	if r&0x0f == 0 {
+		f |= FlagH
+	}
+	if r == 0x80 {
+		f |= FlagPV
+	}
+	c.F = f
+	return r
+}
+
+func (c *CPU) dec8(v uint8) uint8 {
+	r := v - 1
+	f := c.F&FlagC | szxy(r) | FlagN
+	if v&0x0f == 0 {
+		f |= FlagH
+	}
+	if v == 0x80 {
+		f |= FlagPV
+	}
+	c.F = f
+	return r
+}
+
+func (c *CPU) add16(a, b uint16) uint16 {
+	r := uint32(a) + uint32(b)
+	f := c.F&(FlagS|FlagZ|FlagPV) | uint8(r>>8)&(FlagX|FlagY)
+	if (a^b^uint16(r))&0x1000 != 0 {
+		f |= FlagH
+	}
+	if r > 0xffff {
+		f |= FlagC
+	}
+	c.F = f
+	return uint16(r)
+}
+
+func (c *CPU) adc16(a, b uint16) uint16 {
+	r := uint32(a) + uint32(b) + uint32(c.F&FlagC)
+	res := uint16(r)
+	f := uint8(res>>8) & (FlagS | FlagX | FlagY)
+	if res == 0 {
+		f |= FlagZ
+	}
+	if (a^b^res)&0x1000 != 0 {
+		f |= FlagH
+	}
+	if (a^b^0x8000)&(a^res)&0x8000 != 0 {
+		f |= FlagPV
+	}
+	if r > 0xffff {
+		f |= FlagC
+	}
+	c.F = f
+	return res
+}
+
+func (c *CPU) sbc16(a, b uint16) uint16 {
+	r := uint32(a) - uint32(b) - uint32(c.F&FlagC)
+	res := uint16(r)
+	f := uint8(res>>8)&(FlagS|FlagX|FlagY) | FlagN
+	if res == 0 {
+		f |= FlagZ
+	}
+	if (a^b^res)&0x1000 != 0 {
+		f |= FlagH
+	}
+	if (a^b)&(a^res)&0x8000 != 0 {
+		f |= FlagPV
+	}
+	if r > 0xffff {
+		f |= FlagC
+	}
+	c.F = f
+	return res
+}
+
+// rot performs the operation y of the RLC, RRC, RL, RR, SLA, SRA, SLL, SRL
+// table and sets the flags.
+func (c *CPU) rot(y, v uint8) uint8 {
+	var r, carry uint8
+	switch y {
+	case 0:
+		carry = v >> 7
+		r = v<<1 | carry
+	case 1:
+		carry = v & 1
+		r = v>>1 | carry<<7
+	case 2:
+		carry = v >> 7
+		r = v<<1 | c.F&FlagC
+	case 3:
+		carry = v & 1
+		r = v>>1 | (c.F&FlagC)<<7
+	case 4:
+		carry = v >> 7
+		r = v << 1
+	case 5:
+		carry = v & 1
+		r = v>>1 | v&0x80
+	case 6:
+		carry = v >> 7
+		r = v<<1 | 1
+	case 7:
+		carry = v & 1
+		r = v >> 1
+	}
+	c.F = szxy(r) | parity(r) | carry
+	return r
+}
+
+func (c *CPU) bit(y, v uint8, xy uint8) {
+	r := v & (1 << y)
+	f := c.F&FlagC | FlagH | xy&(FlagX|FlagY)
+	if r == 0 {
+		f |= FlagZ | FlagPV
+	}
+	if r&0x80 != 0 {
+		f |= FlagS
+	}
+	c.F = f
+}
+
+func (c *CPU) daa() {
+	a := c.A
+	var diff uint8
+	carry := c.F & FlagC
+	if c.F&FlagH != 0 || a&0x0f > 9 {
+		diff = 0x06
+	}
+	if carry != 0 || a > 0x99 {
+		diff |= 0x60
+		carry = FlagC
+	}
+
+	var half uint8
+	if c.F&FlagN != 0 {
+		if c.F&FlagH != 0 && a&0x0f < 6 {
+			half = FlagH
+		}
+		a -= diff
+	} else {
+		if a&0x0f > 9 {
+			half = FlagH
+		}
+		a += diff
+	}
+
+	c.A = a
+	c.F = szxy(a) | parity(a) | half | carry | c.F&FlagN
+}
@@ -0,0 +1,349 @@
+// Package z80 emulates the Zilog Z80 CPU at instruction level with exact
+// T-state counts.
+package z80
+
+import (
+	"math/bits"
+)
+
+// Flags
+const (
+	FlagC  = 0x01
+	FlagN  = 0x02
+	FlagPV = 0x04
+	FlagX  = 0x08
+	FlagH  = 0x10
+	FlagY  = 0x20
+	FlagZ  = 0x40
+	FlagS  = 0x80
+)
+
+// Bus is the memory and I/O space seen by the CPU.
+type Bus interface {
+	Read(addr uint16) uint8
+	Write(addr uint16, data uint8)
+	In(port uint16) uint8
+	Out(port uint16, data uint8)
+}
+
+// Registers is the register file.
+type Registers struct {
+	A, F, B, C, D, E, H, L         uint8
+	A_, F_, B_, C_, D_, E_, H_, L_ uint8
+
+	IX, IY, SP, PC uint16
+	I, R           uint8
+	IFF1, IFF2     bool
+	IM             uint8
+}
+
+// CPU is a Z80 attached to a bus.
+type CPU struct {
+	Registers
+	Halted bool
+
+	bus     Bus
+	intLine bool
+	nmi     bool
+	eiDelay bool
+
+	// Index register selected by a DD or FD prefix and its displacement
+	index  int
+	disp   uint16
+	cycles int
+}
+
+const (
+	indexHL = iota
+	indexIX
+	indexIY
+)
+
+// New creates a CPU in its reset state.
+func New(bus Bus) *CPU {
+	c := &CPU{bus: bus}
+	c.Reset()
+	return c
+}
+
+// Reset resets the CPU like its RESET pin.
+func (c *CPU) Reset() {
+	c.Registers = Registers{A: 0xff, F: 0xff, SP: 0xffff}
+	c.Halted = false
+	c.eiDelay = false
+	c.nmi = false
+}
+
+// SetINT sets the level of the maskable interrupt line.
+func (c *CPU) SetINT(active bool) {
+	c.intLine = active
+}
+
+// NMI requests a non-maskable interrupt.
+func (c *CPU) NMI() {
+	c.nmi = true
+}
+
+// Step executes one instruction or accepts an interrupt and returns the
+// number of T-states it took.
+func (c *CPU) Step() int {
+	c.cycles = 0
+
+	switch {
+	case c.nmi:
+		c.nmi = false
+		c.Halted = false
+		c.IFF1 = false
+		c.incR()
+		c.push(c.PC)
+		c.PC = 0x66
+		return 11
+	case c.intLine && c.IFF1 && !c.eiDelay:
+		c.Halted = false
+		c.IFF1, c.IFF2 = false, false
+		c.incR()
+		c.push(c.PC)
+		if c.IM == 2 {
+			// The data bus floats high without a device driving a vector
+			vec := uint16(c.I)<<8 | 0xff
+			c.PC = c.read16(vec)
+			return 19
+		}
+		c.PC = 0x38
+		return 13
+	}
+	c.eiDelay = false
+
+	if c.Halted {
+		c.incR()
+		return 4
+	}
+
+	c.index = indexHL
+	op := c.fetchOp()
+	for op == 0xdd || op == 0xfd {
+		c.index = indexIX
+		if op == 0xfd {
+			c.index = indexIY
+		}
+		c.cycles += 4
+		op = c.fetchOp()
+	}
+
+	switch {
+	case op == 0xcb:
+		c.execCB()
+	case op == 0xed:
+		c.index = indexHL
+		c.execED(c.fetchOp())
+	default:
+		c.exec(op)
+	}
+
+	return c.cycles
+}
+
+func (c *CPU) incR() {
+	c.R = c.R&0x80 | (c.R+1)&0x7f
+}
+
+func (c *CPU) fetchOp() uint8 {
+	c.incR()
+	op := c.bus.Read(c.PC)
+	c.PC++
+	return op
+}
+
+func (c *CPU) fetch() uint8 {
+	b := c.bus.Read(c.PC)
+	c.PC++
+	return b
+}
+
+func (c *CPU) fetch16() uint16 {
+	lo := c.fetch()
+	return uint16(c.fetch())<<8 | uint16(lo)
+}
+
+func (c *CPU) read16(addr uint16) uint16 {
+	return uint16(c.bus.Read(addr+1))<<8 | uint16(c.bus.Read(addr))
+}
+
+func (c *CPU) write16(addr, v uint16) {
+	c.bus.Write(addr, uint8(v))
+	c.bus.Write(addr+1, uint8(v>>8))
+}
+
+func (c *CPU) push(v uint16) {
+	c.SP -= 2
+	c.write16(c.SP, v)
+}
+
+func (c *CPU) pop() uint16 {
+	v := c.read16(c.SP)
+	c.SP += 2
+	return v
+}
+
+func (c *CPU) BC() uint16 { return uint16(c.B)<<8 | uint16(c.C) }
+func (c *CPU) DE() uint16 { return uint16(c.D)<<8 | uint16(c.E) }
+func (c *CPU) HL() uint16 { return uint16(c.H)<<8 | uint16(c.L) }
+func (c *CPU) AF() uint16 { return uint16(c.A)<<8 | uint16(c.F) }
+
+func (c *CPU) setBC(v uint16) { c.B, c.C = uint8(v>>8), uint8(v) }
+func (c *CPU) setDE(v uint16) { c.D, c.E = uint8(v>>8), uint8(v) }
+func (c *CPU) setHL(v uint16) { c.H, c.L = uint8(v>>8), uint8(v) }
+func (c *CPU) setAF(v uint16) { c.A, c.F = uint8(v>>8), uint8(v) }
+
+// hl returns HL or the index register selected by the prefix.
+func (c *CPU) hl() uint16 {
+	switch c.index {
+	case indexIX:
+		return c.IX
+	case indexIY:
+		return c.IY
+	}
+	return c.HL()
+}
+
+func (c *CPU) setHLIndexed(v uint16) {
+	switch c.index {
+	case indexIX:
+		c.IX = v
+	case indexIY:
+		c.IY = v
+	default:
+		c.setHL(v)
+	}
+}
+
+// addr returns the address of the (HL) operand, fetching the displacement of
+// indexed instructions.
+func (c *CPU) addr() uint16 {
+	if c.index == indexHL {
+		return c.HL()
+	}
+	c.disp = c.hl() + uint16(int8(c.fetch()))
+	return c.disp
+}
+
+// reg reads an 8 bit register by its encoding, 6 being (HL). H and L are
+// replaced by the index halves unless the instruction accesses memory.
+func (c *CPU) reg(r uint8, mem uint16) uint8 {
+	switch r {
+	case 0:
+		return c.B
+	case 1:
+		return c.C
+	case 2:
+		return c.D
+	case 3:
+		return c.E
+	case 4:
+		return uint8(c.hl() >> 8)
+	case 5:
+		return uint8(c.hl())
+	case 6:
+		return c.bus.Read(mem)
+	}
+	return c.A
+}
+
+func (c *CPU) setReg(r uint8, mem uint16, v uint8) {
+	switch r {
+	case 0:
+		c.B = v
+	case 1:
+		c.C = v
+	case 2:
+		c.D = v
+	case 3:
+		c.E = v
+	case 4:
+		c.setHLIndexed(c.hl()&0x00ff | uint16(v)<<8)
+	case 5:
+		c.setHLIndexed(c.hl()&0xff00 | uint16(v))
+	case 6:
+		c.bus.Write(mem, v)
+	case 7:
+		c.A = v
+	}
+}
+
+// rp reads a register pair of the BC, DE, HL, SP table.
+func (c *CPU) rp(p uint8) uint16 {
+	switch p {
+	case 0:
+		return c.BC()
+	case 1:
+		return c.DE()
+	case 2:
+		return c.hl()
+	}
+	return c.SP
+}
+
+func (c *CPU) setRP(p uint8, v uint16) {
+	switch p {
+	case 0:
+		c.setBC(v)
+	case 1:
+		c.setDE(v)
+	case 2:
+		c.setHLIndexed(v)
+	default:
+		c.SP = v
+	}
+}
+
+// rp2 reads a register pair of the BC, DE, HL, AF table.
+func (c *CPU) rp2(p uint8) uint16 {
+	if p == 3 {
+		return c.AF()
+	}
+	return c.rp(p)
+}
+
+func (c *CPU) setRP2(p uint8, v uint16) {
+	if p == 3 {
+		c.setAF(v)
+	} else {
+		c.setRP(p, v)
+	}
+}
+
+func (c *CPU) cond(y uint8) bool {
+	switch y {
+	case 0:
+		return c.F&FlagZ == 0
+	case 1:
+		return c.F&FlagZ != 0
+	case 2:
+		return c.F&FlagC == 0
+	case 3:
+		return c.F&FlagC != 0
+	case 4:
+		return c.F&FlagPV == 0
+	case 5:
+		return c.F&FlagPV != 0
+	case 6:
+		return c.F&FlagS == 0
+	}
+	return c.F&FlagS != 0
+}
+
+func parity(v uint8) uint8 {
+	if bits.OnesCount8(v)&1 == 0 {
+		return FlagPV
+	}
+	return 0
+}
+
+// szxy returns the sign, zero and undocumented flags of a result.
+func szxy(v uint8) uint8 {
+	f := v & (FlagS | FlagX | FlagY)
+	if v == 0 {
+		f |= FlagZ
+	}
+	return f
+}
@@ -0,0 +1,394 @@
+package z80
+
+import (
+	"testing"
+)
+
+// testBus is 64 KB of RAM and 256 I/O ports decoded by the low address byte.
+type testBus struct {
+	mem [0x10000]uint8
+	io  [0x100]uint8
+}
+
+func (b *testBus) Read(addr uint16) uint8        { return b.mem[addr] }
+func (b *testBus) Write(addr uint16, data uint8) { b.mem[addr] = data }
+func (b *testBus) In(port uint16) uint8          { return b.io[uint8(port)] }
+func (b *testBus) Out(port uint16, data uint8)   { b.io[uint8(port)] = data }
+
+// TestInstructions runs instructions from address 0 and compares the
+// registers, memory and T-states with the documented results, undocumented
+// flags included. R is left out.
+func TestInstructions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		code []byte
+		// steps is the number of instructions run, one if zero
+		steps  int
+		init   func(r *Registers, b *testBus)
+		want   func(r *Registers, b *testBus)
+		cycles int
+	}{
+		// 8 bit arithmetic and logic
+		{"ADD A,B overflow", []byte{0x80}, 0,
+			func(r *Registers, b *testBus) { r.A, r.B = 0x7f, 0x01 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x80, 0x94 }, 4},
+		{"ADD A,n carry", []byte{0xc6, 0x01}, 0,
+			func(r *Registers, b *testBus) { r.A = 0xff },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x00, 0x51 }, 7},
+		{"SUB B", []byte{0x90}, 0,
+			func(r *Registers, b *testBus) { r.A, r.B = 0x80, 0x01 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x7f, 0x3e }, 4},
+		{"CP n", []byte{0xfe, 0x28}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x10 },
+			func(r *Registers, b *testBus) { r.F = 0xbb }, 7},
+		{"ADC A,B", []byte{0x88}, 0,
+			func(r *Registers, b *testBus) { r.A, r.F = 0x0f, FlagC },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x10, 0x10 }, 4},
+		{"SBC A,B", []byte{0x98}, 0,
+			func(r *Registers, b *testBus) { r.F = FlagC },
+			func(r *Registers, b *testBus) { r.A, r.F = 0xff, 0xbb }, 4},
+		{"AND n", []byte{0xe6, 0x3c}, 0,
+			func(r *Registers, b *testBus) { r.A = 0xf0 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x30, 0x34 }, 7},
+		{"XOR A", []byte{0xaf}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x5a },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x00, 0x44 }, 4},
+		{"OR (HL)", []byte{0xb6}, 0,
+			func(r *Registers, b *testBus) { r.A, r.H, b.mem[0x4000] = 0x01, 0x40, 0x02 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x03, 0x04 }, 7},
+		{"INC A", []byte{0x3c}, 0,
+			func(r *Registers, b *testBus) { r.A, r.F = 0x7f, FlagC },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x80, 0x95 }, 4},
+		{"DEC B", []byte{0x05}, 0,
+			nil,
+			func(r *Registers, b *testBus) { r.B, r.F = 0xff, 0xba }, 4},
+		{"INC (HL)", []byte{0x34}, 0,
+			func(r *Registers, b *testBus) { r.H, b.mem[0x4000] = 0x40, 0x0f },
+			func(r *Registers, b *testBus) { r.F, b.mem[0x4000] = 0x10, 0x10 }, 11},
+		{"DAA after ADD", []byte{0xc6, 0x01, 0x27}, 2,
+			func(r *Registers, b *testBus) { r.A = 0x09 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x10, 0x10 }, 11},
+		{"DAA after ADD carry", []byte{0xc6, 0x01, 0x27}, 2,
+			func(r *Registers, b *testBus) { r.A = 0x99 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x00, 0x55 }, 11},
+		{"DAA after SUB", []byte{0xd6, 0x01, 0x27}, 2,
+			func(r *Registers, b *testBus) { r.A = 0x10 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x09, 0x0e }, 11},
+		{"RLCA", []byte{0x07}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x81 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x03, 0x01 }, 4},
+		{"RRA", []byte{0x1f}, 0,
+			func(r *Registers, b *testBus) { r.A, r.F = 0x01, FlagZ },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x00, 0x41 }, 4},
+		{"CPL", []byte{0x2f}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x5a },
+			func(r *Registers, b *testBus) { r.A, r.F = 0xa5, 0x32 }, 4},
+		{"SCF", []byte{0x37}, 0,
+			func(r *Registers, b *testBus) { r.A, r.F = 0x28, FlagH|FlagN },
+			func(r *Registers, b *testBus) { r.F = 0x29 }, 4},
+		{"CCF", []byte{0x3f}, 0,
+			func(r *Registers, b *testBus) { r.F = FlagC },
+			func(r *Registers, b *testBus) { r.F = 0x10 }, 4},
+		{"NEG 0x80", []byte{0xed, 0x44}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x80 },
+			func(r *Registers, b *testBus) { r.F = 0x87 }, 8},
+		{"NEG 0x01", []byte{0xed, 0x44}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x01 },
+			func(r *Registers, b *testBus) { r.A, r.F = 0xff, 0xbb }, 8},
+
+		// 16 bit arithmetic
+		{"ADD HL,BC", []byte{0x09}, 0,
+			func(r *Registers, b *testBus) { r.H, r.L, r.C, r.F = 0x0f, 0xff, 0x01, FlagZ|FlagN },
+			func(r *Registers, b *testBus) { r.H, r.L, r.F = 0x10, 0x00, 0x50 }, 11},
+		{"ADC HL,DE", []byte{0xed, 0x5a}, 0,
+			func(r *Registers, b *testBus) { r.H, r.L, r.F = 0x7f, 0xff, FlagC },
+			func(r *Registers, b *testBus) { r.H, r.L, r.F = 0x80, 0x00, 0x94 }, 15},
+		{"SBC HL,DE", []byte{0xed, 0x52}, 0,
+			nil,
+			func(r *Registers, b *testBus) { r.F = 0x42 }, 15},
+		{"ADD IX,SP", []byte{0xdd, 0x39}, 0,
+			func(r *Registers, b *testBus) { r.IX, r.SP = 0x1000, 0xf000 },
+			func(r *Registers, b *testBus) { r.IX, r.F = 0x0000, 0x01 }, 15},
+
+		// Rotations and bits
+		{"RLC B", []byte{0xcb, 0x00}, 0,
+			func(r *Registers, b *testBus) { r.B = 0x80 },
+			func(r *Registers, b *testBus) { r.B, r.F = 0x01, 0x01 }, 8},
+		{"SRA (HL)", []byte{0xcb, 0x2e}, 0,
+			func(r *Registers, b *testBus) { r.H, b.mem[0x4000] = 0x40, 0x81 },
+			func(r *Registers, b *testBus) { r.F, b.mem[0x4000] = 0x85, 0xc0 }, 15},
+		{"SLL B", []byte{0xcb, 0x30}, 0,
+			func(r *Registers, b *testBus) { r.B = 0x80 },
+			func(r *Registers, b *testBus) { r.B, r.F = 0x01, 0x01 }, 8},
+		{"BIT 7,A", []byte{0xcb, 0x7f}, 0,
+			func(r *Registers, b *testBus) { r.A = 0x80 },
+			func(r *Registers, b *testBus) { r.F = 0x90 }, 8},
+		{"BIT 0,A", []byte{0xcb, 0x47}, 0,
+			func(r *Registers, b *testBus) { r.A, r.F = 0x80, FlagC },
+			func(r *Registers, b *testBus) { r.F = 0x55 }, 8},
+		{"BIT 3,(HL)", []byte{0xcb, 0x5e}, 0,
+			func(r *Registers, b *testBus) { r.H, b.mem[0x2800] = 0x28, 0x00 },
+			func(r *Registers, b *testBus) { r.F = 0x7c }, 12},
+		{"BIT 3,(IX+2)", []byte{0xdd, 0xcb, 0x02, 0x5e}, 0,
+			func(r *Registers, b *testBus) { r.IX, b.mem[0x2802] = 0x2800, 0x08 },
+			func(r *Registers, b *testBus) { r.F = 0x38 }, 20},
+		{"SET 0,(IX+1),B", []byte{0xdd, 0xcb, 0x01, 0xc0}, 0,
+			func(r *Registers, b *testBus) { r.IX, b.mem[0x4001] = 0x4000, 0x80 },
+			func(r *Registers, b *testBus) { r.B, b.mem[0x4001] = 0x81, 0x81 }, 23},
+		{"RES 7,(IY-1)", []byte{0xfd, 0xcb, 0xff, 0xbe}, 0,
+			func(r *Registers, b *testBus) { r.IY, b.mem[0x4000] = 0x4001, 0xff },
+			func(r *Registers, b *testBus) { b.mem[0x4000] = 0x7f }, 23},
+		{"RRD", []byte{0xed, 0x67}, 0,
+			func(r *Registers, b *testBus) { r.A, r.H, b.mem[0x4000] = 0x12, 0x40, 0x34 },
+			func(r *Registers, b *testBus) { r.A, r.F, b.mem[0x4000] = 0x14, 0x04, 0x23 }, 18},
+		{"RLD", []byte{0xed, 0x6f}, 0,
+			func(r *Registers, b *testBus) { r.A, r.H, b.mem[0x4000] = 0x12, 0x40, 0x34 },
+			func(r *Registers, b *testBus) { r.A, r.F, b.mem[0x4000] = 0x13, 0x00, 0x42 }, 18},
+
+		// Index registers
+		{"LD A,(IX-1)", []byte{0xdd, 0x7e, 0xff}, 0,
+			func(r *Registers, b *testBus) { r.IX, b.mem[0x4000] = 0x4001, 0x42 },
+			func(r *Registers, b *testBus) { r.A = 0x42 }, 19},
+		{"LD (IY+3),n", []byte{0xfd, 0x36, 0x03, 0x42}, 0,
+			func(r *Registers, b *testBus) { r.IY = 0x4000 },
+			func(r *Registers, b *testBus) { b.mem[0x4003] = 0x42 }, 19},
+		{"LD IXH,n", []byte{0xdd, 0x26, 0x12}, 0,
+			func(r *Registers, b *testBus) { r.IX = 0x0034 },
+			func(r *Registers, b *testBus) { r.IX = 0x1234 }, 11},
+		{"LD H,(IX+0)", []byte{0xdd, 0x66, 0x00}, 0,
+			func(r *Registers, b *testBus) { r.IX, b.mem[0x4000] = 0x4000, 0x55 },
+			func(r *Registers, b *testBus) { r.H = 0x55 }, 19},
+		{"INC (IX+0)", []byte{0xdd, 0x34, 0x00}, 0,
+			func(r *Registers, b *testBus) { r.IX, b.mem[0x4000] = 0x4000, 0x7f },
+			func(r *Registers, b *testBus) { r.F, b.mem[0x4000] = 0x94, 0x80 }, 23},
+		{"ADD A,IXL", []byte{0xdd, 0x85}, 0,
+			func(r *Registers, b *testBus) { r.A, r.IX = 0x01, 0x0002 },
+			func(r *Registers, b *testBus) { r.A = 0x03 }, 8},
+		{"EX DE,HL after DD", []byte{0xdd, 0xeb}, 0,
+			func(r *Registers, b *testBus) { r.D, r.E, r.H, r.L, r.IX = 1, 2, 3, 4, 0x5555 },
+			func(r *Registers, b *testBus) { r.D, r.E, r.H, r.L = 3, 4, 1, 2 }, 8},
+		{"LD SP,IY", []byte{0xfd, 0xf9}, 0,
+			func(r *Registers, b *testBus) { r.IY = 0x1234 },
+			func(r *Registers, b *testBus) { r.SP = 0x1234 }, 10},
+
+		// Memory, stack and jumps
+		{"LD (nn),HL", []byte{0x22, 0x00, 0x40}, 0,
+			func(r *Registers, b *testBus) { r.H, r.L = 0x12, 0x34 },
+			func(r *Registers, b *testBus) { b.mem[0x4000], b.mem[0x4001] = 0x34, 0x12 }, 16},
+		{"LD BC,(nn)", []byte{0xed, 0x4b, 0x00, 0x40}, 0,
+			func(r *Registers, b *testBus) { b.mem[0x4000], b.mem[0x4001] = 0x34, 0x12 },
+			func(r *Registers, b *testBus) { r.B, r.C = 0x12, 0x34 }, 20},
+		{"PUSH BC", []byte{0xc5}, 0,
+			func(r *Registers, b *testBus) { r.B, r.C = 0x12, 0x34 },
+			func(r *Registers, b *testBus) { r.SP, b.mem[0xeffe], b.mem[0xefff] = 0xeffe, 0x34, 0x12 }, 11},
+		{"POP AF", []byte{0xf1}, 0,
+			func(r *Registers, b *testBus) { r.SP, b.mem[0xeffe], b.mem[0xefff] = 0xeffe, 0xd7, 0x12 },
+			func(r *Registers, b *testBus) { r.SP, r.A, r.F = 0xf000, 0x12, 0xd7 }, 10},
+		{"EX (SP),HL", []byte{0xe3}, 0,
+			func(r *Registers, b *testBus) {
+				r.SP, r.H, r.L, b.mem[0xeffe], b.mem[0xefff] = 0xeffe, 0x12, 0x34, 0x78, 0x56
+			},
+			func(r *Registers, b *testBus) { r.H, r.L, b.mem[0xeffe], b.mem[0xefff] = 0x56, 0x78, 0x34, 0x12 }, 19},
+		{"CALL nn", []byte{0xcd, 0x00, 0x10}, 0,
+			nil,
+			func(r *Registers, b *testBus) { r.PC, r.SP, b.mem[0xeffe] = 0x1000, 0xeffe, 0x03 }, 17},
+		{"CALL NZ,nn not taken", []byte{0xc4, 0x00, 0x10}, 0,
+			func(r *Registers, b *testBus) { r.F = FlagZ },
+			nil, 10},
+		{"RET", []byte{0xc9}, 0,
+			func(r *Registers, b *testBus) { r.SP, b.mem[0xefff] = 0xeffe, 0x10 },
+			func(r *Registers, b *testBus) { r.PC, r.SP = 0x1000, 0xf000 }, 10},
+		{"RET NZ not taken", []byte{0xc0}, 0,
+			func(r *Registers, b *testBus) { r.F = FlagZ },
+			nil, 5},
+		{"RET Z", []byte{0xc8}, 0,
+			func(r *Registers, b *testBus) { r.F, r.SP, b.mem[0xefff] = FlagZ, 0xeffe, 0x10 },
+			func(r *Registers, b *testBus) { r.PC, r.SP = 0x1000, 0xf000 }, 11},
+		{"RST 38", []byte{0xff}, 0,
+			nil,
+			func(r *Registers, b *testBus) { r.PC, r.SP, b.mem[0xeffe] = 0x38, 0xeffe, 0x01 }, 11},
+		{"JR NZ", []byte{0x20, 0x10}, 0,
+			nil,
+			func(r *Registers, b *testBus) { r.PC = 0x12 }, 12},
+		{"JR NZ not taken", []byte{0x20, 0x10}, 0,
+			func(r *Registers, b *testBus) { r.F = FlagZ },
+			nil, 7},
+		{"DJNZ", []byte{0x10, 0xfe}, 0,
+			func(r *Registers, b *testBus) { r.B = 2 },
+			func(r *Registers, b *testBus) { r.PC, r.B = 0, 1 }, 13},
+		{"DJNZ done", []byte{0x10, 0xfe}, 0,
+			func(r *Registers, b *testBus) { r.B = 1 },
+			func(r *Registers, b *testBus) { r.B = 0 }, 8},
+		{"JP (IX)", []byte{0xdd, 0xe9}, 0,
+			func(r *Registers, b *testBus) { r.IX = 0x1234 },
+			func(r *Registers, b *testBus) { r.PC = 0x1234 }, 8},
+
+		// Block instructions
+		{"LDIR", []byte{0xed, 0xb0}, 3,
+			func(r *Registers, b *testBus) {
+				r.H, r.D, r.C, r.F = 0x40, 0x50, 3, FlagH|FlagN|FlagPV
+				copy(b.mem[0x4000:], []byte{1, 2, 3})
+			},
+			func(r *Registers, b *testBus) {
+				r.L, r.E, r.C, r.F = 0x03, 0x03, 0, 0x20
+				copy(b.mem[0x5000:], []byte{1, 2, 3})
+			}, 58},
+		{"CPIR", []byte{0xed, 0xb1}, 2,
+			func(r *Registers, b *testBus) {
+				r.A, r.H, r.C = 0x33, 0x40, 3
+				copy(b.mem[0x4000:], []byte{0x11, 0x33, 0x55})
+			},
+			func(r *Registers, b *testBus) { r.L, r.C, r.F = 0x02, 1, 0x46 }, 37},
+		{"INI", []byte{0xed, 0xa2}, 0,
+			func(r *Registers, b *testBus) { r.B, r.C, r.H, b.io[0x12] = 1, 0x12, 0x40, 0x99 },
+			func(r *Registers, b *testBus) { r.B, r.L, r.F, b.mem[0x4000] = 0, 0x01, 0x42, 0x99 }, 16},
+
+		// I/O and interrupt registers
+		{"IN A,(n)", []byte{0xdb, 0x12}, 0,
+			func(r *Registers, b *testBus) { b.io[0x12] = 0x56 },
+			func(r *Registers, b *testBus) { r.A = 0x56 }, 11},
+		{"IN B,(C)", []byte{0xed, 0x40}, 0,
+			func(r *Registers, b *testBus) { r.C, r.F, b.io[0x12] = 0x12, FlagC|FlagN, 0x80 },
+			func(r *Registers, b *testBus) { r.B, r.F = 0x80, 0x81 }, 12},
+		{"OUT (C),A", []byte{0xed, 0x79}, 0,
+			func(r *Registers, b *testBus) { r.A, r.C = 0x56, 0x12 },
+			func(r *Registers, b *testBus) { b.io[0x12] = 0x56 }, 12},
+		{"LD A,I", []byte{0xed, 0x57}, 0,
+			func(r *Registers, b *testBus) { r.I, r.IFF2, r.F = 0x80, true, FlagC|FlagH },
+			func(r *Registers, b *testBus) { r.A, r.F = 0x80, 0x85 }, 9},
+		{"IM 2", []byte{0xed, 0x5e}, 0,
+			nil,
+			func(r *Registers, b *testBus) { r.IM = 2 }, 8},
+		{"EXX", []byte{0xd9}, 0,
+			func(r *Registers, b *testBus) { r.B, r.L_ = 1, 2 },
+			func(r *Registers, b *testBus) { r.B, r.B_, r.L, r.L_ = 0, 1, 2, 0 }, 4},
+	} {
+		bus := &testBus{}
+		copy(bus.mem[:], tc.code)
+		c := New(bus)
+		c.Registers = Registers{SP: 0xf000}
+		if tc.init != nil {
+			tc.init(&c.Registers, bus)
+		}
+
+		want, wantBus := c.Registers, *bus
+		want.PC = uint16(len(tc.code))
+		if tc.want != nil {
+			tc.want(&want, &wantBus)
+		}
+
+		cycles := 0
+		for range max(tc.steps, 1) {
+			cycles += c.Step()
+		}
+		want.R = c.R
+
+		if c.Registers != want {
+			t.Errorf("%s: registers\n%+v, want\n%+v", tc.name, c.Registers, want)
+		}
+		if bus.mem != wantBus.mem || bus.io != wantBus.io {
+			t.Errorf("%s: memory or ports differ", tc.name)
+		}
+		if cycles != tc.cycles {
+			t.Errorf("%s: %d T-states, want %d", tc.name, cycles, tc.cycles)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		code []byte
+		r    uint8
+		want uint8
+	}{
+		{"NOP", []byte{0x00}, 0x00, 0x01},
+		{"bit 7 is kept", []byte{0x00}, 0xff, 0x80},
+		{"prefix", []byte{0xdd, 0x7e, 0x00}, 0x00, 0x02},
+		{"ED", []byte{0xed, 0x44}, 0x00, 0x02},
+		// The displacement and opcode of DDCB are not M1 cycles
+		{"DDCB", []byte{0xdd, 0xcb, 0x00, 0x46}, 0x00, 0x02},
+	} {
+		c := New(&testBus{})
+		copy(c.bus.(*testBus).mem[:], tc.code)
+		c.R = tc.r
+		c.Step()
+		if c.R != tc.want {
+			t.Errorf("%s: R is %#x, want %#x", tc.name, c.R, tc.want)
+		}
+	}
+}
+
+func TestInterrupts(t *testing.T) {
+	// IM 1 is accepted after the instruction following EI
+	bus := &testBus{}
+	copy(bus.mem[:], []byte{0xed, 0x56, 0xfb, 0x00, 0x00})
+	c := New(bus)
+	c.SP = 0xf000
+	c.SetINT(true)
+	for i, want := range []int{8, 4, 4, 13} {
+		if got := c.Step(); got != want {
+			t.Errorf("IM 1 step %d: %d T-states, want %d", i, got, want)
+		}
+	}
+	if c.PC != 0x38 || c.IFF1 || c.IFF2 || c.read16(c.SP) != 0x0004 {
+		t.Errorf("IM 1: PC %#x, IFF %v %v, return %#x", c.PC, c.IFF1, c.IFF2, c.read16(c.SP))
+	}
+
+	// IM 2 reads the vector at I and the floating data bus
+	bus = &testBus{}
+	copy(bus.mem[:], []byte{0xed, 0x5e, 0xfb, 0x00})
+	bus.mem[0x20ff], bus.mem[0x2100] = 0x00, 0x30
+	c = New(bus)
+	c.I = 0x20
+	c.SetINT(true)
+	c.Step()
+	c.Step()
+	c.Step()
+	if got := c.Step(); got != 19 || c.PC != 0x3000 {
+		t.Errorf("IM 2: %d T-states to %#x, want 19 to 0x3000", got, c.PC)
+	}
+
+	// HALT runs NOPs until an interrupt, which returns past it
+	bus = &testBus{}
+	copy(bus.mem[:], []byte{0xfb, 0x76})
+	c = New(bus)
+	c.SP = 0xf000
+	c.Step()
+	for range 3 {
+		if got := c.Step(); got != 4 || c.PC != 2 {
+			t.Errorf("HALT: %d T-states at %#x", got, c.PC)
+		}
+	}
+	if !c.Halted {
+		t.Error("not halted")
+	}
+	c.SetINT(true)
+	c.Step()
+	if c.Halted || c.PC != 0x38 || c.read16(c.SP) != 0x0002 {
+		t.Errorf("halt interrupted: halted %v, PC %#x, return %#x", c.Halted, c.PC, c.read16(c.SP))
+	}
+
+	// Interrupts are ignored with IFF1 clear, NMI is not and RETN restores
+	// IFF1 from IFF2
+	bus = &testBus{}
+	copy(bus.mem[:], []byte{0xfb, 0xf3, 0x00})
+	copy(bus.mem[0x66:], []byte{0xed, 0x45})
+	c = New(bus)
+	c.SP = 0xf000
+	c.Step()
+	c.Step()
+	c.SetINT(true)
+	if c.Step(); c.PC != 3 {
+		t.Errorf("DI: interrupt accepted, PC %#x", c.PC)
+	}
+	c.IFF2 = true
+	c.NMI()
+	if got := c.Step(); got != 11 || c.PC != 0x66 || c.IFF1 || !c.IFF2 {
+		t.Errorf("NMI: %d T-states to %#x, IFF %v %v", got, c.PC, c.IFF1, c.IFF2)
+	}
+	c.SetINT(false)
+	if got := c.Step(); got != 14 || c.PC != 3 || !c.IFF1 {
+		t.Errorf("RETN: %d T-states to %#x, IFF1 %v", got, c.PC, c.IFF1)
+	}
+}
@@ -0,0 +1,535 @@
+package z80
+
+// Opcodes are decoded by their x, y, z, p and q fields:
+//
+//	x = op>>6, y = op>>3&7, z = op&7, p = y>>1, q = y&1
+func fields(op uint8) (x, y, z, p, q uint8) {
+	x, y, z = op>>6, op>>3&7, op&7
+	return x, y, z, y >> 1, y & 1
+}
+
+// memOp returns the address of an (HL) operand and adds the cycles of its
+// access: 3 for (HL), 11 for (IX+d) including the displacement.
+func (c *CPU) memOp() uint16 {
+	if c.index == indexHL {
+		c.cycles += 3
+	} else {
+		c.cycles += 11
+	}
+	return c.addr()
+}
+
+// plainReg accesses a register ignoring the index prefix, as the register
+// operand of instructions that also access (IX+d).
+func (c *CPU) plainReg(r uint8) uint8 {
+	idx := c.index
+	c.index = indexHL
+	v := c.reg(r, 0)
+	c.index = idx
+	return v
+}
+
+func (c *CPU) setPlainReg(r, v uint8) {
+	idx := c.index
+	c.index = indexHL
+	c.setReg(r, 0, v)
+	c.index = idx
+}
+
+func (c *CPU) jr(taken bool) {
+	d := int8(c.fetch())
+	if taken {
+		c.PC += uint16(d)
+		c.cycles += 12
+	} else {
+		c.cycles += 7
+	}
+}
+
+func (c *CPU) exec(op uint8) {
+	x, y, z, p, q := fields(op)
+
+	switch x {
+	case 0:
+		c.exec0(y, z, p, q)
+	case 1:
+		switch {
+		case y == 6 && z == 6:
+			c.Halted = true
+			c.cycles += 4
+		case y == 6:
+			mem := c.memOp()
+			c.bus.Write(mem, c.plainReg(z))
+			c.cycles += 4
+		case z == 6:
+			mem := c.memOp()
+			c.setPlainReg(y, c.bus.Read(mem))
+			c.cycles += 4
+		default:
+			c.setReg(y, 0, c.reg(z, 0))
+			c.cycles += 4
+		}
+	case 2:
+		var mem uint16
+		if z == 6 {
+			mem = c.memOp()
+		}
+		c.alu(y, c.reg(z, mem))
+		c.cycles += 4
+	case 3:
+		c.exec3(y, z, p, q)
+	}
+}
+
+func (c *CPU) exec0(y, z, p, q uint8) {
+	switch z {
+	case 0:
+		switch y {
+		case 0:
+			c.cycles += 4
+		case 1:
+			c.A, c.A_ = c.A_, c.A
+			c.F, c.F_ = c.F_, c.F
+			c.cycles += 4
+		case 2:
+			c.B--
+			c.cycles++
+			c.jr(c.B != 0)
+		case 3:
+			c.jr(true)
+		default:
+			c.jr(c.cond(y - 4))
+		}
+	case 1:
+		if q == 0 {
+			c.setRP(p, c.fetch16())
+			c.cycles += 10
+		} else {
+			c.setHLIndexed(c.add16(c.hl(), c.rp(p)))
+			c.cycles += 11
+		}
+	case 2:
+		switch p {
+		case 0, 1:
+			addr := c.BC()
+			if p == 1 {
+				addr = c.DE()
+			}
+			if q == 0 {
+				c.bus.Write(addr, c.A)
+			} else {
+				c.A = c.bus.Read(addr)
+			}
+			c.cycles += 7
+		case 2:
+			addr := c.fetch16()
+			if q == 0 {
+				c.write16(addr, c.hl())
+			} else {
+				c.setHLIndexed(c.read16(addr))
+			}
+			c.cycles += 16
+		case 3:
+			addr := c.fetch16()
+			if q == 0 {
+				c.bus.Write(addr, c.A)
+			} else {
+				c.A = c.bus.Read(addr)
+			}
+			c.cycles += 13
+		}
+	case 3:
+		if q == 0 {
+			c.setRP(p, c.rp(p)+1)
+		} else {
+			c.setRP(p, c.rp(p)-1)
+		}
+		c.cycles += 6
+	case 4, 5:
+		var mem uint16
+		if y == 6 {
+			mem = c.memOp()
+			c.cycles += 4
+		}
+		if z == 4 {
+			c.setReg(y, mem, c.inc8(c.reg(y, mem)))
+		} else {
+			c.setReg(y, mem, c.dec8(c.reg(y, mem)))
+		}
+		c.cycles += 4
+	case 6:
+		var mem uint16
+		if y == 6 {
+			if c.index == indexHL {
+				mem = c.memOp()
+			} else {
+				// The immediate is fetched while the address is computed
+				mem = c.addr()
+				c.cycles += 8
+			}
+		}
+		c.setReg(y, mem, c.fetch())
+		c.cycles += 7
+	case 7:
+		c.accOp(y)
+		c.cycles += 4
+	}
+}
+
+// accOp performs the RLCA, RRCA, RLA, RRA, DAA, CPL, SCF, CCF table.
+func (c *CPU) accOp(y uint8) {
+	keep := c.F & (FlagS | FlagZ | FlagPV)
+	switch y {
+	case 0:
+		carry := c.A >> 7
+		c.A = c.A<<1 | carry
+		c.F = keep | c.A&(FlagX|FlagY) | carry
+	case 1:
+		carry := c.A & 1
+		c.A = c.A>>1 | carry<<7
+		c.F = keep | c.A&(FlagX|FlagY) | carry
+	case 2:
+		carry := c.A >> 7
+		c.A = c.A<<1 | c.F&FlagC
+		c.F = keep | c.A&(FlagX|FlagY) | carry
+	case 3:
+		carry := c.A & 1
+		c.A = c.A>>1 | (c.F&FlagC)<<7
+		c.F = keep | c.A&(FlagX|FlagY) | carry
+	case 4:
+		c.daa()
+	case 5:
+		c.A = ^c.A
+		c.F = c.F&(FlagS|FlagZ|FlagPV|FlagC) | c.A&(FlagX|FlagY) | FlagH | FlagN
+	case 6:
+		c.F = keep | c.A&(FlagX|FlagY) | FlagC
+	case 7:
+		f := keep | c.A&(FlagX|FlagY)
+		if c.F&FlagC != 0 {
+			f |= FlagH
+		} else {
+			f |= FlagC
+		}
+		c.F = f
+	}
+}
+
+func (c *CPU) exec3(y, z, p, q uint8) {
+	switch z {
+	case 0:
+		if c.cond(y) {
+			c.PC = c.pop()
+			c.cycles += 11
+		} else {
+			c.cycles += 5
+		}
+	case 1:
+		if q == 0 {
+			c.setRP2(p, c.pop())
+			c.cycles += 10
+			return
+		}
+		switch p {
+		case 0:
+			c.PC = c.pop()
+			c.cycles += 10
+		case 1:
+			c.B, c.B_ = c.B_, c.B
+			c.C, c.C_ = c.C_, c.C
+			c.D, c.D_ = c.D_, c.D
+			c.E, c.E_ = c.E_, c.E
+			c.H, c.H_ = c.H_, c.H
+			c.L, c.L_ = c.L_, c.L
+			c.cycles += 4
+		case 2:
+			c.PC = c.hl()
+			c.cycles += 4
+		case 3:
+			c.SP = c.hl()
+			c.cycles += 6
+		}
+	case 2:
+		addr := c.fetch16()
+		if c.cond(y) {
+			c.PC = addr
+		}
+		c.cycles += 10
+	case 3:
+		switch y {
+		case 0:
+			c.PC = c.fetch16()
+			c.cycles += 10
+		case 2:
+			c.bus.Out(uint16(c.A)<<8|uint16(c.fetch()), c.A)
+			c.cycles += 11
+		case 3:
+			c.A = c.bus.In(uint16(c.A)<<8 | uint16(c.fetch()))
+			c.cycles += 11
+		case 4:
+			v := c.read16(c.SP)
+			c.write16(c.SP, c.hl())
+			c.setHLIndexed(v)
+			c.cycles += 19
+		case 5:
+			c.D, c.H = c.H, c.D
+			c.E, c.L = c.L, c.E
+			c.cycles += 4
+		case 6:
+			c.IFF1, c.IFF2 = false, false
+			c.cycles += 4
+		case 7:
+			c.IFF1, c.IFF2 = true, true
+			c.eiDelay = true
+			c.cycles += 4
+		}
+	case 4:
+		addr := c.fetch16()
+		if c.cond(y) {
+			c.push(c.PC)
+			c.PC = addr
+			c.cycles += 17
+		} else {
+			c.cycles += 10
+		}
+	case 5:
+		if q == 0 {
+			c.push(c.rp2(p))
+			c.cycles += 11
+		} else {
+			c.push(c.PC + 2)
+			c.PC = c.fetch16()
+			c.cycles += 17
+		}
+	case 6:
+		c.alu(y, c.fetch())
+		c.cycles += 7
+	case 7:
+		c.push(c.PC)
+		c.PC = uint16(y) * 8
+		c.cycles += 11
+	}
+}
+
+func (c *CPU) execCB() {
+	var op uint8
+	var mem uint16
+
+	if c.index != indexHL {
+		// DDCB d op: the displacement comes before the opcode
+		mem = c.addr()
+		op = c.fetch()
+	} else {
+		op = c.fetchOp()
+		mem = c.HL()
+	}
+	x, y, z, _, _ := fields(op)
+
+	if c.index != indexHL {
+		v := c.bus.Read(mem)
+		if x == 1 {
+			c.bit(y, v, uint8(mem>>8))
+			c.cycles += 16
+			return
+		}
+		switch x {
+		case 0:
+			v = c.rot(y, v)
+		case 2:
+			v &^= 1 << y
+		case 3:
+			v |= 1 << y
+		}
+		c.bus.Write(mem, v)
+		if z != 6 {
+			// Undocumented copy of the result to a register
+			c.setPlainReg(z, v)
+		}
+		c.cycles += 19
+		return
+	}
+
+	v := c.reg(z, mem)
+	switch x {
+	case 0:
+		c.setReg(z, mem, c.rot(y, v))
+	case 1:
+		xy := v
+		if z == 6 {
+			xy = uint8(mem >> 8)
+		}
+		c.bit(y, v, xy)
+		if z == 6 {
+			c.cycles += 4
+		}
+		c.cycles += 8
+		return
+	case 2:
+		c.setReg(z, mem, v&^(1<<y))
+	case 3:
+		c.setReg(z, mem, v|1<<y)
+	}
+	if z == 6 {
+		c.cycles += 7
+	}
+	c.cycles += 8
+}
+
+var interruptModes = [8]uint8{0, 0, 1, 2, 0, 0, 1, 2}
+
+func (c *CPU) execED(op uint8) {
+	x, y, z, p, q := fields(op)
+
+	if x == 2 && z <= 3 && y >= 4 {
+		c.block(y, z)
+		return
+	}
+	if x != 1 {
+		c.cycles += 8
+		return
+	}
+
+	switch z {
+	case 0:
+		v := c.bus.In(c.BC())
+		if y != 6 {
+			c.setReg(y, 0, v)
+		}
+		c.F = c.F&FlagC | szxy(v) | parity(v)
+		c.cycles += 12
+	case 1:
+		var v uint8
+		if y != 6 {
+			v = c.reg(y, 0)
+		}
+		c.bus.Out(c.BC(), v)
+		c.cycles += 12
+	case 2:
+		if q == 0 {
+			c.setHL(c.sbc16(c.HL(), c.rp(p)))
+		} else {
+			c.setHL(c.adc16(c.HL(), c.rp(p)))
+		}
+		c.cycles += 15
+	case 3:
+		addr := c.fetch16()
+		if q == 0 {
+			c.write16(addr, c.rp(p))
+		} else {
+			c.setRP(p, c.read16(addr))
+		}
+		c.cycles += 20
+	case 4:
+		c.A = c.sub8(0, c.A, 0)
+		c.cycles += 8
+	case 5:
+		c.PC = c.pop()
+		c.IFF1 = c.IFF2
+		c.cycles += 14
+	case 6:
+		c.IM = interruptModes[y]
+		c.cycles += 8
+	case 7:
+		c.edMisc(y)
+	}
+}
+
+func (c *CPU) edMisc(y uint8) {
+	switch y {
+	case 0:
+		c.I = c.A
+		c.cycles += 9
+	case 1:
+		c.R = c.A
+		c.cycles += 9
+	case 2, 3:
+		c.A = c.I
+		if y == 3 {
+			c.A = c.R
+		}
+		f := c.F&FlagC | szxy(c.A)
+		if c.IFF2 {
+			f |= FlagPV
+		}
+		c.F = f
+		c.cycles += 9
+	case 4, 5:
+		hl := c.HL()
+		m := c.bus.Read(hl)
+		if y == 4 {
+			c.bus.Write(hl, c.A<<4|m>>4)
+			c.A = c.A&0xf0 | m&0x0f
+		} else {
+			c.bus.Write(hl, m<<4|c.A&0x0f)
+			c.A = c.A&0xf0 | m>>4
+		}
+		c.F = c.F&FlagC | szxy(c.A) | parity(c.A)
+		c.cycles += 18
+	default:
+		c.cycles += 8
+	}
+}
+
+// block performs LDI, CPI, INI, OUTI and their decrementing and repeating
+// forms.
+func (c *CPU) block(y, z uint8) {
+	step := uint16(1)
+	if y&1 != 0 {
+		step = 0xffff
+	}
+	repeat := y >= 6
+	hl := c.HL()
+	again := false
+
+	switch z {
+	case 0:
+		v := c.bus.Read(hl)
+		c.bus.Write(c.DE(), v)
+		c.setHL(hl + step)
+		c.setDE(c.DE() + step)
+		c.setBC(c.BC() - 1)
+		n := v + c.A
+		f := c.F&(FlagS|FlagZ|FlagC) | n&FlagX | n<<4&FlagY
+		if c.BC() != 0 {
+			f |= FlagPV
+		}
+		c.F = f
+		again = c.BC() != 0
+	case 1:
+		v := c.bus.Read(hl)
+		carry := c.F & FlagC
+		r := c.sub8(c.A, v, 0)
+		c.setHL(hl + step)
+		c.setBC(c.BC() - 1)
+		n := r
+		if c.F&FlagH != 0 {
+			n--
+		}
+		f := c.F&(FlagS|FlagZ|FlagH) | FlagN | carry | n&FlagX | n<<4&FlagY
+		if c.BC() != 0 {
+			f |= FlagPV
+		}
+		c.F = f
+		again = c.BC() != 0 && r != 0
+	case 2:
+		v := c.bus.In(c.BC())
+		c.bus.Write(hl, v)
+		c.setHL(hl + step)
+		c.B--
+		c.F = szxy(c.B) | FlagN
+		again = c.B != 0
+	case 3:
+		v := c.bus.Read(hl)
+		c.B--
+		c.bus.Out(c.BC(), v)
+		c.setHL(hl + step)
+		c.F = szxy(c.B) | FlagN
+		again = c.B != 0
+	}
+
+	if repeat && again {
+		c.PC -= 2
+		c.cycles += 21
+	} else {
+		c.cycles += 16
+	}
+}